@@ -0,0 +1,109 @@
+// godis-check-aof validates aof files and reports the offset of the first invalid record,
+// with --fix the invalid part is cut off.
+//
+//	godis-check-aof [--key-file <file>] [--fix] <file.manifest|file.aof>
+//	godis-check-aof [--key-file <file>] --truncate-to-timestamp <unix> <file.manifest|file.aof>
+//
+// For a manifest all files are checked in the order they are replayed,
+// only the last one can be fixed because cutting an earlier file loses the commands after it.
+// --truncate-to-timestamp drops commands written after the given time, it requires aof_timestamp_enabled
+// when the aof was written. Stop the server before truncating its aof.
+// Encrypted files are read with keys in --key-file, the same file as aof_encryption_key_file
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"godis/database/aof"
+)
+
+func main() {
+	fix := flag.Bool("fix", false, "cut off the first invalid record and everything after it")
+	timestamp := flag.Int64("truncate-to-timestamp", 0, "cut off commands written after the unix timestamp")
+	keyFile := flag.String("key-file", "", "keys to decrypt encrypted aof files")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: godis-check-aof [--key-file <file>] [--fix] <file.manifest|file.aof>")
+		fmt.Fprintln(os.Stderr, "       godis-check-aof [--key-file <file>] --truncate-to-timestamp <unix> <file.manifest|file.aof>")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 || (*fix && *timestamp > 0) {
+		flag.Usage()
+		os.Exit(1)
+	}
+	if err := aof.LoadKeyFile(*keyFile); err != nil {
+		fmt.Fprintln(os.Stderr, "Cannot read key file: "+err.Error())
+		os.Exit(1)
+	}
+	if *timestamp > 0 {
+		os.Exit(truncateToTimestamp(flag.Arg(0), *timestamp))
+	}
+	os.Exit(run(flag.Arg(0), *fix))
+}
+
+func truncateToTimestamp(filename string, ts int64) int {
+	truncated, err := aof.TruncateToTimestamp(filename, ts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to truncate AOF to timestamp: "+err.Error())
+		return 1
+	}
+	if !truncated {
+		fmt.Printf("No timestamp annotation later than %d, nothing to truncate\n", ts)
+		return 0
+	}
+	fmt.Printf("Successfully truncated AOF %s to timestamp %d\n", filename, ts)
+	return 0
+}
+
+func run(filename string, fix bool) int {
+	files := []string{filename}
+	if strings.HasSuffix(filename, ".manifest") {
+		var err error
+		files, err = aof.ManifestFiles(filename)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Cannot read manifest: "+err.Error())
+			return 1
+		}
+		fmt.Printf("Manifest %s lists %d files\n", filename, len(files))
+	}
+
+	for i, file := range files {
+		result, err := aof.CheckFile(file)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Cannot check "+file+": "+err.Error())
+			return 1
+		}
+		fmt.Printf("AOF analyzed: filename=%s, size=%d, ok_up_to=%d, commands=%d, diff=%d, compressed=%t, checksum=%t, encrypted=%t\n",
+			file, result.Size, result.ValidSize, result.Commands, result.Size-result.ValidSize, result.Compressed, result.Checksum, result.Encrypted)
+		if result.Valid() {
+			continue
+		}
+		fmt.Printf("AOF %s is not valid: %v at offset %d\n", file, result.Err, result.ValidSize)
+		if !fix {
+			fmt.Println("Use the --fix option to try fixing it.")
+			return 1
+		}
+		if result.Compressed || (result.Encrypted && !result.Truncated()) || result.Err == aof.ErrChecksum {
+			fmt.Println("The file is corrupted and can not be fixed by truncating, restore it from backup.")
+			return 1
+		}
+		if i != len(files)-1 {
+			fmt.Println("Only the last file of the manifest can be fixed, restore the others from backup.")
+			return 1
+		}
+		if !result.Truncated() {
+			fmt.Printf("This will discard %d bytes after the invalid record.\n", result.Size-result.ValidSize)
+		}
+		if err := aof.Truncate(file, result.ValidSize); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to truncate AOF: "+err.Error())
+			return 1
+		}
+		fmt.Println("Successfully truncated AOF " + file)
+		return 0
+	}
+	fmt.Println("AOF is valid")
+	return 0
+}
@@ -1,7 +1,9 @@
 package config
 
 import (
+	"fmt"
 	"os"
+	"sync/atomic"
 
 	"godis/lib/logger"
 
@@ -12,82 +14,237 @@ import (
 type ServerProperties struct {
 	Debug     bool   `mapstructure:"debug"`     // 是否是debug
 	Bind      string `mapstructure:"bind"`      // 服务器绑定地址
-	Port      int    `mapstructure:"port"`      // 监听端口
-	Password  string `mapstructure:"password"`  // 密码
+	Port      int    `mapstructure:"port"`      // 监听端口，0为不监听 TCP 端口
+	Password  string `mapstructure:"password"`  // 密码，即 default 用户的密码
+	AclFile   string `mapstructure:"aclfile"`   // ACL 用户文件，ACL SAVE/LOAD 使用
 	Databases int    `mapstructure:"databases"` // 数据库数量
-	Keepalive int    `mapstructure:"keepalive"` // 存活检查, 0为不开启检查
+	Keepalive int    `mapstructure:"keepalive"` // TCP keepalive 及集群节点间的心跳间隔(秒), 0为不开启
+	LogLevel  string `mapstructure:"log_level"` // 日志级别: debug, info, warn, error
+
+	UnixSocket     string `mapstructure:"unixsocket"`     // Unix socket 路径，为空时不监听
+	UnixSocketPerm string `mapstructure:"unixsocketperm"` // Unix socket 文件的权限，八进制，如 700，为空时使用默认权限
+
+	MaxClients              int    `mapstructure:"maxclients"`                 // 最大客户端连接数
+	Timeout                 int    `mapstructure:"timeout"`                    // 客户端空闲超过该秒数后断开, 0为不断开
+	ClientOutputBufferLimit string `mapstructure:"client_output_buffer_limit"` // 各类客户端的输出缓冲区限制: class hard soft seconds
+	ProtoMaxBulkLen         int64  `mapstructure:"proto_max_bulk_len"`         // 请求中单个参数的最大长度(字节)
+	ProtoMaxMultiBulkLen    int64  `mapstructure:"proto_max_multibulk_len"`    // 请求中参数的最大个数
+	IoModel                 string `mapstructure:"io_model"`                   // goroutine: 每个连接一个协程, epoll: 由事件循环处理连接，仅支持 linux
+	EventLoops              int    `mapstructure:"event_loops"`                // io_model 为 epoll 时事件循环的数量，0 为 CPU 核数
 
 	OpenAtomicTx bool `mapstructure:"open_atomic_tx"` // 是否开启原子性事务
 
+	ShutdownTimeout int `mapstructure:"shutdown_timeout"` // 关闭服务器时等待执行中的命令完成的最长秒数
+
+	LuaTimeLimit int64 `mapstructure:"lua_time_limit"` // 脚本和函数执行的最长毫秒数，超时后没有执行过写命令的脚本被终止，0为不限制
+
+	TrackingTableMaxKeys int `mapstructure:"tracking_table_max_keys"` // client side caching 最多记录的 key 数量，超过后淘汰并通知客户端，0为不限制
+
+	/* TLS配置 */
+	TlsPort        int    `mapstructure:"tls_port"`         // TLS 监听端口，0为不开启
+	TlsCertFile    string `mapstructure:"tls_cert_file"`    // 服务器证书，同时作为连接其他节点时的客户端证书
+	TlsKeyFile     string `mapstructure:"tls_key_file"`     // 证书私钥
+	TlsCaCertFile  string `mapstructure:"tls_ca_cert_file"` // 用于校验客户端证书和其他节点证书的 CA
+	TlsAuthClients string `mapstructure:"tls_auth_clients"` // 是否校验客户端证书: no, optional, yes
+	TlsCluster     bool   `mapstructure:"tls_cluster"`      // 集群节点之间是否使用 TLS 连接
+
 	/* AOF持久化配置 */
 	AppendOnly               bool   `mapstructure:"append_only"`                 // 是否开启 AOF 持久化
-	AofFilename              string `mapstructure:"aof_filename"`                // AOF 持久化文件名
+	AofFilename              string `mapstructure:"aof_filename"`                // AOF 文件名前缀，各部分文件和 manifest 以此命名
+	AofDirname               string `mapstructure:"aof_dirname"`                 // 保存 AOF 各部分文件和 manifest 的目录
 	AofFsync                 int    `mapstructure:"aof_fsync"`                   // AOF 刷盘策略
+	AofLoadTruncated         bool   `mapstructure:"aof_load_truncated"`          // 最后一个 AOF 文件结尾的命令不完整时截断并继续启动，否则拒绝启动
+	AofTimestampEnabled      bool   `mapstructure:"aof_timestamp_enabled"`       // 在 AOF 中写入 #TS:<unix> 时间戳注释，用于恢复到指定时间点
+	AofChecksum              bool   `mapstructure:"aof_checksum"`                // 在重写生成的 base 文件末尾写入 CRC64 校验和
+	AofRewriteCompression    string `mapstructure:"aof_rewrite_compression"`     // 重写生成的 base 文件的压缩方式，no、gzip 或 zstd
+	AofEncryptionKeyFile     string `mapstructure:"aof_encryption_key_file"`     // AES-256 密钥文件，不为空时加密 AOF 的所有文件
 	AutoAofRewrite           bool   `mapstructure:"auto_aof_rewrite"`            // 是否开启 AOF 自动重写
 	AutoAofRewritePercentage int64  `mapstructure:"auto_aof_rewrite_percentage"` // 触发重写所需要的 aof 文件体积百分比，增量大于这个值时才进行重写
 	AutoAofRewriteMinSize    int64  `mapstructure:"auto_aov_rewrite_min_size"`   // 表示触发AOF重写的最小文件体积，单位mb
 
+	/* 监控配置 */
+	MetricsPort          int   `mapstructure:"metrics_port"`            // Prometheus 指标 HTTP 监听端口，0为不开启
+	SlowlogLogSlowerThan int64 `mapstructure:"slowlog_log_slower_than"` // 执行时间超过该值(微秒)的命令记录到慢日志，负数为不记录
+	SlowlogMaxLen        int   `mapstructure:"slowlog_max_len"`         // 慢日志最多保存的条数
+
 	/* 集群配置 */
 	Self  string   `mapstructure:"self"`
 	Peers []string `mapstructure:"peers"`
 }
 
-var Properties *ServerProperties
+// active 当前生效的配置，CONFIG SET 和 reload 会替换为修改后的副本，不会原地修改
+var active atomic.Pointer[ServerProperties]
 
 func init() {
-	// 默认配置
-	Properties = &ServerProperties{
+	active.Store(defaultProperties())
+}
+
+// Properties returns the configuration in effect. It may be replaced by CONFIG SET or reload at any time,
+// callers reading several related fields should keep the returned pointer
+func Properties() *ServerProperties {
+	return active.Load()
+}
+
+// SetProperties replaces the configuration in effect, it is used on startup and by tests
+func SetProperties(properties *ServerProperties) {
+	active.Store(properties)
+}
+
+// defaultProperties 默认配置
+func defaultProperties() *ServerProperties {
+	return &ServerProperties{
 		Debug:     os.Getenv("ENV") == "DEBUG",
 		Bind:      "127.0.0.1",
 		Port:      6179,
 		Password:  "",
 		Databases: 16,
 		Keepalive: 0,
+		LogLevel:  "debug",
+
+		MaxClients:              10000,
+		ClientOutputBufferLimit: defaultOutputBufferLimit,
+		ProtoMaxBulkLen:         512 << 20,
+		ProtoMaxMultiBulkLen:    1024 * 1024,
+		IoModel:                 "goroutine",
 
 		OpenAtomicTx: false,
 
+		ShutdownTimeout: 10,
+
+		LuaTimeLimit: 0,
+
+		TrackingTableMaxKeys: 1000000,
+
+		TlsAuthClients: "no",
+
 		AppendOnly:               true,
 		AofFilename:              "dump.aof",
+		AofDirname:               "appendonlydir",
 		AofFsync:                 0,
+		AofLoadTruncated:         true,
+		AofChecksum:              false,
+		AofRewriteCompression:    "no",
 		AutoAofRewrite:           false,
 		AutoAofRewritePercentage: 100,
 		AutoAofRewriteMinSize:    64,
+
+		SlowlogLogSlowerThan: 10000,
+		SlowlogMaxLen:        128,
 	}
 }
 
-// SetupConfig 读配置文件，加载配置文件
-func SetupConfig(configFilename string) {
+// SetupConfig 读配置文件，加载配置文件。以 .conf 结尾的文件使用 redis.conf 格式，其他文件使用 yaml 格式。
+// overrides 是命令行中的 --name value 选项，会覆盖配置文件中的值，reload 时依然生效
+func SetupConfig(configFilename string, overrides ...[]string) {
+	cmdOverrides = overrides
 	if !fileExists(configFilename) {
 		// 文件不存在，直接用默认配置
-		return
+		configFilename = ""
+		if len(overrides) == 0 {
+			return
+		}
 	}
 
-	viper.SetConfigFile(configFilename)
-	viper.SetConfigType("yaml")
-	setDefault() // 设置默认值
-	if err := viper.ReadInConfig(); err != nil {
+	properties, err := load(configFilename)
+	if err != nil {
 		logger.Fatalf("setup config err, %v", err)
 	}
+	if err := logger.SetLevel(properties.LogLevel); err != nil {
+		logger.Fatal(err)
+	}
+	SetProperties(properties)
+	configFile = configFilename
+}
+
+// cmdOverrides 命令行中的 --name value 选项
+var cmdOverrides [][]string
+
+// load 读取配置文件并应用命令行选项，filename 为空时只包含默认值和命令行选项
+func load(filename string) (*ServerProperties, error) {
+	properties, err := loadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	for _, override := range cmdOverrides {
+		if err := applyDirective(properties, override); err != nil {
+			return nil, fmt.Errorf("bad option --%s: %v", override[0], err)
+		}
+	}
+
+	if properties.Debug == true { // debug 没有密码
+		properties.Password = ""
+	}
+	return properties, nil
+}
+
+// loadFile 只读取配置文件，filename 为空时返回只包含默认值的配置
+func loadFile(filename string) (*ServerProperties, error) {
+	v := viper.New()
+	setDefault(v) // 设置默认值
+	if filename != "" && !isRedisConf(filename) {
+		v.SetConfigFile(filename)
+		v.SetConfigType("yaml")
+		if err := v.ReadInConfig(); err != nil {
+			return nil, err
+		}
+	}
 
-	if err := viper.Unmarshal(Properties); err != nil {
-		logger.Fatalf("setup config unmarshal err, %v", err)
+	properties := defaultProperties()
+	properties.Timeout = unsetTimeout // 文件中没有 timeout 时保持不变
+	if err := v.Unmarshal(properties); err != nil {
+		return nil, fmt.Errorf("unmarshal err, %v", err)
+	}
+	if filename != "" && isRedisConf(filename) {
+		if err := loadRedisConf(filename, properties); err != nil {
+			return nil, err
+		}
+	}
+	migrateKeepalive(properties)
+	if err := normalize(properties); err != nil {
+		return nil, err
 	}
+	return properties, nil
+}
+
+// unsetTimeout 标记配置文件中没有设置 timeout
+const unsetTimeout = -1
 
-	if Properties.Debug == true { // debug 没有密码
-		Properties.Password = ""
+// migrateKeepalive 兼容旧配置：keepalive 以前同时用于关闭空闲客户端，现在只设置 TCP keepalive，
+// 空闲断开由 timeout 控制。文件中只有 keepalive 没有 timeout 时沿用 keepalive 作为 timeout
+func migrateKeepalive(properties *ServerProperties) {
+	if properties.Timeout != unsetTimeout {
+		return
+	}
+	properties.Timeout = 0
+	if properties.Keepalive > 0 {
+		properties.Timeout = properties.Keepalive
+		logger.Warn(fmt.Sprintf("keepalive no longer closes idle clients, using it as timeout %d; "+
+			"set timeout explicitly to silence this warning", properties.Keepalive))
 	}
 }
 
-func setDefault() {
+func setDefault(viper *viper.Viper) {
 	viper.SetDefault("bind", "0.0.0.0")
 	viper.SetDefault("port", 6179)
 	viper.SetDefault("databases", 16)
 
+	viper.SetDefault("lua_time_limit", int64(0))
+	viper.SetDefault("tracking_table_max_keys", 1000000)
+
+	viper.SetDefault("tls_auth_clients", "no")
+
 	viper.SetDefault("append_only", true)
 	viper.SetDefault("aof_filename", "dump.aof")
+	viper.SetDefault("aof_dirname", "appendonlydir")
+	viper.SetDefault("aof_load_truncated", true)
+	viper.SetDefault("aof_checksum", false)
+	viper.SetDefault("aof_rewrite_compression", "no")
 	viper.SetDefault("auto_aof_rewrite", true)
 	viper.SetDefault("auto_aof_rewrite_percentage", int64(100))
 	viper.SetDefault("auto_aov_rewrite_min_size", int64(64))
+
+	viper.SetDefault("slowlog_log_slower_than", int64(10000))
+	viper.SetDefault("slowlog_max_len", 128)
 }
 
 func fileExists(filename string) bool {
@@ -0,0 +1,356 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func setupTestConfig(t *testing.T, content string) string {
+	filename := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	SetupConfig(filename)
+	t.Cleanup(func() {
+		SetProperties(defaultProperties())
+		configFile = ""
+	})
+	return filename
+}
+
+func TestGetSet(t *testing.T) {
+	setupTestConfig(t, "port: 6399\nkeepalive: 10\n")
+	names, values := Get("keep*", "PORT")
+	if strings.Join(names, ",") != "keepalive,port" || strings.Join(values, ",") != "10,6399" {
+		t.Fatalf("unexpected result %v %v", names, values)
+	}
+
+	var changed []string
+	AddObserver(func(names []string) {
+		changed = names
+	})
+	old := Properties()
+	if err := Set("keepalive", "30", "open_atomic_tx", "yes"); err != nil {
+		t.Fatal(err)
+	}
+	if Properties().Keepalive != 30 || !Properties().OpenAtomicTx || old.Keepalive != 10 {
+		t.Error("set failed or modified the old properties in place")
+	}
+	if strings.Join(changed, ",") != "keepalive,open_atomic_tx" {
+		t.Errorf("unexpected changed %v", changed)
+	}
+	// 值没有变化的配置项不通知观察者
+	if err := Set("keepalive", "30", "password", ""); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(changed, ",") != "keepalive,open_atomic_tx" {
+		t.Errorf("unchanged parameters should not be notified, got %v", changed)
+	}
+
+	cases := []struct {
+		pairs []string
+		name  string
+	}{
+		{[]string{"nothing", "1"}, "nothing"},
+		{[]string{"port", "6400"}, "port"},
+		{[]string{"keepalive", "abc"}, "keepalive"},
+		{[]string{"keepalive", "-1"}, "keepalive"},
+		{[]string{"aof_fsync", "3"}, "aof_fsync"},
+		{[]string{"log_level", "verbose"}, "log_level"},
+		{[]string{"keepalive", "1", "keepalive", "2"}, "keepalive"},
+		{[]string{"slowlog_max_len", "1", "maxclients", "0"}, "maxclients"},
+	}
+	for _, c := range cases {
+		err := Set(c.pairs...)
+		var paramErr *ParamError
+		if !errors.As(err, &paramErr) || paramErr.Name != c.name {
+			t.Errorf("%v: expect error of %s, got %v", c.pairs, c.name, err)
+		}
+	}
+	if Properties().Keepalive != 30 || Properties().SlowlogMaxLen != 128 {
+		t.Error("failed CONFIG SET should not change anything")
+	}
+	if err := Set("unknown", "1"); !errors.Is(err, ErrUnknownParam) {
+		t.Errorf("expect ErrUnknownParam, got %v", err)
+	}
+}
+
+// TestSetConcurrent 在其他协程读取配置的同时执行 CONFIG SET，需要使用 -race 运行
+func TestSetConcurrent(t *testing.T) {
+	setupTestConfig(t, "timeout: 0\n")
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+					_ = Properties().Timeout
+				}
+			}
+		}()
+	}
+	for i := 0; i < 100; i++ {
+		if err := Set("timeout", strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(done)
+	wg.Wait()
+	if Properties().Timeout != 99 {
+		t.Errorf("unexpected timeout %d", Properties().Timeout)
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	filename := setupTestConfig(t, "# server\nport: 6399 # listen port\nkeepalive: 10\npeers: []\n")
+	if err := Set("keepalive", "20", "slowlog_max_len", "64"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Rewrite(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := string(data)
+	for _, expected := range []string{"# server\n", "port: 6399 # listen port\n", "keepalive: 20\n", "slowlog_max_len: 64\n"} {
+		if !strings.Contains(content, expected) {
+			t.Errorf("expect %q in rewritten config:\n%s", expected, content)
+		}
+	}
+	if strings.Contains(content, "databases") {
+		t.Errorf("default values should not be written:\n%s", content)
+	}
+
+	loaded, err := load(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Keepalive != 20 || loaded.SlowlogMaxLen != 64 || loaded.Port != 6399 {
+		t.Errorf("unexpected config after rewrite %+v", loaded)
+	}
+}
+
+// TestRewriteDebugPassword debug 模式下运行时没有密码，CONFIG REWRITE 不能清空配置文件中的密码
+func TestRewriteDebugPassword(t *testing.T) {
+	filename := setupTestConfig(t, "debug: true\npassword: secret\n")
+	if Properties().Password != "" {
+		t.Fatal("password should be ignored in debug mode")
+	}
+	if err := Set("keepalive", "20"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Rewrite(); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := loadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Password != "secret" || loaded.Keepalive != 20 {
+		t.Errorf("unexpected config after rewrite %+v", loaded)
+	}
+
+	if err := Set("password", "changed"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Rewrite(); err != nil {
+		t.Fatal(err)
+	}
+	if loaded, _ := loadFile(filename); loaded.Password != "changed" {
+		t.Errorf("password set at runtime should be written, got %q", loaded.Password)
+	}
+}
+
+func TestReload(t *testing.T) {
+	filename := setupTestConfig(t, "port: 6399\nkeepalive: 10\ntimeout: 0\n")
+	var changed []string
+	AddObserver(func(names []string) {
+		changed = names
+	})
+	if err := os.WriteFile(filename, []byte("port: 6400\nkeepalive: 5\ntimeout: 0\nslowlog_max_len: 16\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if Properties().Keepalive != 5 || Properties().SlowlogMaxLen != 16 {
+		t.Error("mutable parameters should be reloaded")
+	}
+	if Properties().Port != 6399 {
+		t.Error("port can not be changed without restart")
+	}
+	if strings.Join(changed, ",") != "keepalive,slowlog_max_len" {
+		t.Errorf("unexpected changed %v", changed)
+	}
+
+	configFile = ""
+	if err := Reload(); !errors.Is(err, ErrNoConfigFile) {
+		t.Errorf("expect ErrNoConfigFile, got %v", err)
+	}
+}
+
+func TestRedisConf(t *testing.T) {
+	dir := t.TempDir()
+	included := filepath.Join(dir, "included.conf")
+	if err := os.WriteFile(included, []byte("slowlog-max-len 32\nunknown-directive 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(dir, "redis.conf")
+	content := "# redis style config\n" +
+		"bind 127.0.0.1 ::1\n" +
+		"port 6400\n" +
+		"requirepass \"my pass\"\n" +
+		"loglevel notice\n" +
+		"appendonly no\n" +
+		"appendfsync everysec\n" +
+		"auto-aof-rewrite-min-size 100kb\n" +
+		"include included.conf\n" +
+		"slowlog-max-len 64\n"
+	if err := os.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	SetupConfig(filename, []string{"port", "6500"}, []string{"open_atomic_tx", "yes"})
+	t.Cleanup(func() {
+		SetProperties(defaultProperties())
+		configFile = ""
+		cmdOverrides = nil
+	})
+
+	p := Properties()
+	if p.Bind != "127.0.0.1" || p.Password != "my pass" || p.LogLevel != "info" || p.AppendOnly ||
+		p.AofFsync != 1 || p.AutoAofRewriteMinSize != 1 || p.SlowlogMaxLen != 64 {
+		t.Errorf("unexpected config %+v", p)
+	}
+	if p.Port != 6500 || !p.OpenAtomicTx {
+		t.Error("command line options should override config file")
+	}
+
+	if err := Set("keepalive", "15", "appendfsync", "0"); err == nil {
+		t.Error("CONFIG SET uses names of godis parameters")
+	}
+	if err := Set("keepalive", "15", "aof_fsync", "0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Rewrite(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rewritten := string(data)
+	for _, expected := range []string{"# redis style config\n", "bind 127.0.0.1 ::1\n", "appendfsync always\n",
+		"include included.conf\n", "tcp-keepalive 15\n", "port 6500\n"} {
+		if !strings.Contains(rewritten, expected) {
+			t.Errorf("expect %q in rewritten config:\n%s", expected, rewritten)
+		}
+	}
+	loaded, err := loadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Keepalive != 15 || loaded.AofFsync != 0 || loaded.Password != "my pass" {
+		t.Errorf("unexpected config after rewrite %+v", loaded)
+	}
+
+	if err := os.WriteFile(filename, []byte("port abc\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadFile(filename); err == nil || !strings.Contains(err.Error(), "redis.conf:1") {
+		t.Errorf("expect error with line number, got %v", err)
+	}
+}
+
+func TestParseMemory(t *testing.T) {
+	cases := map[string]int64{"100": 100, "1k": 1000, "1KB": 1024, "64mb": 64 << 20, "2g": 2e9, "1gb": 1 << 30}
+	for s, expected := range cases {
+		if n, err := ParseMemory(s); err != nil || n != expected {
+			t.Errorf("%s: expect %d, got %d %v", s, expected, n, err)
+		}
+	}
+	for _, s := range []string{"", "mb", "-1k", "1tb"} {
+		if _, err := ParseMemory(s); err == nil {
+			t.Errorf("%s should be invalid", s)
+		}
+	}
+}
+
+func TestSplitOverrides(t *testing.T) {
+	rest, overrides := SplitOverrides([]string{"-f", "redis.conf", "--port", "6400", "--bind", "a", "b", "--slowlog-log-slower-than", "-1"})
+	if strings.Join(rest, " ") != "-f redis.conf" {
+		t.Errorf("unexpected rest %v", rest)
+	}
+	if len(overrides) != 3 || strings.Join(overrides[1], " ") != "bind a b" || strings.Join(overrides[2], " ") != "slowlog-log-slower-than -1" {
+		t.Errorf("unexpected overrides %v", overrides)
+	}
+}
+
+func TestOutputBufferLimit(t *testing.T) {
+	setupTestConfig(t, "client_output_buffer_limit: pubsub 1mb 512kb 10\n")
+	limit := GetOutputBufferLimit(ClientClassPubsub)
+	if limit.Hard != 1<<20 || limit.Soft != 512<<10 || limit.SoftSeconds != 10 {
+		t.Errorf("unexpected pubsub limit %+v", limit)
+	}
+	if limit := GetOutputBufferLimit(ClientClassReplica); limit.Hard != 256<<20 {
+		t.Errorf("replica limit should be default, got %+v", limit)
+	}
+
+	if err := Set("client_output_buffer_limit", "normal 1k 0 0"); err != nil {
+		t.Fatal(err)
+	}
+	if GetOutputBufferLimit(ClientClassNormal).Hard != 1000 || GetOutputBufferLimit(ClientClassPubsub).Hard != 1<<20 {
+		t.Error("CONFIG SET should only change the given class")
+	}
+	_, values := Get("client_output_buffer_limit")
+	if values[0] != "normal 1000 0 0 replica 268435456 67108864 60 pubsub 1048576 524288 10" {
+		t.Errorf("unexpected value %s", values[0])
+	}
+	for _, invalid := range []string{"normal 1 2", "other 0 0 0", "pubsub 1x 0 0", "pubsub 0 0 -1"} {
+		if err := Set("client_output_buffer_limit", invalid); err == nil {
+			t.Errorf("%q should be invalid", invalid)
+		}
+	}
+}
+
+// TestKeepaliveAsTimeout 旧配置只设置了 keepalive 时继续用它关闭空闲客户端
+func TestKeepaliveAsTimeout(t *testing.T) {
+	setupTestConfig(t, "keepalive: 30\n")
+	if p := Properties(); p.Keepalive != 30 || p.Timeout != 30 {
+		t.Errorf("unexpected keepalive %d timeout %d", p.Keepalive, p.Timeout)
+	}
+	setupTestConfig(t, "keepalive: 30\ntimeout: 0\n")
+	if p := Properties(); p.Keepalive != 30 || p.Timeout != 0 {
+		t.Errorf("unexpected keepalive %d timeout %d", p.Keepalive, p.Timeout)
+	}
+
+	filename := filepath.Join(t.TempDir(), "redis.conf")
+	if err := os.WriteFile(filename, []byte("keepalive 20\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	properties, err := loadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if properties.Timeout != 20 {
+		t.Errorf("unexpected timeout %d", properties.Timeout)
+	}
+	properties, err = loadFile("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if properties.Timeout != 0 {
+		t.Errorf("unexpected default timeout %d", properties.Timeout)
+	}
+}
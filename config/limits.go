@@ -0,0 +1,115 @@
+package config
+
+import (
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// 客户端类别，每一类客户端有各自的输出缓冲区限制
+const (
+	ClientClassNormal  = "normal"
+	ClientClassReplica = "replica"
+	ClientClassPubsub  = "pubsub"
+)
+
+var clientClasses = []string{ClientClassNormal, ClientClassReplica, ClientClassPubsub}
+
+// defaultOutputBufferLimit 与 redis 的默认值相同
+const defaultOutputBufferLimit = "normal 0 0 0 replica 256mb 64mb 60 pubsub 32mb 8mb 60"
+
+// OutputBufferLimit limits pending output of a client class, zero means no limit.
+// A client is disconnected once its output buffer reaches Hard,
+// or stays above Soft for SoftSeconds
+type OutputBufferLimit struct {
+	Hard        int64
+	Soft        int64
+	SoftSeconds int64
+}
+
+// parsedLimits 缓存解析后的 client_output_buffer_limit，避免每次写入都重新解析
+type parsedLimits struct {
+	source string
+	limits map[string]OutputBufferLimit
+}
+
+var limitsCache atomic.Pointer[parsedLimits]
+
+// GetOutputBufferLimit returns output buffer limit of class in current config
+func GetOutputBufferLimit(class string) OutputBufferLimit {
+	source := Properties().ClientOutputBufferLimit
+	cached := limitsCache.Load()
+	if cached == nil || cached.source != source {
+		limits, err := parseOutputBufferLimits(source)
+		if err != nil {
+			// 配置在加载和 CONFIG SET 时已经校验过，这里不会出错
+			limits, _ = parseOutputBufferLimits("")
+		}
+		cached = &parsedLimits{source: source, limits: limits}
+		limitsCache.Store(cached)
+	}
+	return cached.limits[class]
+}
+
+// parseOutputBufferLimits parses `class hard soft seconds` groups over the defaults
+func parseOutputBufferLimits(s string) (map[string]OutputBufferLimit, error) {
+	limits := make(map[string]OutputBufferLimit)
+	if err := mergeOutputBufferLimits(limits, defaultOutputBufferLimit); err != nil {
+		return nil, err
+	}
+	if err := mergeOutputBufferLimits(limits, s); err != nil {
+		return nil, err
+	}
+	return limits, nil
+}
+
+func mergeOutputBufferLimits(limits map[string]OutputBufferLimit, s string) error {
+	fields := strings.Fields(s)
+	if len(fields)%4 != 0 {
+		return errors.New("wrong number of arguments in buffer limit configuration")
+	}
+	for i := 0; i < len(fields); i += 4 {
+		class := strings.ToLower(fields[i])
+		if class == "slave" {
+			class = ClientClassReplica
+		}
+		if class != ClientClassNormal && class != ClientClassReplica && class != ClientClassPubsub {
+			return errors.New("invalid client class specified in buffer limit configuration")
+		}
+		hard, err := ParseMemory(fields[i+1])
+		if err != nil {
+			return errors.New("error in hard, soft or soft_seconds setting in buffer limit configuration")
+		}
+		soft, err := ParseMemory(fields[i+2])
+		if err != nil {
+			return errors.New("error in hard, soft or soft_seconds setting in buffer limit configuration")
+		}
+		seconds, err := strconv.ParseInt(fields[i+3], 10, 64)
+		if err != nil || seconds < 0 {
+			return errors.New("error in hard, soft or soft_seconds setting in buffer limit configuration")
+		}
+		limits[class] = OutputBufferLimit{Hard: hard, Soft: soft, SoftSeconds: seconds}
+	}
+	return nil
+}
+
+// setOutputBufferLimits 与 redis 一样只修改给出的客户端类别，其他类别保持原值
+func setOutputBufferLimits(value reflect.Value, s string) error {
+	limits, err := parseOutputBufferLimits(value.String())
+	if err != nil {
+		return err
+	}
+	if err := mergeOutputBufferLimits(limits, s); err != nil {
+		return err
+	}
+	parts := make([]string, 0, len(clientClasses))
+	for _, class := range clientClasses {
+		limit := limits[class]
+		parts = append(parts, class+" "+strconv.FormatInt(limit.Hard, 10)+" "+
+			strconv.FormatInt(limit.Soft, 10)+" "+strconv.FormatInt(limit.SoftSeconds, 10))
+	}
+	value.SetString(strings.Join(parts, " "))
+	return nil
+}
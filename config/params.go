@@ -0,0 +1,444 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"godis/lib/logger"
+	"godis/lib/wildcard"
+
+	"gopkg.in/yaml.v3"
+)
+
+// param 是一个可以通过 CONFIG GET/SET 访问的配置项，名字与配置文件中的 key 相同
+type param struct {
+	name    string
+	field   int  // ServerProperties 中字段的下标
+	mutable bool // 是否可以在运行时修改
+	check   func(value reflect.Value) error
+	parse   func(value reflect.Value, s string) error // 为空时使用 parseValue
+}
+
+var (
+	// mu 保证 CONFIG SET、REWRITE 和 reload 串行执行
+	mu sync.Mutex
+	// configFile 启动时加载的配置文件，为空表示没有使用配置文件
+	configFile string
+	params     []*param
+	paramMap   = make(map[string]*param)
+	observers  []func(changed []string)
+)
+
+var (
+	// ErrNoConfigFile is returned by Reload and Rewrite when no config file was loaded
+	ErrNoConfigFile = errors.New("the server is running without a config file")
+	// ErrUnknownParam is wrapped in ParamError when the parameter does not exist
+	ErrUnknownParam = errors.New("unknown option")
+)
+
+// mutableParams 运行时可以修改的配置项及其校验规则
+var mutableParams = map[string]func(value reflect.Value) error{
+	"password":                    nil,
+	"keepalive":                   atLeast(0),
+	"log_level":                   oneOf("debug", "info", "warn", "error"),
+	"maxclients":                  atLeast(1),
+	"open_atomic_tx":              nil,
+	"shutdown_timeout":            atLeast(0),
+	"lua_time_limit":              atLeast(0),
+	"tracking_table_max_keys":     atLeast(0),
+	"aof_fsync":                   between(0, 2),
+	"aof_load_truncated":          nil,
+	"aof_timestamp_enabled":       nil,
+	"aof_checksum":                nil,
+	"aof_rewrite_compression":     oneOf("no", "gzip", "zstd"),
+	"auto_aof_rewrite":            nil,
+	"auto_aof_rewrite_percentage": atLeast(1),
+	"auto_aov_rewrite_min_size":   atLeast(0),
+	"slowlog_log_slower_than":     nil,
+	"slowlog_max_len":             atLeast(0),
+	"timeout":                     atLeast(0),
+	"client_output_buffer_limit":  nil,
+	"proto_max_bulk_len":          atLeast(1),
+	"proto_max_multibulk_len":     atLeast(1),
+}
+
+// customParsers 取值格式特殊的配置项
+var customParsers = map[string]func(value reflect.Value, s string) error{
+	"client_output_buffer_limit": setOutputBufferLimits,
+	"proto_max_bulk_len":         setMemory,
+}
+
+func init() {
+	t := reflect.TypeOf(ServerProperties{})
+	for i := 0; i < t.NumField(); i++ {
+		name := t.Field(i).Tag.Get("mapstructure")
+		if name == "" {
+			continue
+		}
+		check, mutable := mutableParams[name]
+		p := &param{name: name, field: i, mutable: mutable, check: check, parse: parseValue}
+		if parse, ok := customParsers[name]; ok {
+			p.parse = parse
+		}
+		params = append(params, p)
+		paramMap[name] = p
+	}
+}
+
+func atLeast(min int64) func(value reflect.Value) error {
+	return func(value reflect.Value) error {
+		if value.Int() < min {
+			return fmt.Errorf("argument must be at least %d", min)
+		}
+		return nil
+	}
+}
+
+func between(min int64, max int64) func(value reflect.Value) error {
+	return func(value reflect.Value) error {
+		if value.Int() < min || value.Int() > max {
+			return fmt.Errorf("argument must be between %d and %d inclusive", min, max)
+		}
+		return nil
+	}
+}
+
+func oneOf(values ...string) func(value reflect.Value) error {
+	return func(value reflect.Value) error {
+		for _, v := range values {
+			if value.String() == v {
+				return nil
+			}
+		}
+		return errors.New("argument must be one of " + strings.Join(values, ", "))
+	}
+}
+
+// ParamError is returned by Set when a parameter is unknown, immutable or invalid
+type ParamError struct {
+	Name string
+	Err  error
+}
+
+func (e *ParamError) Error() string {
+	return e.Name + ": " + e.Err.Error()
+}
+
+func (e *ParamError) Unwrap() error {
+	return e.Err
+}
+
+// AddObserver registers fn which is called with names of changed parameters after CONFIG SET or reload
+func AddObserver(fn func(changed []string)) {
+	mu.Lock()
+	defer mu.Unlock()
+	observers = append(observers, fn)
+}
+
+// Get returns names and values of parameters matching any of patterns, names are sorted
+func Get(patterns ...string) ([]string, []string) {
+	properties := reflect.ValueOf(Properties()).Elem()
+	var names, values []string
+	for _, p := range params {
+		for _, pattern := range patterns {
+			if wildcard.MatchNoCase(pattern, p.name) {
+				names = append(names, p.name)
+				values = append(values, formatValue(properties.Field(p.field)))
+				break
+			}
+		}
+	}
+	sort.Sort(byName{names, values})
+	return names, values
+}
+
+type byName struct {
+	names  []string
+	values []string
+}
+
+func (b byName) Len() int           { return len(b.names) }
+func (b byName) Less(i, j int) bool { return b.names[i] < b.names[j] }
+func (b byName) Swap(i, j int) {
+	b.names[i], b.names[j] = b.names[j], b.names[i]
+	b.values[i], b.values[j] = b.values[j], b.values[i]
+}
+
+// Set changes parameters given as name value pairs, either all of them are applied or none
+func Set(pairs ...string) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	old := Properties()
+	next := *old
+	current := reflect.ValueOf(old).Elem()
+	nextValue := reflect.ValueOf(&next).Elem()
+	seen := make(map[string]struct{})
+	var changed []string
+	for i := 0; i+1 < len(pairs); i += 2 {
+		name := strings.ToLower(pairs[i])
+		p, ok := paramMap[name]
+		if !ok {
+			return &ParamError{Name: pairs[i], Err: ErrUnknownParam}
+		}
+		if _, ok := seen[name]; ok {
+			return &ParamError{Name: name, Err: errors.New("duplicate parameter")}
+		}
+		seen[name] = struct{}{}
+		if !p.mutable {
+			return &ParamError{Name: name, Err: errors.New("can't set immutable config")}
+		}
+		field := nextValue.Field(p.field)
+		if err := p.parse(field, pairs[i+1]); err != nil {
+			return &ParamError{Name: name, Err: err}
+		}
+		if p.check != nil {
+			if err := p.check(field); err != nil {
+				return &ParamError{Name: name, Err: err}
+			}
+		}
+		// 与当前值相同的配置项不通知观察者，避免覆盖运行时修改的状态，如 aclfile 中加载的 default 用户密码
+		if !reflect.DeepEqual(field.Interface(), current.Field(p.field).Interface()) {
+			changed = append(changed, name)
+		}
+	}
+	apply(&next, changed)
+	return nil
+}
+
+// apply 替换当前配置并通知观察者，调用者需持有 mu
+func apply(next *ServerProperties, changed []string) {
+	if len(changed) == 0 {
+		return
+	}
+	if next.LogLevel != Properties().LogLevel {
+		_ = logger.SetLevel(next.LogLevel)
+	}
+	SetProperties(next)
+	for _, fn := range observers {
+		fn(changed)
+	}
+}
+
+// Reload reads the config file again and applies changes of mutable parameters,
+// changes of other parameters are ignored with a warning because they need restart
+func Reload() error {
+	mu.Lock()
+	defer mu.Unlock()
+	if configFile == "" {
+		return ErrNoConfigFile
+	}
+	loaded, err := load(configFile)
+	if err != nil {
+		return err
+	}
+
+	old := Properties()
+	next := *old
+	current := reflect.ValueOf(old).Elem()
+	loadedValue := reflect.ValueOf(loaded).Elem()
+	nextValue := reflect.ValueOf(&next).Elem()
+	var changed []string
+	for _, p := range params {
+		value := loadedValue.Field(p.field)
+		if reflect.DeepEqual(value.Interface(), current.Field(p.field).Interface()) {
+			continue
+		}
+		if !p.mutable {
+			logger.Warn(p.name + " is changed in config file, it takes effect after restart")
+			continue
+		}
+		if p.check != nil {
+			if err := p.check(value); err != nil {
+				return fmt.Errorf("invalid %s: %v", p.name, err)
+			}
+		}
+		nextValue.Field(p.field).Set(value)
+		changed = append(changed, p.name)
+	}
+	apply(&next, changed)
+	if len(changed) > 0 {
+		logger.Info("config reloaded, changed: " + strings.Join(changed, ", "))
+	}
+	return nil
+}
+
+// Rewrite writes current parameters back into the config file, comments and order of existing keys are kept.
+// Parameters missing in the file are appended when they differ from default
+func Rewrite() error {
+	mu.Lock()
+	defer mu.Unlock()
+	if configFile == "" {
+		return ErrNoConfigFile
+	}
+	if isRedisConf(configFile) {
+		return rewriteRedisConf(configFile, Properties())
+	}
+	data, err := os.ReadFile(configFile)
+	if err != nil {
+		return err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	if doc.Kind == 0 {
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode}}}
+	}
+	mapping := doc.Content[0]
+	if mapping.Kind != yaml.MappingNode {
+		return errors.New("config file is not a yaml mapping")
+	}
+	defaults, err := loadFile("")
+	if err != nil {
+		return err
+	}
+	inFile, err := loadFile(configFile)
+	if err != nil {
+		return err
+	}
+
+	current := reflect.ValueOf(persistedValues(Properties(), inFile)).Elem()
+	defaultValue := reflect.ValueOf(defaults).Elem()
+	for _, p := range params {
+		value := current.Field(p.field)
+		var valueNode yaml.Node
+		if err := valueNode.Encode(value.Interface()); err != nil {
+			return err
+		}
+		if node := findKey(mapping, p.name); node != nil {
+			old := reflect.New(value.Type())
+			if node.Decode(old.Interface()) == nil && reflect.DeepEqual(old.Elem().Interface(), value.Interface()) {
+				continue
+			}
+			valueNode.LineComment = node.LineComment
+			*node = valueNode
+			continue
+		}
+		if reflect.DeepEqual(value.Interface(), defaultValue.Field(p.field).Interface()) {
+			continue
+		}
+		keyNode := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: p.name}
+		mapping.Content = append(mapping.Content, keyNode, &valueNode)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(configFile), filepath.Base(configFile)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	encoder := yaml.NewEncoder(tmp)
+	encoder.SetIndent(2)
+	err = encoder.Encode(&doc)
+	if err == nil {
+		err = encoder.Close()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), configFile)
+}
+
+// persistedValues 返回 CONFIG REWRITE 需要写回配置文件的值。debug 模式下 load 清空了密码，
+// 运行时的空密码不是配置的值，写回时保留文件中的密码
+func persistedValues(current *ServerProperties, inFile *ServerProperties) *ServerProperties {
+	if !current.Debug || current.Password != "" {
+		return current
+	}
+	persisted := *current
+	persisted.Password = inFile.Password
+	return &persisted
+}
+
+// normalize 在默认值的基础上重新解析取值格式特殊的配置项，同时校验其格式
+func normalize(properties *ServerProperties) error {
+	value := reflect.ValueOf(properties).Elem()
+	defaults := reflect.ValueOf(defaultProperties()).Elem()
+	for name := range customParsers {
+		p := paramMap[name]
+		field := value.Field(p.field)
+		if field.Kind() != reflect.String {
+			continue
+		}
+		s := field.String()
+		field.Set(defaults.Field(p.field))
+		if err := p.parse(field, s); err != nil {
+			return fmt.Errorf("invalid %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// setMemory 解析带单位的内存大小，如 64mb
+func setMemory(value reflect.Value, s string) error {
+	n, err := ParseMemory(s)
+	if err != nil {
+		return err
+	}
+	value.SetInt(n)
+	return nil
+}
+
+// findKey returns value node of key in mapping
+func findKey(mapping *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// formatValue 与 redis 一致，布尔值显示为 yes/no，列表以空格分隔
+func formatValue(value reflect.Value) string {
+	switch value.Kind() {
+	case reflect.Bool:
+		if value.Bool() {
+			return "yes"
+		}
+		return "no"
+	case reflect.Int, reflect.Int64:
+		return strconv.FormatInt(value.Int(), 10)
+	case reflect.Slice:
+		return strings.Join(value.Interface().([]string), " ")
+	}
+	return value.String()
+}
+
+// parseValue parses s and stores it in value according to its kind
+func parseValue(value reflect.Value, s string) error {
+	switch value.Kind() {
+	case reflect.Bool:
+		switch strings.ToLower(s) {
+		case "yes", "true":
+			value.SetBool(true)
+		case "no", "false":
+			value.SetBool(false)
+		default:
+			return errors.New("argument must be 'yes' or 'no'")
+		}
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return errors.New("argument couldn't be parsed into an integer")
+		}
+		value.SetInt(n)
+	case reflect.String:
+		value.SetString(s)
+	case reflect.Slice:
+		value.Set(reflect.ValueOf(strings.Fields(s)))
+	default:
+		return errors.New("unsupported parameter type")
+	}
+	return nil
+}
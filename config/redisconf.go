@@ -0,0 +1,414 @@
+package config
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"godis/lib/logger"
+	"godis/lib/utils"
+)
+
+// directive 是 redis.conf 中的一条配置指令，可能对应多个配置项
+type directive struct {
+	name   string
+	params []string
+	parse  func(p *ServerProperties, args []string) error
+	format func(p *ServerProperties) []string
+}
+
+// redisDirectives 与 godis 配置项名字不同或者取值方式不同的 redis 指令，
+// 其他配置项也可以使用名字中的 _ 替换为 - 后的指令设置，如 open-atomic-tx yes
+var redisDirectives = []*directive{
+	{
+		name:   "bind",
+		params: []string{"bind"},
+		parse: func(p *ServerProperties, args []string) error {
+			if len(args) > 1 {
+				logger.Warn("only the first address of bind is used: " + args[0])
+			}
+			p.Bind = args[0]
+			return nil
+		},
+		format: func(p *ServerProperties) []string { return []string{p.Bind} },
+	},
+	stringDirective("requirepass", "password"),
+	stringDirective("tcp-keepalive", "keepalive"),
+	{
+		name:   "loglevel",
+		params: []string{"log_level"},
+		parse: func(p *ServerProperties, args []string) error {
+			level, ok := redisLogLevels[strings.ToLower(args[0])]
+			if !ok {
+				return errors.New("invalid log level " + args[0])
+			}
+			p.LogLevel = level
+			return nil
+		},
+		format: func(p *ServerProperties) []string {
+			if p.LogLevel == "info" {
+				return []string{"notice"}
+			}
+			if p.LogLevel == "warn" {
+				return []string{"warning"}
+			}
+			return []string{p.LogLevel}
+		},
+	},
+	stringDirective("appendonly", "append_only"),
+	stringDirective("appendfilename", "aof_filename"),
+	stringDirective("appenddirname", "aof_dirname"),
+	{
+		name:   "appendfsync",
+		params: []string{"aof_fsync"},
+		parse: func(p *ServerProperties, args []string) error {
+			for i, name := range fsyncNames {
+				if strings.EqualFold(args[0], name) {
+					p.AofFsync = i
+					return nil
+				}
+			}
+			return errors.New("appendfsync must be one of always, everysec, no")
+		},
+		format: func(p *ServerProperties) []string {
+			if p.AofFsync < 0 || p.AofFsync >= len(fsyncNames) {
+				return []string{strconv.Itoa(p.AofFsync)}
+			}
+			return []string{fsyncNames[p.AofFsync]}
+		},
+	},
+	{
+		// redis 中 0 表示关闭自动重写
+		name:   "auto-aof-rewrite-percentage",
+		params: []string{"auto_aof_rewrite", "auto_aof_rewrite_percentage"},
+		parse: func(p *ServerProperties, args []string) error {
+			percentage, err := strconv.ParseInt(args[0], 10, 64)
+			if err != nil || percentage < 0 {
+				return errors.New("invalid auto-aof-rewrite-percentage " + args[0])
+			}
+			p.AutoAofRewrite = percentage > 0
+			if percentage > 0 {
+				p.AutoAofRewritePercentage = percentage
+			}
+			return nil
+		},
+		format: func(p *ServerProperties) []string {
+			if !p.AutoAofRewrite {
+				return []string{"0"}
+			}
+			return []string{strconv.FormatInt(p.AutoAofRewritePercentage, 10)}
+		},
+	},
+	{
+		// godis 中的单位是 mb，不足 1mb 的部分向上取整
+		name:   "auto-aof-rewrite-min-size",
+		params: []string{"auto_aov_rewrite_min_size"},
+		parse: func(p *ServerProperties, args []string) error {
+			size, err := ParseMemory(args[0])
+			if err != nil {
+				return err
+			}
+			p.AutoAofRewriteMinSize = (size + 1<<20 - 1) >> 20
+			return nil
+		},
+		format: func(p *ServerProperties) []string {
+			return []string{strconv.FormatInt(p.AutoAofRewriteMinSize, 10) + "mb"}
+		},
+	},
+}
+
+var (
+	fsyncNames     = []string{"always", "everysec", "no"}
+	redisLogLevels = map[string]string{
+		"debug":   "debug",
+		"verbose": "debug",
+		"notice":  "info",
+		"info":    "info",
+		"warning": "warn",
+		"warn":    "warn",
+		"error":   "error",
+	}
+	directiveMap = make(map[string]*directive)
+)
+
+func init() {
+	for _, d := range redisDirectives {
+		directiveMap[d.name] = d
+	}
+	for _, p := range params {
+		name := strings.ReplaceAll(p.name, "_", "-")
+		if _, ok := directiveMap[name]; !ok {
+			directiveMap[name] = paramDirective(p)
+		}
+	}
+}
+
+// stringDirective 只是名字与配置项不同的指令
+func stringDirective(name string, param string) *directive {
+	d := &directive{name: name, params: []string{param}}
+	d.parse = func(p *ServerProperties, args []string) error {
+		return paramDirective(paramMap[param]).parse(p, args)
+	}
+	d.format = func(p *ServerProperties) []string {
+		return paramDirective(paramMap[param]).format(p)
+	}
+	return d
+}
+
+// paramDirective 使用与 CONFIG SET 相同的方式解析配置项
+func paramDirective(pa *param) *directive {
+	return &directive{
+		name:   strings.ReplaceAll(pa.name, "_", "-"),
+		params: []string{pa.name},
+		parse: func(p *ServerProperties, args []string) error {
+			field := reflect.ValueOf(p).Elem().Field(pa.field)
+			_, custom := customParsers[pa.name]
+			if field.Kind() != reflect.Slice && !custom && len(args) != 1 {
+				return errors.New("wrong number of arguments")
+			}
+			return pa.parse(field, strings.Join(args, " "))
+		},
+		format: func(p *ServerProperties) []string {
+			field := reflect.ValueOf(p).Elem().Field(pa.field)
+			if field.Kind() == reflect.Slice {
+				return field.Interface().([]string)
+			}
+			return []string{formatValue(field)}
+		},
+	}
+}
+
+// ParseMemory parses memory size with optional unit like redis: 1k = 1000, 1kb = 1024, also m, mb, g and gb
+func ParseMemory(s string) (int64, error) {
+	lower := strings.ToLower(s)
+	units := []struct {
+		suffix string
+		mul    int64
+	}{
+		{"kb", 1 << 10}, {"mb", 1 << 20}, {"gb", 1 << 30},
+		{"k", 1000}, {"m", 1000 * 1000}, {"g", 1000 * 1000 * 1000},
+		{"b", 1},
+	}
+	mul := int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(lower, unit.suffix) {
+			lower = strings.TrimSuffix(lower, unit.suffix)
+			mul = unit.mul
+			break
+		}
+	}
+	n, err := strconv.ParseInt(lower, 10, 64)
+	if err != nil || n < 0 {
+		return 0, errors.New("invalid memory size " + s)
+	}
+	return n * mul, nil
+}
+
+// isRedisConf 以 .conf 结尾的配置文件使用 redis.conf 格式，其他的使用 yaml 格式
+func isRedisConf(filename string) bool {
+	return strings.HasSuffix(filename, ".conf")
+}
+
+// maxIncludeDepth 防止 include 循环引用
+const maxIncludeDepth = 16
+
+// loadRedisConf reads directives in redis.conf format into p
+func loadRedisConf(filename string, p *ServerProperties) error {
+	return readRedisConf(filename, p, 0)
+}
+
+func readRedisConf(filename string, p *ServerProperties, depth int) error {
+	if depth > maxIncludeDepth {
+		return errors.New("too many nested includes in " + filename)
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		args, err := splitLine(scanner.Text())
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", filename, lineNum, err)
+		}
+		if len(args) == 0 {
+			continue
+		}
+		if strings.ToLower(args[0]) == "include" {
+			if len(args) != 2 {
+				return fmt.Errorf("%s:%d: include requires a file name", filename, lineNum)
+			}
+			included := args[1]
+			if !filepath.IsAbs(included) {
+				included = filepath.Join(filepath.Dir(filename), included)
+			}
+			if err := readRedisConf(included, p, depth+1); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := applyDirective(p, args); err != nil {
+			return fmt.Errorf("%s:%d: %v", filename, lineNum, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// splitLine 解析一行配置，忽略空行和注释
+func splitLine(line string) ([]string, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' {
+		return nil, nil
+	}
+	return utils.SplitArgs(line)
+}
+
+// applyDirective sets parameters according to directive args[0] with arguments args[1:], unknown directives are ignored with a warning
+func applyDirective(p *ServerProperties, args []string) error {
+	d, ok := lookupDirective(args[0])
+	if !ok {
+		logger.Warn("unknown config directive '" + args[0] + "' is ignored")
+		return nil
+	}
+	if len(args) < 2 {
+		return errors.New("missing argument of " + args[0])
+	}
+	if err := d.parse(p, args[1:]); err != nil {
+		return fmt.Errorf("bad directive '%s': %v", args[0], err)
+	}
+	return nil
+}
+
+// lookupDirective 指令名不区分大小写，也可以直接使用 yaml 中的名字
+func lookupDirective(name string) (*directive, bool) {
+	d, ok := directiveMap[strings.ReplaceAll(strings.ToLower(name), "_", "-")]
+	return d, ok
+}
+
+// SplitOverrides separates `--name value ...` options from command line args like redis-server,
+// values of an option continue until the next argument starting with --
+func SplitOverrides(args []string) ([]string, [][]string) {
+	var rest []string
+	var overrides [][]string
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "--") && len(arg) > 2 {
+			overrides = append(overrides, []string{arg[2:]})
+			continue
+		}
+		if len(overrides) > 0 {
+			last := overrides[len(overrides)-1]
+			overrides[len(overrides)-1] = append(last, arg)
+			continue
+		}
+		rest = append(rest, arg)
+	}
+	return rest, overrides
+}
+
+// rewriteRedisConf 替换文件中已有的指令并追加其他修改过的配置项，注释和 include 保持不变
+func rewriteRedisConf(filename string, current *ServerProperties) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	inFile, err := loadFile(filename)
+	if err != nil {
+		return err
+	}
+	current = persistedValues(current, inFile)
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+
+	// 同一个配置项只保留最后一次出现的指令，和读取时的语义一致
+	lastLine := make(map[string]int)
+	for i, line := range lines {
+		args, _ := splitLine(line)
+		if len(args) == 0 {
+			continue
+		}
+		if d, ok := lookupDirective(args[0]); ok {
+			for _, name := range d.params {
+				lastLine[name] = i
+			}
+		}
+	}
+
+	currentValue := reflect.ValueOf(current).Elem()
+	inFileValue := reflect.ValueOf(inFile).Elem()
+	changed := func(d *directive) bool {
+		for _, name := range d.params {
+			pa := paramMap[name]
+			if !reflect.DeepEqual(currentValue.Field(pa.field).Interface(), inFileValue.Field(pa.field).Interface()) {
+				return true
+			}
+		}
+		return false
+	}
+
+	written := make(map[string]bool)
+	for _, pa := range params {
+		if written[pa.name] {
+			continue
+		}
+		var d *directive
+		i, exists := lastLine[pa.name]
+		if exists {
+			args, _ := splitLine(lines[i])
+			d, _ = lookupDirective(args[0])
+		} else {
+			d = preferredDirective(pa.name)
+		}
+		for _, name := range d.params {
+			written[name] = true
+		}
+		if !changed(d) {
+			continue
+		}
+		line := formatDirective(d.name, d.format(current))
+		if exists {
+			lines[i] = line
+		} else {
+			lines = append(lines, line)
+		}
+	}
+
+	content := strings.Join(lines, "\n") + "\n"
+	tmp := filename + ".tmp"
+	if err := os.WriteFile(tmp, []byte(content), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+// preferredDirective 写入新的配置项时优先使用 redis 中的指令名
+func preferredDirective(param string) *directive {
+	for _, d := range redisDirectives {
+		for _, name := range d.params {
+			if name == param {
+				return d
+			}
+		}
+	}
+	d, _ := lookupDirective(param)
+	return d
+}
+
+// formatDirective 必要时为参数加上引号
+func formatDirective(name string, args []string) string {
+	parts := []string{name}
+	for _, arg := range args {
+		if arg == "" || strings.ContainsAny(arg, " \t\"'\\#") {
+			arg = strconv.Quote(arg)
+		}
+		parts = append(parts, arg)
+	}
+	return strings.Join(parts, " ")
+}
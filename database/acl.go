@@ -0,0 +1,343 @@
+package database
+
+import (
+	"os"
+	"strings"
+
+	"godis/config"
+	"godis/database/acl"
+	"godis/database/engine"
+	"godis/interface/redis"
+	"godis/lib/logger"
+	"godis/redis/protocol"
+)
+
+// systemCommandCategories 记录由 Server 直接处理的命令及其 ACL 类别，数据命令的类别由 engine 中的 flags 决定
+var systemCommandCategories = map[string][]string{
+	"ping":         {"connection"},
+	"auth":         {"connection"},
+	"hello":        {"connection"},
+	"select":       {"connection"},
+	"bgrewriteaof": {"admin", "dangerous"},
+	"rewriteaof":   {"admin", "dangerous"},
+	"multi":        {"transaction"},
+	"exec":         {"transaction"},
+	"discard":      {"transaction"},
+	"watch":        {"transaction"},
+	"unwatch":      {"transaction"},
+	"publish":      {"pubsub"},
+	"subscribe":    {"pubsub"},
+	"unsubscribe":  {"pubsub"},
+	"pubsub":       {"pubsub"},
+	"client":       {"admin", "connection", "dangerous"},
+	"slowlog":      {"admin", "dangerous"},
+	"monitor":      {"admin", "dangerous"},
+	"acl":          {"admin", "dangerous"},
+	"eval":         {"scripting"},
+	"evalsha":      {"scripting"},
+	"script":       {"scripting"},
+	"function":     {"scripting"},
+	"fcall":        {"scripting"},
+	"fcall_ro":     {"scripting"},
+	"command":      {"connection"},
+	"config":       {"admin", "dangerous"},
+	"shutdown":     {"admin", "dangerous"},
+}
+
+// aclCommandTable 向 acl 包提供命令信息
+type aclCommandTable struct{}
+
+func (aclCommandTable) IsCommand(name string) bool {
+	if _, ok := systemCommandCategories[name]; ok {
+		return true
+	}
+	return engine.IsCommand(name)
+}
+
+func (aclCommandTable) CommandNames() []string {
+	names := engine.CommandNames()
+	for name := range systemCommandCategories {
+		names = append(names, name)
+	}
+	return names
+}
+
+func (aclCommandTable) CommandCategories(name string) []string {
+	if categories, ok := systemCommandCategories[name]; ok {
+		return categories
+	}
+	if engine.IsReadOnlyCommand(name) {
+		return []string{"read"}
+	}
+	if engine.IsWriteCommand(name) {
+		return []string{"write"}
+	}
+	return nil
+}
+
+// initACL 创建 default 用户，配置了 aclfile 时从文件中加载用户
+func (s *Server) initACL() {
+	s.acl = acl.New(aclCommandTable{})
+	if config.Properties().Password != "" {
+		if err := s.acl.SetUser(acl.DefaultUser, "resetpass", ">"+config.Properties().Password); err != nil {
+			logger.Fatal(err)
+		}
+	}
+	filename := config.Properties().AclFile
+	if filename == "" {
+		return
+	}
+	if _, err := os.Stat(filename); os.IsNotExist(err) {
+		logger.Info("acl file " + filename + " does not exist, it will be created by ACL SAVE")
+		return
+	}
+	if config.Properties().Password != "" {
+		logger.Warn("password is ignored because users are loaded from acl file " + filename)
+	}
+	if err := s.acl.Load(filename); err != nil {
+		logger.Fatal("load acl file failed: " + err.Error())
+	}
+}
+
+// clientUser returns name of the user c authenticated as
+func clientUser(c redis.Connection) string {
+	if user := c.GetUser(); user != "" {
+		return user
+	}
+	return acl.DefaultUser
+}
+
+// Auth AUTH [username] password
+func Auth(s *Server, c redis.Connection, args [][]byte) redis.Reply {
+	var username, password string
+	switch len(args) {
+	case 1:
+		if s.acl.GetUser(acl.DefaultUser).NoPass() {
+			return protocol.MakeErrReply("ERR Client sent AUTH, but no password is set")
+		}
+		username, password = acl.DefaultUser, string(args[0])
+	case 2:
+		username, password = string(args[0]), string(args[1])
+	default:
+		return protocol.MakeArgNumErrReply("auth")
+	}
+	if err := s.acl.Authenticate(username, password); err != nil {
+		return protocol.MakeErrReply(err.Error())
+	}
+	c.SetUser(username)
+	return protocol.MakeOkReply()
+}
+
+// isAuthenticated 未认证的连接使用 default 用户，default 用户没有密码时无需认证
+func isAuthenticated(s *Server, c redis.Connection) bool {
+	if c.GetUser() != "" {
+		return true
+	}
+	defaultUser := s.acl.GetUser(acl.DefaultUser)
+	return defaultUser.Enabled() && defaultUser.NoPass()
+}
+
+// checkPermission verifies the user of c may run cmdLine and access its keys and channels
+func (s *Server) checkPermission(c redis.Connection, cmdLine [][]byte) redis.Reply {
+	table := s.acl.Table()
+	cmdName := strings.ToLower(string(cmdLine[0]))
+	if cmdName == "auth" || cmdName == "hello" || !table.IsCommand(cmdName) {
+		return nil // 未知命令交给后面返回 unknown command
+	}
+	username := clientUser(c)
+	user := s.acl.GetUser(username)
+	if user == nil {
+		return protocol.MakeErrReply("NOAUTH Authentication required")
+	}
+
+	var subCmd string
+	if len(cmdLine) > 1 {
+		subCmd = strings.ToLower(string(cmdLine[1]))
+	}
+	var errReply redis.Reply
+	if !user.CanRun(table, cmdName, subCmd) {
+		errReply = protocol.MakeErrReply("NOPERM User " + username + " has no permissions to run the '" + cmdName + "' command")
+	} else if !canAccessKeys(user, cmdLine) {
+		errReply = protocol.MakeErrReply("NOPERM No permissions to access a key")
+	} else if !canAccessChannels(user, cmdName, cmdLine) {
+		errReply = protocol.MakeErrReply("NOPERM No permissions to access a channel")
+	}
+	if errReply != nil && c.GetMultiStatus() {
+		c.EnqueueSyntaxErrQueue(errReply) // 让 EXEC 放弃整个事务
+	}
+	return errReply
+}
+
+func canAccessKeys(user *acl.User, cmdLine [][]byte) bool {
+	writeKeys, readKeys, ok := engine.GetRelatedKeys(cmdLine)
+	if !ok {
+		return true
+	}
+	// 只读命令的 PreFunc 也可能返回 write key，只需要读权限
+	readOnly := engine.IsReadOnlyCommand(string(cmdLine[0]))
+	for _, key := range writeKeys {
+		if !user.CanAccessKey(key, !readOnly) {
+			return false
+		}
+	}
+	for _, key := range readKeys {
+		if !user.CanAccessKey(key, false) {
+			return false
+		}
+	}
+	return true
+}
+
+func canAccessChannels(user *acl.User, cmdName string, cmdLine [][]byte) bool {
+	var channels [][]byte
+	switch cmdName {
+	case "publish":
+		if len(cmdLine) > 1 {
+			channels = cmdLine[1:2]
+		}
+	case "subscribe":
+		channels = cmdLine[1:]
+	}
+	for _, channel := range channels {
+		if !user.CanAccessChannel(string(channel)) {
+			return false
+		}
+	}
+	return true
+}
+
+// execACL ACL SETUSER|GETUSER|DELUSER|LIST|USERS|WHOAMI|CAT|SAVE|LOAD
+func execACL(s *Server, c redis.Connection, args [][]byte) redis.Reply {
+	if len(args) == 0 {
+		return protocol.MakeArgNumErrReply("acl")
+	}
+	subCmd := strings.ToLower(string(args[0]))
+	args = args[1:]
+	switch subCmd {
+	case "setuser":
+		if len(args) < 1 {
+			return protocol.MakeArgNumErrReply("acl|setuser")
+		}
+		rules := make([]string, len(args)-1)
+		for i, arg := range args[1:] {
+			rules[i] = string(arg)
+		}
+		if err := s.acl.SetUser(string(args[0]), rules...); err != nil {
+			return protocol.MakeErrReply("ERR " + err.Error())
+		}
+		return protocol.MakeOkReply()
+	case "getuser":
+		if len(args) != 1 {
+			return protocol.MakeArgNumErrReply("acl|getuser")
+		}
+		return aclGetUser(s, string(args[0]))
+	case "deluser":
+		if len(args) < 1 {
+			return protocol.MakeArgNumErrReply("acl|deluser")
+		}
+		names := make([]string, len(args))
+		for i, arg := range args {
+			names[i] = string(arg)
+		}
+		deleted, err := s.acl.DelUser(names...)
+		if err != nil {
+			return protocol.MakeErrReply("ERR " + err.Error())
+		}
+		s.killClientsOfRemovedUsers()
+		return protocol.MakeIntReply(int64(deleted))
+	case "list":
+		if len(args) != 0 {
+			return protocol.MakeArgNumErrReply("acl|list")
+		}
+		return protocol.MakeMultiBulkReply(toBulks(s.acl.List()))
+	case "users":
+		if len(args) != 0 {
+			return protocol.MakeArgNumErrReply("acl|users")
+		}
+		return protocol.MakeMultiBulkReply(toBulks(s.acl.Users()))
+	case "whoami":
+		if len(args) != 0 {
+			return protocol.MakeArgNumErrReply("acl|whoami")
+		}
+		return protocol.MakeBulkReply([]byte(clientUser(c)))
+	case "cat":
+		switch len(args) {
+		case 0:
+			return protocol.MakeMultiBulkReply(toBulks(acl.Categories(s.acl.Table())))
+		case 1:
+			names, err := acl.CommandsInCategory(s.acl.Table(), string(args[0]))
+			if err != nil {
+				return protocol.MakeErrReply("ERR " + err.Error())
+			}
+			return protocol.MakeMultiBulkReply(toBulks(names))
+		}
+		return protocol.MakeArgNumErrReply("acl|cat")
+	case "save", "load":
+		if len(args) != 0 {
+			return protocol.MakeArgNumErrReply("acl|" + subCmd)
+		}
+		filename := config.Properties().AclFile
+		if filename == "" {
+			return protocol.MakeErrReply("ERR This Redis instance is not configured to use an ACL file. You may want to specify users via the ACL SETUSER command and then set aclfile in the configuration file.")
+		}
+		if subCmd == "save" {
+			if err := s.acl.Save(filename); err != nil {
+				return protocol.MakeErrReply("ERR There was an error trying to save the ACLs. Please check the server logs for more information")
+			}
+			return protocol.MakeOkReply()
+		}
+		if err := s.acl.Load(filename); err != nil {
+			return protocol.MakeErrReply("ERR " + err.Error())
+		}
+		s.killClientsOfRemovedUsers()
+		return protocol.MakeOkReply()
+	}
+	return protocol.MakeErrReply("ERR unknown subcommand '" + subCmd + "'. Try ACL HELP.")
+}
+
+func aclGetUser(s *Server, name string) redis.Reply {
+	user := s.acl.GetUser(name)
+	if user == nil {
+		return protocol.MakeNullBulkReply()
+	}
+	keys := []redis.Reply{
+		protocol.MakeBulkReply([]byte("flags")),
+		protocol.MakeBulkReply([]byte("passwords")),
+		protocol.MakeBulkReply([]byte("commands")),
+		protocol.MakeBulkReply([]byte("keys")),
+		protocol.MakeBulkReply([]byte("channels")),
+	}
+	values := []redis.Reply{
+		protocol.MakeMultiBulkReply(toBulks(user.Flags())),
+		protocol.MakeMultiBulkReply(toBulks(user.Passwords())),
+		protocol.MakeBulkReply([]byte(user.CommandRules())),
+		protocol.MakeBulkReply([]byte(user.KeyRules())),
+		protocol.MakeBulkReply([]byte(user.ChannelRules())),
+	}
+	return protocol.MakeMapReply(keys, values)
+}
+
+// killClientsOfRemovedUsers 断开已经被删除的用户的连接
+func (s *Server) killClientsOfRemovedUsers() {
+	if s.clients == nil {
+		return
+	}
+	var victims []int64
+	s.clients.ForEachClient(func(c redis.Connection) bool {
+		if s.acl.GetUser(clientUser(c)) == nil {
+			victims = append(victims, c.GetID())
+		}
+		return true
+	})
+	for _, id := range victims {
+		s.clients.KillClient(id)
+	}
+}
+
+func toBulks(values []string) [][]byte {
+	bulks := make([][]byte, len(values))
+	for i, value := range values {
+		bulks[i] = []byte(value)
+	}
+	return bulks
+}
@@ -0,0 +1,264 @@
+package acl
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"godis/lib/utils"
+)
+
+// DefaultUser is used by connections which never called AUTH <user> <pass>
+const DefaultUser = "default"
+
+// CommandTable provides command metadata to acl, implemented by the database package
+type CommandTable interface {
+	IsCommand(name string) bool
+	CommandNames() []string
+	CommandCategories(name string) []string
+}
+
+// ACL holds all users, users are copy-on-write so a *User returned by GetUser can be used without locking
+type ACL struct {
+	mu    sync.RWMutex
+	users map[string]*User
+	table CommandTable
+}
+
+func New(table CommandTable) *ACL {
+	a := &ACL{
+		users: make(map[string]*User),
+		table: table,
+	}
+	a.users[DefaultUser] = newDefaultUser(table)
+	return a
+}
+
+// newDefaultUser 默认用户可以执行所有命令、访问所有 key 和 channel
+func newDefaultUser(table CommandTable) *User {
+	u := newUser(DefaultUser)
+	for _, rule := range []string{"on", "nopass", "allkeys", "allchannels", "+@all"} {
+		_ = u.setRule(table, rule)
+	}
+	return u
+}
+
+func (a *ACL) GetUser(name string) *User {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.users[name]
+}
+
+// SetUser creates or modifies user, rules are applied in order and nothing changes if any rule is invalid
+func (a *ACL) SetUser(name string, rules ...string) error {
+	if name == "" || strings.ContainsAny(name, " \t\r\n") {
+		return errors.New("Usernames can't contain spaces or null characters")
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var u *User
+	if existed, ok := a.users[name]; ok {
+		u = existed.clone()
+	} else {
+		u = newUser(name)
+	}
+	for _, rule := range rules {
+		if err := u.setRule(a.table, rule); err != nil {
+			return fmt.Errorf("Error in ACL SETUSER modifier '%s': %s", rule, err.Error())
+		}
+	}
+	a.users[name] = u
+	return nil
+}
+
+// DelUser removes users and returns how many of them existed, the default user can't be removed
+func (a *ACL) DelUser(names ...string) (int, error) {
+	for _, name := range names {
+		if name == DefaultUser {
+			return 0, errors.New("The 'default' user cannot be removed")
+		}
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	deleted := 0
+	for _, name := range names {
+		if _, ok := a.users[name]; ok {
+			delete(a.users, name)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// Users returns sorted user names
+func (a *ACL) Users() []string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	names := make([]string, 0, len(a.users))
+	for name := range a.users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// List returns users in acl file format
+func (a *ACL) List() []string {
+	names := a.Users()
+	lines := make([]string, 0, len(names))
+	for _, name := range names {
+		if u := a.GetUser(name); u != nil {
+			lines = append(lines, "user "+name+" "+u.Describe())
+		}
+	}
+	return lines
+}
+
+// Authenticate checks username and password, user must exist and be enabled
+func (a *ACL) Authenticate(name string, password string) error {
+	u := a.GetUser(name)
+	if u == nil || !u.enabled || !u.checkPassword(password) {
+		return errors.New("WRONGPASS invalid username-password pair or user is disabled.")
+	}
+	return nil
+}
+
+// Table returns the command table users are checked against
+func (a *ACL) Table() CommandTable {
+	return a.table
+}
+
+// Categories returns all known command categories
+func Categories(table CommandTable) []string {
+	set := map[string]struct{}{"all": {}}
+	for _, name := range table.CommandNames() {
+		for _, category := range table.CommandCategories(name) {
+			set[category] = struct{}{}
+		}
+	}
+	categories := make([]string, 0, len(set))
+	for category := range set {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+	return categories
+}
+
+// CommandsInCategory returns sorted names of commands belong to category
+func CommandsInCategory(table CommandTable, category string) ([]string, error) {
+	category = strings.ToLower(category)
+	if !isKnownCategory(table, category) {
+		return nil, errors.New("Unknown category '" + category + "'")
+	}
+	var names []string
+	for _, name := range table.CommandNames() {
+		if category == "all" {
+			names = append(names, name)
+			continue
+		}
+		for _, c := range table.CommandCategories(name) {
+			if c == category {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Load replaces all users with the content of filename, the current users are kept on any error.
+// The default user is created with full permissions if the file doesn't mention it
+func (a *ACL) Load(filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	loaded := &ACL{users: make(map[string]*User), table: a.table}
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		args, err := utils.SplitArgs(line)
+		if err != nil || len(args) < 2 || args[0] != "user" {
+			return fmt.Errorf("%s:%d: line should start with user keyword", filename, lineNum)
+		}
+		name := args[1]
+		if _, ok := loaded.users[name]; ok {
+			return fmt.Errorf("%s:%d: duplicate user '%s' found", filename, lineNum, name)
+		}
+		if err := loaded.SetUser(name, args[2:]...); err != nil {
+			return fmt.Errorf("%s:%d: %s", filename, lineNum, err.Error())
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if _, ok := loaded.users[DefaultUser]; !ok {
+		loaded.users[DefaultUser] = newDefaultUser(a.table)
+	}
+
+	a.mu.Lock()
+	a.users = loaded.users
+	a.mu.Unlock()
+	return nil
+}
+
+// Save writes all users into filename atomically
+func (a *ACL) Save(filename string) error {
+	var sb strings.Builder
+	for _, line := range a.List() {
+		sb.WriteString(line)
+		sb.WriteByte('\n')
+	}
+	tmpFile, err := os.CreateTemp(filepath.Dir(filename), "temp-acl-*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmpFile.Name()
+	if _, err = tmpFile.WriteString(sb.String()); err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmpName)
+		return err
+	}
+	return os.Rename(tmpName, filename)
+}
+
+// RedactFrom returns the index from which arguments of cmdLine contain secrets and must not be shown
+// by MONITOR or SLOWLOG, it returns len(cmdLine) if nothing needs redacting
+func RedactFrom(cmdLine [][]byte) int {
+	if len(cmdLine) == 0 {
+		return 0
+	}
+	switch strings.ToLower(string(cmdLine[0])) {
+	case "auth":
+		return 1
+	case "acl":
+		if len(cmdLine) > 2 && strings.EqualFold(string(cmdLine[1]), "setuser") {
+			return 3
+		}
+	case "hello":
+		for i := 2; i < len(cmdLine); i++ {
+			if strings.EqualFold(string(cmdLine[i]), "auth") {
+				return i + 1
+			}
+		}
+	}
+	return len(cmdLine)
+}
@@ -0,0 +1,130 @@
+package acl
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type testTable map[string][]string
+
+func (t testTable) IsCommand(name string) bool {
+	_, ok := t[name]
+	return ok
+}
+
+func (t testTable) CommandNames() []string {
+	names := make([]string, 0, len(t))
+	for name := range t {
+		names = append(names, name)
+	}
+	return names
+}
+
+func (t testTable) CommandCategories(name string) []string {
+	return t[name]
+}
+
+var table = testTable{
+	"get":     {"read"},
+	"set":     {"write"},
+	"del":     {"write"},
+	"client":  {"admin", "connection"},
+	"publish": {"pubsub"},
+}
+
+func TestSetUser(t *testing.T) {
+	a := New(table)
+	if err := a.SetUser("alice", "on", ">secret", "~app:*", "%R~shared:*", "&news.*", "+@read", "+set", "-get", "+client|id"); err != nil {
+		t.Fatal(err)
+	}
+	u := a.GetUser("alice")
+	if !u.CanRun(table, "set", "") || u.CanRun(table, "get", "") || u.CanRun(table, "del", "") {
+		t.Error("command rules are not applied in order")
+	}
+	if !u.CanRun(table, "client", "id") || u.CanRun(table, "client", "kill") {
+		t.Error("subcommand rule mismatch")
+	}
+	if !u.CanAccessKey("app:1", true) || u.CanAccessKey("other", false) {
+		t.Error("key pattern mismatch")
+	}
+	if !u.CanAccessKey("shared:1", false) || u.CanAccessKey("shared:1", true) {
+		t.Error("read only key pattern mismatch")
+	}
+	if !u.CanAccessChannel("news.sport") || u.CanAccessChannel("chat") {
+		t.Error("channel pattern mismatch")
+	}
+
+	if err := a.Authenticate("alice", "secret"); err != nil {
+		t.Error(err)
+	}
+	if err := a.Authenticate("alice", "wrong"); err == nil {
+		t.Error("expect wrong password")
+	}
+	_ = a.SetUser("alice", "off")
+	if err := a.Authenticate("alice", "secret"); err == nil {
+		t.Error("expect disabled user")
+	}
+	if !u.Enabled() {
+		t.Error("published user should never be modified")
+	}
+
+	if err := a.SetUser("alice", "+unknown"); err == nil {
+		t.Error("expect unknown command error")
+	}
+	if err := a.SetUser("alice", "+@unknown"); err == nil {
+		t.Error("expect unknown category error")
+	}
+	if err := a.SetUser("alice", "on", "bad-rule"); err == nil {
+		t.Error("expect syntax error")
+	}
+	if a.GetUser("alice").Enabled() {
+		t.Error("failed SETUSER should change nothing")
+	}
+	if _, err := a.DelUser(DefaultUser); err == nil {
+		t.Error("default user should not be removed")
+	}
+	if n, _ := a.DelUser("alice", "bob"); n != 1 {
+		t.Errorf("expect 1 deleted, actual %d", n)
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	a := New(table)
+	_ = a.SetUser(DefaultUser, "resetpass", ">pass")
+	_ = a.SetUser("bob", "on", ">bobpass", "allkeys", "&chat", "+@all", "-client")
+	filename := filepath.Join(t.TempDir(), "users.acl")
+	if err := a.Save(filename); err != nil {
+		t.Fatal(err)
+	}
+
+	b := New(table)
+	if err := b.Load(filename); err != nil {
+		t.Fatal(err)
+	}
+	aLines, bLines := a.List(), b.List()
+	if len(aLines) != len(bLines) {
+		t.Fatalf("expect %v, actual %v", aLines, bLines)
+	}
+	for i := range aLines {
+		if aLines[i] != bLines[i] {
+			t.Errorf("expect %s, actual %s", aLines[i], bLines[i])
+		}
+	}
+	if err := b.Authenticate("bob", "bobpass"); err != nil {
+		t.Error(err)
+	}
+	if b.GetUser("bob").CanRun(table, "client", "list") {
+		t.Error("expect -client")
+	}
+
+	if err := os.WriteFile(filename, []byte("user carol on +nosuchcmd\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Load(filename); err == nil {
+		t.Error("expect load error")
+	}
+	if b.GetUser("bob") == nil {
+		t.Error("users should be kept when load failed")
+	}
+}
@@ -0,0 +1,436 @@
+package acl
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"strings"
+
+	"godis/lib/wildcard"
+)
+
+// key 访问权限
+const (
+	permRead = 1 << iota
+	permWrite
+	permAll = permRead | permWrite
+)
+
+var errUnknownCommand = errors.New("Unknown command or category name in ACL")
+
+type keyPattern struct {
+	pattern string
+	perm    int
+}
+
+// cmdRule 对应一条 +cmd/-cmd/+@category/-@category 规则
+type cmdRule struct {
+	allow    bool
+	command  string // 命令名，可以是 cmd|subcmd 的形式
+	category string // 非空时表示这是一条类别规则
+}
+
+func (r cmdRule) String() string {
+	prefix := "-"
+	if r.allow {
+		prefix = "+"
+	}
+	if r.category != "" {
+		return prefix + "@" + r.category
+	}
+	return prefix + r.command
+}
+
+// User is a snapshot of an acl user, it is never modified after being published by ACL,
+// SETUSER builds a new copy instead
+type User struct {
+	name        string
+	enabled     bool
+	noPass      bool
+	passwords   map[string]struct{} // sha256 之后的十六进制字符串
+	cmdRules    []cmdRule           // 按顺序求值，最后一条命中的规则生效
+	keys        []keyPattern
+	channels    []string
+	allChannels bool
+}
+
+func newUser(name string) *User {
+	return &User{
+		name:      name,
+		passwords: make(map[string]struct{}),
+	}
+}
+
+func (u *User) clone() *User {
+	c := &User{
+		name:        u.name,
+		enabled:     u.enabled,
+		noPass:      u.noPass,
+		passwords:   make(map[string]struct{}, len(u.passwords)),
+		cmdRules:    append([]cmdRule(nil), u.cmdRules...),
+		keys:        append([]keyPattern(nil), u.keys...),
+		channels:    append([]string(nil), u.channels...),
+		allChannels: u.allChannels,
+	}
+	for p := range u.passwords {
+		c.passwords[p] = struct{}{}
+	}
+	return c
+}
+
+func (u *User) Name() string {
+	return u.name
+}
+
+func (u *User) Enabled() bool {
+	return u.enabled
+}
+
+func (u *User) NoPass() bool {
+	return u.noPass
+}
+
+// HashPassword returns the hex encoded sha256 of password, which is how passwords are stored
+func HashPassword(password string) string {
+	sum := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+func (u *User) checkPassword(password string) bool {
+	if u.noPass {
+		return true
+	}
+	_, ok := u.passwords[HashPassword(password)]
+	return ok
+}
+
+// CanRun reports whether user is allowed to execute cmdName, subCmd may be empty
+func (u *User) CanRun(table CommandTable, cmdName string, subCmd string) bool {
+	allowed := false
+	for _, rule := range u.cmdRules {
+		if rule.matches(table, cmdName, subCmd) {
+			allowed = rule.allow
+		}
+	}
+	return allowed
+}
+
+func (r cmdRule) matches(table CommandTable, cmdName string, subCmd string) bool {
+	if r.category != "" {
+		if r.category == "all" {
+			return true
+		}
+		for _, category := range table.CommandCategories(cmdName) {
+			if category == r.category {
+				return true
+			}
+		}
+		return false
+	}
+	if r.command == cmdName {
+		return true
+	}
+	return subCmd != "" && r.command == cmdName+"|"+subCmd
+}
+
+// CanAccessKey reports whether key matches a pattern which grants read (or write) permission
+func (u *User) CanAccessKey(key string, write bool) bool {
+	need := permRead
+	if write {
+		need = permWrite
+	}
+	for _, kp := range u.keys {
+		if kp.perm&need != 0 && wildcard.Match(kp.pattern, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// CanAccessChannel reports whether user may publish or subscribe to channel
+func (u *User) CanAccessChannel(channel string) bool {
+	if u.allChannels {
+		return true
+	}
+	for _, pattern := range u.channels {
+		if wildcard.Match(pattern, channel) {
+			return true
+		}
+	}
+	return false
+}
+
+// setRule applies a single ACL SETUSER rule, rules are case-insensitive except passwords and patterns
+func (u *User) setRule(table CommandTable, rule string) error {
+	if rule == "" {
+		return errors.New("Syntax error")
+	}
+	switch strings.ToLower(rule) {
+	case "on":
+		u.enabled = true
+		return nil
+	case "off":
+		u.enabled = false
+		return nil
+	case "nopass":
+		u.noPass = true
+		u.passwords = make(map[string]struct{})
+		return nil
+	case "resetpass":
+		u.noPass = false
+		u.passwords = make(map[string]struct{})
+		return nil
+	case "allkeys":
+		u.keys = []keyPattern{{pattern: "*", perm: permAll}}
+		return nil
+	case "resetkeys":
+		u.keys = nil
+		return nil
+	case "allchannels":
+		u.allChannels = true
+		u.channels = nil
+		return nil
+	case "resetchannels":
+		u.allChannels = false
+		u.channels = nil
+		return nil
+	case "allcommands":
+		u.cmdRules = []cmdRule{{allow: true, category: "all"}}
+		return nil
+	case "nocommands":
+		u.cmdRules = nil
+		return nil
+	case "reset":
+		for _, r := range []string{"resetpass", "resetkeys", "resetchannels", "off", "nocommands"} {
+			_ = u.setRule(table, r)
+		}
+		return nil
+	}
+
+	switch rule[0] {
+	case '>':
+		u.passwords[HashPassword(rule[1:])] = struct{}{}
+		u.noPass = false
+		return nil
+	case '<':
+		hash := HashPassword(rule[1:])
+		if _, ok := u.passwords[hash]; !ok {
+			return errors.New("no such password")
+		}
+		delete(u.passwords, hash)
+		return nil
+	case '#', '!':
+		hash := strings.ToLower(rule[1:])
+		if !isValidHash(hash) {
+			return errors.New("The password hash must be exactly 64 characters and contain only lowercase hexadecimal characters")
+		}
+		if rule[0] == '!' {
+			if _, ok := u.passwords[hash]; !ok {
+				return errors.New("no such password")
+			}
+			delete(u.passwords, hash)
+			return nil
+		}
+		u.passwords[hash] = struct{}{}
+		u.noPass = false
+		return nil
+	case '~':
+		u.addKeyPattern(rule[1:], permAll)
+		return nil
+	case '%':
+		idx := strings.IndexByte(rule, '~')
+		if idx < 0 {
+			return errors.New("Syntax error")
+		}
+		perm := 0
+		for _, flag := range strings.ToUpper(rule[1:idx]) {
+			switch flag {
+			case 'R':
+				perm |= permRead
+			case 'W':
+				perm |= permWrite
+			default:
+				return errors.New("Syntax error")
+			}
+		}
+		if perm == 0 {
+			return errors.New("Syntax error")
+		}
+		u.addKeyPattern(rule[idx+1:], perm)
+		return nil
+	case '&':
+		if u.allChannels {
+			return nil
+		}
+		pattern := rule[1:]
+		if pattern == "*" {
+			u.allChannels = true
+			u.channels = nil
+			return nil
+		}
+		for _, ch := range u.channels {
+			if ch == pattern {
+				return nil
+			}
+		}
+		u.channels = append(u.channels, pattern)
+		return nil
+	case '+', '-':
+		return u.addCmdRule(table, rule)
+	}
+	return errors.New("Syntax error")
+}
+
+func (u *User) addKeyPattern(pattern string, perm int) {
+	for i, kp := range u.keys {
+		if kp.pattern == pattern {
+			u.keys[i].perm |= perm
+			return
+		}
+	}
+	u.keys = append(u.keys, keyPattern{pattern: pattern, perm: perm})
+}
+
+func (u *User) addCmdRule(table CommandTable, rule string) error {
+	r := cmdRule{allow: rule[0] == '+'}
+	name := strings.ToLower(rule[1:])
+	if strings.HasPrefix(name, "@") {
+		r.category = name[1:]
+		if !isKnownCategory(table, r.category) {
+			return errUnknownCommand
+		}
+		if r.category == "all" { // +@all/-@all 覆盖之前所有的命令规则
+			u.cmdRules = nil
+			if r.allow {
+				u.cmdRules = append(u.cmdRules, r)
+			}
+			return nil
+		}
+	} else {
+		cmdName := name
+		if idx := strings.IndexByte(name, '|'); idx >= 0 {
+			cmdName = name[:idx]
+			if idx == len(name)-1 {
+				return errUnknownCommand
+			}
+		}
+		if !table.IsCommand(cmdName) {
+			return errUnknownCommand
+		}
+		r.command = name
+	}
+
+	// 同一个目标只保留最后一条规则，保持 ACL LIST 的输出简洁
+	rules := u.cmdRules[:0]
+	for _, existed := range u.cmdRules {
+		if existed.command != r.command || existed.category != r.category {
+			rules = append(rules, existed)
+		}
+	}
+	u.cmdRules = append(rules, r)
+	return nil
+}
+
+func isKnownCategory(table CommandTable, category string) bool {
+	for _, c := range Categories(table) {
+		if c == category {
+			return true
+		}
+	}
+	return false
+}
+
+func isValidHash(hash string) bool {
+	if len(hash) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
+
+// Flags returns on/off and nopass flags like ACL GETUSER
+func (u *User) Flags() []string {
+	flags := []string{"off"}
+	if u.enabled {
+		flags[0] = "on"
+	}
+	if u.noPass {
+		flags = append(flags, "nopass")
+	}
+	return flags
+}
+
+// Passwords returns sorted password hashes
+func (u *User) Passwords() []string {
+	hashes := make([]string, 0, len(u.passwords))
+	for hash := range u.passwords {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+	return hashes
+}
+
+// CommandRules describes command permissions, e.g. "+@all -flushdb"
+func (u *User) CommandRules() string {
+	if len(u.cmdRules) == 0 {
+		return "-@all"
+	}
+	rules := make([]string, 0, len(u.cmdRules)+1)
+	if u.cmdRules[0].category != "all" {
+		rules = append(rules, "-@all")
+	}
+	for _, rule := range u.cmdRules {
+		rules = append(rules, rule.String())
+	}
+	return strings.Join(rules, " ")
+}
+
+// KeyRules describes key patterns, e.g. "~app:* %R~shared:*"
+func (u *User) KeyRules() string {
+	rules := make([]string, len(u.keys))
+	for i, kp := range u.keys {
+		rules[i] = keyPatternString(kp)
+	}
+	return strings.Join(rules, " ")
+}
+
+func keyPatternString(kp keyPattern) string {
+	switch kp.perm {
+	case permRead:
+		return "%R~" + kp.pattern
+	case permWrite:
+		return "%W~" + kp.pattern
+	}
+	return "~" + kp.pattern
+}
+
+// ChannelRules describes channel patterns, e.g. "&news.*"
+func (u *User) ChannelRules() string {
+	if u.allChannels {
+		return "&*"
+	}
+	rules := make([]string, len(u.channels))
+	for i, ch := range u.channels {
+		rules[i] = "&" + ch
+	}
+	return strings.Join(rules, " ")
+}
+
+// Describe returns rules which rebuild the user from scratch, used by ACL LIST and the acl file
+func (u *User) Describe() string {
+	parts := u.Flags()
+	for _, hash := range u.Passwords() {
+		parts = append(parts, "#"+hash)
+	}
+	if keys := u.KeyRules(); keys != "" {
+		parts = append(parts, keys)
+	}
+	if u.allChannels || len(u.channels) > 0 {
+		parts = append(parts, "resetchannels", u.ChannelRules())
+	} else {
+		parts = append(parts, "resetchannels")
+	}
+	parts = append(parts, u.CommandRules())
+	return strings.Join(parts, " ")
+}
@@ -3,17 +3,19 @@ package aof
 import (
 	"context"
 	"errors"
+	"godis/config"
 	"godis/interface/database"
 	"godis/lib/logger"
+	"godis/lib/metrics"
 	"godis/lib/utils"
 	"godis/redis/connection"
-	"godis/redis/parser"
 	"godis/redis/protocol"
 	"io"
 	"os"
+	"path/filepath"
 	"strconv"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -23,21 +25,33 @@ const (
 	FsyncNo
 )
 
-type CmdLine [][]byte
+type CmdLine = [][]byte
 
 const (
 	aofQueueSize = 1 << 16
 )
 
+var (
+	aofWriteDuration = metrics.NewHistogram("godis_aof_write_duration_seconds",
+		"Latency of writing a command into aof file.", nil)
+	aofFsyncDuration = metrics.NewHistogram("godis_aof_fsync_duration_seconds",
+		"Latency of aof fsync.", nil)
+	aofRewriteDuration = metrics.NewHistogram("godis_aof_rewrite_duration_seconds",
+		"Duration of aof rewrites.", []float64{.01, .05, .1, .5, 1, 5, 10, 30, 60, 300})
+)
+
 type Persister struct {
-	ctx         context.Context
-	cancel      context.CancelFunc
-	db          database.DBEngine
-	tmpDBMaker  func() database.DBEngine
-	aofChan     chan *payload
-	aofFile     *os.File
-	aofFilename string
-	aofFsync    int // AOF 刷盘策略
+	ctx        context.Context
+	cancel     context.CancelFunc
+	db         database.DBEngine
+	tmpDBMaker func() database.DBEngine
+	aofChan    chan *payload
+	aofFile    *os.File  // 当前写入的 incr 文件
+	aofWriter  io.Writer // 写入 aofFile，开启加密时加密每次写入
+	aofDir     string    // 保存各部分文件和 manifest 的目录
+	aofPrefix  string    // 各部分文件名的前缀
+	manifest   *manifest
+	aofFsync   atomic.Int32 // AOF 刷盘策略，可以通过 CONFIG SET aof_fsync 修改
 	// aof goroutine will send msg to main goroutine through this channel when aof tasks finished and ready to shut down
 	aofFinished chan struct{}
 	// pause aof for start/finish aof rewrite progress
@@ -45,33 +59,79 @@ type Persister struct {
 	// 表示正在aof重写，同时只有一个aof重写
 	aofRewriting sync.WaitGroup
 	currentDB    int
+	// 当前文件中最后写入的时间戳注释
+	lastTimestamp int64
 }
 
 type payload struct {
-	cmdLine CmdLine
-	dbIndex int
+	cmdLines []CmdLine // 连续写入，中间不会插入其他客户端的命令
+	dbIndex  int
+	done     chan struct{} // 不为空时写入并刷盘后关闭，用于 FsyncAlways
 }
 
-func NewPersister(db database.DBEngine, filename string, load bool, fsync int, tmpDBMaker func() database.DBEngine) (*Persister, error) {
-	if fsync < FsyncAlways || fsync > FsyncNo {
-		return nil, errors.New("load aof failed, aof fsync must be: 0: always, 1: every sec, 2: no")
-	}
+// NewPersister opens the multi part aof in dir, files are named after filename.
+// A single aof file at filename written by older versions is moved into dir as the base file
+func NewPersister(db database.DBEngine, dir string, filename string, load bool, fsync int, tmpDBMaker func() database.DBEngine) (*Persister, error) {
 	persister := &Persister{}
+	if err := persister.SetFsync(fsync); err != nil {
+		return nil, errors.New("load aof failed, " + err.Error())
+	}
 	persister.db = db
 	persister.tmpDBMaker = tmpDBMaker
-	persister.aofFilename = filename
-	persister.aofFsync = fsync
+	persister.aofDir = dir
+	persister.aofPrefix = filepath.Base(filename)
 	persister.currentDB = 0
 
+	if err := LoadKeyFile(config.Properties().AofEncryptionKeyFile); err != nil {
+		return nil, errors.New("load aof encryption key failed, " + err.Error())
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	m, err := loadManifest(dir, persister.aofPrefix)
+	if err != nil {
+		return nil, err
+	}
+	legacy, err := upgradeLegacyAof(dir, filename, m)
+	if err != nil {
+		return nil, err
+	}
+	if legacy != nil {
+		logger.Info("moved aof file " + filename + " into " + dir + " as base file")
+		m = legacy
+	}
+	persister.manifest = m
+
 	if load {
-		persister.LoadAof(0)
+		if err := persister.LoadAof(); err != nil {
+			return nil, err
+		}
 	}
+	removeUnusedParts(dir, persister.aofPrefix, m)
 
-	aofFile, err := os.OpenFile(persister.aofFilename, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0666)
-	if err != nil {
+	if activeKey() != nil {
+		for _, part := range m.parts() {
+			if encrypted, err := isEncryptedFile(persister.partPath(part)); err == nil && !encrypted {
+				logger.Warn("aof file " + part.name + " is not encrypted, run BGREWRITEAOF to encrypt it")
+			}
+		}
+	}
+
+	// 继续写入最后一个 incr 文件，currentDB 已经由 LoadAof 设置为它最后选择的 db。
+	// 文件是否加密与当前配置不同时新建 incr 文件，同一个文件中不能混合明文和密文
+	if last := m.lastIncr(); last != nil && load && persister.canAppend(last) {
+		persister.aofFile, err = os.OpenFile(persister.partPath(last), os.O_APPEND|os.O_CREATE|os.O_RDWR, 0666)
+		if err != nil {
+			return nil, err
+		}
+		persister.aofWriter, err = newAofWriter(persister.aofFile)
+		if err != nil {
+			_ = persister.aofFile.Close()
+			return nil, err
+		}
+	} else if err := persister.openNewIncr(); err != nil {
 		return nil, err
 	}
-	persister.aofFile = aofFile
 	persister.aofChan = make(chan *payload, aofQueueSize)
 	persister.aofFinished = make(chan struct{})
 
@@ -82,23 +142,100 @@ func NewPersister(db database.DBEngine, filename string, load bool, fsync int, t
 	ctx, cancel := context.WithCancel(context.Background())
 	persister.ctx = ctx
 	persister.cancel = cancel
-	if persister.aofFsync == FsyncEverySec {
-		persister.fsyncEverySecond()
-	}
+	persister.fsyncEverySecond()
 
 	return persister, nil
 }
 
+func (persister *Persister) partPath(part *aofPart) string {
+	return filepath.Join(persister.aofDir, part.name)
+}
+
+// canAppend 空文件或者是否加密与当前配置相同时可以继续追加
+func (persister *Persister) canAppend(part *aofPart) bool {
+	if utils.GetFileSizeByName(persister.partPath(part)) <= 0 {
+		return true
+	}
+	encrypted, err := isEncryptedFile(persister.partPath(part))
+	return err == nil && encrypted == (activeKey() != nil)
+}
+
+// newAofWriter 开启加密时在 file 末尾写入新的段头，之后的写入使用当前的密钥加密
+func newAofWriter(file *os.File) (io.Writer, error) {
+	key := activeKey()
+	if key == nil {
+		return file, nil
+	}
+	return newEncryptWriter(file, key)
+}
+
+// openNewIncr 新建一个 incr 文件并写入 manifest，之后的命令写入新文件。
+// 调用者需持有 pausingAof 或者还没有开始写入
+func (persister *Persister) openNewIncr() error {
+	seq := persister.manifest.nextIncrSeq()
+	part := &aofPart{name: incrName(persister.aofPrefix, seq), seq: seq, typ: partTypeIncr}
+	file, err := os.OpenFile(persister.partPath(part), os.O_APPEND|os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		return err
+	}
+	writer, err := newAofWriter(file)
+	if err != nil {
+		_ = file.Close()
+		_ = os.Remove(file.Name())
+		return err
+	}
+	m := persister.manifest.clone()
+	m.incrs = append(m.incrs, part)
+	if err := writeManifest(persister.aofDir, persister.aofPrefix, m); err != nil {
+		_ = file.Close()
+		_ = os.Remove(file.Name())
+		return err
+	}
+	if persister.aofFile != nil {
+		_ = persister.aofFile.Close()
+	}
+	persister.manifest = m
+	persister.aofFile = file
+	persister.aofWriter = writer
+	// 加载时每个文件都从 0 号 db 开始回放
+	persister.currentDB = 0
+	persister.lastTimestamp = 0
+	return nil
+}
+
+// Size returns total size of all aof files
+func (persister *Persister) Size() int64 {
+	persister.pausingAof.Lock()
+	parts := persister.manifest.parts()
+	persister.pausingAof.Unlock()
+	var size int64
+	for _, part := range parts {
+		size += utils.GetFileSizeByName(persister.partPath(part))
+	}
+	return size
+}
+
+// SetFsync changes fsync policy, commands saved after it returns use the new policy
+func (persister *Persister) SetFsync(fsync int) error {
+	if fsync < FsyncAlways || fsync > FsyncNo {
+		return errors.New("aof fsync must be: 0: always, 1: every sec, 2: no")
+	}
+	persister.aofFsync.Store(int32(fsync))
+	return nil
+}
+
+// fsyncEverySecond 刷盘策略可能在运行时修改，所以总是启动定时器，只在 FsyncEverySec 时刷盘
 func (persister *Persister) fsyncEverySecond() {
 	ticker := time.NewTicker(time.Second)
 	go func() {
 		for {
 			select {
 			case <-ticker.C:
-				persister.pausingAof.Lock()
-				if err := persister.aofFile.Sync(); err != nil {
-					logger.Errorf("fsync failed: %v", err)
+				if persister.aofFsync.Load() != FsyncEverySec {
+					continue
 				}
+				persister.pausingAof.Lock()
+				persister.fsync()
 				persister.pausingAof.Unlock()
 			case <-persister.ctx.Done():
 				ticker.Stop()
@@ -114,6 +251,10 @@ func (persister *Persister) Close() {
 	if persister.aofFile != nil {
 		close(persister.aofChan)
 		<-persister.aofFinished
+		// 无论刷盘策略是什么，关闭前都要刷盘，保证已经回复客户端的写命令不会丢失
+		persister.pausingAof.Lock()
+		persister.fsync()
+		persister.pausingAof.Unlock()
 		err := persister.aofFile.Close()
 		if err != nil {
 			logger.Warn(err)
@@ -122,66 +263,69 @@ func (persister *Persister) Close() {
 	persister.cancel()
 }
 
-func (persister *Persister) LoadAof(maxBytes int64) {
+// LoadAof replays all aof files into db in the order of manifest.
+// An incomplete command at the end of the last file is cut off if aof_load_truncated is on,
+// other invalid records fail the loading, godis-check-aof reports and fixes them
+func (persister *Persister) LoadAof() error {
+	return persister.loadParts(true)
+}
+
+// loadParts 回放所有文件，fixTail 为 false 时最后一个文件不完整也返回错误
+func (persister *Persister) loadParts(fixTail bool) error {
 	aofChan := persister.aofChan
 	persister.aofChan = nil
 	defer func(aofChan chan *payload) {
 		persister.aofChan = aofChan
 	}(aofChan)
 
-	file, err := os.Open(persister.aofFilename)
-	if err != nil {
-		if _, ok := err.(*os.PathError); ok {
-			return
+	parts := persister.manifest.parts()
+	for i, part := range parts {
+		dbIndex, result, err := persister.replayFile(persister.partPath(part))
+		if err != nil {
+			return err
 		}
-		logger.Warn(err)
-		return
-	}
-	defer file.Close()
-
-	// 打开 AOF 文件，从 AOF 文件中读取 maxBytes 字节的数据。
-	var reader io.Reader
-	if maxBytes > 0 {
-		reader = io.LimitReader(file, int64(maxBytes))
-	} else {
-		reader = file
-	}
-	ch := parser.ParseStream(reader)
-	for p := range ch {
-		if p.Err != nil {
-			if p.Err == io.EOF {
-				break
-			}
-			logger.Error("parse error: " + p.Err.Error())
+		persister.currentDB = dbIndex
+		if result.Valid() {
 			continue
 		}
-
-		//执行
-		r, ok := p.Data.(*protocol.MultiBulkReply)
-		fakeConn := connection.NewFakeConn()
-		if !ok {
-			logger.Error("require multi bulk protocol")
-			continue
+		if !result.Truncated() {
+			return errors.New("bad format of aof: " + result.Error() + ", use godis-check-aof --fix to repair it")
 		}
-		ret := persister.db.Exec(fakeConn, r.Args)
-		if protocol.IsErrorReply(ret) {
-			logger.Error("exec err", string(ret.ToBytes()))
+		if !fixTail || i != len(parts)-1 || !config.Properties().AofLoadTruncated {
+			return errors.New("aof is truncated: " + result.Error() +
+				", set aof_load_truncated or use godis-check-aof --fix to repair it")
 		}
-
-		if strings.ToLower(string(r.Args[0])) == "select" {
-			dbIndex, err := strconv.Atoi(string(r.Args[1]))
-			if err == nil {
-				persister.currentDB = dbIndex
-			}
+		logger.Warn("!!! aof is truncated: " + result.Error() + ", cutting off the incomplete command")
+		if err := Truncate(result.Filename, result.ValidSize); err != nil {
+			return err
 		}
 	}
+	return nil
+}
 
+// replayFile 回放一个 AOF 文件中的完整命令，返回文件结束时选择的 db 和检查结果
+func (persister *Persister) replayFile(filename string) (int, *CheckResult, error) {
+	// 同一个文件中的命令使用同一个连接回放，SELECT 才能生效
+	fakeConn := connection.NewFakeConn()
+	result, err := readCommands(filename, func(cmdLine [][]byte) {
+		ret := persister.db.Exec(fakeConn, cmdLine)
+		if protocol.IsErrorReply(ret) {
+			logger.Error("exec err", string(ret.ToBytes()))
+		}
+	}, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	return fakeConn.GetDBIndex(), result, nil
 }
 
 // 监听aofChan，写入 AOF 文件
 func (persister *Persister) listenCmd() {
 	for p := range persister.aofChan {
 		persister.writeAof(p)
+		if p.done != nil {
+			close(p.done)
+		}
 	}
 	persister.aofFinished <- struct{}{}
 }
@@ -189,6 +333,16 @@ func (persister *Persister) listenCmd() {
 func (persister *Persister) writeAof(p *payload) {
 	persister.pausingAof.Lock()
 	defer persister.pausingAof.Unlock()
+	start := time.Now()
+
+	// 开启时间戳后，每秒第一条命令之前写入 #TS:<unix>，恢复时可以截断到指定时间
+	if config.Properties().AofTimestampEnabled && start.Unix() != persister.lastTimestamp {
+		if _, err := persister.aofWriter.Write(timestampAnnotation(start.Unix())); err != nil {
+			logger.Warn(err)
+			return
+		}
+		persister.lastTimestamp = start.Unix()
+	}
 
 	// 首先，**选择正确的数据库**。
 	// 每个客户端都可以选择自己的数据库，所以 payload 中要保存客户端选择的数据库。
@@ -196,7 +350,7 @@ func (persister *Persister) writeAof(p *payload) {
 	if p.dbIndex != persister.currentDB {
 		selectCmd := utils.ToCmdLine("SELECT", strconv.Itoa(p.dbIndex))
 		data := protocol.MakeMultiBulkReply(selectCmd).ToBytes()
-		_, err := persister.aofFile.Write(data)
+		_, err := persister.aofWriter.Write(data)
 		if err != nil {
 			logger.Warn(err)
 			return
@@ -204,33 +358,51 @@ func (persister *Persister) writeAof(p *payload) {
 		persister.currentDB = p.dbIndex
 	}
 
-	data := protocol.MakeMultiBulkReply(p.cmdLine).ToBytes()
-	_, err := persister.aofFile.Write(data)
+	var data []byte
+	for _, cmdLine := range p.cmdLines {
+		data = append(data, protocol.MakeMultiBulkReply(cmdLine).ToBytes()...)
+	}
+	_, err := persister.aofWriter.Write(data)
 	if err != nil {
 		logger.Warn(err)
 	}
+	aofWriteDuration.ObserveDuration(time.Since(start))
 
-	if persister.aofFsync == FsyncAlways {
-		_ = persister.aofFile.Sync()
+	if persister.aofFsync.Load() == FsyncAlways {
+		persister.fsync()
 	}
 }
 
-func (persister *Persister) SaveCmdLine(dbIndex int, cmdLine CmdLine) {
+// fsync 刷盘并记录耗时，调用者需持有 pausingAof
+func (persister *Persister) fsync() {
+	start := time.Now()
+	if err := persister.aofFile.Sync(); err != nil {
+		logger.Errorf("fsync failed: %v", err)
+		return
+	}
+	aofFsyncDuration.ObserveDuration(time.Since(start))
+}
+
+// SaveCmdLine appends cmdLines to aof, they are written together without commands of other clients in between
+func (persister *Persister) SaveCmdLine(dbIndex int, cmdLines ...CmdLine) {
 	if persister.aofChan == nil {
 		return
 	}
 
-	if persister.aofFsync == FsyncAlways {
+	if persister.aofFsync.Load() == FsyncAlways {
+		// 同样经过 aofChan 写入，保证与修改刷盘策略之前排队的命令顺序一致，等待刷盘后返回
 		p := &payload{
-			cmdLine: cmdLine,
-			dbIndex: dbIndex,
+			cmdLines: cmdLines,
+			dbIndex:  dbIndex,
+			done:     make(chan struct{}),
 		}
-		persister.writeAof(p)
+		persister.aofChan <- p
+		<-p.done
 		return
 	}
 
 	persister.aofChan <- &payload{
-		cmdLine: cmdLine,
-		dbIndex: dbIndex,
+		cmdLines: cmdLines,
+		dbIndex:  dbIndex,
 	}
 }
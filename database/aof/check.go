@@ -0,0 +1,200 @@
+package aof
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"godis/redis/parser"
+)
+
+// ErrTruncated means the last command of an aof file is incomplete, usually caused by a crash during writing
+var ErrTruncated = errors.New("unexpected end of file")
+
+// CheckResult describes the first invalid record of an aof file
+type CheckResult struct {
+	Filename  string
+	Size      int64
+	ValidSize int64 // 最后一条完整记录结束的位置，也就是第一条不合法记录开始的位置
+	Commands  int   // 完整命令的数量
+	Err       error // 文件完整时为 nil，结尾不完整时为 ErrTruncated
+	// Compressed 压缩文件中的位置无法对应到文件，ValidSize 只有 0 和 Size 两种取值
+	Compressed bool
+	Checksum   bool // 文件末尾有校验和并且校验通过
+	// Encrypted 加密文件只能在块的边界上截断，ValidSize 是最后一个完整的块结束的位置
+	Encrypted bool
+}
+
+// Valid returns true if all records of the file are complete commands
+func (r *CheckResult) Valid() bool {
+	return r.Err == nil
+}
+
+// Truncated returns true if only the last command is incomplete, cutting it off loses nothing acknowledged
+func (r *CheckResult) Truncated() bool {
+	return r.Err == ErrTruncated
+}
+
+func (r *CheckResult) Error() string {
+	return fmt.Sprintf("%s: %v at offset %d of %d", r.Filename, r.Err, r.ValidSize, r.Size)
+}
+
+// countingReader 记录已经读取的字节数，减去解析器缓冲的字节数就是已经解析的位置
+type countingReader struct {
+	reader io.Reader
+	n      int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// readCommands 依次将文件中的完整命令交给 fn，返回检查结果，不完整或者不合法的记录不会交给 fn。
+// onAnnotation 不为空时接收注释和它开始的位置，返回 false 时停止读取，之后的记录不再检查。
+// 加密文件中注释不在块的边界上时位置为 -1
+func readCommands(filename string, fn func(cmdLine [][]byte), onAnnotation func(line []byte, offset int64) bool) (*CheckResult, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	result := &CheckResult{Filename: filename, Size: info.Size()}
+	reader, decrypt, compressed, err := openAofReader(file)
+	result.Compressed = compressed
+	result.Encrypted = decrypt != nil
+	if err != nil {
+		result.Err = ErrCompressed
+		return result, nil
+	}
+	sum := newChecksumReader(reader)
+	counter := &countingReader{reader: sum}
+	p := parser.NewParser(counter)
+	p.MultiBulkOnly = true
+
+	// parsed 是明文中已经解析的位置，加密文件只有在块的边界上才能对应到文件中的位置
+	var parsed int64
+	aligned := true
+	advance := func() {
+		parsed = counter.n - int64(p.Buffered())
+		if decrypt == nil {
+			result.ValidSize = parsed
+			return
+		}
+		var offset int64
+		if offset, aligned = decrypt.fileOffset(parsed); aligned {
+			result.ValidSize = offset
+		}
+	}
+	stopped := false
+	p.OnAnnotation = func(line []byte) {
+		if stopped {
+			return
+		}
+		offset := result.ValidSize
+		if !aligned {
+			offset = -1
+		}
+		if onAnnotation != nil && !onAnnotation(line, offset) {
+			stopped = true
+			return
+		}
+		advance()
+	}
+	var eof error
+	for {
+		cmdLine, err := p.Next()
+		if stopped {
+			return result, nil
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			eof = err
+			break
+		}
+		if err != nil {
+			var pathErr *os.PathError
+			if errors.As(err, &pathErr) {
+				return nil, err
+			}
+			result.Err = err
+			if compressed {
+				if err != ErrChecksum && err != ErrDecrypt {
+					result.Err = ErrCompressed
+				}
+				result.ValidSize = 0
+			}
+			return result, nil
+		}
+		advance()
+		result.Commands++
+		if fn != nil {
+			fn(cmdLine)
+		}
+	}
+
+	// 压缩或者加密的数据不完整时返回 io.ErrUnexpectedEOF
+	complete := eof == io.EOF && parsed == counter.n
+	result.Checksum = sum.verified && complete
+	switch {
+	case complete && (compressed || decrypt != nil):
+		result.ValidSize = result.Size
+	case complete && sum.verified:
+		result.ValidSize += int64(checksumLen)
+	case compressed:
+		result.ValidSize = 0
+		result.Err = ErrCompressed
+	case decrypt != nil && !complete:
+		result.Err = ErrTruncated
+		if !aligned {
+			result.Err = ErrDecrypt
+		}
+	}
+	if result.Err == nil && result.ValidSize < result.Size {
+		result.Err = ErrTruncated
+	}
+	return result, nil
+}
+
+// CheckFile validates records of an aof file without executing them
+func CheckFile(filename string) (*CheckResult, error) {
+	return readCommands(filename, nil, nil)
+}
+
+// ManifestFiles returns paths of files listed in the manifest in the order they are replayed
+func ManifestFiles(manifestFile string) ([]string, error) {
+	data, err := os.ReadFile(manifestFile)
+	if err != nil {
+		return nil, err
+	}
+	m, err := parseManifest(data)
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Dir(manifestFile)
+	var files []string
+	for _, part := range m.parts() {
+		files = append(files, filepath.Join(dir, part.name))
+	}
+	return files, nil
+}
+
+// Truncate cuts the file at size and flushes it to disk
+func Truncate(filename string, size int64) error {
+	file, err := os.OpenFile(filename, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := file.Truncate(size); err != nil {
+		return err
+	}
+	return file.Sync()
+}
@@ -0,0 +1,50 @@
+package aof
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckFile(t *testing.T) {
+	set := "*3\r\n$3\r\nSET\r\n$1\r\na\r\n$1\r\n1\r\n"
+	cases := []struct {
+		name      string
+		data      string
+		validSize int
+		truncated bool
+		valid     bool
+	}{
+		{"valid", set + set, 2 * len(set), false, true},
+		{"empty", "", 0, false, true},
+		{"partial bulk", set + set[:len(set)-3], len(set), true, false},
+		{"partial header", set + "*3", len(set), true, false},
+		{"missing arguments", set + "*3\r\n$3\r\nSET\r\n", len(set), true, false},
+		{"bad record", set + "$3\r\nSET\r\n" + set, len(set), false, false},
+		{"inline command", set + "SET a 1\r\n" + set, len(set), false, false},
+		{"annotation", "#TS:1\r\n" + set + "#TS:2\r\n", 2*len("#TS:1\r\n") + len(set), false, true},
+	}
+	dir := t.TempDir()
+	for _, c := range cases {
+		filename := filepath.Join(dir, c.name)
+		if err := os.WriteFile(filename, []byte(c.data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		result, err := CheckFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.ValidSize != int64(c.validSize) || result.Truncated() != c.truncated || result.Valid() != c.valid {
+			t.Errorf("%s: unexpected result %+v", c.name, result)
+		}
+		if result.Valid() {
+			continue
+		}
+		if err := Truncate(filename, result.ValidSize); err != nil {
+			t.Fatal(err)
+		}
+		if result, err := CheckFile(filename); err != nil || !result.Valid() || result.Commands != 1 {
+			t.Errorf("%s: file is not fixed: %+v %v", c.name, result, err)
+		}
+	}
+}
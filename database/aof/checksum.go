@@ -0,0 +1,218 @@
+package aof
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc64"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/klauspost/compress/zstd"
+
+	"godis/config"
+)
+
+// 重写生成的 base 文件可以使用 gzip 或 zstd 压缩，加载时根据魔数自动识别。
+// 开启 aof_checksum 时文件末尾(压缩前)写入一行 #CRC64:<16 位十六进制>，校验它之前的所有内容，
+// 它本身也是一条注释，incr 文件和旧版本的文件没有校验和，同样可以加载。
+// godis 没有 RDB，SHUTDOWN SAVE 保存的快照也是重写生成的 base 文件，同样可以压缩和校验
+const (
+	checksumPrefix = "#CRC64:"
+	checksumLen    = len(checksumPrefix) + 16 + 2
+
+	compressionGzip = "gzip"
+	compressionZstd = "zstd"
+)
+
+var crcTable = crc64.MakeTable(crc64.ECMA)
+
+var (
+	// ErrChecksum means the content of an aof file does not match its checksum, the file can not be fixed by truncating
+	ErrChecksum = errors.New("checksum mismatch")
+	// ErrCompressed means a compressed aof file is incomplete or corrupted, the file can not be fixed by truncating
+	ErrCompressed = errors.New("compressed data is incomplete or corrupted")
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// baseWriter 写入重写生成的 base 文件，根据配置压缩、计算校验和并加密
+type baseWriter struct {
+	buf        *bufio.Writer
+	compressor io.WriteCloser // 为空表示不压缩
+	w          io.Writer      // 压缩时为 compressor，否则为 buf
+	crc        hash.Hash64    // 为空表示不写入校验和
+}
+
+func newBaseWriter(file *os.File) (*baseWriter, error) {
+	// 缓冲后再加密，每个块 64KB
+	out, err := newAofWriter(file)
+	if err != nil {
+		return nil, err
+	}
+	w := &baseWriter{buf: bufio.NewWriterSize(out, 64*1024)}
+	w.w = w.buf
+	// 重写的数据量很大，压缩速度比压缩率重要
+	switch config.Properties().AofRewriteCompression {
+	case compressionGzip:
+		gz, err := gzip.NewWriterLevel(w.buf, gzip.BestSpeed)
+		if err != nil {
+			return nil, err
+		}
+		w.compressor = gz
+	case compressionZstd:
+		// 只用一个协程同步压缩，写入出错时不需要 Close 也不会泄漏协程
+		zw, err := zstd.NewWriter(w.buf, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		w.compressor = zw
+	}
+	if w.compressor != nil {
+		w.w = w.compressor
+	}
+	if config.Properties().AofChecksum {
+		w.crc = crc64.New(crcTable)
+	}
+	return w, nil
+}
+
+func (w *baseWriter) Write(p []byte) (int, error) {
+	if w.crc != nil {
+		_, _ = w.crc.Write(p)
+	}
+	return w.w.Write(p)
+}
+
+// Finish 写入校验和，结束压缩并写入缓冲的数据，不会关闭和刷盘文件
+func (w *baseWriter) Finish() error {
+	if w.crc != nil {
+		if _, err := w.w.Write(checksumLine(w.crc.Sum64())); err != nil {
+			return err
+		}
+	}
+	if w.compressor != nil {
+		if err := w.compressor.Close(); err != nil {
+			return err
+		}
+	}
+	return w.buf.Flush()
+}
+
+// checksumLine 固定长度，加载时只需要检查最后 checksumLen 字节
+func checksumLine(sum uint64) []byte {
+	return []byte(fmt.Sprintf("%s%016x\r\n", checksumPrefix, sum))
+}
+
+// parseChecksumLine 解析文件最后 checksumLen 字节，不是校验和时返回 false
+func parseChecksumLine(line []byte) (uint64, bool) {
+	if len(line) != checksumLen || string(line[:len(checksumPrefix)]) != checksumPrefix ||
+		string(line[checksumLen-2:]) != "\r\n" {
+		return 0, false
+	}
+	sum, err := strconv.ParseUint(string(line[len(checksumPrefix):checksumLen-2]), 16, 64)
+	if err != nil {
+		return 0, false
+	}
+	return sum, true
+}
+
+// openAofReader 识别加密和压缩格式，返回解密和解压后的数据，文件未加密时 decrypt 为 nil
+func openAofReader(file *os.File) (reader io.Reader, decrypt *decryptReader, compressed bool, err error) {
+	buffered := bufio.NewReader(file)
+	if isEncrypted(buffered) {
+		decrypt = newDecryptReader(buffered)
+		buffered = bufio.NewReader(decrypt)
+	}
+	magic, _ := buffered.Peek(len(zstdMagic))
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			return nil, decrypt, true, err
+		}
+		return gz, decrypt, true, nil
+	case bytes.Equal(magic, zstdMagic):
+		// 同步解压，不会启动后台协程，不需要 Close
+		zr, err := zstd.NewReader(buffered, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, decrypt, true, err
+		}
+		return zr, decrypt, true, nil
+	}
+	return buffered, decrypt, false, nil
+}
+
+// checksumReader 读到结尾之前保留最后 checksumLen 字节，结尾是校验和时校验并丢弃它，否则原样交给解析器
+type checksumReader struct {
+	reader   io.Reader
+	crc      hash.Hash64
+	buf      []byte
+	held     []byte // buf 中还没有交出的数据
+	done     bool   // 已经读到结尾
+	err      error  // 交出所有数据后返回的错误
+	verified bool   // 结尾有校验和并且与内容一致
+}
+
+func newChecksumReader(reader io.Reader) *checksumReader {
+	buf := make([]byte, 32*1024+checksumLen)
+	return &checksumReader{
+		reader: reader,
+		crc:    crc64.New(crcTable),
+		buf:    buf,
+		held:   buf[:0],
+	}
+}
+
+func (r *checksumReader) Read(p []byte) (int, error) {
+	for !r.done && len(r.held) <= checksumLen {
+		m := copy(r.buf, r.held)
+		n, err := r.reader.Read(r.buf[m:])
+		r.held = r.buf[:m+n]
+		if err == io.EOF {
+			r.finish()
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	if r.done {
+		n := copy(p, r.held)
+		r.held = r.held[n:]
+		if n == 0 {
+			return 0, r.err
+		}
+		return n, nil
+	}
+	n := copy(p, r.held[:len(r.held)-checksumLen])
+	_, _ = r.crc.Write(p[:n])
+	r.held = r.held[n:]
+	return n, nil
+}
+
+func (r *checksumReader) finish() {
+	r.done = true
+	r.err = io.EOF
+	if len(r.held) < checksumLen {
+		return
+	}
+	// 最后一次读取可能同时返回数据和 io.EOF
+	data, tail := r.held[:len(r.held)-checksumLen], r.held[len(r.held)-checksumLen:]
+	sum, ok := parseChecksumLine(tail)
+	if !ok {
+		return
+	}
+	r.held = data
+	_, _ = r.crc.Write(data)
+	if sum != r.crc.Sum64() {
+		r.err = ErrChecksum
+		return
+	}
+	r.verified = true
+}
@@ -0,0 +1,108 @@
+package aof
+
+import (
+	"bytes"
+	"hash/crc64"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/iotest"
+
+	"godis/config"
+)
+
+func writeBaseFile(t *testing.T, filename string, data string) {
+	file, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	w, err := newBaseWriter(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Finish(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBaseFileFormat(t *testing.T) {
+	old := config.Properties()
+	defer func() { config.SetProperties(old) }()
+
+	set := "*3\r\n$3\r\nSET\r\n$1\r\na\r\n$1\r\n1\r\n"
+	cases := []struct {
+		compression string
+		checksum    bool
+	}{
+		{"no", false},
+		{"no", true},
+		{"gzip", false},
+		{"gzip", true},
+		{"zstd", false},
+		{"zstd", true},
+	}
+	dir := t.TempDir()
+	for _, c := range cases {
+		properties := *old
+		properties.AofRewriteCompression = c.compression
+		properties.AofChecksum = c.checksum
+		config.SetProperties(&properties)
+
+		filename := filepath.Join(dir, c.compression+".aof")
+		writeBaseFile(t, filename, "#TS:1\r\n"+set+set)
+		result, err := CheckFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !result.Valid() || result.Commands != 2 || result.ValidSize != result.Size ||
+			result.Compressed != (c.compression != "no") || result.Checksum != c.checksum {
+			t.Errorf("%s %v: unexpected result %+v", c.compression, c.checksum, result)
+		}
+
+		// 任意一个字节损坏都能被发现
+		data, _ := os.ReadFile(filename)
+		data[len(data)/2] ^= 0xff
+		_ = os.WriteFile(filename, data, 0644)
+		if result, err := CheckFile(filename); err == nil && c.checksum && result.Valid() {
+			t.Errorf("%s %v: corrupted file is not detected", c.compression, c.checksum)
+		}
+
+		// 压缩文件结尾不完整时不能截断修复
+		if c.compression != "no" {
+			_ = os.WriteFile(filename, data[:len(data)-4], 0644)
+			result, err := CheckFile(filename)
+			if err != nil || result.Err != ErrCompressed || result.Truncated() {
+				t.Errorf("unexpected result of incomplete compressed file %+v %v", result, err)
+			}
+		}
+	}
+}
+
+func TestChecksumReader(t *testing.T) {
+	data := bytes.Repeat([]byte("*1\r\n$4\r\nPING\r\n"), 5000)
+	sum := crc64.Checksum(data, crcTable)
+
+	// 逐字节读取
+	r := newChecksumReader(iotest.OneByteReader(bytes.NewReader(append(append([]byte{}, data...), checksumLine(sum)...))))
+	out, err := io.ReadAll(r)
+	if err != nil || !bytes.Equal(out, data) || !r.verified {
+		t.Errorf("checksum is not stripped: %v %v", err, r.verified)
+	}
+
+	r = newChecksumReader(bytes.NewReader(append(append([]byte{}, data...), checksumLine(sum+1)...)))
+	if _, err := io.ReadAll(r); err != ErrChecksum {
+		t.Errorf("expect checksum mismatch, got %v", err)
+	}
+
+	// 没有校验和时原样返回
+	r = newChecksumReader(bytes.NewReader(data[:10]))
+	out, err = io.ReadAll(r)
+	if err != nil || !bytes.Equal(out, data[:10]) || r.verified {
+		t.Errorf("unexpected output %q %v", out, err)
+	}
+}
@@ -0,0 +1,296 @@
+package aof
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// 配置 aof_encryption_key_file 后 AOF 的各部分文件使用 AES-256-GCM 加密。
+// 文件由若干段组成，每段以段头开始: magic(8) 版本(1) 密钥指纹(8) salt(16)，之后是若干块:
+// 4 字节大端密文长度 + 密文。每次写入 AOF 至少是一个完整的块，所以追加和刷盘不受影响，宕机时只会丢失最后一个不完整的块。
+// 每段使用 HMAC-SHA256(key, salt) 派生的密钥，nonce 为块在段中的序号，重新打开文件追加时写入新的段头。
+//
+// 密钥文件中每行一个十六进制编码的 32 字节密钥，最后一个用于加密，所有密钥都可以用于解密。
+// 轮换密钥时在文件末尾添加新的密钥并执行 BGREWRITEAOF，重写会重新读取密钥文件，
+// 完成后所有文件都由新的密钥加密，之后可以从密钥文件中删除旧的密钥。
+//
+// godis 没有 RDB，SHUTDOWN SAVE 保存的快照就是重写生成的 base 文件，所以快照也由这里加密，没有单独的快照格式
+const (
+	encMagic       = "GODISENC"
+	encVersion     = 1
+	fingerprintLen = 8
+	saltLen        = 16
+	encHeaderLen   = len(encMagic) + 1 + fingerprintLen + saltLen
+	// maxChunkSize 一个块中明文的最大长度，更大的写入拆分为多个块
+	maxChunkSize = 1 << 20
+)
+
+// ErrDecrypt means an encrypted aof file is corrupted or was encrypted by another key, the file can not be fixed by truncating
+var ErrDecrypt = errors.New("encrypted data is corrupted")
+
+type encryptionKey struct {
+	key         []byte
+	fingerprint []byte
+}
+
+var (
+	keyringMu sync.RWMutex
+	// keyring 最后一个密钥用于加密，为空表示不加密
+	keyring []*encryptionKey
+)
+
+// LoadKeyFile reads aes-256 keys for aof encryption, one hex encoded key per line and the last one encrypts new files.
+// Keys are kept until the next call, an empty filename disables encryption
+func LoadKeyFile(filename string) error {
+	var keys []*encryptionKey
+	if filename != "" {
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			return err
+		}
+		for lineNum, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || line[0] == '#' {
+				continue
+			}
+			key, err := hex.DecodeString(line)
+			if err != nil || len(key) != 32 {
+				return fmt.Errorf("invalid aof encryption key at line %d of %s, expect 64 hex characters", lineNum+1, filename)
+			}
+			sum := sha256.Sum256(key)
+			keys = append(keys, &encryptionKey{key: key, fingerprint: sum[:fingerprintLen]})
+		}
+		if len(keys) == 0 {
+			return errors.New("no aof encryption key in " + filename)
+		}
+	}
+	keyringMu.Lock()
+	keyring = keys
+	keyringMu.Unlock()
+	return nil
+}
+
+// activeKey 返回用于加密的密钥，未开启加密时返回 nil
+func activeKey() *encryptionKey {
+	keyringMu.RLock()
+	defer keyringMu.RUnlock()
+	if len(keyring) == 0 {
+		return nil
+	}
+	return keyring[len(keyring)-1]
+}
+
+func findKey(fingerprint []byte) *encryptionKey {
+	keyringMu.RLock()
+	defer keyringMu.RUnlock()
+	for _, key := range keyring {
+		if bytes.Equal(key.fingerprint, fingerprint) {
+			return key
+		}
+	}
+	return nil
+}
+
+// segmentCipher 每段使用不同的密钥，块的序号作为 nonce 不会重复
+func segmentCipher(key *encryptionKey, salt []byte) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, key.key)
+	mac.Write(salt)
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(aead cipher.AEAD, seq uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], seq)
+	return nonce
+}
+
+// encryptWriter 将每次写入加密为完整的块写入 w
+type encryptWriter struct {
+	w    io.Writer
+	aead cipher.AEAD
+	seq  uint64
+	buf  []byte
+}
+
+// newEncryptWriter 写入段头，之后的数据使用 key 加密
+func newEncryptWriter(w io.Writer, key *encryptionKey) (*encryptWriter, error) {
+	header := make([]byte, 0, encHeaderLen)
+	header = append(header, encMagic...)
+	header = append(header, encVersion)
+	header = append(header, key.fingerprint...)
+	salt := make([]byte, saltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	header = append(header, salt...)
+	aead, err := segmentCipher(key, salt)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{w: w, aead: aead}, nil
+}
+
+// Write 一次写入所有块，块不会被其他写入分开
+func (w *encryptWriter) Write(p []byte) (int, error) {
+	w.buf = w.buf[:0]
+	for data := p; len(data) > 0; {
+		n := len(data)
+		if n > maxChunkSize {
+			n = maxChunkSize
+		}
+		w.buf = binary.BigEndian.AppendUint32(w.buf, uint32(n+w.aead.Overhead()))
+		w.buf = w.aead.Seal(w.buf, chunkNonce(w.aead, w.seq), data[:n], nil)
+		w.seq++
+		data = data[n:]
+	}
+	if _, err := w.w.Write(w.buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// chunkBoundary 记录块开始的位置，用于将明文中的位置转换为文件中的位置
+type chunkBoundary struct {
+	plain int64
+	file  int64
+}
+
+// decryptReader 解密文件中的所有段，只在块的边界上可以截断文件
+type decryptReader struct {
+	reader     *bufio.Reader
+	aead       cipher.AEAD
+	seq        uint64
+	plain      []byte // 当前块中还没有交出的明文
+	plainOff   int64  // 已经解密的明文长度
+	fileOff    int64  // 已经读取的文件长度
+	boundaries []chunkBoundary
+	err        error
+}
+
+func newDecryptReader(reader *bufio.Reader) *decryptReader {
+	return &decryptReader{reader: reader}
+}
+
+// isEncrypted 判断数据是否以段头开始
+func isEncrypted(reader *bufio.Reader) bool {
+	magic, _ := reader.Peek(len(encMagic))
+	return string(magic) == encMagic
+}
+
+func isEncryptedFile(filename string) (bool, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	return isEncrypted(bufio.NewReaderSize(file, 16)), nil
+}
+
+func (r *decryptReader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.err = r.nextChunk()
+	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+// nextChunk 读取并解密下一个块，遇到段头时切换密钥。文件在块的边界上结束时返回 io.EOF
+func (r *decryptReader) nextChunk() error {
+	r.boundaries = append(r.boundaries, chunkBoundary{plain: r.plainOff, file: r.fileOff})
+	magic, _ := r.reader.Peek(len(encMagic))
+	if string(magic) == encMagic {
+		return r.readHeader()
+	}
+	if len(magic) > 0 && len(magic) < len(encMagic) && strings.HasPrefix(encMagic, string(magic)) {
+		// 写入段头时宕机
+		return io.ErrUnexpectedEOF
+	}
+	if r.aead == nil {
+		return ErrDecrypt
+	}
+	var size [4]byte
+	if n, err := io.ReadFull(r.reader, size[:]); err != nil {
+		if err == io.EOF && n == 0 {
+			return io.EOF
+		}
+		return io.ErrUnexpectedEOF
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n < uint32(r.aead.Overhead()) || n > uint32(maxChunkSize+r.aead.Overhead()) {
+		return ErrDecrypt
+	}
+	chunk := make([]byte, n)
+	if _, err := io.ReadFull(r.reader, chunk); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	plain, err := r.aead.Open(chunk[:0], chunkNonce(r.aead, r.seq), chunk, nil)
+	if err != nil {
+		return ErrDecrypt
+	}
+	r.seq++
+	r.plain = plain
+	r.plainOff += int64(len(plain))
+	r.fileOff += int64(len(size) + len(chunk))
+	return nil
+}
+
+func (r *decryptReader) readHeader() error {
+	header := make([]byte, encHeaderLen)
+	if _, err := io.ReadFull(r.reader, header); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	if header[len(encMagic)] != encVersion {
+		return fmt.Errorf("unsupported version %d of encrypted aof", header[len(encMagic)])
+	}
+	fingerprint := header[len(encMagic)+1 : len(encMagic)+1+fingerprintLen]
+	key := findKey(fingerprint)
+	if key == nil {
+		return fmt.Errorf("no key in aof_encryption_key_file can decrypt aof, key fingerprint %x", fingerprint)
+	}
+	aead, err := segmentCipher(key, header[len(encMagic)+1+fingerprintLen:])
+	if err != nil {
+		return err
+	}
+	r.aead = aead
+	r.seq = 0
+	r.fileOff += int64(len(header))
+	return nil
+}
+
+// fileOffset 返回明文中的位置 plain 在文件中的位置，plain 不在块的边界上时返回 false。
+// plain 必须是递增的，之前的边界会被丢弃
+func (r *decryptReader) fileOffset(plain int64) (int64, bool) {
+	i := 0
+	for i < len(r.boundaries) && r.boundaries[i].plain < plain {
+		i++
+	}
+	r.boundaries = r.boundaries[i:]
+	if len(r.boundaries) > 0 && r.boundaries[0].plain == plain {
+		return r.boundaries[0].file, true
+	}
+	return 0, false
+}
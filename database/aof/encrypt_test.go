@@ -0,0 +1,114 @@
+package aof
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeKeyFile(t *testing.T, dir string, keys ...string) string {
+	filename := filepath.Join(dir, "aof.key")
+	if err := os.WriteFile(filename, []byte(strings.Join(keys, "\n")), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestEncryptedFile(t *testing.T) {
+	dir := t.TempDir()
+	key1 := strings.Repeat("01", 32)
+	key2 := strings.Repeat("02", 32)
+	if err := LoadKeyFile(writeKeyFile(t, dir, key1)); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = LoadKeyFile("") }()
+
+	set := "*3\r\n$3\r\nSET\r\n$1\r\na\r\n$5\r\nvalue\r\n"
+	filename := filepath.Join(dir, "dump.aof")
+	file, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := newEncryptWriter(file, activeKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = w.Write([]byte(set))
+	_, _ = w.Write([]byte(set))
+
+	// 轮换密钥后重新打开文件追加，写入新的段
+	if err := LoadKeyFile(writeKeyFile(t, dir, key1, key2)); err != nil {
+		t.Fatal(err)
+	}
+	w, err = newEncryptWriter(file, activeKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 大于一个块的写入
+	big := "*3\r\n$3\r\nSET\r\n$1\r\nb\r\n$" + "2000000\r\n" + strings.Repeat("x", 2000000) + "\r\n"
+	_, _ = w.Write([]byte(big))
+	_ = file.Close()
+
+	data, _ := os.ReadFile(filename)
+	if bytes.Contains(data, []byte("value")) {
+		t.Error("plaintext is found in encrypted file")
+	}
+	result, err := CheckFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Valid() || !result.Encrypted || result.Commands != 3 || result.ValidSize != result.Size {
+		t.Errorf("unexpected result %+v", *result)
+	}
+
+	// 最后一个块不完整时在块的边界上截断
+	_ = os.WriteFile(filename, data[:len(data)-10], 0644)
+	result, err = CheckFile(filename)
+	if err != nil || !result.Truncated() || result.Commands != 2 {
+		t.Fatalf("unexpected result of truncated file %+v %v", result, err)
+	}
+	if err := Truncate(filename, result.ValidSize); err != nil {
+		t.Fatal(err)
+	}
+	if result, err := CheckFile(filename); err != nil || !result.Valid() || result.Commands != 2 {
+		t.Errorf("file is not fixed: %+v %v", result, err)
+	}
+
+	// 密文被修改
+	corrupted := append([]byte{}, data...)
+	corrupted[encHeaderLen+10] ^= 0xff
+	_ = os.WriteFile(filename, corrupted, 0644)
+	if result, err := CheckFile(filename); err != nil || result.Err != ErrDecrypt || result.Truncated() {
+		t.Errorf("corrupted chunk is not detected: %+v %v", result, err)
+	}
+
+	// 缺少密钥
+	_ = os.WriteFile(filename, data, 0644)
+	if err := LoadKeyFile(writeKeyFile(t, dir, key2)); err != nil {
+		t.Fatal(err)
+	}
+	if result, err := CheckFile(filename); err != nil || result.Valid() || result.Truncated() {
+		t.Errorf("file should not be decrypted without key: %+v %v", result, err)
+	}
+}
+
+func TestLoadKeyFile(t *testing.T) {
+	dir := t.TempDir()
+	defer func() { _ = LoadKeyFile("") }()
+	for _, content := range []string{"", "# comment", "0102", strings.Repeat("zz", 32)} {
+		if err := LoadKeyFile(writeKeyFile(t, dir, content)); err == nil {
+			t.Errorf("expect error for key file %q", content)
+		}
+	}
+	if err := LoadKeyFile(writeKeyFile(t, dir, "# old key", strings.Repeat("01", 32), "", strings.Repeat("02", 32))); err != nil {
+		t.Fatal(err)
+	}
+	if key := activeKey(); key == nil || key.key[0] != 2 {
+		t.Error("the last key should encrypt new files")
+	}
+	if err := LoadKeyFile(""); err != nil || activeKey() != nil {
+		t.Error("empty filename should disable encryption")
+	}
+}
@@ -0,0 +1,250 @@
+package aof
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// 与 redis 7 的 multi part aof 一样，AOF 由一个 base 文件和若干按序号递增的 incr 文件组成，
+// manifest 记录它们的顺序。重写时只需要新建一个 incr 文件，重写完成后替换 manifest，不需要复制数据
+const (
+	partTypeBase = "b"
+	partTypeIncr = "i"
+
+	baseSuffix     = ".base.aof"
+	incrSuffix     = ".incr.aof"
+	manifestSuffix = ".manifest"
+	tempPrefix     = "temp-"
+)
+
+// aofPart 是 manifest 中的一项
+type aofPart struct {
+	name string
+	seq  int
+	typ  string
+}
+
+// manifest 中 base 在最前面，incr 按序号排列
+type manifest struct {
+	base  *aofPart
+	incrs []*aofPart
+}
+
+// parts 返回按回放顺序排列的所有文件
+func (m *manifest) parts() []*aofPart {
+	parts := make([]*aofPart, 0, len(m.incrs)+1)
+	if m.base != nil {
+		parts = append(parts, m.base)
+	}
+	return append(parts, m.incrs...)
+}
+
+func (m *manifest) lastIncr() *aofPart {
+	if len(m.incrs) == 0 {
+		return nil
+	}
+	return m.incrs[len(m.incrs)-1]
+}
+
+func (m *manifest) nextIncrSeq() int {
+	if last := m.lastIncr(); last != nil {
+		return last.seq + 1
+	}
+	return 1
+}
+
+func (m *manifest) nextBaseSeq() int {
+	if m.base != nil {
+		return m.base.seq + 1
+	}
+	return 1
+}
+
+func (m *manifest) clone() *manifest {
+	c := &manifest{base: m.base}
+	c.incrs = append(c.incrs, m.incrs...)
+	return c
+}
+
+func baseName(prefix string, seq int) string {
+	return prefix + "." + strconv.Itoa(seq) + baseSuffix
+}
+
+func incrName(prefix string, seq int) string {
+	return prefix + "." + strconv.Itoa(seq) + incrSuffix
+}
+
+func manifestName(prefix string) string {
+	return prefix + manifestSuffix
+}
+
+// format 每行一个文件: file <name> seq <seq> type <b|i>
+func (m *manifest) format() []byte {
+	var sb strings.Builder
+	for _, part := range m.parts() {
+		sb.WriteString(fmt.Sprintf("file %s seq %d type %s\n", part.name, part.seq, part.typ))
+	}
+	return []byte(sb.String())
+}
+
+// parseManifest 解析 manifest，文件名中不能包含空白和路径分隔符
+func parseManifest(data []byte) (*manifest, error) {
+	m := &manifest{}
+	scanner := bufio.NewScanner(strings.NewReader(string(data)))
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields)%2 != 0 {
+			return nil, fmt.Errorf("invalid aof manifest line %d: %s", lineNum, line)
+		}
+		part := &aofPart{}
+		for i := 0; i < len(fields); i += 2 {
+			switch fields[i] {
+			case "file":
+				part.name = fields[i+1]
+			case "seq":
+				seq, err := strconv.Atoi(fields[i+1])
+				if err != nil || seq <= 0 {
+					return nil, fmt.Errorf("invalid aof manifest line %d: bad seq %s", lineNum, fields[i+1])
+				}
+				part.seq = seq
+			case "type":
+				part.typ = fields[i+1]
+			}
+			// 忽略不认识的字段，便于以后扩展
+		}
+		if part.name == "" || part.seq == 0 || strings.ContainsRune(part.name, filepath.Separator) {
+			return nil, fmt.Errorf("invalid aof manifest line %d: %s", lineNum, line)
+		}
+		switch part.typ {
+		case partTypeBase:
+			if m.base != nil {
+				return nil, errors.New("found duplicate base file in aof manifest")
+			}
+			m.base = part
+		case partTypeIncr:
+			if last := m.lastIncr(); last != nil && part.seq <= last.seq {
+				return nil, fmt.Errorf("invalid aof manifest line %d: seq of incr files must increase", lineNum)
+			}
+			m.incrs = append(m.incrs, part)
+		default:
+			return nil, fmt.Errorf("invalid aof manifest line %d: unknown type %s", lineNum, part.typ)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// writeManifest 先写临时文件再 rename，保证 manifest 总是完整的
+func writeManifest(dir string, prefix string, m *manifest) error {
+	tmp, err := os.CreateTemp(dir, tempPrefix+"*"+manifestSuffix)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(m.format()); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(dir, manifestName(prefix))); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return syncDir(dir)
+}
+
+// syncDir 刷新目录项，保证 rename 和新建的文件在宕机后依然存在
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil && !errors.Is(err, os.ErrInvalid) {
+		return err
+	}
+	return nil
+}
+
+// loadManifest 读取 dir 中的 manifest，不存在时返回空的 manifest
+func loadManifest(dir string, prefix string) (*manifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, manifestName(prefix)))
+	if os.IsNotExist(err) {
+		return &manifest{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseManifest(data)
+}
+
+// upgradeLegacyAof 将旧版本的单个 AOF 文件移动到 dir 中作为 base 文件，m 是 dir 中已有的 manifest。
+// 先写入 manifest 再移动文件，移动之前宕机时 manifest 中的 base 文件还不存在，下次启动时继续移动，旧文件不会被忽略
+func upgradeLegacyAof(dir string, prefix string, m *manifest) (*manifest, error) {
+	if _, err := os.Stat(prefix); err != nil {
+		return nil, nil
+	}
+	name := filepath.Base(prefix)
+	target := filepath.Join(dir, name)
+	switch {
+	case len(m.parts()) == 0:
+		m = &manifest{base: &aofPart{name: name, seq: 1, typ: partTypeBase}}
+		if err := writeManifest(dir, name, m); err != nil {
+			return nil, err
+		}
+	case m.base != nil && m.base.name == name && len(m.incrs) == 0:
+		if _, err := os.Stat(target); err == nil {
+			return nil, nil
+		}
+	default:
+		return nil, nil
+	}
+	if err := os.Rename(prefix, target); err != nil {
+		return nil, err
+	}
+	if err := syncDir(dir); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// removeUnusedParts 删除 dir 中不在 manifest 里的部分文件和临时文件，它们来自已完成的重写或重写中途的宕机
+func removeUnusedParts(dir string, prefix string, m *manifest) {
+	used := make(map[string]struct{})
+	for _, part := range m.parts() {
+		used[part.name] = struct{}{}
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if _, ok := used[name]; ok || entry.IsDir() {
+			continue
+		}
+		isPart := strings.HasPrefix(name, prefix+".") && (strings.HasSuffix(name, baseSuffix) || strings.HasSuffix(name, incrSuffix))
+		if isPart || strings.HasPrefix(name, tempPrefix) {
+			_ = os.Remove(filepath.Join(dir, name))
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package aof
+
+import "testing"
+
+func TestParseManifest(t *testing.T) {
+	data := "file dump.aof.3.base.aof seq 3 type b\n" +
+		"file dump.aof.5.incr.aof seq 5 type i\n" +
+		"\n" +
+		"file dump.aof.6.incr.aof seq 6 type i\n"
+	m, err := parseManifest([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.base.name != "dump.aof.3.base.aof" || len(m.incrs) != 2 || m.nextIncrSeq() != 7 || m.nextBaseSeq() != 4 {
+		t.Errorf("unexpected manifest %+v", m)
+	}
+	if string(m.format()) != "file dump.aof.3.base.aof seq 3 type b\nfile dump.aof.5.incr.aof seq 5 type i\nfile dump.aof.6.incr.aof seq 6 type i\n" {
+		t.Errorf("unexpected format %q", m.format())
+	}
+
+	for _, bad := range []string{
+		"file a seq 1 type b\nfile b seq 2 type b\n",
+		"file a seq 2 type i\nfile b seq 1 type i\n",
+		"file a seq x type i\n",
+		"file ../a seq 1 type i\n",
+		"file a seq 1 type x\n",
+		"file a seq\n",
+	} {
+		if _, err := parseManifest([]byte(bad)); err == nil {
+			t.Errorf("expect error for %q", bad)
+		}
+	}
+}
@@ -6,8 +6,6 @@ import (
 	"godis/lib/logger"
 	"godis/lib/utils"
 	"godis/redis/protocol"
-	"io"
-	"io/ioutil"
 	"os"
 	"strconv"
 	"sync"
@@ -16,21 +14,32 @@ import (
 )
 
 type RewriteCtx struct {
-	tmpFile  *os.File // 重写时用到的临时文件
-	fileSize int64    // 重写时文件大小
-	dbIndex  int      // 重写时的当前数据库
+	tmpFile *os.File   // 重写时用到的临时文件，完成后成为新的 base 文件
+	parts   []*aofPart // 重写开始前的所有文件，重写完成后删除
+	started int64      // 重写开始的时间，新的 base 文件包含这一时刻的数据
 }
 
-func (persister *Persister) newRewritePersister() *Persister {
+// newRewritePersister 创建只读取 parts 的 Persister，用于将重写开始前的数据加载到临时 db
+func (persister *Persister) newRewritePersister(parts []*aofPart) *Persister {
 	tmpDB := persister.tmpDBMaker()
+	m := &manifest{}
+	for _, part := range parts {
+		if part.typ == partTypeBase {
+			m.base = part
+		} else {
+			m.incrs = append(m.incrs, part)
+		}
+	}
 	return &Persister{
-		db:          tmpDB,
-		aofFilename: persister.aofFilename,
+		db:       tmpDB,
+		aofDir:   persister.aofDir,
+		manifest: m,
 	}
 }
 
 func (persister *Persister) Rewrite(rewriteWait *sync.WaitGroup, rewriting *atomic.Bool) error {
 	logger.Info("rewrite aof start")
+	start := time.Now()
 	persister.aofRewriting.Add(1)
 	rewriting.Store(true)
 	defer persister.aofRewriting.Done()
@@ -49,18 +58,28 @@ func (persister *Persister) Rewrite(rewriteWait *sync.WaitGroup, rewriting *atom
 
 	err = persister.DoRewrite(rewriteCtx)
 	if err != nil {
+		_ = rewriteCtx.tmpFile.Close()
+		_ = os.Remove(rewriteCtx.tmpFile.Name())
 		return err
 	}
 	err = persister.FinishRewrite(rewriteCtx)
 	if err != nil {
 		return err
 	}
+	aofRewriteDuration.ObserveDuration(time.Since(start))
 
 	return nil
 }
 
-// StartRewrite 暂停 AOF 写入 ->  准备重写 -> 恢复AOF写入。
+// StartRewrite 暂停 AOF 写入 -> 新建 incr 文件，之后的命令写入新文件 -> 恢复 AOF 写入。
+// 新文件之前的所有文件就是需要重写的数据
 func (persister *Persister) StartRewrite() (*RewriteCtx, error) {
+	// 重新读取密钥文件，新的 incr 文件和 base 文件使用最新的密钥加密，重写完成后旧的密钥不再被使用
+	if err := LoadKeyFile(config.Properties().AofEncryptionKeyFile); err != nil {
+		logger.Warn("reload aof encryption key failed: " + err.Error())
+		return nil, err
+	}
+
 	// 首先暂停aof写入
 	persister.pausingAof.Lock()
 	defer persister.pausingAof.Unlock()
@@ -71,98 +90,126 @@ func (persister *Persister) StartRewrite() (*RewriteCtx, error) {
 		return nil, err
 	}
 
-	fileStat, _ := os.Stat(persister.aofFilename)
-	fileSize := fileStat.Size()
-	tmpFile, err := ioutil.TempFile("./", "*.aof")
+	parts := persister.manifest.parts()
+	if err := persister.openNewIncr(); err != nil {
+		logger.Warn("open new incr aof file failed: " + err.Error())
+		return nil, err
+	}
+	tmpFile, err := os.CreateTemp(persister.aofDir, tempPrefix+"rewrite-*"+baseSuffix)
 	if err != nil {
 		logger.Warn("tmp file create failed")
 		return nil, err
 	}
 	return &RewriteCtx{
-		tmpFile:  tmpFile,
-		fileSize: fileSize,
-		dbIndex:  persister.currentDB,
+		tmpFile: tmpFile,
+		parts:   parts,
+		started: time.Now().Unix(),
 	}, nil
 }
 
 // DoRewrite 用于重写协程读取 AOF 文件中的前一部分（重写开始前的数据，不包括读写过程中写入的数据）并重写到临时文件中。流程如下：
 func (persister *Persister) DoRewrite(rewriteCtx *RewriteCtx) error {
-	tmpFile := rewriteCtx.tmpFile
+	tmpFile, err := newBaseWriter(rewriteCtx.tmpFile)
+	if err != nil {
+		return err
+	}
 
-	rewritePersister := persister.newRewritePersister()
-	rewritePersister.LoadAof(rewriteCtx.fileSize)
+	rewritePersister := persister.newRewritePersister(rewriteCtx.parts)
+	if err := rewritePersister.loadParts(false); err != nil {
+		return err
+	}
 
-	for i := 0; i < config.Properties.Databases; i++ {
+	if config.Properties().AofTimestampEnabled {
+		if _, err := tmpFile.Write(timestampAnnotation(rewriteCtx.started)); err != nil {
+			return err
+		}
+	}
+
+	// 函数库不属于任何 db，写在最前面
+	if store, ok := rewritePersister.db.(database.FunctionStore); ok {
+		for _, code := range store.FunctionCodes() {
+			data := protocol.MakeMultiBulkReply(utils.ToCmdLine("FUNCTION", "LOAD", "REPLACE", code)).ToBytes()
+			if _, err := tmpFile.Write(data); err != nil {
+				return err
+			}
+		}
+	}
+
+	for i := 0; i < config.Properties().Databases; i++ {
 		data := protocol.MakeMultiBulkReply(utils.ToCmdLine("SELECT", strconv.Itoa(i))).ToBytes()
 		if _, err := tmpFile.Write(data); err != nil {
 			return err
 		}
 
+		// 记录第一个写入错误并停止遍历，不完整的临时文件不能成为新的 base 文件
+		var writeErr error
 		rewritePersister.db.ForEach(i, func(key string, data *database.DataEntity, expiration *time.Time) bool {
 			bytes := utils.EntityToBytes(key, data)
 			if bytes != nil {
-				_, _ = tmpFile.Write(bytes)
+				if _, writeErr = tmpFile.Write(bytes); writeErr != nil {
+					return false
+				}
 			}
 			if expiration != nil {
 				bytes := utils.ExpireToBytes(key, *expiration)
 				if bytes != nil {
-					_, _ = tmpFile.Write(bytes)
+					if _, writeErr = tmpFile.Write(bytes); writeErr != nil {
+						return false
+					}
 				}
 			}
 			return true
 		})
+		if writeErr != nil {
+			return writeErr
+		}
 	}
-	return nil
+	if err := tmpFile.Finish(); err != nil {
+		return err
+	}
+	return rewriteCtx.tmpFile.Sync()
 }
 
-// FinishRewrite 暂停 AOF 写入 -> 将重写过程中产生的**新数据写入临时文件**中 -> 使用临时文件覆盖 AOF 文件（使用文件系统的 mv 命令保证安全） -> 恢复 AOF 写入。
+// FinishRewrite 暂停 AOF 写入 -> 临时文件成为新的 base 文件，替换 manifest，其中只保留重写开始后新建的 incr 文件 -> 恢复 AOF 写入。
+// 不需要复制重写期间写入的数据，旧的文件在替换 manifest 后删除
 func (persister *Persister) FinishRewrite(rewriteCtx *RewriteCtx) error {
-	persister.pausingAof.Lock()
-	defer persister.pausingAof.Unlock()
-
-	src, err := os.Open(persister.aofFilename)
-	if err != nil {
-		logger.Error("open aofFilename failed: " + err.Error())
+	tmpFile := rewriteCtx.tmpFile
+	if err := tmpFile.Close(); err != nil {
+		_ = os.Remove(tmpFile.Name())
 		return err
 	}
 
-	_, err = src.Seek(rewriteCtx.fileSize, 0)
-	if err != nil {
-		logger.Error("seek failed: " + err.Error())
-		return err
+	persister.pausingAof.Lock()
+	m := &manifest{}
+	seq := persister.manifest.nextBaseSeq()
+	m.base = &aofPart{name: baseName(persister.aofPrefix, seq), seq: seq, typ: partTypeBase}
+	rewritten := make(map[*aofPart]struct{}, len(rewriteCtx.parts))
+	for _, part := range rewriteCtx.parts {
+		rewritten[part] = struct{}{}
 	}
-
-	tmpFile := rewriteCtx.tmpFile
-
-	data := protocol.MakeMultiBulkReply(utils.ToCmdLine("SELECT", strconv.Itoa(rewriteCtx.dbIndex))).ToBytes()
-	_, err = tmpFile.Write(data)
-	if err != nil {
-		logger.Error("tmp file rewrite failed: " + err.Error())
-		return err
+	for _, part := range persister.manifest.incrs {
+		if _, ok := rewritten[part]; !ok {
+			m.incrs = append(m.incrs, part)
+		}
 	}
-
-	_, err = io.Copy(tmpFile, src)
-	if err != nil {
-		logger.Error("copy aof file failed: " + err.Error())
-		return err
+	err := os.Rename(tmpFile.Name(), persister.partPath(m.base))
+	if err == nil {
+		err = writeManifest(persister.aofDir, persister.aofPrefix, m)
 	}
-
-	_ = persister.aofFile.Close()
-	_ = src.Close()
-	_ = tmpFile.Close()
-	_ = os.Rename(tmpFile.Name(), persister.aofFilename)
-
-	aofFile, err := os.OpenFile(persister.aofFilename, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0666)
 	if err != nil {
-		panic(err)
+		persister.pausingAof.Unlock()
+		logger.Error("replace aof manifest failed: " + err.Error())
+		_ = os.Remove(tmpFile.Name())
+		_ = os.Remove(persister.partPath(m.base))
+		return err
 	}
-	persister.aofFile = aofFile
+	persister.manifest = m
+	persister.pausingAof.Unlock()
 
-	data = protocol.MakeMultiBulkReply(utils.ToCmdLine("SELECT", strconv.Itoa(rewriteCtx.dbIndex))).ToBytes()
-	_, err = persister.aofFile.Write(data)
-	if err != nil {
-		panic(err)
+	for _, part := range rewriteCtx.parts {
+		if err := os.Remove(persister.partPath(part)); err != nil {
+			logger.Warn("remove old aof file failed: " + err.Error())
+		}
 	}
-
 	return nil
 }
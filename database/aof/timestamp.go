@@ -0,0 +1,119 @@
+package aof
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// 开启 aof_timestamp_enabled 后每秒第一条命令前写入一行 #TS:<unix>，加载时作为注释跳过，
+// 误操作后可以用 godis-check-aof --truncate-to-timestamp 将 AOF 截断到某个时间点再重启恢复
+const timestampPrefix = "#TS:"
+
+func timestampAnnotation(ts int64) []byte {
+	return []byte(timestampPrefix + strconv.FormatInt(ts, 10) + "\r\n")
+}
+
+// parseTimestamp 解析 #TS:<unix> 注释，其它注释返回 false
+func parseTimestamp(line []byte) (int64, bool) {
+	if !bytes.HasPrefix(line, []byte(timestampPrefix)) {
+		return 0, false
+	}
+	ts, err := strconv.ParseInt(string(line[len(timestampPrefix):]), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return ts, true
+}
+
+// findTimestamp 返回文件中第一个晚于 ts 的时间戳注释开始的位置，没有时返回 -1
+func findTimestamp(filename string, ts int64) (int64, *CheckResult, error) {
+	cut := int64(-1)
+	found := false
+	result, err := readCommands(filename, nil, func(line []byte, offset int64) bool {
+		if t, ok := parseTimestamp(line); ok && t > ts {
+			cut, found = offset, true
+			return false
+		}
+		return true
+	})
+	if err == nil && found && cut < 0 {
+		return 0, nil, fmt.Errorf("%s: timestamp annotation is not at the boundary of encrypted chunks", filename)
+	}
+	return cut, result, err
+}
+
+// TruncateToTimestamp cuts the aof at the first timestamp annotation later than ts, commands written after ts are dropped.
+// filename may be a single aof file or a manifest, incr files after the cut point are removed from the manifest.
+// It returns false if no annotation is later than ts
+func TruncateToTimestamp(filename string, ts int64) (bool, error) {
+	if !strings.HasSuffix(filename, manifestSuffix) {
+		cut, result, err := findTimestamp(filename, ts)
+		if err != nil {
+			return false, err
+		}
+		if cut < 0 {
+			return false, nil
+		}
+		if result.Compressed {
+			return false, fmt.Errorf("%s: compressed file can not be truncated", filename)
+		}
+		return true, Truncate(filename, cut)
+	}
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return false, err
+	}
+	m, err := parseManifest(data)
+	if err != nil {
+		return false, err
+	}
+	dir := filepath.Dir(filename)
+	parts := m.parts()
+	for i, part := range parts {
+		path := filepath.Join(dir, part.name)
+		cut, result, err := findTimestamp(path, ts)
+		if err != nil {
+			return false, err
+		}
+		if cut < 0 {
+			// 只有最后一个文件的结尾允许不完整
+			if result.Err != nil && (i != len(parts)-1 || !result.Truncated()) {
+				return false, result
+			}
+			continue
+		}
+		if result.Compressed && cut > 0 {
+			return false, fmt.Errorf("%s: compressed file can not be truncated", path)
+		}
+		if part.typ == partTypeBase && cut == 0 {
+			return false, fmt.Errorf("%s: base file is written after %d, can not truncate to an earlier time", path, ts)
+		}
+		if err := Truncate(path, cut); err != nil {
+			return false, err
+		}
+		// 时间点之后的 incr 文件不再回放
+		dropped := parts[i+1:]
+		if len(dropped) == 0 {
+			return true, nil
+		}
+		if part.typ == partTypeBase {
+			m.incrs = nil
+		} else {
+			m.incrs = m.incrs[:i-len(parts)+len(m.incrs)+1]
+		}
+		prefix := strings.TrimSuffix(filepath.Base(filename), manifestSuffix)
+		if err := writeManifest(dir, prefix, m); err != nil {
+			return false, err
+		}
+		for _, p := range dropped {
+			_ = os.Remove(filepath.Join(dir, p.name))
+		}
+		return true, nil
+	}
+	return false, nil
+}
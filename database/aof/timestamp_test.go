@@ -0,0 +1,65 @@
+package aof
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTruncateToTimestamp(t *testing.T) {
+	set := "*3\r\n$3\r\nSET\r\n$1\r\na\r\n$1\r\n1\r\n"
+	write := func(filename string, data string) {
+		if err := os.WriteFile(filename, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dir := t.TempDir()
+
+	// 单个文件
+	single := filepath.Join(dir, "single.aof")
+	write(single, "#TS:100\r\n"+set+"#TS:200\r\n"+set+"#TS:300\r\n"+set)
+	if truncated, err := TruncateToTimestamp(single, 400); err != nil || truncated {
+		t.Errorf("nothing should be truncated: %v %v", truncated, err)
+	}
+	if truncated, err := TruncateToTimestamp(single, 250); err != nil || !truncated {
+		t.Fatalf("truncate failed: %v %v", truncated, err)
+	}
+	if result, err := CheckFile(single); err != nil || !result.Valid() || result.Commands != 2 {
+		t.Errorf("unexpected result after truncate: %+v %v", result, err)
+	}
+
+	// manifest 中时间点之后的 incr 文件被删除
+	write(filepath.Join(dir, "dump.aof.1.base.aof"), "#TS:100\r\n"+set)
+	write(filepath.Join(dir, "dump.aof.1.incr.aof"), "#TS:150\r\n"+set+"#TS:200\r\n"+set)
+	write(filepath.Join(dir, "dump.aof.2.incr.aof"), "#TS:300\r\n"+set)
+	m := &manifest{
+		base: &aofPart{name: "dump.aof.1.base.aof", seq: 1, typ: partTypeBase},
+		incrs: []*aofPart{
+			{name: "dump.aof.1.incr.aof", seq: 1, typ: partTypeIncr},
+			{name: "dump.aof.2.incr.aof", seq: 2, typ: partTypeIncr},
+		},
+	}
+	if err := writeManifest(dir, "dump.aof", m); err != nil {
+		t.Fatal(err)
+	}
+	manifestFile := filepath.Join(dir, "dump.aof.manifest")
+	if _, err := TruncateToTimestamp(manifestFile, 50); err == nil {
+		t.Error("expect truncating before base file to be refused")
+	}
+	if truncated, err := TruncateToTimestamp(manifestFile, 170); err != nil || !truncated {
+		t.Fatalf("truncate failed: %v %v", truncated, err)
+	}
+	files, err := ManifestFiles(manifestFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Errorf("expect later incr file to be removed from manifest: %v", files)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "dump.aof.2.incr.aof")); !os.IsNotExist(err) {
+		t.Error("expect later incr file to be deleted")
+	}
+	if result, err := CheckFile(files[1]); err != nil || !result.Valid() || result.Commands != 1 {
+		t.Errorf("unexpected result after truncate: %+v %v", result, err)
+	}
+}
@@ -0,0 +1,437 @@
+package database
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"godis/database/engine"
+	"godis/interface/database"
+	"godis/interface/redis"
+	"godis/redis/connection"
+	"godis/redis/protocol"
+)
+
+const (
+	pauseNone = iota
+	pauseWrite
+	pauseAll
+)
+
+// clientPause 记录 CLIENT PAUSE 的状态
+type clientPause struct {
+	mu       sync.Mutex
+	mode     int
+	deadline time.Time
+	lifted   chan struct{} // 暂停解除时关闭
+}
+
+// feedMonitors 将即将执行的命令发送给 MONITOR 客户端，未知命令和参数个数错误的命令不发送
+func (s *Server) feedMonitors(c redis.Connection, cmdName string, cmdLine [][]byte) {
+	if s.clients == nil {
+		return
+	}
+	var arity int
+	if cmd, ok := systemCommandTable[cmdName]; ok {
+		arity = cmd.arity
+	} else if info, ok := engine.GetCommandInfo(cmdName); ok {
+		arity = info.Arity
+	} else {
+		return
+	}
+	if validArity(arity, len(cmdLine)) {
+		s.clients.FeedMonitors(c, cmdLine)
+	}
+}
+
+// SetClientManager binds the network layer which owns connections, required by CLIENT LIST/KILL
+func (s *Server) SetClientManager(m database.ClientManager) {
+	s.clients = m
+}
+
+func execClient(s *Server, c redis.Connection, args [][]byte) redis.Reply {
+	if len(args) == 0 {
+		return protocol.MakeArgNumErrReply("client")
+	}
+	subCmd := strings.ToLower(string(args[0]))
+	args = args[1:]
+	switch subCmd {
+	case "id":
+		if len(args) != 0 {
+			return protocol.MakeArgNumErrReply("client|id")
+		}
+		return protocol.MakeIntReply(c.GetID())
+	case "setname":
+		return clientSetName(c, args)
+	case "getname":
+		if len(args) != 0 {
+			return protocol.MakeArgNumErrReply("client|getname")
+		}
+		name := c.GetName()
+		if name == "" {
+			return protocol.MakeNullBulkReply()
+		}
+		return protocol.MakeBulkReply([]byte(name))
+	case "info":
+		if len(args) != 0 {
+			return protocol.MakeArgNumErrReply("client|info")
+		}
+		return protocol.MakeBulkReply([]byte(clientInfoString(c) + "\n"))
+	case "list":
+		return clientList(s, args)
+	case "kill":
+		return clientKill(s, c, args)
+	case "pause":
+		return clientPauseCmd(s, args)
+	case "unpause":
+		if len(args) != 0 {
+			return protocol.MakeArgNumErrReply("client|unpause")
+		}
+		s.unpauseClients()
+		return protocol.MakeOkReply()
+	case "no-evict":
+		if len(args) != 1 {
+			return protocol.MakeArgNumErrReply("client|no-evict")
+		}
+		switch strings.ToLower(string(args[0])) {
+		case "on":
+			c.SetFlag(connection.FlagNoEvict)
+		case "off":
+			c.ClearFlag(connection.FlagNoEvict)
+		default:
+			return protocol.MakeSyntaxErrReply()
+		}
+		return protocol.MakeOkReply()
+	case "tracking":
+		return clientTracking(s, c, args)
+	case "getredir":
+		if len(args) != 0 {
+			return protocol.MakeArgNumErrReply("client|getredir")
+		}
+		return clientGetRedir(s, c)
+	case "trackinginfo":
+		if len(args) != 0 {
+			return protocol.MakeArgNumErrReply("client|trackinginfo")
+		}
+		return clientTrackingInfo(s, c)
+	}
+	return protocol.MakeErrReply("ERR unknown subcommand '" + subCmd + "'. Try CLIENT HELP.")
+}
+
+// getClient finds a connected client by id
+func (s *Server) getClient(id int64) (redis.Connection, bool) {
+	if s.clients == nil {
+		return nil, false
+	}
+	return s.clients.GetClient(id)
+}
+
+func clientSetName(c redis.Connection, args [][]byte) redis.Reply {
+	if len(args) != 1 {
+		return protocol.MakeArgNumErrReply("client|setname")
+	}
+	name := string(args[0])
+	if !isValidClientName(name) {
+		return protocol.MakeErrReply("ERR Client names cannot contain spaces, newlines or special characters.")
+	}
+	c.SetName(name)
+	return protocol.MakeOkReply()
+}
+
+func isValidClientName(name string) bool {
+	for _, ch := range name {
+		if ch <= ' ' || ch > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// clientInfoString 按照 redis CLIENT LIST 的格式描述一个客户端
+func clientInfoString(c redis.Connection) string {
+	now := time.Now()
+	multi := -1
+	if c.GetMultiStatus() {
+		multi = len(c.GetEnqueuedCmdLine())
+	}
+	lastCmd := c.GetLastCmd()
+	if lastCmd == "" {
+		lastCmd = "NULL"
+	}
+
+	var sb strings.Builder
+	sb.WriteString("id=" + strconv.FormatInt(c.GetID(), 10))
+	sb.WriteString(" addr=" + c.Name())
+	sb.WriteString(" name=" + c.GetName())
+	sb.WriteString(" age=" + strconv.Itoa(int(now.Sub(c.GetCreatedAt()).Seconds())))
+	sb.WriteString(" idle=" + strconv.Itoa(int(now.Sub(c.GetLastInteraction()).Seconds())))
+	sb.WriteString(" flags=" + clientFlagsString(c))
+	sb.WriteString(" db=" + strconv.Itoa(c.GetDBIndex()))
+	sb.WriteString(" sub=" + strconv.Itoa(c.GetSubscribeNum()))
+	sb.WriteString(" psub=0")
+	sb.WriteString(" multi=" + strconv.Itoa(multi))
+	sb.WriteString(" cmd=" + lastCmd)
+	sb.WriteString(" user=" + clientUser(c))
+	return sb.String()
+}
+
+func clientFlagsString(c redis.Connection) string {
+	var flags []byte
+	if c.GetSubscribeNum() > 0 {
+		flags = append(flags, 'P')
+	}
+	if c.GetMultiStatus() {
+		flags = append(flags, 'x')
+	}
+	if c.HasFlag(connection.FlagMonitor) {
+		flags = append(flags, 'O')
+	}
+	if c.HasFlag(connection.FlagNoEvict) {
+		flags = append(flags, 'e')
+	}
+	if c.HasFlag(connection.FlagTracking) {
+		flags = append(flags, 't')
+	}
+	if len(flags) == 0 {
+		return "N"
+	}
+	return string(flags)
+}
+
+func clientType(c redis.Connection) string {
+	if c.GetSubscribeNum() > 0 {
+		return "pubsub"
+	}
+	return "normal"
+}
+
+// clientList CLIENT LIST [TYPE normal|master|replica|pubsub] [ID client-id ...]
+func clientList(s *Server, args [][]byte) redis.Reply {
+	if s.clients == nil {
+		return protocol.MakeBulkReply([]byte{})
+	}
+	var typeFilter string
+	var idFilter map[int64]struct{}
+	for i := 0; i < len(args); i++ {
+		option := strings.ToLower(string(args[i]))
+		switch {
+		case option == "type" && i+1 < len(args):
+			typeFilter = strings.ToLower(string(args[i+1]))
+			switch typeFilter {
+			case "normal", "pubsub", "master", "replica":
+			default:
+				return protocol.MakeErrReply("ERR Unknown client type '" + typeFilter + "'")
+			}
+			i++
+		case option == "id" && i+1 < len(args):
+			idFilter = make(map[int64]struct{})
+			for i++; i < len(args); i++ {
+				id, err := strconv.ParseInt(string(args[i]), 10, 64)
+				if err != nil || id <= 0 {
+					return protocol.MakeErrReply("ERR Invalid client ID")
+				}
+				idFilter[id] = struct{}{}
+			}
+		default:
+			return protocol.MakeSyntaxErrReply()
+		}
+	}
+
+	var sb strings.Builder
+	s.clients.ForEachClient(func(c redis.Connection) bool {
+		if typeFilter != "" && clientType(c) != typeFilter {
+			return true
+		}
+		if idFilter != nil {
+			if _, ok := idFilter[c.GetID()]; !ok {
+				return true
+			}
+		}
+		sb.WriteString(clientInfoString(c))
+		sb.WriteByte('\n')
+		return true
+	})
+	return protocol.MakeBulkReply([]byte(sb.String()))
+}
+
+// clientKill supports both CLIENT KILL addr:port
+// and CLIENT KILL [ID client-id] [ADDR ip:port] [USER username] [SKIPME yes/no]
+func clientKill(s *Server, self redis.Connection, args [][]byte) redis.Reply {
+	if len(args) == 0 {
+		return protocol.MakeArgNumErrReply("client|kill")
+	}
+	if s.clients == nil {
+		return protocol.MakeErrReply("ERR No such client")
+	}
+
+	if len(args) == 1 { // 旧格式
+		addr := string(args[0])
+		killed := int64(0)
+		s.clients.ForEachClient(func(c redis.Connection) bool {
+			if c.Name() == addr && s.clients.KillClient(c.GetID()) {
+				killed++
+				return false
+			}
+			return true
+		})
+		if killed == 0 {
+			return protocol.MakeErrReply("ERR No such client")
+		}
+		return protocol.MakeOkReply()
+	}
+
+	if len(args)%2 != 0 {
+		return protocol.MakeSyntaxErrReply()
+	}
+	var id int64
+	var addr, user string
+	skipMe := true
+	for i := 0; i < len(args); i += 2 {
+		value := string(args[i+1])
+		switch strings.ToLower(string(args[i])) {
+		case "id":
+			parsed, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || parsed <= 0 {
+				return protocol.MakeErrReply("ERR client-id should be greater than 0")
+			}
+			id = parsed
+		case "addr":
+			addr = value
+		case "user":
+			user = value
+		case "skipme":
+			switch strings.ToLower(value) {
+			case "yes":
+				skipMe = true
+			case "no":
+				skipMe = false
+			default:
+				return protocol.MakeSyntaxErrReply()
+			}
+		default:
+			return protocol.MakeSyntaxErrReply()
+		}
+	}
+
+	var victims []int64
+	s.clients.ForEachClient(func(c redis.Connection) bool {
+		if id != 0 && c.GetID() != id {
+			return true
+		}
+		if addr != "" && c.Name() != addr {
+			return true
+		}
+		if user != "" && clientUser(c) != user {
+			return true
+		}
+		if skipMe && c.GetID() == self.GetID() {
+			return true
+		}
+		victims = append(victims, c.GetID())
+		return true
+	})
+	killed := int64(0)
+	for _, victim := range victims {
+		if s.clients.KillClient(victim) {
+			killed++
+		}
+	}
+	return protocol.MakeIntReply(killed)
+}
+
+// clientPauseCmd CLIENT PAUSE timeout [WRITE|ALL]
+func clientPauseCmd(s *Server, args [][]byte) redis.Reply {
+	if len(args) != 1 && len(args) != 2 {
+		return protocol.MakeArgNumErrReply("client|pause")
+	}
+	timeout, err := strconv.ParseInt(string(args[0]), 10, 64)
+	if err != nil || timeout < 0 {
+		return protocol.MakeErrReply("ERR timeout is not an integer or out of range")
+	}
+	mode := pauseAll
+	if len(args) == 2 {
+		switch strings.ToLower(string(args[1])) {
+		case "write":
+			mode = pauseWrite
+		case "all":
+			mode = pauseAll
+		default:
+			return protocol.MakeSyntaxErrReply()
+		}
+	}
+	s.pauseClients(mode, time.Now().Add(time.Duration(timeout)*time.Millisecond))
+	return protocol.MakeOkReply()
+}
+
+// pauseClients 暂停客户端直到 deadline，已经处于暂停状态时取更长的时间和更严格的模式
+func (s *Server) pauseClients(mode int, deadline time.Time) {
+	p := &s.pause
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.mode == pauseNone || time.Now().After(p.deadline) {
+		p.mode = mode
+		p.deadline = deadline
+		p.lifted = make(chan struct{})
+		return
+	}
+	if mode > p.mode {
+		p.mode = mode
+	}
+	if deadline.After(p.deadline) {
+		p.deadline = deadline
+	}
+}
+
+func (s *Server) unpauseClients() {
+	p := &s.pause
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.mode == pauseNone {
+		return
+	}
+	p.mode = pauseNone
+	close(p.lifted)
+}
+
+// waitIfPaused blocks the calling client while CLIENT PAUSE is in effect for cmdLine
+func (s *Server) waitIfPaused(c redis.Connection, cmdName string) {
+	p := &s.pause
+	for {
+		p.mu.Lock()
+		if p.mode == pauseNone || !time.Now().Before(p.deadline) || !pauseAffects(p.mode, c, cmdName) {
+			p.mu.Unlock()
+			return
+		}
+		lifted, deadline := p.lifted, p.deadline
+		p.mu.Unlock()
+
+		timer := time.NewTimer(time.Until(deadline))
+		select {
+		case <-lifted:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+func pauseAffects(mode int, c redis.Connection, cmdName string) bool {
+	if cmdName == "client" { // 保证 CLIENT UNPAUSE 等管理命令可以执行
+		return false
+	}
+	if mode == pauseAll {
+		return true
+	}
+	if cmdName == "exec" { // 事务中含有写命令时才暂停
+		for _, cmdLine := range c.GetEnqueuedCmdLine() {
+			if engine.IsWriteCommand(string(cmdLine[0])) {
+				return true
+			}
+		}
+		return false
+	}
+	if c.GetMultiStatus() { // 排队阶段不执行命令
+		return false
+	}
+	return cmdName == "publish" || cmdName == "eval" || cmdName == "evalsha" || cmdName == "fcall" || engine.IsWriteCommand(cmdName)
+}
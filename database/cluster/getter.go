@@ -1,15 +1,39 @@
 package cluster
 
 import (
+	"crypto/tls"
 	"godis/config"
 	"godis/interface/redis"
 	"godis/lib/pool"
 	"godis/lib/utils"
 	"godis/redis/client"
 	"godis/redis/protocol"
+	"godis/tcp"
 	"strconv"
+	"sync"
 )
 
+var (
+	peerTLSOnce   sync.Once
+	peerTLSConfig *tls.Config
+	peerTLSErr    error
+)
+
+// makePeerClient 连接其他节点，开启 tls_cluster 时使用 TLS，并出示本节点的证书
+func makePeerClient(addr string) (*client.Client, error) {
+	if !config.Properties().TlsCluster {
+		return client.MakeClient(addr, config.Properties().Keepalive)
+	}
+	peerTLSOnce.Do(func() {
+		peerTLSConfig, peerTLSErr = tcp.MakeClientTLSConfig(config.Properties().TlsCertFile,
+			config.Properties().TlsKeyFile, config.Properties().TlsCaCertFile)
+	})
+	if peerTLSErr != nil {
+		return nil, peerTLSErr
+	}
+	return client.MakeTLSClient(addr, config.Properties().Keepalive, peerTLSConfig)
+}
+
 type getter struct {
 	addr    string
 	poolMap map[int]*pool.Pool
@@ -30,18 +54,18 @@ func newGetter(addr string) *getter {
 		return false
 	}
 
-	poolMap := make(map[int]*pool.Pool, config.Properties.Databases)
-	for i := 0; i < config.Properties.Databases; i++ {
+	poolMap := make(map[int]*pool.Pool, config.Properties().Databases)
+	for i := 0; i < config.Properties().Databases; i++ {
 		var dbIndex = i
 		factory := func() (interface{}, error) {
-			c, err := client.MakeClient(addr, config.Properties.Keepalive)
+			c, err := makePeerClient(addr)
 			if err != nil {
 				return nil, err
 			}
 
 			c.Start()
-			if config.Properties.Password != "" {
-				r := c.Send(utils.ToCmdLine("AUTH", config.Properties.Password))
+			if config.Properties().Password != "" {
+				r := c.Send(utils.ToCmdLine("AUTH", config.Properties().Password))
 				if protocol.IsErrorReply(r) {
 					c.Close()
 					return nil, protocol.MakeErrReply("ERR cluster password is required, please set same password in cluster")
@@ -0,0 +1,288 @@
+package database
+
+import (
+	"sort"
+	"strings"
+
+	"godis/database/engine"
+	"godis/interface/redis"
+	"godis/redis/protocol"
+)
+
+// systemCommand 记录由 Server 直接处理的命令的元数据，它们的 ACL 类别见 systemCommandCategories
+type systemCommand struct {
+	arity   int
+	flags   []string
+	keys    engine.KeySpec
+	numKeys bool // 第二个参数是 key 的个数，如 EVAL、FCALL
+}
+
+var systemCommandTable = map[string]systemCommand{
+	"ping":         {arity: -1, flags: []string{"fast", "stale"}},
+	"auth":         {arity: -2, flags: []string{"noscript", "loading", "stale", "fast", "no_auth"}},
+	"hello":        {arity: -1, flags: []string{"noscript", "loading", "stale", "fast", "no_auth"}},
+	"select":       {arity: 2, flags: []string{"loading", "stale", "fast"}},
+	"bgrewriteaof": {arity: 1, flags: []string{"admin", "noscript"}},
+	"rewriteaof":   {arity: 1, flags: []string{"admin", "noscript"}},
+	"multi":        {arity: 1, flags: []string{"noscript", "loading", "stale", "fast"}},
+	"exec":         {arity: 1, flags: []string{"noscript", "loading", "stale"}},
+	"discard":      {arity: 1, flags: []string{"noscript", "loading", "stale", "fast"}},
+	"watch":        {arity: -2, flags: []string{"noscript", "loading", "stale", "fast"}, keys: engine.KeySpec{FirstKey: 1, LastKey: -1, Step: 1}},
+	"unwatch":      {arity: 1, flags: []string{"noscript", "loading", "stale", "fast"}},
+	"publish":      {arity: 3, flags: []string{"pubsub", "loading", "stale", "fast"}},
+	"subscribe":    {arity: -2, flags: []string{"pubsub", "noscript", "loading", "stale"}},
+	"unsubscribe":  {arity: -1, flags: []string{"pubsub", "noscript", "loading", "stale"}},
+	"pubsub":       {arity: -2, flags: []string{"pubsub", "loading", "stale"}},
+	"client":       {arity: -2, flags: []string{"admin", "noscript", "loading", "stale"}},
+	"slowlog":      {arity: -2, flags: []string{"admin", "loading", "stale"}},
+	"monitor":      {arity: 1, flags: []string{"admin", "noscript", "loading", "stale"}},
+	"acl":          {arity: -2, flags: []string{"admin", "noscript", "loading", "stale"}},
+	"eval":         {arity: -3, flags: []string{"noscript", "stale"}, numKeys: true},
+	"evalsha":      {arity: -3, flags: []string{"noscript", "stale"}, numKeys: true},
+	"script":       {arity: -2, flags: []string{"noscript"}},
+	"function":     {arity: -2, flags: []string{"noscript"}},
+	"fcall":        {arity: -3, flags: []string{"noscript", "stale"}, numKeys: true},
+	"fcall_ro":     {arity: -3, flags: []string{"noscript", "stale", "readonly"}, numKeys: true},
+	"command":      {arity: -1, flags: []string{"loading", "stale"}},
+	"config":       {arity: -2, flags: []string{"admin", "noscript", "loading", "stale"}},
+	"shutdown":     {arity: -1, flags: []string{"admin", "noscript", "loading", "stale"}},
+}
+
+// checkSystemArity returns an error reply if cmdLine of a system command does not match its arity,
+// within MULTI the error also discards the transaction like arity errors of data commands
+func checkSystemArity(client redis.Connection, cmdName string, cmdLine [][]byte) redis.Reply {
+	cmd, ok := systemCommandTable[cmdName]
+	if !ok {
+		return nil
+	}
+	if validArity(cmd.arity, len(cmdLine)) {
+		return nil
+	}
+	errReply := protocol.MakeArgNumErrReply(cmdName)
+	if client.GetMultiStatus() {
+		client.EnqueueSyntaxErrQueue(errReply)
+	}
+	return errReply
+}
+
+// validArity arity < 0 means argNum >= -arity, argNum includes the command name
+func validArity(arity int, argNum int) bool {
+	if arity >= 0 {
+		return argNum == arity
+	}
+	return argNum >= -arity
+}
+
+// execCommand COMMAND [COUNT|INFO|GETKEYS|DOCS]
+func execCommand(args [][]byte) redis.Reply {
+	if len(args) == 0 {
+		names := allCommandNames()
+		replies := make([]redis.Reply, len(names))
+		for i, name := range names {
+			replies[i] = commandInfoReply(name)
+		}
+		return protocol.MakeMultiRawReply(replies)
+	}
+	subCmd := strings.ToLower(string(args[0]))
+	args = args[1:]
+	switch subCmd {
+	case "count":
+		if len(args) != 0 {
+			return protocol.MakeArgNumErrReply("command|count")
+		}
+		return protocol.MakeIntReply(int64(len(allCommandNames())))
+	case "info":
+		names := toStrings(args)
+		if len(names) == 0 {
+			names = allCommandNames()
+		}
+		replies := make([]redis.Reply, len(names))
+		for i, name := range names {
+			replies[i] = commandInfoReply(strings.ToLower(name))
+		}
+		return protocol.MakeMultiRawReply(replies)
+	case "getkeys":
+		if len(args) == 0 {
+			return protocol.MakeArgNumErrReply("command|getkeys")
+		}
+		return commandGetKeys(args)
+	case "docs":
+		return commandDocs(toStrings(args))
+	}
+	return protocol.MakeErrReply("ERR unknown subcommand '" + subCmd + "'. Try COMMAND HELP.")
+}
+
+// allCommandNames returns sorted names of data commands and system commands
+func allCommandNames() []string {
+	names := engine.CommandNames()
+	for name := range systemCommandTable {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func toStrings(args [][]byte) []string {
+	values := make([]string, len(args))
+	for i, arg := range args {
+		values[i] = string(arg)
+	}
+	return values
+}
+
+// lookupCommand returns arity, flags and key spec of command, ok is false if it does not exist
+func lookupCommand(name string) (arity int, flags []string, keys engine.KeySpec, ok bool) {
+	if cmd, exists := systemCommandTable[name]; exists {
+		return cmd.arity, cmd.flags, cmd.keys, true
+	}
+	info, exists := engine.GetCommandInfo(name)
+	if !exists {
+		return 0, nil, engine.KeySpec{}, false
+	}
+	if info.ReadOnly {
+		flags = []string{"readonly"}
+	} else {
+		flags = []string{"write"}
+	}
+	if info.Module {
+		flags = append(flags, "module")
+	}
+	return info.Arity, flags, info.Keys, true
+}
+
+// commandInfoReply returns the same array as redis 7:
+// name, arity, flags, first key, last key, step, acl categories, tips, key specs, subcommands
+func commandInfoReply(name string) redis.Reply {
+	arity, flags, keys, ok := lookupCommand(name)
+	if !ok {
+		return protocol.MakeNullBulkReply()
+	}
+	categories := aclCommandTable{}.CommandCategories(name)
+	aclCategories := make([]redis.Reply, len(categories))
+	for i, category := range categories {
+		aclCategories[i] = protocol.MakeStatusReply("@" + category)
+	}
+	flagReplies := make([]redis.Reply, len(flags))
+	for i, flag := range flags {
+		flagReplies[i] = protocol.MakeStatusReply(flag)
+	}
+	var keySpecs []redis.Reply
+	if keys.FirstKey > 0 {
+		keySpecs = append(keySpecs, keySpecReply(keys, flags))
+	}
+	return protocol.MakeMultiRawReply([]redis.Reply{
+		protocol.MakeBulkReply([]byte(name)),
+		protocol.MakeIntReply(int64(arity)),
+		protocol.MakeSetReply(flagReplies),
+		protocol.MakeIntReply(int64(keys.FirstKey)),
+		protocol.MakeIntReply(int64(keys.LastKey)),
+		protocol.MakeIntReply(int64(keys.Step)),
+		protocol.MakeSetReply(aclCategories),
+		protocol.MakeEmptyMultiBulkReply(),
+		protocol.MakeMultiRawReply(keySpecs),
+		protocol.MakeEmptyMultiBulkReply(),
+	})
+}
+
+// keySpecReply 将 first/last/step 转换为 redis 7 的 key spec，range 中的 lastkey 是相对于 first key 的位置
+func keySpecReply(keys engine.KeySpec, flags []string) redis.Reply {
+	access := "RO"
+	for _, flag := range flags {
+		if flag == "write" {
+			access = "RW"
+		}
+	}
+	lastKey := keys.LastKey
+	if lastKey > 0 {
+		lastKey -= keys.FirstKey
+	}
+	return protocol.MakeMapReply(
+		[]redis.Reply{
+			protocol.MakeBulkReply([]byte("flags")),
+			protocol.MakeBulkReply([]byte("begin_search")),
+			protocol.MakeBulkReply([]byte("find_keys")),
+		},
+		[]redis.Reply{
+			protocol.MakeSetReply([]redis.Reply{protocol.MakeStatusReply(access)}),
+			protocol.MakeMapReply(
+				[]redis.Reply{protocol.MakeBulkReply([]byte("type")), protocol.MakeBulkReply([]byte("spec"))},
+				[]redis.Reply{
+					protocol.MakeBulkReply([]byte("index")),
+					protocol.MakeMapReply(
+						[]redis.Reply{protocol.MakeBulkReply([]byte("index"))},
+						[]redis.Reply{protocol.MakeIntReply(int64(keys.FirstKey))},
+					),
+				},
+			),
+			protocol.MakeMapReply(
+				[]redis.Reply{protocol.MakeBulkReply([]byte("type")), protocol.MakeBulkReply([]byte("spec"))},
+				[]redis.Reply{
+					protocol.MakeBulkReply([]byte("range")),
+					protocol.MakeMapReply(
+						[]redis.Reply{
+							protocol.MakeBulkReply([]byte("lastkey")),
+							protocol.MakeBulkReply([]byte("keystep")),
+							protocol.MakeBulkReply([]byte("limit")),
+						},
+						[]redis.Reply{
+							protocol.MakeIntReply(int64(lastKey)),
+							protocol.MakeIntReply(int64(keys.Step)),
+							protocol.MakeIntReply(0),
+						},
+					),
+				},
+			),
+		},
+	)
+}
+
+// commandGetKeys COMMAND GETKEYS command [arg ...], keys of data commands are extracted by their PreFunc
+func commandGetKeys(cmdLine [][]byte) redis.Reply {
+	name := strings.ToLower(string(cmdLine[0]))
+	arity, _, keySpec, ok := lookupCommand(name)
+	if !ok {
+		return protocol.MakeErrReply("ERR Invalid command specified")
+	}
+	if (arity >= 0 && len(cmdLine) != arity) || (arity < 0 && len(cmdLine) < -arity) {
+		return protocol.MakeErrReply("ERR Invalid number of arguments specified for command")
+	}
+
+	var keys []string
+	if cmd, ok := systemCommandTable[name]; ok {
+		if cmd.numKeys {
+			keyArgs, _, errReply := parseNumKeys(cmdLine[2:])
+			if errReply != nil {
+				return errReply
+			}
+			keys = toStrings(keyArgs)
+		} else {
+			keys = keySpec.Keys(cmdLine[1:])
+		}
+	} else {
+		writeKeys, readKeys, _ := engine.GetRelatedKeys(cmdLine)
+		keys = append(writeKeys, readKeys...)
+	}
+	if len(keys) == 0 {
+		return protocol.MakeErrReply("ERR The command has no key arguments")
+	}
+	return protocol.MakeMultiBulkReply(toBulks(keys))
+}
+
+// commandDocs COMMAND DOCS [command ...]
+// godis 没有附带命令文档，对每个已知命令返回空文档，避免连接时请求文档的客户端报错
+func commandDocs(names []string) redis.Reply {
+	if len(names) == 0 {
+		names = allCommandNames()
+	}
+	keys := make([]redis.Reply, 0, len(names))
+	values := make([]redis.Reply, 0, len(names))
+	for _, name := range names {
+		name = strings.ToLower(name)
+		if _, _, _, ok := lookupCommand(name); !ok {
+			continue
+		}
+		keys = append(keys, protocol.MakeBulkReply([]byte(name)))
+		values = append(values, protocol.MakeMapReply(nil, nil))
+	}
+	return protocol.MakeMapReply(keys, values)
+}
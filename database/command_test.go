@@ -0,0 +1,105 @@
+package database
+
+import (
+	"strings"
+	"testing"
+
+	"godis/lib/utils"
+	"godis/redis/protocol"
+)
+
+func TestSystemCommandTable(t *testing.T) {
+	for name := range systemCommandCategories {
+		if _, ok := systemCommandTable[name]; !ok {
+			t.Errorf("system command %s has no arity", name)
+		}
+	}
+	for name := range systemCommandTable {
+		if _, ok := systemCommandCategories[name]; !ok {
+			t.Errorf("system command %s has no acl categories", name)
+		}
+	}
+}
+
+func TestCommandGetKeys(t *testing.T) {
+	cases := []struct {
+		cmdLine  []string
+		expected string
+	}{
+		{[]string{"set", "k", "v"}, "*1\r\n$1\r\nk\r\n"},
+		{[]string{"sinter", "a", "b"}, "*2\r\n$1\r\na\r\n$1\r\nb\r\n"},
+		{[]string{"memory", "usage", "k"}, "*1\r\n$1\r\nk\r\n"},
+		{[]string{"fcall", "f", "1", "k", "arg"}, "*1\r\n$1\r\nk\r\n"},
+		{[]string{"watch", "a", "b"}, "*2\r\n$1\r\na\r\n$1\r\nb\r\n"},
+		{[]string{"ping"}, "-ERR The command has no key arguments\r\n"},
+		{[]string{"get"}, "-ERR Invalid number of arguments specified for command\r\n"},
+		{[]string{"none"}, "-ERR Invalid command specified\r\n"},
+	}
+	for _, c := range cases {
+		r := commandGetKeys(utils.ToCmdLine(c.cmdLine...))
+		if string(r.ToBytes()) != c.expected {
+			t.Errorf("%v: expect %q, got %q", c.cmdLine, c.expected, r.ToBytes())
+		}
+	}
+}
+
+func TestCommandInfo(t *testing.T) {
+	r := execCommand(utils.ToCmdLine("info", "sunion", "none"))
+	replies := r.(*protocol.MultiRawReply).Replies
+	if len(replies) != 2 {
+		t.Fatalf("expect 2 replies, got %d", len(replies))
+	}
+	if _, ok := replies[1].(*protocol.NullBulkReply); !ok {
+		t.Errorf("unknown command should be nil, got %q", replies[1].ToBytes())
+	}
+	info := replies[0].(*protocol.MultiRawReply).Replies
+	if len(info) != 10 {
+		t.Fatalf("expect 10 fields, got %d", len(info))
+	}
+	expected := []string{"$6\r\nsunion\r\n", ":-2\r\n", "*1\r\n+readonly\r\n", ":1\r\n", ":-1\r\n", ":1\r\n"}
+	for i, e := range expected {
+		if got := string(info[i].ToBytes()); got != e {
+			t.Errorf("field %d: expect %q, got %q", i, e, got)
+		}
+	}
+
+	count := execCommand(utils.ToCmdLine("count")).(*protocol.IntReply).Code
+	all := execCommand(nil).(*protocol.MultiRawReply).Replies
+	if int(count) != len(all) {
+		t.Errorf("COMMAND COUNT %d does not match COMMAND %d", count, len(all))
+	}
+}
+
+func TestSystemCommandArity(t *testing.T) {
+	s, _ := makeShutdownTestServer(t)
+	c := newRecordConn(1, protocol.RESP2)
+	for _, name := range []string{"config", "client", "slowlog", "acl", "script", "function", "eval"} {
+		expected := "-ERR wrong number of arguments for '" + name + "' command\r\n"
+		if r := execString(s, c, name); r != expected {
+			t.Errorf("%s: expect %q, got %q", name, expected, r)
+		}
+	}
+
+	// 事务中参数个数错误的命令使事务失败
+	execString(s, c, "multi")
+	execString(s, c, "select")
+	if r := execString(s, c, "exec"); !strings.HasPrefix(r, "-EXECABORT") {
+		t.Errorf("expect EXECABORT, got %q", r)
+	}
+}
+
+// TestExecWriteKeys EXEC 只增加事务中写入的 key 的版本，不会把空字符串当作 key 加锁和修改
+func TestExecWriteKeys(t *testing.T) {
+	s, _ := makeShutdownTestServer(t)
+	c := newRecordConn(1, protocol.RESP2)
+	execString(s, c, "multi")
+	execString(s, c, "set", "k", "v")
+	execString(s, c, "get", "k")
+	if r := execString(s, c, "exec"); !strings.HasPrefix(r, "*2\r\n") {
+		t.Fatalf("unexpected reply %q", r)
+	}
+	db, _ := s.selectDB(0)
+	if db.GetVersion("k") != 1 || db.GetVersion("") != 0 {
+		t.Errorf("unexpected versions k=%d empty=%d", db.GetVersion("k"), db.GetVersion(""))
+	}
+}
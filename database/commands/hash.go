@@ -146,19 +146,20 @@ func execHGetAll(db *engine.DB, args [][]byte) (redis.Reply, *engine.AofExpireCt
 		return errReply, nil
 	}
 	if dict == nil {
-		return protocol.MakeEmptyMultiBulkReply(), nil
+		return protocol.MakeMapReply(nil, nil), nil
 	}
 
-	var results [][]byte
+	// 记录所有的key和value，RESP3 下返回 map 类型
+	keys := make([]redis.Reply, 0, dict.Len())
+	values := make([]redis.Reply, 0, dict.Len())
 	dict.ForEach(func(key string, val interface{}) bool {
-		// 记录所有的key和value
-		results = append(results, []byte(key))
-		results = append(results, val.([]byte))
+		keys = append(keys, protocol.MakeBulkReply([]byte(key)))
+		values = append(values, protocol.MakeBulkReply(val.([]byte)))
 
 		return true
 	})
 
-	return protocol.MakeMultiBulkReply(results), nil
+	return protocol.MakeMapReply(keys, values), nil
 }
 
 func execHIncrBy(db *engine.DB, args [][]byte) (redis.Reply, *engine.AofExpireCtx) {
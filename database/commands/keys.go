@@ -3,18 +3,24 @@ package commands
 import (
 	"godis/database/engine"
 	"godis/interface/redis"
+	"godis/lib/utils"
 	"godis/redis/protocol"
 	"strconv"
+	"strings"
 	"time"
 )
 
 func init() {
 	engine.RegisterCommand("Del", execDel, writeFirstKey, 2, engine.FlagWrite)
 	engine.RegisterCommand("ExpireAt", execExpireAt, writeFirstKey, 3, engine.FlagWrite)
+	engine.RegisterCommand("PExpireAt", execPExpireAt, writeFirstKey, 3, engine.FlagWrite)
 	engine.RegisterCommand("Expire", execExpire, writeFirstKey, 3, engine.FlagWrite)
 	engine.RegisterCommand("KeyVersion", execKeyVersion, writeFirstKey, 2, engine.FlagReadOnly)
 	engine.RegisterCommand("Exist", execExist, readFirstKey, 2, engine.FlagReadOnly)
 	engine.RegisterCommand("Persist", execPersist, writeFirstKey, 2, engine.FlagWrite)
+	engine.RegisterCommand("Type", execType, readFirstKey, 2, engine.FlagReadOnly)
+	engine.RegisterCommand("Memory", execMemory, prepareMemory, -3, engine.FlagReadOnly)
+	engine.SetKeySpec("Memory", engine.KeySpec{FirstKey: 2, LastKey: 2, Step: 1})
 }
 
 func execDel(db *engine.DB, args [][]byte) (redis.Reply, *engine.AofExpireCtx) {
@@ -58,6 +64,25 @@ func execExpireAt(db *engine.DB, args [][]byte) (redis.Reply, *engine.AofExpireC
 	}
 }
 
+// execPExpireAt PEXPIREAT key milliseconds-timestamp, AOF 和重写使用它记录过期时间
+func execPExpireAt(db *engine.DB, args [][]byte) (redis.Reply, *engine.AofExpireCtx) {
+	key := string(args[0])
+
+	raw, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return protocol.MakeErrReply("ERR value is not an integer or out of range"), nil
+	}
+	expireAt := time.UnixMilli(raw)
+
+	_, exists := db.GetEntity(key)
+	if !exists {
+		return protocol.MakeIntReply(0), nil
+	}
+
+	db.Expire(key, expireAt)
+	return protocol.MakeIntReply(1), &engine.AofExpireCtx{NeedAof: true}
+}
+
 func execExpire(db *engine.DB, args [][]byte) (redis.Reply, *engine.AofExpireCtx) {
 	key := string(args[0])
 
@@ -118,3 +143,34 @@ func execPersist(db *engine.DB, args [][]byte) (redis.Reply, *engine.AofExpireCt
 
 	return protocol.MakeIntReply(1), &engine.AofExpireCtx{NeedAof: true}
 }
+
+func execType(db *engine.DB, args [][]byte) (redis.Reply, *engine.AofExpireCtx) {
+	key := string(args[0])
+
+	entity, exists := db.GetEntity(key)
+	if !exists {
+		return protocol.MakeStatusReply("none"), nil
+	}
+	return protocol.MakeStatusReply(utils.EntityTypeName(entity)), nil
+}
+
+// prepareMemory MEMORY USAGE key [SAMPLES count]
+func prepareMemory(args [][]byte) ([]string, []string) {
+	return nil, []string{string(args[1])}
+}
+
+func execMemory(db *engine.DB, args [][]byte) (redis.Reply, *engine.AofExpireCtx) {
+	if strings.ToLower(string(args[0])) != "usage" {
+		return protocol.MakeErrReply("ERR unknown subcommand '" + string(args[0]) + "'. Try MEMORY HELP."), nil
+	}
+	if len(args) != 2 && (len(args) != 4 || strings.ToLower(string(args[2])) != "samples") {
+		return protocol.MakeSyntaxErrReply(), nil
+	}
+	key := string(args[1])
+
+	entity, exists := db.GetEntity(key)
+	if !exists {
+		return protocol.MakeNullBulkReply(), nil
+	}
+	return protocol.MakeIntReply(utils.EntityMemoryUsage(key, entity)), nil
+}
@@ -340,4 +340,7 @@ func init() {
 	engine.RegisterCommand("SRandMember", execSRandMember, readFirstKey, -2, engine.FlagReadOnly)
 	engine.RegisterCommand("SRem", execSRem, writeFirstKey, -3, engine.FlagWrite)
 	engine.RegisterCommand("SUnion", execSUnion, prepareSetCalculate, -2, engine.FlagReadOnly)
+	for _, name := range []string{"SDiff", "SInter", "SUnion"} {
+		engine.SetKeySpec(name, allKeysSpec)
+	}
 }
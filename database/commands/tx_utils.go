@@ -1,5 +1,10 @@
 package commands
 
+import "godis/database/engine"
+
+// allKeysSpec 所有参数都是 key
+var allKeysSpec = engine.KeySpec{FirstKey: 1, LastKey: -1, Step: 1}
+
 func writeFirstKey(args [][]byte) ([]string, []string) {
 	key := string(args[0])
 	return []string{key}, nil
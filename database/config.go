@@ -0,0 +1,94 @@
+package database
+
+import (
+	"errors"
+	"strings"
+
+	"godis/config"
+	"godis/database/acl"
+	"godis/interface/redis"
+	"godis/lib/logger"
+	"godis/lib/metrics"
+	"godis/redis/protocol"
+)
+
+// execConfig CONFIG GET|SET|REWRITE|RESETSTAT
+func execConfig(c redis.Connection, args [][]byte) redis.Reply {
+	if len(args) == 0 {
+		return protocol.MakeArgNumErrReply("config")
+	}
+	subCmd := strings.ToLower(string(args[0]))
+	args = args[1:]
+	switch subCmd {
+	case "get":
+		if len(args) == 0 {
+			return protocol.MakeArgNumErrReply("config|get")
+		}
+		names, values := config.Get(toStrings(args)...)
+		keys := make([]redis.Reply, len(names))
+		replies := make([]redis.Reply, len(values))
+		for i := range names {
+			keys[i] = protocol.MakeBulkReply([]byte(names[i]))
+			replies[i] = protocol.MakeBulkReply([]byte(values[i]))
+		}
+		return protocol.MakeMapReply(keys, replies)
+	case "set":
+		if len(args) == 0 || len(args)%2 != 0 {
+			return protocol.MakeArgNumErrReply("config|set")
+		}
+		if err := config.Set(toStrings(args)...); err != nil {
+			var paramErr *config.ParamError
+			if errors.As(err, &paramErr) && errors.Is(err, config.ErrUnknownParam) {
+				return protocol.MakeErrReply("ERR Unknown option or number of arguments for CONFIG SET - '" + paramErr.Name + "'")
+			}
+			if errors.As(err, &paramErr) {
+				return protocol.MakeErrReply("ERR CONFIG SET failed (possibly related to argument '" +
+					paramErr.Name + "') - " + paramErr.Err.Error())
+			}
+			return protocol.MakeErrReply("ERR " + err.Error())
+		}
+		return protocol.MakeOkReply()
+	case "rewrite":
+		if len(args) != 0 {
+			return protocol.MakeArgNumErrReply("config|rewrite")
+		}
+		if err := config.Rewrite(); err != nil {
+			if errors.Is(err, config.ErrNoConfigFile) {
+				return protocol.MakeErrReply("ERR The server is running without a config file")
+			}
+			logger.Warn("config rewrite failed: " + err.Error())
+			return protocol.MakeErrReply("ERR Rewriting config file: " + err.Error())
+		}
+		logger.Info("CONFIG REWRITE executed with success.")
+		return protocol.MakeOkReply()
+	case "resetstat":
+		if len(args) != 0 {
+			return protocol.MakeArgNumErrReply("config|resetstat")
+		}
+		metrics.DefaultRegistry.Reset()
+		return protocol.MakeOkReply()
+	}
+	return protocol.MakeErrReply("ERR unknown subcommand '" + subCmd + "'. Try CONFIG HELP.")
+}
+
+// onConfigChanged 将 CONFIG SET 或 reload 修改的配置应用到运行中的服务器，其他配置项在使用时读取，无需处理
+func (s *Server) onConfigChanged(changed []string) {
+	for _, name := range changed {
+		switch name {
+		case "password":
+			rule := "nopass"
+			if config.Properties().Password != "" {
+				rule = ">" + config.Properties().Password
+			}
+			if err := s.acl.SetUser(acl.DefaultUser, "resetpass", rule); err != nil {
+				logger.Error("set password of default user failed: " + err.Error())
+			}
+		case "aof_fsync":
+			if s.AofPersister != nil {
+				if err := s.AofPersister.SetFsync(config.Properties().AofFsync); err != nil {
+					logger.Error(err)
+				}
+			}
+		}
+	}
+}
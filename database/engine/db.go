@@ -5,6 +5,7 @@ import (
 	"godis/datastruct/lock"
 	"godis/interface/database"
 	"godis/interface/redis"
+	"godis/lib/metrics"
 	"godis/lib/utils"
 	"godis/redis/protocol"
 	"strings"
@@ -19,13 +20,22 @@ const (
 
 type CmdLine = [][]byte
 
+var (
+	execDuration = metrics.NewHistogramVec("godis_db_exec_duration_seconds",
+		"Time spent executing data commands while holding key locks.", nil, "cmd")
+	lockWaitDuration = metrics.NewHistogram("godis_db_lock_wait_seconds",
+		"Time spent waiting for key locks before executing data commands.", nil)
+)
+
 type DB struct {
-	index      int                // 数据库号
-	data       dict.Dict          //是一个 dict.Dict 接口类型的属性，记录数据库中所有的数据。
-	ttlMap     dict.Dict          //用来记录所有 key 的过期时间。
-	versionMap dict.Dict          //用来记录所有 key 的版本号，在事务中会用到。
-	locker     *lock.Locks        //就是之前的 LockMap，用于一次性加锁，实现对数据的互斥访问。
-	addAof     func(line CmdLine) //用于AOF持久化
+	index      int                    // 数据库号
+	data       dict.Dict              //是一个 dict.Dict 接口类型的属性，记录数据库中所有的数据。
+	ttlMap     dict.Dict              //用来记录所有 key 的过期时间。
+	versionMap dict.Dict              //用来记录所有 key 的版本号，在事务中会用到。
+	locker     *lock.Locks            //就是之前的 LockMap，用于一次性加锁，实现对数据的互斥访问。
+	addAof     func(lines ...CmdLine) //用于AOF持久化，一次传入的多条命令连续写入
+	// onKeysChanged 在 key 被写命令修改或者过期删除后调用，用于 client side caching 发送失效消息
+	onKeysChanged func(keys []string)
 }
 
 func MakeDB() *DB {
@@ -34,16 +44,21 @@ func MakeDB() *DB {
 		ttlMap:     dict.MakeConcurrent(ttlDictSize),
 		versionMap: dict.MakeConcurrent(dataDictSize),
 		locker:     lock.Make(lockSize),
-		addAof:     func(line CmdLine) {},
+		addAof:     func(lines ...CmdLine) {},
+
+		onKeysChanged: func(keys []string) {},
 	}
 }
 
 func MakeBasicDB() *DB {
 	return &DB{
-		data:   dict.MakeSimpleDict(),
-		ttlMap: dict.MakeSimpleDict(),
-		locker: lock.Make(1),
-		addAof: func(line CmdLine) {},
+		data:       dict.MakeSimpleDict(),
+		ttlMap:     dict.MakeSimpleDict(),
+		versionMap: dict.MakeSimpleDict(),
+		locker:     lock.Make(1),
+		addAof:     func(lines ...CmdLine) {},
+
+		onKeysChanged: func(keys []string) {},
 	}
 }
 
@@ -63,10 +78,10 @@ func (db *DB) Exec(client redis.Connection, cmdLine [][]byte) redis.Reply {
 
 		return protocol.MakeStatusReply("QUEUED")
 	}
-	return db.execNormalCommand(cmdLine)
+	return db.execNormalCommand(client, cmdLine)
 }
 
-func (db *DB) execNormalCommand(cmdLine [][]byte) redis.Reply {
+func (db *DB) execNormalCommand(client redis.Connection, cmdLine [][]byte) redis.Reply {
 	if errReply := db.CheckSyntaxErr(cmdLine); errReply != nil {
 		return errReply
 	}
@@ -76,14 +91,20 @@ func (db *DB) execNormalCommand(cmdLine [][]byte) redis.Reply {
 
 	prepare := cmd.prepare
 	write, read := prepare(cmdLine[1:])
+	lockStart := time.Now()
 	db.locker.RWLocks(write, read)
 	defer db.locker.RWUnlocks(write, read)
+	execStart := time.Now()
+	client.SetExecStart(execStart)
+	lockWaitDuration.ObserveDuration(execStart.Sub(lockStart))
 
 	funE := cmd.executor
 	r, aofExpireCtx := funE(db, cmdLine[1:])
+	execDuration.WithLabelValues(cmdName).ObserveDuration(time.Since(execStart))
 	db.afterExec(r, aofExpireCtx, cmdLine)
 	if !IsReadOnlyCommand(cmdName) && !protocol.IsErrorReply(r) {
 		db.AddVersion(write...)
+		db.onKeysChanged(write)
 	}
 
 	return r
@@ -114,14 +135,21 @@ func (db *DB) CheckSupportMulti(cmdLine [][]byte) redis.Reply {
 }
 
 func (db *DB) afterExec(r redis.Reply, aofExpireCtx *AofExpireCtx, cmdLine [][]byte) {
-	key := string(cmdLine[1])
+	if lines := aofLines(aofExpireCtx, cmdLine); len(lines) > 0 {
+		db.addAof(lines...)
+	}
+}
 
-	if aofExpireCtx != nil && aofExpireCtx.NeedAof {
-		db.addAof(cmdLine)
-		if aofExpireCtx.ExpireAt != nil {
-			db.addAof(utils.ExpireToCmdLine(key, *aofExpireCtx.ExpireAt))
-		}
+// aofLines 返回执行 cmdLine 之后需要写入 AOF 的命令
+func aofLines(aofExpireCtx *AofExpireCtx, cmdLine [][]byte) []CmdLine {
+	if aofExpireCtx == nil || !aofExpireCtx.NeedAof {
+		return nil
 	}
+	lines := []CmdLine{cmdLine}
+	if aofExpireCtx.ExpireAt != nil {
+		lines = append(lines, utils.ExpireToCmdLine(string(cmdLine[1]), *aofExpireCtx.ExpireAt))
+	}
+	return lines
 }
 
 // Flush Warning! clean all db data
@@ -164,14 +192,60 @@ func (db *DB) GetDBSize() (int, int) {
 	return db.data.Len(), db.ttlMap.Len()
 }
 
-func (db *DB) SetAddAof(addAof func(line CmdLine)) {
+func (db *DB) SetAddAof(addAof func(lines ...CmdLine)) {
 	db.addAof = addAof
 }
 
+// SetKeysChangedHook sets the function called with keys modified by write commands or removed by expiration,
+// hook is called while holding key locks so it must not block
+func (db *DB) SetKeysChangedHook(hook func(keys []string)) {
+	db.onKeysChanged = hook
+}
+
+// ExecLocked locks writeKeys and readKeys and calls fn, commands passed to exec are executed without locking,
+// so fn must only access locked keys. Versions of keys modified by fn are increased after fn returns.
+// Commands written to AOF by fn are wrapped in MULTI/EXEC, so they are replayed atomically.
+// It is used by scripts which execute several commands atomically
+func (db *DB) ExecLocked(writeKeys []string, readKeys []string, fn func(exec func(cmdLine CmdLine) redis.Reply)) {
+	db.RWLocks(writeKeys, readKeys)
+	defer db.RWUnLocks(writeKeys, readKeys)
+
+	var changed []string
+	var aof []CmdLine
+	fn(func(cmdLine CmdLine) redis.Reply {
+		r, lines := db.execWithLock(cmdLine)
+		aof = append(aof, lines...)
+		if !protocol.IsErrorReply(r) && IsWriteCommand(string(cmdLine[0])) {
+			write, _, _ := GetRelatedKeys(cmdLine)
+			changed = append(changed, write...)
+		}
+		return r
+	})
+	if len(aof) > 1 {
+		aof = append(append([]CmdLine{utils.ToCmdLine("MULTI")}, aof...), utils.ToCmdLine("EXEC"))
+	}
+	if len(aof) > 0 {
+		db.addAof(aof...)
+	}
+	if len(changed) > 0 {
+		db.AddVersion(changed...)
+		db.onKeysChanged(changed)
+	}
+}
+
 func (db *DB) ExecWithLock(cmdLine CmdLine) redis.Reply {
+	r, lines := db.execWithLock(cmdLine)
+	if len(lines) > 0 {
+		db.addAof(lines...)
+	}
+	return r
+}
+
+// execWithLock 执行命令并返回需要写入 AOF 的命令，由调用者写入
+func (db *DB) execWithLock(cmdLine CmdLine) (redis.Reply, []CmdLine) {
 	if errReply := db.CheckSyntaxErr(cmdLine); errReply != nil {
 		// 检查是否有语法错误
-		return errReply
+		return errReply, nil
 	}
 
 	// 执行
@@ -179,7 +253,5 @@ func (db *DB) ExecWithLock(cmdLine CmdLine) redis.Reply {
 	cmd := cmdTable[cmdName]
 	fun := cmd.executor
 	r, aofExpireCtx := fun(db, cmdLine[1:])
-	db.afterExec(r, aofExpireCtx, cmdLine)
-
-	return r
+	return r, aofLines(aofExpireCtx, cmdLine)
 }
@@ -29,6 +29,7 @@ func (db *DB) Expire(key string, expireTime time.Time) {
 		expired := time.Now().After(expireTime)
 		if expired { // 过期则移除
 			db.Remove(key)
+			db.onKeysChanged(keys)
 		}
 	})
 }
@@ -43,6 +44,7 @@ func (db *DB) IsExpired(key string) bool {
 	expired := time.Now().After(expireTime)
 	if expired {
 		db.Remove(key)
+		db.onKeysChanged([]string{key})
 	}
 
 	return expired
@@ -77,6 +79,7 @@ func (db *DB) ExpireAfter(key string, delay time.Duration) {
 		expired := time.Now().After(expireTime)
 		if expired { // 过期则移除
 			db.Remove(key)
+			db.onKeysChanged(keys)
 		}
 	})
 }
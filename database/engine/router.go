@@ -1,6 +1,7 @@
 package engine
 
 import (
+	"errors"
 	"godis/interface/redis"
 	"strings"
 	"time"
@@ -26,6 +27,51 @@ type command struct {
 	prepare  PreFunc  // return related keys command,用于解析出命令中需要加读锁和写锁的 keys
 	arity    int      // allow number of args, arity < 0 means len(args) >= -arity,合法的参数数量，
 	flags    int      // 记录这个命令是只读命令还是涉及到了写操作,flagWrite or flagReadOnly
+	keySpec  KeySpec  // key 的位置，由 COMMAND 命令返回给客户端
+	module   bool     // 是否由模块注册
+}
+
+// KeySpec describes positions of keys in command line, positions start from 1 (the first argument after command name).
+// LastKey < 0 counts from the end, -1 means the last argument. Step is the distance between two keys.
+// A KeySpec with FirstKey 0 means the command has no keys
+type KeySpec struct {
+	FirstKey int
+	LastKey  int
+	Step     int
+}
+
+// Keys returns keys in args according to spec, args don't include command name
+func (spec KeySpec) Keys(args [][]byte) []string {
+	if spec.FirstKey <= 0 {
+		return nil
+	}
+	last := spec.LastKey
+	if last < 0 {
+		last = len(args) + 1 + last
+	}
+	if last > len(args) {
+		last = len(args)
+	}
+	step := spec.Step
+	if step <= 0 {
+		step = 1
+	}
+	var keys []string
+	for i := spec.FirstKey; i <= last; i += step {
+		keys = append(keys, string(args[i-1]))
+	}
+	return keys
+}
+
+// PreFunc returns a PreFunc which locks keys described by spec
+func (spec KeySpec) PreFunc(readOnly bool) PreFunc {
+	return func(args [][]byte) ([]string, []string) {
+		keys := spec.Keys(args)
+		if readOnly {
+			return nil, keys
+		}
+		return keys, nil
+	}
 }
 
 const (
@@ -33,6 +79,11 @@ const (
 	FlagReadOnly = 1
 )
 
+// firstKeySpec 大部分命令只有第一个参数是 key
+var firstKeySpec = KeySpec{FirstKey: 1, LastKey: 1, Step: 1}
+
+// RegisterCommand registers a built-in data command, its key spec defaults to the first argument,
+// commands with other key positions should call SetKeySpec
 func RegisterCommand(name string, executor ExecFunc, prepare PreFunc, arity int, flags int) {
 	name = strings.ToLower(name)
 	cmdTable[name] = &command{
@@ -40,7 +91,65 @@ func RegisterCommand(name string, executor ExecFunc, prepare PreFunc, arity int,
 		prepare:  prepare,
 		arity:    arity,
 		flags:    flags,
+		keySpec:  firstKeySpec,
+	}
+}
+
+// SetKeySpec sets key positions of a registered command which are reported by COMMAND,
+// the keys actually locked are still decided by its PreFunc
+func SetKeySpec(name string, keySpec KeySpec) {
+	if cmd, ok := cmdTable[strings.ToLower(name)]; ok {
+		cmd.keySpec = keySpec
+	}
+}
+
+// RegisterModuleCommand registers a command defined outside of godis, see package godis/module.
+// Unlike RegisterCommand it refuses to replace an existing command
+func RegisterModuleCommand(name string, executor ExecFunc, keySpec KeySpec, arity int, flags int) error {
+	name = strings.ToLower(name)
+	if name == "" || strings.ContainsAny(name, " |") {
+		return errors.New("invalid command name '" + name + "'")
+	}
+	if arity == 0 {
+		return errors.New("arity of command '" + name + "' must not be 0")
+	}
+	if _, ok := cmdTable[name]; ok {
+		return errors.New("command '" + name + "' already exists")
+	}
+	cmdTable[name] = &command{
+		executor: executor,
+		prepare:  keySpec.PreFunc(flags&FlagReadOnly > 0),
+		arity:    arity,
+		flags:    flags,
+		keySpec:  keySpec,
+		module:   true,
+	}
+	return nil
+}
+
+// CommandInfo describes a registered data command
+type CommandInfo struct {
+	Name     string
+	Arity    int
+	ReadOnly bool
+	Module   bool
+	Keys     KeySpec
+}
+
+// GetCommandInfo returns description of data command with given name
+func GetCommandInfo(name string) (CommandInfo, bool) {
+	name = strings.ToLower(name)
+	cmd, ok := cmdTable[name]
+	if !ok {
+		return CommandInfo{}, false
 	}
+	return CommandInfo{
+		Name:     name,
+		Arity:    cmd.arity,
+		ReadOnly: cmd.flags&FlagReadOnly > 0,
+		Module:   cmd.module,
+		Keys:     cmd.keySpec,
+	}, true
 }
 
 func IsReadOnlyCommand(name string) bool {
@@ -51,3 +160,39 @@ func IsReadOnlyCommand(name string) bool {
 
 	return false
 }
+
+// IsWriteCommand returns true if name is a registered data command which may modify keys
+func IsWriteCommand(name string) bool {
+	name = strings.ToLower(name)
+	if cmd, ok := cmdTable[name]; ok && (cmd.flags&FlagReadOnly == 0) {
+		return true
+	}
+
+	return false
+}
+
+// IsCommand returns true if name is a registered data command
+func IsCommand(name string) bool {
+	_, ok := cmdTable[strings.ToLower(name)]
+	return ok
+}
+
+// CommandNames returns names of all registered data commands
+func CommandNames() []string {
+	names := make([]string, 0, len(cmdTable))
+	for name := range cmdTable {
+		names = append(names, name)
+	}
+	return names
+}
+
+// GetRelatedKeys returns write keys and read keys of cmdLine using its PreFunc,
+// ok is false if cmdLine is not a valid data command
+func GetRelatedKeys(cmdLine [][]byte) (writeKeys []string, readKeys []string, ok bool) {
+	cmd, exists := cmdTable[strings.ToLower(string(cmdLine[0]))]
+	if !exists || cmd.prepare == nil || !validateArity(cmd.arity, cmdLine) {
+		return nil, nil, false
+	}
+	writeKeys, readKeys = cmd.prepare(cmdLine[1:])
+	return writeKeys, readKeys, true
+}
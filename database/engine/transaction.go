@@ -11,15 +11,20 @@ import (
 
 // ExecMulti multi命令执行阶段
 func (db *DB) ExecMulti(c redis.Connection) redis.Reply {
-	return db.ExecMultiCommand(c.GetEnqueuedCmdLine(), c.GetWatching())
+	return db.execMultiCommand(c, c.GetEnqueuedCmdLine(), c.GetWatching())
 }
 
 func (db *DB) ExecMultiCommand(cmdLines [][][]byte, watching map[string]uint32) redis.Reply {
+	return db.execMultiCommand(nil, cmdLines, watching)
+}
+
+// execMultiCommand 执行事务，c 不为空时在加锁之后重新记录命令开始执行的时间
+func (db *DB) execMultiCommand(c redis.Connection, cmdLines [][][]byte, watching map[string]uint32) redis.Reply {
 	// 此时不需要检查是否有语法错误，因为在排队过程中已经检查过了
 
 	// // 获取所有需要加锁的key
-	writeKeys := make([]string, len(cmdLines))
-	readKeys := make([]string, len(cmdLines)+len(watching))
+	writeKeys := make([]string, 0, len(cmdLines))
+	readKeys := make([]string, 0, len(cmdLines)+len(watching))
 	for _, cmdLine := range cmdLines {
 		cmdName := strings.ToLower(string(cmdLine[0]))
 		cmd := cmdTable[cmdName]
@@ -37,6 +42,9 @@ func (db *DB) ExecMultiCommand(cmdLines [][][]byte, watching map[string]uint32)
 	readKeys = append(readKeys, watchingKeys...)
 	db.RWLocks(writeKeys, readKeys)
 	defer db.RWUnLocks(writeKeys, readKeys)
+	if c != nil {
+		c.SetExecStart(time.Now())
+	}
 
 	versionChanged := db.checkVersionChanged(watching)
 	if versionChanged {
@@ -50,14 +58,14 @@ func (db *DB) ExecMultiCommand(cmdLines [][][]byte, watching map[string]uint32)
 	for _, cmdLine := range cmdLines {
 		cmdName := strings.ToLower(string(cmdLine[0]))
 		cmd := cmdTable[cmdName]
-		if config.Properties.OpenAtomicTx {
+		if config.Properties().OpenAtomicTx {
 			key := string(cmdLine[1])
 			undoLogs = append(undoLogs, db.GetUndoLog(key))
 		}
 
 		fn := cmd.executor
 		r, aofExpireCtx := fn(db, cmdLine[1:])
-		if config.Properties.OpenAtomicTx && protocol.IsErrorReply(r) {
+		if config.Properties().OpenAtomicTx && protocol.IsErrorReply(r) {
 			undoLogs = undoLogs[:len(undoLogs)-1]
 			aborted = true
 			break
@@ -70,7 +78,7 @@ func (db *DB) ExecMultiCommand(cmdLines [][][]byte, watching map[string]uint32)
 		return protocol.MakeEmptyMultiBulkReply()
 	}
 
-	if config.Properties.OpenAtomicTx && aborted {
+	if config.Properties().OpenAtomicTx && aborted {
 		size := len(undoLogs)
 		for i := size - 1; i >= 0; i-- {
 			undoLog := undoLogs[i]
@@ -87,6 +95,7 @@ func (db *DB) ExecMultiCommand(cmdLines [][][]byte, watching map[string]uint32)
 	// 未开启原子性事务，或者执行成功
 	// 写命令增加版本
 	db.AddVersion(writeKeys...)
+	db.onKeysChanged(writeKeys)
 	return protocol.MakeMultiBulkReply(results)
 }
 
@@ -0,0 +1,182 @@
+package database
+
+import (
+	"context"
+	"strings"
+
+	"godis/config"
+	"godis/database/script"
+	"godis/interface/redis"
+	"godis/lib/utils"
+	"godis/redis/protocol"
+)
+
+// FunctionCodes returns code of all function libraries, they are written into the rewritten aof
+func (s *Server) FunctionCodes() []string {
+	return s.functions.Codes()
+}
+
+// appendFunctionAof 函数库不属于任何一个 db，使用客户端当前的 db 写入 aof 以避免多余的 SELECT
+func (s *Server) appendFunctionAof(c redis.Connection, cmdLine [][]byte) {
+	if config.Properties().AppendOnly && s.AofPersister != nil {
+		s.AofPersister.SaveCmdLine(c.GetDBIndex(), cmdLine)
+	}
+}
+
+// FCall FCALL function numkeys [key ...] [arg ...], FCALL_RO only calls functions with no-writes flag
+func FCall(s *Server, c redis.Connection, args [][]byte, readOnly bool) redis.Reply {
+	cmdName := "fcall"
+	if readOnly {
+		cmdName = "fcall_ro"
+	}
+	if len(args) < 2 {
+		return protocol.MakeArgNumErrReply(cmdName)
+	}
+	fn, ok := s.functions.GetFunction(string(args[0]))
+	if !ok {
+		return protocol.MakeErrReply("ERR Function not found")
+	}
+	if readOnly && !fn.ReadOnly() {
+		return protocol.MakeErrReply("ERR Can not execute a script with write flag using *_ro command.")
+	}
+	return s.runScript(c, cmdName, args[1:], fn.ReadOnly(), func(ctx context.Context, keys, argv [][]byte, call script.CallFunc) redis.Reply {
+		return fn.Library.Call(ctx, fn.Name, keys, argv, call)
+	})
+}
+
+// execFunction FUNCTION LOAD|DELETE|FLUSH|LIST|DUMP|RESTORE|KILL
+func execFunction(s *Server, c redis.Connection, args [][]byte) redis.Reply {
+	if len(args) == 0 {
+		return protocol.MakeArgNumErrReply("function")
+	}
+	subCmd := strings.ToLower(string(args[0]))
+	args = args[1:]
+	switch subCmd {
+	case "load":
+		replace := false
+		if len(args) == 2 && strings.ToLower(string(args[0])) == "replace" {
+			replace = true
+			args = args[1:]
+		}
+		if len(args) != 1 {
+			return protocol.MakeArgNumErrReply("function|load")
+		}
+		code := string(args[0])
+		name, err := s.functions.Load(code, replace)
+		if err != nil {
+			return protocol.MakeErrReply("ERR " + err.Error())
+		}
+		// 总是以 REPLACE 写入，保证 aof 重写之后重放时不会因为库已经存在而失败
+		s.appendFunctionAof(c, utils.ToCmdLine("FUNCTION", "LOAD", "REPLACE", code))
+		return protocol.MakeBulkReply([]byte(name))
+	case "delete":
+		if len(args) != 1 {
+			return protocol.MakeArgNumErrReply("function|delete")
+		}
+		if err := s.functions.Delete(string(args[0])); err != nil {
+			return protocol.MakeErrReply("ERR " + err.Error())
+		}
+		s.appendFunctionAof(c, utils.ToCmdLine("FUNCTION", "DELETE", string(args[0])))
+		return protocol.MakeOkReply()
+	case "flush":
+		if len(args) > 1 {
+			return protocol.MakeArgNumErrReply("function|flush")
+		}
+		if len(args) == 1 {
+			mode := strings.ToLower(string(args[0]))
+			if mode != "async" && mode != "sync" {
+				return protocol.MakeErrReply("ERR FUNCTION FLUSH only supports SYNC|ASYNC option")
+			}
+		}
+		s.functions.Flush()
+		s.appendFunctionAof(c, utils.ToCmdLine("FUNCTION", "FLUSH"))
+		return protocol.MakeOkReply()
+	case "list":
+		return functionList(s, args)
+	case "dump":
+		if len(args) != 0 {
+			return protocol.MakeArgNumErrReply("function|dump")
+		}
+		return protocol.MakeBulkReply(s.functions.Dump())
+	case "restore":
+		if len(args) != 1 && len(args) != 2 {
+			return protocol.MakeArgNumErrReply("function|restore")
+		}
+		policy := script.RestoreAppend
+		if len(args) == 2 {
+			policy = strings.ToLower(string(args[1]))
+			if policy != script.RestoreAppend && policy != script.RestoreReplace && policy != script.RestoreFlush {
+				return protocol.MakeErrReply("ERR Wrong restore policy given, value should be either FLUSH, APPEND or REPLACE.")
+			}
+		}
+		if err := s.functions.Restore(args[0], policy); err != nil {
+			return protocol.MakeErrReply("ERR " + err.Error())
+		}
+		s.appendFunctionAof(c, utils.ToCmdLine2("FUNCTION", []byte("RESTORE"), args[0], []byte(policy)))
+		return protocol.MakeOkReply()
+	case "kill":
+		if len(args) != 0 {
+			return protocol.MakeArgNumErrReply("function|kill")
+		}
+		return s.scriptRuns.kill(true)
+	}
+	return protocol.MakeErrReply("ERR unknown subcommand '" + subCmd + "'. Try FUNCTION HELP.")
+}
+
+// functionList FUNCTION LIST [LIBRARYNAME pattern] [WITHCODE]
+func functionList(s *Server, args [][]byte) redis.Reply {
+	var pattern string
+	withCode := false
+	for i := 0; i < len(args); i++ {
+		option := strings.ToLower(string(args[i]))
+		switch {
+		case option == "withcode" && !withCode:
+			withCode = true
+		case option == "libraryname" && pattern == "" && i+1 < len(args):
+			pattern = string(args[i+1])
+			i++
+		default:
+			return protocol.MakeErrReply("ERR Unknown argument " + string(args[i]))
+		}
+	}
+
+	libs := s.functions.List(pattern)
+	replies := make([]redis.Reply, len(libs))
+	for i, lib := range libs {
+		functions := make([]redis.Reply, len(lib.Functions))
+		for j, fn := range lib.Functions {
+			var description redis.Reply = protocol.MakeNullReply()
+			if fn.Description != "" {
+				description = protocol.MakeBulkReply([]byte(fn.Description))
+			}
+			functions[j] = protocol.MakeMapReply(
+				[]redis.Reply{
+					protocol.MakeBulkReply([]byte("name")),
+					protocol.MakeBulkReply([]byte("description")),
+					protocol.MakeBulkReply([]byte("flags")),
+				},
+				[]redis.Reply{
+					protocol.MakeBulkReply([]byte(fn.Name)),
+					description,
+					protocol.MakeSetReply(bulkReplies(toBulks(fn.Flags))),
+				},
+			)
+		}
+		keys := []redis.Reply{
+			protocol.MakeBulkReply([]byte("library_name")),
+			protocol.MakeBulkReply([]byte("engine")),
+			protocol.MakeBulkReply([]byte("functions")),
+		}
+		values := []redis.Reply{
+			protocol.MakeBulkReply([]byte(lib.Name)),
+			protocol.MakeBulkReply([]byte("LUA")),
+			protocol.MakeMultiRawReply(functions),
+		}
+		if withCode {
+			keys = append(keys, protocol.MakeBulkReply([]byte("library_code")))
+			values = append(values, protocol.MakeBulkReply([]byte(lib.Code)))
+		}
+		replies[i] = protocol.MakeMapReply(keys, values)
+	}
+	return protocol.MakeMultiRawReply(replies)
+}
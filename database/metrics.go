@@ -0,0 +1,52 @@
+package database
+
+import (
+	"strconv"
+	"time"
+
+	"godis/database/engine"
+	"godis/interface/redis"
+	"godis/lib/metrics"
+	"godis/redis/protocol"
+)
+
+var (
+	commandCalls = metrics.NewCounterVec("godis_commands_total",
+		"Total number of commands processed by server.", "cmd")
+	commandErrors = metrics.NewCounterVec("godis_command_errors_total",
+		"Total number of commands which replied an error.", "cmd")
+	commandDuration = metrics.NewHistogramVec("godis_command_duration_seconds",
+		"Latency of commands dispatched by server, including waiting for key locks.", nil, "cmd")
+)
+
+// unknownCmdLabel 不在命令表中的命令统一使用的标签，防止客户端乱发命令导致指标基数膨胀
+const unknownCmdLabel = "unknown"
+
+func recordCommand(cmdName string, result redis.Reply, cost time.Duration) {
+	if _, ok := systemCommandTable[cmdName]; !ok && !engine.IsCommand(cmdName) {
+		cmdName = unknownCmdLabel
+	}
+	if result != nil && protocol.IsErrorReply(result) {
+		commandErrors.WithLabelValues(cmdName).Inc()
+	}
+	commandCalls.WithLabelValues(cmdName).Inc()
+	commandDuration.WithLabelValues(cmdName).ObserveDuration(cost)
+}
+
+// registerKeyspaceMetrics exports number of keys of each db, collected on scrape
+func (s *Server) registerKeyspaceMetrics() {
+	metrics.NewGaugeVecFunc("godis_db_keys", "Number of keys in each db.", []string{"db"},
+		func(emit func(float64, ...string)) {
+			for i := range s.dbSet {
+				keys, _ := s.mustSelectDB(i).GetDBSize()
+				emit(float64(keys), strconv.Itoa(i))
+			}
+		})
+	metrics.NewGaugeVecFunc("godis_db_expires", "Number of keys with an expiration in each db.", []string{"db"},
+		func(emit func(float64, ...string)) {
+			for i := range s.dbSet {
+				_, expires := s.mustSelectDB(i).GetDBSize()
+				emit(float64(expires), strconv.Itoa(i))
+			}
+		})
+}
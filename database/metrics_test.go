@@ -0,0 +1,32 @@
+package database
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"godis/lib/metrics"
+	"godis/redis/protocol"
+)
+
+func TestRecordCommandLabel(t *testing.T) {
+	recordCommand("get", protocol.MakeNullBulkReply(), time.Millisecond)
+	recordCommand("no-such-cmd", protocol.MakeErrReply("NOAUTH Authentication required"), time.Millisecond)
+	recordCommand("bad-arity", protocol.MakeArgNumErrReply("bad-arity"), time.Millisecond)
+
+	var buf bytes.Buffer
+	if _, err := metrics.DefaultRegistry.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	if !strings.Contains(out, `godis_commands_total{cmd="get"}`) {
+		t.Error("expect label of known command")
+	}
+	if strings.Contains(out, "no-such-cmd") || strings.Contains(out, "bad-arity") {
+		t.Error("unknown command names should not be used as labels")
+	}
+	if !strings.Contains(out, `godis_command_errors_total{cmd="unknown"}`) {
+		t.Error("expect errors of unknown commands to be counted")
+	}
+}
@@ -4,13 +4,16 @@ import (
 	"godis/config"
 	"godis/database/aof"
 	"godis/database/engine"
+	"godis/database/script"
 	"godis/interface/database"
 	"sync/atomic"
 )
 
 func MakeAuxiliaryServer() database.DBEngine {
-	mdb := &Server{}
-	mdb.dbSet = make([]*atomic.Value, config.Properties.Databases)
+	mdb := &Server{
+		functions: script.NewFunctions(),
+	}
+	mdb.dbSet = make([]*atomic.Value, config.Properties().Databases)
 	for i := range mdb.dbSet {
 		db := engine.MakeBasicDB()
 		holder := &atomic.Value{}
@@ -24,10 +27,9 @@ func (s *Server) bindPersister(aofPersister *aof.Persister) {
 	s.AofPersister = aofPersister
 	for _, db := range s.dbSet {
 		singleDB := db.Load().(*engine.DB)
-		singleDB.SetAddAof(func(line engine.CmdLine) {
-			if config.Properties.AppendOnly {
-				// todo 处理TTL命令
-				aofPersister.SaveCmdLine(singleDB.GetIndex(), line)
+		singleDB.SetAddAof(func(lines ...engine.CmdLine) {
+			if config.Properties().AppendOnly {
+				aofPersister.SaveCmdLine(singleDB.GetIndex(), lines...)
 			}
 		})
 	}
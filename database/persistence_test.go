@@ -0,0 +1,403 @@
+package database
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"godis/config"
+	"godis/database/aof"
+	"godis/database/engine"
+	"godis/database/script"
+	"godis/interface/redis"
+	"godis/lib/utils"
+	"godis/redis/connection"
+)
+
+// withAofConfig 在测试期间使用开启了 AOF 的配置副本，set 修改其他配置项，测试结束后恢复原来的配置
+func withAofConfig(t *testing.T, set func(properties *config.ServerProperties)) {
+	old := config.Properties()
+	properties := *old
+	properties.AppendOnly = true
+	if set != nil {
+		set(&properties)
+	}
+	config.SetProperties(&properties)
+	t.Cleanup(func() { config.SetProperties(old) })
+}
+
+func openTestAof(t *testing.T, dir string, filename string) *Server {
+	s := MakeAuxiliaryServer().(*Server)
+	for i, holder := range s.dbSet {
+		holder.Load().(*engine.DB).SetIndex(i)
+	}
+	persister, err := aof.NewPersister(s, dir, filename, true, aof.FsyncAlways, MakeAuxiliaryServer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.bindPersister(persister)
+	return s
+}
+
+func execString(s *Server, c redis.Connection, args ...string) string {
+	return string(s.Exec(c, utils.ToCmdLine(args...)).ToBytes())
+}
+
+func TestMultiPartAof(t *testing.T) {
+	withAofConfig(t, nil)
+
+	tmp := t.TempDir()
+	dir := filepath.Join(tmp, "appendonlydir")
+	legacy := filepath.Join(tmp, "dump.aof")
+	if err := os.WriteFile(legacy, []byte("*3\r\n$3\r\nSET\r\n$1\r\na\r\n$1\r\n1\r\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// 旧版本的 AOF 文件被移动到目录中作为 base 文件
+	s := openTestAof(t, dir, legacy)
+	if _, err := os.Stat(legacy); !os.IsNotExist(err) {
+		t.Error("expect legacy aof to be moved")
+	}
+	c := connection.NewFakeConn()
+	if r := execString(s, c, "GET", "a"); r != "$1\r\n1\r\n" {
+		t.Errorf("legacy aof is not loaded: %q", r)
+	}
+	execString(s, c, "SELECT", "1")
+	execString(s, c, "SET", "b", "2")
+
+	if err := s.AofPersister.Rewrite(nil, &atomic.Bool{}); err != nil {
+		t.Fatal(err)
+	}
+	execString(s, c, "SET", "c", "3")
+	s.AofPersister.Close()
+
+	manifest, err := os.ReadFile(filepath.Join(dir, "dump.aof.manifest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "file dump.aof.2.base.aof seq 2 type b\nfile dump.aof.2.incr.aof seq 2 type i\n"
+	if string(manifest) != expected {
+		t.Errorf("unexpected manifest %q", manifest)
+	}
+	entries, _ := os.ReadDir(dir)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if strings.Join(names, ",") != "dump.aof.2.base.aof,dump.aof.2.incr.aof,dump.aof.manifest" {
+		t.Errorf("old aof files are not removed: %v", names)
+	}
+
+	// 按 manifest 的顺序回放，incr 文件中的 SELECT 生效
+	s = openTestAof(t, dir, legacy)
+	defer s.AofPersister.Close()
+	c = connection.NewFakeConn()
+	if r := execString(s, c, "GET", "a"); r != "$1\r\n1\r\n" {
+		t.Errorf("unexpected a: %q", r)
+	}
+	execString(s, c, "SELECT", "1")
+	if r := execString(s, c, "GET", "b"); r != "$1\r\n2\r\n" {
+		t.Errorf("unexpected b: %q", r)
+	}
+	if r := execString(s, c, "GET", "c"); r != "$1\r\n3\r\n" {
+		t.Errorf("unexpected c: %q", r)
+	}
+}
+
+// TestUpgradeInterrupted manifest 已经写入但旧文件还没有移动时宕机，重启后继续移动并加载旧文件
+func TestUpgradeInterrupted(t *testing.T) {
+	withAofConfig(t, nil)
+
+	tmp := t.TempDir()
+	dir := filepath.Join(tmp, "appendonlydir")
+	legacy := filepath.Join(tmp, "dump.aof")
+	if err := os.WriteFile(legacy, []byte("*3\r\n$3\r\nSET\r\n$1\r\na\r\n$1\r\n1\r\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "dump.aof.manifest"), []byte("file dump.aof seq 1 type b\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := openTestAof(t, dir, legacy)
+	defer s.AofPersister.Close()
+	if _, err := os.Stat(legacy); !os.IsNotExist(err) {
+		t.Error("expect legacy aof to be moved")
+	}
+	if r := execString(s, connection.NewFakeConn(), "GET", "a"); r != "$1\r\n1\r\n" {
+		t.Errorf("legacy aof is not loaded: %q", r)
+	}
+}
+
+// TestScriptAof 脚本的多条写命令使用 MULTI/EXEC 包裹，重放时作为整体执行
+func TestScriptAof(t *testing.T) {
+	withAofConfig(t, nil)
+
+	dir := t.TempDir()
+	s := openTestAof(t, dir, "dump.aof")
+	s.scripts = script.NewCache()
+	c := connection.NewFakeConn()
+	execString(s, c, "EVAL", "redis.call('SET', KEYS[1], 'a') redis.call('SETEX', KEYS[2], 100, 'b')", "2", "x", "y")
+	execString(s, c, "EVAL", "return redis.call('SET', KEYS[1], 'c')", "1", "z")
+	execString(s, c, "EVAL", "return redis.call('GET', KEYS[1])", "1", "x")
+	s.AofPersister.Close()
+
+	data, err := os.ReadFile(filepath.Join(dir, "dump.aof.1.incr.aof"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := string(data)
+	multi, exec := strings.Index(content, "MULTI"), strings.Index(content, "EXEC")
+	if strings.Count(content, "MULTI") != 1 || multi < 0 || exec < 0 ||
+		!strings.Contains(content[multi:exec], "$1\r\nx\r\n") || !strings.Contains(content[multi:exec], "PEXPIREAT") {
+		t.Fatalf("writes of the script should be wrapped in MULTI/EXEC: %q", content)
+	}
+	if !strings.Contains(content[exec:], "$1\r\nz\r\n") {
+		t.Errorf("unexpected aof %q", content)
+	}
+
+	s = openTestAof(t, dir, "dump.aof")
+	defer s.AofPersister.Close()
+	for key, value := range map[string]string{"x": "a", "y": "b", "z": "c"} {
+		if r := execString(s, c, "GET", key); r != "$1\r\n"+value+"\r\n" {
+			t.Errorf("unexpected %s: %q", key, r)
+		}
+	}
+	db, _ := s.selectDB(0)
+	if _, ok := db.TTLMap().Get("y"); !ok {
+		t.Error("ttl of y is lost")
+	}
+}
+
+func TestLoadTruncatedAof(t *testing.T) {
+	withAofConfig(t, nil)
+
+	dir := t.TempDir()
+	s := openTestAof(t, dir, "dump.aof")
+	c := connection.NewFakeConn()
+	execString(s, c, "SET", "a", "1")
+	s.AofPersister.Close()
+
+	// 模拟写入一半时宕机
+	incr := filepath.Join(dir, "dump.aof.1.incr.aof")
+	file, err := os.OpenFile(incr, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = file.WriteString("*3\r\n$3\r\nSET\r\n$1\r\nb\r\n$1")
+	_ = file.Close()
+	size := utils.GetFileSizeByName(incr)
+
+	config.Properties().AofLoadTruncated = false
+	if _, err := aof.NewPersister(MakeAuxiliaryServer(), dir, "dump.aof", true, aof.FsyncAlways, MakeAuxiliaryServer); err == nil {
+		t.Fatal("expect truncated aof to be refused")
+	}
+	if utils.GetFileSizeByName(incr) != size {
+		t.Error("aof should not be modified when refused")
+	}
+
+	config.Properties().AofLoadTruncated = true
+	s = openTestAof(t, dir, "dump.aof")
+	defer s.AofPersister.Close()
+	if r := execString(s, c, "GET", "a"); r != "$1\r\n1\r\n" {
+		t.Errorf("unexpected a: %q", r)
+	}
+	if r := execString(s, c, "GET", "b"); r != "$-1\r\n" {
+		t.Errorf("half written command should not be applied: %q", r)
+	}
+	if result, err := aof.CheckFile(incr); err != nil || !result.Valid() {
+		t.Errorf("truncated tail is not removed: %+v %v", result, err)
+	}
+}
+
+func TestAofTimestamp(t *testing.T) {
+	withAofConfig(t, func(properties *config.ServerProperties) {
+		properties.AofTimestampEnabled = true
+	})
+
+	dir := t.TempDir()
+	s := openTestAof(t, dir, "dump.aof")
+	c := connection.NewFakeConn()
+	execString(s, c, "SET", "a", "1")
+	execString(s, c, "SET", "b", "2")
+	s.AofPersister.Close()
+
+	incr := filepath.Join(dir, "dump.aof.1.incr.aof")
+	data, err := os.ReadFile(incr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), "#TS:") || strings.Count(string(data), "#TS:") > 2 {
+		t.Errorf("unexpected timestamp annotations: %q", data)
+	}
+
+	// 模拟一小时后的误操作
+	later := time.Now().Unix() + 3600
+	file, err := os.OpenFile(incr, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = file.WriteString("#TS:" + strconv.FormatInt(later, 10) + "\r\n*2\r\n$3\r\nDEL\r\n$1\r\na\r\n")
+	_ = file.Close()
+
+	// 注释在加载时被跳过
+	s = openTestAof(t, dir, "dump.aof")
+	if r := execString(s, c, "GET", "a"); r != "$-1\r\n" {
+		t.Errorf("unexpected a: %q", r)
+	}
+	s.AofPersister.Close()
+
+	truncated, err := aof.TruncateToTimestamp(filepath.Join(dir, "dump.aof.manifest"), later-1)
+	if err != nil || !truncated {
+		t.Fatalf("truncate to timestamp failed: %v %v", truncated, err)
+	}
+	s = openTestAof(t, dir, "dump.aof")
+	defer s.AofPersister.Close()
+	if r := execString(s, c, "GET", "a"); r != "$1\r\n1\r\n" {
+		t.Errorf("commands after timestamp should be dropped: %q", r)
+	}
+	if r := execString(s, c, "GET", "b"); r != "$1\r\n2\r\n" {
+		t.Errorf("unexpected b: %q", r)
+	}
+}
+
+func TestCompressedAof(t *testing.T) {
+	for _, compression := range []string{"gzip", "zstd"} {
+		t.Run(compression, func(t *testing.T) {
+			withAofConfig(t, func(properties *config.ServerProperties) {
+				properties.AofChecksum = true
+				properties.AofRewriteCompression = compression
+			})
+
+			dir := t.TempDir()
+			s := openTestAof(t, dir, "dump.aof")
+			c := connection.NewFakeConn()
+			execString(s, c, "SET", "a", "1")
+			execString(s, c, "RPUSH", "list", "a", "b", "c")
+			if err := s.AofPersister.Rewrite(nil, &atomic.Bool{}); err != nil {
+				t.Fatal(err)
+			}
+			execString(s, c, "SET", "b", "2")
+			s.AofPersister.Close()
+
+			result, err := aof.CheckFile(filepath.Join(dir, "dump.aof.1.base.aof"))
+			if err != nil || !result.Valid() || !result.Compressed || !result.Checksum {
+				t.Fatalf("unexpected base file: %+v %v", result, err)
+			}
+
+			// 关闭压缩后依然能够加载压缩的 base 文件
+			config.Properties().AofRewriteCompression = "no"
+			s = openTestAof(t, dir, "dump.aof")
+			defer s.AofPersister.Close()
+			if r := execString(s, c, "LRANGE", "list", "0", "-1"); r != "*3\r\n$1\r\na\r\n$1\r\nb\r\n$1\r\nc\r\n" {
+				t.Errorf("unexpected list: %q", r)
+			}
+			if r := execString(s, c, "GET", "b"); r != "$1\r\n2\r\n" {
+				t.Errorf("unexpected b: %q", r)
+			}
+		})
+	}
+}
+
+func TestEncryptedAof(t *testing.T) {
+	withAofConfig(t, func(properties *config.ServerProperties) {
+		properties.AofRewriteCompression = "gzip"
+	})
+	t.Cleanup(func() { _ = aof.LoadKeyFile("") })
+
+	tmp := t.TempDir()
+	dir := filepath.Join(tmp, "appendonlydir")
+	keyFile := filepath.Join(tmp, "aof.key")
+	key1 := strings.Repeat("01", 32)
+	key2 := strings.Repeat("02", 32)
+	if err := os.WriteFile(keyFile, []byte(key1+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// 开启加密前写入的明文文件不再追加，重写后被删除
+	s := openTestAof(t, dir, "dump.aof")
+	c := connection.NewFakeConn()
+	execString(s, c, "SET", "p", "plain-secret")
+	s.AofPersister.Close()
+
+	config.Properties().AofEncryptionKeyFile = keyFile
+	s = openTestAof(t, dir, "dump.aof")
+	execString(s, c, "SET", "a", "secret-value")
+	s.AofPersister.Close()
+	if _, err := os.Stat(filepath.Join(dir, "dump.aof.2.incr.aof")); err != nil {
+		t.Errorf("expect a new incr file after enabling encryption: %v", err)
+	}
+
+	// 重新打开后继续追加到同一个文件
+	s = openTestAof(t, dir, "dump.aof")
+	execString(s, c, "SET", "b", "another-secret")
+
+	// 轮换密钥，重写后所有文件都使用新的密钥
+	if err := os.WriteFile(keyFile, []byte(key1+"\n"+key2+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AofPersister.Rewrite(nil, &atomic.Bool{}); err != nil {
+		t.Fatal(err)
+	}
+	execString(s, c, "SET", "c", "third-secret")
+	s.AofPersister.Close()
+
+	entries, _ := os.ReadDir(dir)
+	for _, entry := range entries {
+		data, _ := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if strings.Contains(string(data), "secret") {
+			t.Errorf("plaintext is found in %s", entry.Name())
+		}
+	}
+
+	// 删除旧的密钥后依然可以加载
+	if err := os.WriteFile(keyFile, []byte(key2+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s = openTestAof(t, dir, "dump.aof")
+	defer s.AofPersister.Close()
+	for key, value := range map[string]string{"p": "plain-secret", "a": "secret-value", "b": "another-secret", "c": "third-secret"} {
+		if r := execString(s, c, "GET", key); r != "$"+strconv.Itoa(len(value))+"\r\n"+value+"\r\n" {
+			t.Errorf("unexpected %s: %q", key, r)
+		}
+	}
+}
+
+// TestEncryptedShutdownSave godis 没有 RDB，SHUTDOWN SAVE 的快照是重写生成的 base 文件，同样被加密
+func TestEncryptedShutdownSave(t *testing.T) {
+	tmp := t.TempDir()
+	keyFile := filepath.Join(tmp, "aof.key")
+	if err := os.WriteFile(keyFile, []byte(strings.Repeat("01", 32)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	withAofConfig(t, func(properties *config.ServerProperties) {
+		properties.AofEncryptionKeyFile = keyFile
+	})
+	t.Cleanup(func() { _ = aof.LoadKeyFile("") })
+
+	dir := filepath.Join(tmp, "appendonlydir")
+	s := openTestAof(t, dir, "dump.aof")
+	execString(s, connection.NewFakeConn(), "SET", "a", "secret-value")
+	if !s.saveBeforeShutdown() {
+		t.Fatal("shutdown save failed")
+	}
+	s.AofPersister.Close()
+
+	result, err := aof.CheckFile(filepath.Join(dir, "dump.aof.1.base.aof"))
+	if err != nil || !result.Valid() || !result.Encrypted || result.Commands == 0 {
+		t.Fatalf("unexpected snapshot: %+v %v", result, err)
+	}
+	entries, _ := os.ReadDir(dir)
+	for _, entry := range entries {
+		data, _ := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if strings.Contains(string(data), "secret") {
+			t.Errorf("plaintext is found in %s", entry.Name())
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package database
 
 import (
+	"godis/database/publish"
 	"godis/interface/redis"
 	"godis/redis/protocol"
 )
@@ -34,6 +35,14 @@ func Publish(s *Server, args [][]byte) redis.Reply {
 func UnSubscribe(s *Server, client redis.Connection, args [][]byte) redis.Reply {
 	var names []string
 
+	if len(args) == 0 && client.GetSubscribeNum() == 0 {
+		// 没有订阅任何管道时 redis 回复 channel 为 nil 的退订消息
+		return protocol.MakePushReply([]redis.Reply{
+			protocol.MakeBulkReply([]byte(publish.UnsubscribeHeader)),
+			protocol.MakeNullBulkReply(),
+			protocol.MakeIntReply(0),
+		})
+	}
 	if len(args) == 0 {
 		names = make([]string, client.GetSubscribeNum())
 
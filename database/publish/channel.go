@@ -3,6 +3,7 @@ package publish
 import (
 	"godis/interface/redis"
 	"godis/lib/sync/wait"
+	"godis/redis/protocol"
 	"sync"
 	"time"
 )
@@ -41,28 +42,30 @@ func newChannel(name string) *channel {
 func (c *channel) publish(message []byte) int {
 	c.mu.Lock()
 	result := c.subscriberNum
+	c.mu.Unlock()
 	if result == 0 {
 		return result
 	}
-	c.mu.Unlock()
 
 	c.messageCh <- message
 
 	return result
 }
 
-// 删除一个订阅者
-func (c *channel) deleteSubscriber(client redis.Connection) {
+// 删除一个订阅者，notify 为 false 时不发送退订消息，用于连接关闭时
+func (c *channel) deleteSubscriber(client redis.Connection, notify bool) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	delete(c.subscribers, client)
-	c.subscriberNum--
+	if _, ok := c.subscribers[client]; ok {
+		delete(c.subscribers, client)
+		c.subscriberNum--
+	}
 
 	client.CancelSubscribeChannel(c.name)
-	code := client.GetSubscribeNum()
-
-	_, _ = client.Write(makeMsg(UnsubscribeHeader, c.name, code))
+	if notify {
+		_, _ = client.Write(makeMsg(client, UnsubscribeHeader, c.name, client.GetSubscribeNum()))
+	}
 }
 
 func (c *channel) close() {
@@ -74,13 +77,15 @@ func (c *channel) addSubscriber(client redis.Connection) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	c.subscribers[client] = struct{}{}
-	c.subscriberNum++
+	if _, ok := c.subscribers[client]; !ok { // 重复订阅只回复确认消息
+		c.subscribers[client] = struct{}{}
+		c.subscriberNum++
+	}
 
 	client.AddSubscribeChannel(c.name)
 	code := client.GetSubscribeNum()
 
-	_, _ = client.Write(makeMsg(UnsubscribeHeader, c.name, code))
+	_, _ = client.Write(makeMsg(client, SubscribeHeader, c.name, code))
 }
 
 // 循环从c.messageCh消息管道中取出消息，然后进行发送
@@ -108,14 +113,24 @@ func (c *channel) doSend(message []byte) {
 	// 发送订阅消息
 	c.wait.Add(len(subscribers))
 	for _, subscriber := range subscribers {
-		_, _ = subscriber.Write(makeMsg(MessageHeader, c.name, message))
+		_, _ = subscriber.Write(makeMsg(subscriber, MessageHeader, c.name, message))
 		c.wait.Done()
 	}
 }
 
-func makeMsg(header string, name string, value interface{}) []byte {
-	//todo
-	var msg []byte
-
-	return msg
+// makeMsg 生成 [header, channel, value] 消息，RESP3 客户端收到的是 push 类型
+func makeMsg(client redis.Connection, header string, name string, value interface{}) []byte {
+	var last redis.Reply
+	switch v := value.(type) {
+	case int:
+		last = protocol.MakeIntReply(int64(v))
+	case []byte:
+		last = protocol.MakeBulkReply(v)
+	}
+	msg := protocol.MakePushReply([]redis.Reply{
+		protocol.MakeBulkReply([]byte(header)),
+		protocol.MakeBulkReply([]byte(name)),
+		last,
+	})
+	return protocol.Encode(msg, client.GetProtocol())
 }
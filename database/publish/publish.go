@@ -11,6 +11,8 @@ type Publish struct {
 }
 
 func (p *Publish) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 	for _, c := range p.channels {
 		c.close()
 	}
@@ -31,7 +33,7 @@ func (pub *Publish) Subscribe(client redis.Connection, names ...string) {
 
 		c, ok := pub.channels[name]
 		if !ok {
-			c := newChannel(name)
+			c = newChannel(name)
 			go c.loopSendMessage()
 			pub.channels[name] = c
 		}
@@ -60,12 +62,30 @@ func (pub *Publish) UnSubscribe(client redis.Connection, names ...string) {
 	for _, name := range names {
 		c, ok := pub.channels[name]
 		if !ok {
+			// 没有订阅过的管道也要回复退订消息
+			_, _ = client.Write(makeMsg(client, UnsubscribeHeader, name, client.GetSubscribeNum()))
 			continue
 		}
-		c.deleteSubscriber(client)
-		if c.subscriberNum <= 0 {
-			c.close()
-			delete(pub.channels, name)
+		pub.removeSubscriber(c, client, true)
+	}
+}
+
+// Remove unsubscribes client from all channels silently, used when the connection is closed
+func (pub *Publish) Remove(client redis.Connection) {
+	pub.mu.Lock()
+	defer pub.mu.Unlock()
+
+	for _, name := range client.GetSubscribes() {
+		if c, ok := pub.channels[name]; ok {
+			pub.removeSubscriber(c, client, false)
 		}
 	}
 }
+
+func (pub *Publish) removeSubscriber(c *channel, client redis.Connection, notify bool) {
+	c.deleteSubscriber(client, notify)
+	if c.subscriberNum <= 0 {
+		c.close()
+		delete(pub.channels, c.name)
+	}
+}
@@ -0,0 +1,480 @@
+package script
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"sort"
+	"strings"
+	"sync"
+
+	"godis/interface/redis"
+	"godis/lib/wildcard"
+	"godis/redis/protocol"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// 函数的 flags，与 redis 保持一致
+const (
+	FlagNoWrites           = "no-writes"
+	FlagAllowOOM           = "allow-oom"
+	FlagAllowStale         = "allow-stale"
+	FlagNoCluster          = "no-cluster"
+	FlagAllowCrossSlotKeys = "allow-cross-slot-keys"
+)
+
+var validFlags = map[string]struct{}{
+	FlagNoWrites:           {},
+	FlagAllowOOM:           {},
+	FlagAllowStale:         {},
+	FlagNoCluster:          {},
+	FlagAllowCrossSlotKeys: {},
+}
+
+// Function is a function registered by redis.register_function
+type Function struct {
+	Name        string
+	Description string
+	Flags       []string
+	Library     *Library
+}
+
+// ReadOnly returns whether the function declares no-writes flag, only read-only functions can be called by FCALL_RO
+func (f *Function) ReadOnly() bool {
+	for _, flag := range f.Flags {
+		if flag == FlagNoWrites {
+			return true
+		}
+	}
+	return false
+}
+
+// Library is a lua library loaded by FUNCTION LOAD, each library has its own pool of lua VMs
+// in which the library code has been executed, so functions of one library can run concurrently
+type Library struct {
+	Name      string
+	Code      string
+	Functions []*Function // 按照注册的顺序
+	body      *lua.FunctionProto
+	pool      sync.Pool
+}
+
+// libraryVM 是一个已经执行过库代码的虚拟机
+type libraryVM struct {
+	*vm
+	callbacks map[string]*lua.LFunction
+}
+
+// registration 收集 FUNCTION LOAD 时库代码注册的函数
+type registration struct {
+	functions []*Function
+	callbacks map[string]*lua.LFunction
+}
+
+// parseShebang parses the first line of library code: #!lua name=<library name>
+func parseShebang(code string) (string, error) {
+	if !strings.HasPrefix(code, "#!") {
+		return "", errors.New("Missing library metadata")
+	}
+	line := code
+	if i := strings.IndexByte(code, '\n'); i >= 0 {
+		line = code[:i]
+	}
+	fields := strings.Fields(strings.TrimSpace(line[2:]))
+	if len(fields) == 0 || fields[0] != "lua" {
+		engine := ""
+		if len(fields) > 0 {
+			engine = fields[0]
+		}
+		return "", errors.New("Engine '" + engine + "' not found")
+	}
+	var name string
+	for _, field := range fields[1:] {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok || key != "name" {
+			return "", errors.New("Invalid metadata value given: " + field)
+		}
+		name = value
+	}
+	if name == "" {
+		return "", errors.New("Library name was not given")
+	}
+	if !isValidName(name) {
+		return "", errors.New("Library names can only contain letters, numbers, or underscores(_) and must be at least one character long")
+	}
+	return name, nil
+}
+
+func isValidName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, ch := range name {
+		if !(ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch >= '0' && ch <= '9' || ch == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// LoadLibrary compiles code and runs it to collect registered functions
+func LoadLibrary(code string) (*Library, error) {
+	name, err := parseShebang(code)
+	if err != nil {
+		return nil, err
+	}
+	// 去掉 shebang 但保留换行，使错误信息中的行号不变
+	body := code
+	if i := strings.IndexByte(code, '\n'); i >= 0 {
+		body = code[i:]
+	} else {
+		body = ""
+	}
+	proto, err := compile(body)
+	if err != nil {
+		return nil, err
+	}
+	lib := &Library{
+		Name: name,
+		Code: code,
+		body: proto,
+	}
+	lv, reg, err := lib.newVM()
+	if err != nil {
+		return nil, err
+	}
+	if len(reg.functions) == 0 {
+		return nil, errors.New("No functions registered")
+	}
+	for _, fn := range reg.functions {
+		fn.Library = lib
+	}
+	lib.Functions = reg.functions
+	lib.pool.New = func() interface{} {
+		lv, _, err := lib.newVM()
+		if err != nil {
+			return nil
+		}
+		return lv
+	}
+	lib.pool.Put(lv)
+	return lib, nil
+}
+
+// newVM runs library code in a new VM, redis.call is not allowed while loading
+func (lib *Library) newVM() (*libraryVM, *registration, error) {
+	v := newVM()
+	reg := &registration{callbacks: make(map[string]*lua.LFunction)}
+	v.registry = reg
+	defer func() {
+		v.registry = nil
+	}()
+	L := v.L
+	L.Push(L.NewFunctionFromProto(lib.body))
+	if err := L.PCall(0, 0, nil); err != nil {
+		return nil, nil, errors.New(errorMessage(err))
+	}
+	// 库代码执行之后的状态是每次调用函数的初始状态
+	v.saveState()
+	return &libraryVM{vm: v, callbacks: reg.callbacks}, reg, nil
+}
+
+// registerFunction redis.register_function(name, callback) or
+// redis.register_function{function_name=name, callback=callback, flags={...}, description=...}
+func (v *vm) registerFunction(L *lua.LState) int {
+	if v.registry == nil {
+		L.RaiseError("redis.register_function can only be called on FUNCTION LOAD command")
+		return 0
+	}
+	fn := &Function{}
+	var callback *lua.LFunction
+	switch arg := L.Get(1).(type) {
+	case lua.LString:
+		if L.GetTop() != 2 {
+			L.RaiseError("wrong number of arguments to redis.register_function")
+		}
+		fn.Name = string(arg)
+		callback, _ = L.Get(2).(*lua.LFunction)
+	case *lua.LTable:
+		if L.GetTop() != 1 {
+			L.RaiseError("wrong number of arguments to redis.register_function")
+		}
+		var failed string
+		arg.ForEach(func(key lua.LValue, value lua.LValue) {
+			switch key.String() {
+			case "function_name":
+				fn.Name = value.String()
+			case "callback":
+				callback, _ = value.(*lua.LFunction)
+			case "description":
+				fn.Description = value.String()
+			case "flags":
+				flags, ok := value.(*lua.LTable)
+				if !ok {
+					failed = "flags argument to redis.register_function must be a table representing function flags"
+					return
+				}
+				flags.ForEach(func(_ lua.LValue, flag lua.LValue) {
+					if _, ok := validFlags[flag.String()]; !ok {
+						failed = "unknown flag given"
+						return
+					}
+					fn.Flags = append(fn.Flags, flag.String())
+				})
+			default:
+				failed = "unknown argument given to redis.register_function"
+			}
+		})
+		if failed != "" {
+			L.RaiseError(failed)
+		}
+	default:
+		L.RaiseError("calling redis.register_function with a single argument is only applicable to Lua table (representing named arguments).")
+	}
+	if !isValidName(fn.Name) {
+		L.RaiseError("Function names can only contain letters, numbers, or underscores(_) and must be at least one character long")
+	}
+	if callback == nil {
+		L.RaiseError("callback argument given to redis.register_function must be a function")
+	}
+	if _, ok := v.registry.callbacks[fn.Name]; ok {
+		L.RaiseError("Function already exists in the library")
+	}
+	v.registry.callbacks[fn.Name] = callback
+	v.registry.functions = append(v.registry.functions, fn)
+	return 0
+}
+
+// Call runs function name of the library with KEYS and ARGV passed as arguments,
+// the function is aborted when ctx is cancelled or its deadline is exceeded
+func (lib *Library) Call(ctx context.Context, name string, keys [][]byte, args [][]byte, call CallFunc) redis.Reply {
+	lv, ok := lib.pool.Get().(*libraryVM)
+	if !ok {
+		return protocol.MakeErrReply("ERR failed to load library " + lib.Name)
+	}
+	defer func() {
+		lv.release()
+		lib.pool.Put(lv)
+	}()
+	callback, ok := lv.callbacks[name]
+	if !ok {
+		return protocol.MakeErrReply("ERR Function not found")
+	}
+	lv.call = call
+	L := lv.L
+	L.Push(callback)
+	L.Push(bytesToTable(L, keys))
+	L.Push(bytesToTable(L, args))
+	if err := lv.pcall(ctx, 2); err != nil {
+		return errorToReply(err, "script: "+name+", on "+lib.Name)
+	}
+	return luaToReply(L.Get(-1))
+}
+
+// Functions stores function libraries, libraries are replaced as a whole
+type Functions struct {
+	mu        sync.RWMutex
+	libraries map[string]*Library
+	functions map[string]*Function
+}
+
+func NewFunctions() *Functions {
+	return &Functions{
+		libraries: make(map[string]*Library),
+		functions: make(map[string]*Function),
+	}
+}
+
+// Load loads library code, returns name of the library
+func (f *Functions) Load(code string, replace bool) (string, error) {
+	lib, err := LoadLibrary(code)
+	if err != nil {
+		return "", err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.add(lib, replace); err != nil {
+		return "", err
+	}
+	return lib.Name, nil
+}
+
+// add 检查库名和函数名冲突后加入库，调用者需持有写锁
+func (f *Functions) add(lib *Library, replace bool) error {
+	old, exists := f.libraries[lib.Name]
+	if exists && !replace {
+		return errors.New("Library '" + lib.Name + "' already exists")
+	}
+	for _, fn := range lib.Functions {
+		if other, ok := f.functions[fn.Name]; ok && other.Library != old {
+			return errors.New("Function " + fn.Name + " already exists")
+		}
+	}
+	if exists {
+		f.remove(old)
+	}
+	f.libraries[lib.Name] = lib
+	for _, fn := range lib.Functions {
+		f.functions[fn.Name] = fn
+	}
+	return nil
+}
+
+func (f *Functions) remove(lib *Library) {
+	delete(f.libraries, lib.Name)
+	for _, fn := range lib.Functions {
+		delete(f.functions, fn.Name)
+	}
+}
+
+// Delete removes a library and all its functions
+func (f *Functions) Delete(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	lib, ok := f.libraries[name]
+	if !ok {
+		return errors.New("Library not found")
+	}
+	f.remove(lib)
+	return nil
+}
+
+// Flush removes all libraries
+func (f *Functions) Flush() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.libraries = make(map[string]*Library)
+	f.functions = make(map[string]*Function)
+}
+
+// GetFunction finds a function by name
+func (f *Functions) GetFunction(name string) (*Function, bool) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	fn, ok := f.functions[name]
+	return fn, ok
+}
+
+// List returns libraries whose name matches pattern sorted by name, empty pattern matches all
+func (f *Functions) List(pattern string) []*Library {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	libs := make([]*Library, 0, len(f.libraries))
+	for name, lib := range f.libraries {
+		if pattern == "" || wildcard.Match(pattern, name) {
+			libs = append(libs, lib)
+		}
+	}
+	sort.Slice(libs, func(i, j int) bool {
+		return libs[i].Name < libs[j].Name
+	})
+	return libs
+}
+
+// Codes returns code of all libraries, which is used to rewrite aof
+func (f *Functions) Codes() []string {
+	libs := f.List("")
+	codes := make([]string, len(libs))
+	for i, lib := range libs {
+		codes[i] = lib.Code
+	}
+	return codes
+}
+
+// 函数的序列化格式: magic | version | 库的数量 | (代码长度 | 代码)... | crc32
+const (
+	dumpMagic   = "GFN"
+	dumpVersion = 1
+)
+
+var ErrBadPayload = errors.New("payload version or checksum are wrong")
+
+// Dump serializes all libraries, the payload can be loaded by Restore
+func (f *Functions) Dump() []byte {
+	codes := f.Codes()
+	var buf bytes.Buffer
+	buf.WriteString(dumpMagic)
+	buf.WriteByte(dumpVersion)
+	buf.Write(binary.AppendUvarint(nil, uint64(len(codes))))
+	for _, code := range codes {
+		buf.Write(binary.AppendUvarint(nil, uint64(len(code))))
+		buf.WriteString(code)
+	}
+	return binary.BigEndian.AppendUint32(buf.Bytes(), crc32.ChecksumIEEE(buf.Bytes()))
+}
+
+func parseDump(payload []byte) ([]string, error) {
+	if len(payload) < len(dumpMagic)+1+4 || string(payload[:len(dumpMagic)]) != dumpMagic ||
+		payload[len(dumpMagic)] != dumpVersion {
+		return nil, ErrBadPayload
+	}
+	body, sum := payload[:len(payload)-4], payload[len(payload)-4:]
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(sum) {
+		return nil, ErrBadPayload
+	}
+	reader := bytes.NewReader(body[len(dumpMagic)+1:])
+	count, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return nil, ErrBadPayload
+	}
+	codes := make([]string, 0, count)
+	for i := uint64(0); i < count; i++ {
+		size, err := binary.ReadUvarint(reader)
+		if err != nil || size > uint64(reader.Len()) {
+			return nil, ErrBadPayload
+		}
+		code := make([]byte, size)
+		_, _ = reader.Read(code)
+		codes = append(codes, string(code))
+	}
+	return codes, nil
+}
+
+// restore policies of FUNCTION RESTORE
+const (
+	RestoreAppend  = "append"
+	RestoreReplace = "replace"
+	RestoreFlush   = "flush"
+)
+
+// Restore loads libraries in payload created by Dump, nothing is changed if any library fails to load
+func (f *Functions) Restore(payload []byte, policy string) error {
+	codes, err := parseDump(payload)
+	if err != nil {
+		return err
+	}
+	libs := make([]*Library, 0, len(codes))
+	for _, code := range codes {
+		lib, err := LoadLibrary(code)
+		if err != nil {
+			return err
+		}
+		libs = append(libs, lib)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	restored := &Functions{
+		libraries: make(map[string]*Library),
+		functions: make(map[string]*Function),
+	}
+	if policy != RestoreFlush {
+		for name, lib := range f.libraries {
+			restored.libraries[name] = lib
+		}
+		for name, fn := range f.functions {
+			restored.functions[name] = fn
+		}
+	}
+	for _, lib := range libs {
+		if err := restored.add(lib, policy == RestoreReplace); err != nil {
+			return err
+		}
+	}
+	f.libraries = restored.libraries
+	f.functions = restored.functions
+	return nil
+}
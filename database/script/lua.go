@@ -0,0 +1,432 @@
+package script
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+
+	"godis/interface/redis"
+	"godis/lib/logger"
+	"godis/redis/protocol"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// CallFunc executes a command issued by redis.call or redis.pcall and returns its reply
+type CallFunc func(cmdLine [][]byte) redis.Reply
+
+// vm 是一个沙箱化的 lua 虚拟机，创建开销较大，使用 sync.Pool 复用
+type vm struct {
+	L        *lua.LState
+	call     CallFunc      // 当前执行的脚本的命令回调
+	registry *registration // 只在 FUNCTION LOAD 执行库代码时不为空
+	saved    *snapshot     // 每次执行结束后恢复到这个状态
+}
+
+// snapshot 记录全局变量、标准库和 redis 表的初始内容。脚本可以通过 rawset、setmetatable、setfenv 等方式
+// 修改它们，复用虚拟机之前恢复原状，一个脚本的修改不会影响之后的脚本
+type snapshot struct {
+	env    *lua.LTable
+	global *lua.LTable
+	tables []tableSnapshot
+}
+
+type tableSnapshot struct {
+	tbl    *lua.LTable
+	fields map[lua.LValue]lua.LValue
+	mt     lua.LValue
+}
+
+var vmPool = sync.Pool{
+	New: func() interface{} {
+		return newVM()
+	},
+}
+
+// libs 脚本中可用的标准库，不包含 io、os 等可以访问外部环境的库
+var libs = []struct {
+	name string
+	open lua.LGFunction
+}{
+	{lua.BaseLibName, lua.OpenBase},
+	{lua.TabLibName, lua.OpenTable},
+	{lua.StringLibName, lua.OpenString},
+	{lua.MathLibName, lua.OpenMath},
+}
+
+func newVM() *vm {
+	v := &vm{}
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, lib := range libs {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	for _, name := range []string{"dofile", "loadfile", "require", "module"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+
+	api := L.NewTable()
+	L.SetFuncs(api, map[string]lua.LGFunction{
+		"call":         v.redisCall,
+		"pcall":        v.redisPCall,
+		"error_reply":  errorReply,
+		"status_reply": statusReply,
+		"sha1hex":      sha1hex,
+		"log":          redisLog,
+
+		"register_function": v.registerFunction,
+	})
+	api.RawSetString("LOG_DEBUG", lua.LNumber(logDebug))
+	api.RawSetString("LOG_VERBOSE", lua.LNumber(logVerbose))
+	api.RawSetString("LOG_NOTICE", lua.LNumber(logNotice))
+	api.RawSetString("LOG_WARNING", lua.LNumber(logWarning))
+	L.SetGlobal("redis", api)
+	protectGlobals(L)
+	v.L = L
+	v.saveState()
+	return v
+}
+
+// saveState 记录虚拟机当前的状态，之后每次执行结束由 restoreState 恢复
+func (v *vm) saveState() {
+	L := v.L
+	saved := &snapshot{env: L.Env, global: L.G.Global}
+	seen := make(map[*lua.LTable]struct{})
+	add := func(tbl *lua.LTable) {
+		if _, ok := seen[tbl]; ok {
+			return
+		}
+		seen[tbl] = struct{}{}
+		ts := tableSnapshot{tbl: tbl, fields: make(map[lua.LValue]lua.LValue), mt: L.GetMetatable(tbl)}
+		tbl.ForEach(func(key lua.LValue, value lua.LValue) {
+			ts.fields[key] = value
+		})
+		saved.tables = append(saved.tables, ts)
+	}
+	add(L.G.Global)
+	L.G.Global.ForEach(func(_ lua.LValue, value lua.LValue) {
+		if tbl, ok := value.(*lua.LTable); ok {
+			add(tbl)
+		}
+	})
+	// 字符串的方法通过元表中的 __index 查找
+	if mt, ok := L.GetMetatable(lua.LString("")).(*lua.LTable); ok {
+		add(mt)
+	}
+	v.saved = saved
+}
+
+// restoreState 删除脚本添加的字段，恢复被修改或删除的字段和元表
+func (v *vm) restoreState() {
+	L := v.L
+	L.Env = v.saved.env
+	L.G.Global = v.saved.global
+	for _, ts := range v.saved.tables {
+		var added []lua.LValue
+		ts.tbl.ForEach(func(key lua.LValue, _ lua.LValue) {
+			if _, ok := ts.fields[key]; !ok {
+				added = append(added, key)
+			}
+		})
+		for _, key := range added {
+			ts.tbl.RawSet(key, lua.LNil)
+		}
+		for key, value := range ts.fields {
+			ts.tbl.RawSet(key, value)
+		}
+		L.SetMetatable(ts.tbl, ts.mt)
+	}
+}
+
+// pcall 在 ctx 结束时中止执行中的脚本，被中止的脚本返回 ctx 结束的原因，
+// context.Canceled 表示被用户终止，context.DeadlineExceeded 表示超时
+func (v *vm) pcall(ctx context.Context, nargs int) error {
+	L := v.L
+	L.SetContext(ctx)
+	defer L.RemoveContext()
+	err := L.PCall(nargs, 1, nil)
+	if err != nil && ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+	return err
+}
+
+// release 清理虚拟机中上一次执行的痕迹，之后可以放回池中
+func (v *vm) release() {
+	v.call = nil
+	v.L.SetTop(0)
+	v.restoreState()
+}
+
+// protectGlobals 禁止脚本读写未定义的全局变量，避免复用虚拟机时脚本之间互相影响
+func protectGlobals(L *lua.LState) {
+	mt := L.NewTable()
+	mt.RawSetString("__newindex", L.NewFunction(func(L *lua.LState) int {
+		L.RaiseError("Script attempted to create global variable '%s'", L.CheckAny(2).String())
+		return 0
+	}))
+	mt.RawSetString("__index", L.NewFunction(func(L *lua.LState) int {
+		L.RaiseError("Script attempted to access nonexistent global variable '%s'", L.CheckAny(2).String())
+		return 0
+	}))
+	L.SetMetatable(L.G.Global, mt)
+}
+
+// Run executes script with KEYS and ARGV, commands called by the script are executed by call.
+// The script is aborted when ctx is cancelled or its deadline is exceeded
+func Run(ctx context.Context, script *Script, keys [][]byte, args [][]byte, call CallFunc) redis.Reply {
+	v := vmPool.Get().(*vm)
+	defer func() {
+		v.release()
+		vmPool.Put(v)
+	}()
+	v.call = call
+	L := v.L
+	L.G.Global.RawSetString("KEYS", bytesToTable(L, keys))
+	L.G.Global.RawSetString("ARGV", bytesToTable(L, args))
+	L.Push(L.NewFunctionFromProto(script.proto))
+	if err := v.pcall(ctx, 0); err != nil {
+		return errorToReply(err, "script: "+script.SHA)
+	}
+	return luaToReply(L.Get(-1))
+}
+
+// errorToReply converts lua error to redis error, error tables raised by redis.call are returned as they are
+func errorToReply(err error, where string) redis.Reply {
+	switch {
+	case errors.Is(err, context.Canceled):
+		return protocol.MakeErrReply("ERR Script killed by user " + where)
+	case errors.Is(err, context.DeadlineExceeded):
+		return protocol.MakeErrReply("ERR Script killed by timeout " + where)
+	}
+	var apiErr *lua.ApiError
+	if errors.As(err, &apiErr) {
+		if tbl, ok := apiErr.Object.(*lua.LTable); ok {
+			if msg, ok := tbl.RawGetString("err").(lua.LString); ok {
+				return protocol.MakeErrReply(string(msg))
+			}
+		}
+	}
+	return protocol.MakeErrReply("ERR " + errorMessage(err) + " " + where)
+}
+
+// errorMessage 返回 lua 错误的内容，不包含调用栈
+func errorMessage(err error) string {
+	var apiErr *lua.ApiError
+	if errors.As(err, &apiErr) {
+		if tbl, ok := apiErr.Object.(*lua.LTable); ok {
+			return tbl.RawGetString("err").String()
+		}
+		return strings.TrimPrefix(apiErr.Object.String(), "@")
+	}
+	return strings.TrimPrefix(strings.TrimSpace(err.Error()), "@")
+}
+
+func bytesToTable(L *lua.LState, values [][]byte) *lua.LTable {
+	tbl := L.CreateTable(len(values), 0)
+	for _, value := range values {
+		tbl.Append(lua.LString(value))
+	}
+	return tbl
+}
+
+func (v *vm) redisCall(L *lua.LState) int {
+	reply := v.exec(L)
+	if errReply, ok := reply.(protocol.ErrorReply); ok {
+		L.Error(errorTable(L, errReply.Error()), 1)
+		return 0
+	}
+	L.Push(replyToLua(L, reply))
+	return 1
+}
+
+func (v *vm) redisPCall(L *lua.LState) int {
+	L.Push(replyToLua(L, v.exec(L)))
+	return 1
+}
+
+// exec 检查 redis.call 的参数并执行命令
+func (v *vm) exec(L *lua.LState) redis.Reply {
+	n := L.GetTop()
+	if n == 0 {
+		return protocol.MakeErrReply("ERR Please specify at least one argument for this redis lib call")
+	}
+	cmdLine := make([][]byte, n)
+	for i := 1; i <= n; i++ {
+		switch arg := L.Get(i).(type) {
+		case lua.LString:
+			cmdLine[i-1] = []byte(arg)
+		case lua.LNumber:
+			cmdLine[i-1] = []byte(arg.String())
+		default:
+			return protocol.MakeErrReply("ERR Lua redis lib command arguments must be strings or integers")
+		}
+	}
+	if v.call == nil {
+		return protocol.MakeErrReply("ERR redis.call is not allowed here")
+	}
+	return v.call(cmdLine)
+}
+
+func errorTable(L *lua.LState, msg string) *lua.LTable {
+	tbl := L.NewTable()
+	tbl.RawSetString("err", lua.LString(msg))
+	return tbl
+}
+
+func statusTable(L *lua.LState, status string) *lua.LTable {
+	tbl := L.NewTable()
+	tbl.RawSetString("ok", lua.LString(status))
+	return tbl
+}
+
+func errorReply(L *lua.LState) int {
+	L.Push(errorTable(L, L.CheckString(1)))
+	return 1
+}
+
+func statusReply(L *lua.LState) int {
+	L.Push(statusTable(L, L.CheckString(1)))
+	return 1
+}
+
+func sha1hex(L *lua.LState) int {
+	L.Push(lua.LString(SHA1Hex(L.CheckString(1))))
+	return 1
+}
+
+const (
+	logDebug = iota
+	logVerbose
+	logNotice
+	logWarning
+)
+
+func redisLog(L *lua.LState) int {
+	level := L.CheckInt(1)
+	parts := make([]string, 0, L.GetTop()-1)
+	for i := 2; i <= L.GetTop(); i++ {
+		parts = append(parts, L.Get(i).String())
+	}
+	msg := strings.Join(parts, " ")
+	switch level {
+	case logDebug, logVerbose:
+		logger.Debug(msg)
+	case logNotice:
+		logger.Info(msg)
+	case logWarning:
+		logger.Warn(msg)
+	default:
+		L.RaiseError("Invalid debug level.")
+	}
+	return 0
+}
+
+// replyToLua converts redis reply to lua value:
+// integer -> number, bulk string -> string, nil -> false, array -> table,
+// status -> table with ok field, error -> table with err field
+func replyToLua(L *lua.LState, reply redis.Reply) lua.LValue {
+	switch r := reply.(type) {
+	case *protocol.IntReply:
+		return lua.LNumber(r.Code)
+	case *protocol.BulkReply:
+		if r.Arg == nil {
+			return lua.LFalse
+		}
+		return lua.LString(r.Arg)
+	case *protocol.NullBulkReply, *protocol.NullReply:
+		return lua.LFalse
+	case *protocol.StatusReply:
+		return statusTable(L, r.Status)
+	case *protocol.OkReply, *protocol.PongReply:
+		return statusTable(L, r.DataString())
+	case *protocol.BooleanReply:
+		if r.Value {
+			return lua.LNumber(1)
+		}
+		return lua.LFalse
+	case *protocol.DoubleReply, *protocol.BigNumberReply, *protocol.VerbatimReply:
+		return lua.LString(stripBulk(protocol.Encode(r, protocol.RESP2)))
+	case *protocol.EmptyMultiBulkReply:
+		return L.NewTable()
+	case *protocol.MultiBulkReply:
+		tbl := L.CreateTable(len(r.Args), 0)
+		for _, arg := range r.Args {
+			if arg == nil {
+				tbl.Append(lua.LFalse)
+			} else {
+				tbl.Append(lua.LString(arg))
+			}
+		}
+		return tbl
+	case *protocol.MultiRawReply:
+		return repliesToTable(L, r.Replies)
+	case *protocol.SetReply:
+		return repliesToTable(L, r.Members)
+	case *protocol.MapReply:
+		replies := make([]redis.Reply, 0, len(r.Keys)*2)
+		for i := range r.Keys {
+			replies = append(replies, r.Keys[i], r.Values[i])
+		}
+		return repliesToTable(L, replies)
+	case protocol.ErrorReply:
+		return errorTable(L, r.Error())
+	}
+	return lua.LString(reply.DataString())
+}
+
+func repliesToTable(L *lua.LState, replies []redis.Reply) *lua.LTable {
+	tbl := L.CreateTable(len(replies), 0)
+	for _, reply := range replies {
+		tbl.Append(replyToLua(L, reply))
+	}
+	return tbl
+}
+
+// stripBulk 取出 RESP2 bulk string 中的内容
+func stripBulk(raw []byte) string {
+	s := string(raw)
+	if i := strings.Index(s, "\r\n"); i >= 0 {
+		s = s[i+2:]
+	}
+	return strings.TrimSuffix(s, "\r\n")
+}
+
+// luaToReply converts lua value returned by script to redis reply:
+// number -> integer, string -> bulk string, true -> 1, false and nil -> nil,
+// table with ok or err field -> status or error, other tables -> array until the first nil
+func luaToReply(value lua.LValue) redis.Reply {
+	switch v := value.(type) {
+	case lua.LNumber:
+		return protocol.MakeIntReply(int64(v))
+	case lua.LString:
+		return protocol.MakeBulkReply([]byte(v))
+	case lua.LBool:
+		if v {
+			return protocol.MakeIntReply(1)
+		}
+		return protocol.MakeNullBulkReply()
+	case *lua.LTable:
+		if msg, ok := v.RawGetString("err").(lua.LString); ok {
+			return protocol.MakeErrReply(string(msg))
+		}
+		if status, ok := v.RawGetString("ok").(lua.LString); ok {
+			return protocol.MakeStatusReply(string(status))
+		}
+		var replies []redis.Reply
+		for i := 1; ; i++ {
+			item := v.RawGetInt(i)
+			if item == lua.LNil {
+				break
+			}
+			replies = append(replies, luaToReply(item))
+		}
+		if len(replies) == 0 {
+			return protocol.MakeEmptyMultiBulkReply()
+		}
+		return protocol.MakeMultiRawReply(replies)
+	}
+	return protocol.MakeNullBulkReply()
+}
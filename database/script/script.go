@@ -0,0 +1,104 @@
+package script
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"strings"
+	"sync"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// chunkName 出现在错误信息中，例如 user_script:1: attempt to call a nil value
+const chunkName = "@user_script"
+
+// Script is a compiled lua script
+type Script struct {
+	SHA   string
+	Body  string
+	proto *lua.FunctionProto
+}
+
+// SHA1Hex returns the lower case hex sha1 digest of body, which is the name of a script
+func SHA1Hex(body string) string {
+	sum := sha1.Sum([]byte(body))
+	return hex.EncodeToString(sum[:])
+}
+
+// Compile parses and compiles body, the compiled script can be run concurrently
+func Compile(body string) (*Script, error) {
+	proto, err := compile(body)
+	if err != nil {
+		return nil, err
+	}
+	return &Script{
+		SHA:   SHA1Hex(body),
+		Body:  body,
+		proto: proto,
+	}, nil
+}
+
+func compile(body string) (*lua.FunctionProto, error) {
+	chunk, err := parse.Parse(strings.NewReader(body), chunkName)
+	if err != nil {
+		return nil, err
+	}
+	return lua.Compile(chunk, chunkName)
+}
+
+// Cache stores compiled scripts by sha1, it is used by EVAL, EVALSHA and SCRIPT commands
+type Cache struct {
+	mu      sync.RWMutex
+	scripts map[string]*Script
+}
+
+func NewCache() *Cache {
+	return &Cache{
+		scripts: make(map[string]*Script),
+	}
+}
+
+// Load compiles body and stores it, scripts loaded before are not compiled again
+func (c *Cache) Load(body string) (*Script, error) {
+	sha := SHA1Hex(body)
+	if script, ok := c.Get(sha); ok {
+		return script, nil
+	}
+	script, err := Compile(body)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.scripts[sha] = script
+	return script, nil
+}
+
+// Get finds a script by sha1, sha is case-insensitive
+func (c *Cache) Get(sha string) (*Script, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	script, ok := c.scripts[strings.ToLower(sha)]
+	return script, ok
+}
+
+// Exists returns whether script named sha has been loaded
+func (c *Cache) Exists(sha string) bool {
+	_, ok := c.Get(sha)
+	return ok
+}
+
+// Flush removes all scripts
+func (c *Cache) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.scripts = make(map[string]*Script)
+}
+
+// Len returns number of cached scripts
+func (c *Cache) Len() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.scripts)
+}
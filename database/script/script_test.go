@@ -0,0 +1,254 @@
+package script
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"godis/interface/redis"
+	"godis/redis/protocol"
+)
+
+// fakeCall 使用 map 模拟 GET/SET/INCR 命令
+func fakeCall(data map[string]string) CallFunc {
+	return func(cmdLine [][]byte) redis.Reply {
+		switch strings.ToLower(string(cmdLine[0])) {
+		case "get":
+			if value, ok := data[string(cmdLine[1])]; ok {
+				return protocol.MakeBulkReply([]byte(value))
+			}
+			return protocol.MakeNullBulkReply()
+		case "set":
+			data[string(cmdLine[1])] = string(cmdLine[2])
+			return protocol.MakeOkReply()
+		case "lrange":
+			return protocol.MakeMultiBulkReply([][]byte{[]byte("a"), []byte("b")})
+		}
+		return protocol.MakeErrReply("ERR unknown command")
+	}
+}
+
+func run(t *testing.T, body string, keys []string, args []string, call CallFunc) redis.Reply {
+	t.Helper()
+	sc, err := Compile(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	toBytes := func(values []string) [][]byte {
+		result := make([][]byte, len(values))
+		for i, value := range values {
+			result[i] = []byte(value)
+		}
+		return result
+	}
+	return Run(context.Background(), sc, toBytes(keys), toBytes(args), call)
+}
+
+func TestRun(t *testing.T) {
+	data := map[string]string{}
+	call := fakeCall(data)
+	tests := []struct {
+		body   string
+		expect string
+	}{
+		{"return 1.9", ":1\r\n"},
+		{"return 'hello'", "$5\r\nhello\r\n"},
+		{"return true", ":1\r\n"},
+		{"return false", "$-1\r\n"},
+		{"return nil", "$-1\r\n"},
+		{"return {1, 'a', {2}, nil, 3}", "*3\r\n:1\r\n$1\r\na\r\n*1\r\n:2\r\n"},
+		{"return redis.status_reply('FINE')", "+FINE\r\n"},
+		{"return redis.error_reply('MY error')", "-MY error\r\n"},
+		{"return {KEYS[1], ARGV[1]}", "*2\r\n$1\r\nk\r\n$1\r\nv\r\n"},
+		{"return redis.call('SET', KEYS[1], ARGV[1])", "+OK\r\n"},
+		{"return redis.call('GET', KEYS[1])", "$1\r\nv\r\n"},
+		{"return redis.call('GET', 'missing') == false", ":1\r\n"},
+		{"return redis.call('LRANGE', 'l', 0, -1)", "*2\r\n$1\r\na\r\n$1\r\nb\r\n"},
+		{"return redis.pcall('BAD')['err']", "$19\r\nERR unknown command\r\n"},
+		{"return redis.call('BAD')", "-ERR unknown command\r\n"},
+		{"return redis.sha1hex('')", "$40\r\nda39a3ee5e6b4b0d3255bfef95601890afd80709\r\n"},
+	}
+	for _, tt := range tests {
+		reply := run(t, tt.body, []string{"k"}, []string{"v"}, call)
+		if got := string(reply.ToBytes()); got != tt.expect {
+			t.Errorf("%s: expect %q, got %q", tt.body, tt.expect, got)
+		}
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	call := fakeCall(map[string]string{})
+	for _, body := range []string{
+		"x = 1",
+		"return undefined_var",
+		"return os.exit()",
+		"error('boom')",
+	} {
+		reply := run(t, body, nil, nil, call)
+		if !protocol.IsErrorReply(reply) || !strings.HasPrefix(string(reply.ToBytes()), "-ERR user_script:1:") {
+			t.Errorf("%s: expect script error, got %q", body, reply.ToBytes())
+		}
+	}
+	// 出错之后复用的虚拟机仍然可用
+	if reply := run(t, "return ARGV[1]", nil, []string{"ok"}, call); string(reply.ToBytes()) != "$2\r\nok\r\n" {
+		t.Errorf("unexpected reply %q", reply.ToBytes())
+	}
+	if _, err := Compile("return ("); err == nil {
+		t.Error("expect compile error")
+	}
+}
+
+func TestRunKilled(t *testing.T) {
+	sc, err := Compile("while true do pcall(function() while true do end end) end")
+	if err != nil {
+		t.Fatal(err)
+	}
+	call := fakeCall(map[string]string{})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if reply := Run(ctx, sc, nil, nil, call); !strings.HasPrefix(string(reply.ToBytes()), "-ERR Script killed by timeout") {
+		t.Errorf("unexpected reply %q", reply.ToBytes())
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if reply := Run(ctx, sc, nil, nil, call); !strings.HasPrefix(string(reply.ToBytes()), "-ERR Script killed by user") {
+		t.Errorf("unexpected reply %q", reply.ToBytes())
+	}
+	if reply := run(t, "return 1", nil, nil, call); string(reply.ToBytes()) != ":1\r\n" {
+		t.Errorf("unexpected reply %q", reply.ToBytes())
+	}
+}
+
+// TestSandboxRestored 脚本对全局变量和标准库的修改不会影响复用同一个虚拟机的脚本
+func TestSandboxRestored(t *testing.T) {
+	call := fakeCall(map[string]string{})
+	body := "string.upper = nil; table.insert = nil; redis.call = nil; rawset(_G, 'x', 1); " +
+		"getmetatable('').__index = {}; setmetatable(_G, nil); setfenv(0, {}); return 1"
+	if reply := run(t, body, nil, nil, call); string(reply.ToBytes()) != ":1\r\n" {
+		t.Fatalf("unexpected reply %q", reply.ToBytes())
+	}
+	check := "return {string.upper('a'), ('b'):upper(), type(table.insert), type(redis.call), tostring(rawget(_G, 'x'))}"
+	if reply := run(t, check, nil, nil, call); string(reply.ToBytes()) != "*5\r\n$1\r\nA\r\n$1\r\nB\r\n$8\r\nfunction\r\n$8\r\nfunction\r\n$3\r\nnil\r\n" {
+		t.Errorf("unexpected reply %q", reply.ToBytes())
+	}
+	if reply := run(t, "y = 1", nil, nil, call); !protocol.IsErrorReply(reply) {
+		t.Error("globals should be protected again")
+	}
+}
+
+func TestCache(t *testing.T) {
+	cache := NewCache()
+	sc, err := cache.Load("return 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sc.SHA != SHA1Hex("return 1") || !cache.Exists(strings.ToUpper(sc.SHA)) {
+		t.Error("script should be found by sha1")
+	}
+	if _, err := cache.Load("return +"); err == nil {
+		t.Error("expect compile error")
+	}
+	cache.Flush()
+	if cache.Exists(sc.SHA) || cache.Len() != 0 {
+		t.Error("cache should be empty after flush")
+	}
+}
+
+const testLibrary = `#!lua name=mylib
+local function get(keys, args)
+  return redis.call('GET', keys[1])
+end
+redis.register_function('myget', get)
+redis.register_function{
+  function_name = 'myset',
+  callback = function(keys, args) return redis.call('SET', keys[1], args[1]) end,
+  description = 'set a key',
+}
+redis.register_function{function_name = 'ro', callback = get, flags = {'no-writes'}}
+`
+
+func TestFunctions(t *testing.T) {
+	functions := NewFunctions()
+	name, err := functions.Load(testLibrary, false)
+	if err != nil || name != "mylib" {
+		t.Fatalf("load failed: %s %v", name, err)
+	}
+	if _, err := functions.Load(testLibrary, false); err == nil {
+		t.Error("expect library exists error")
+	}
+	if _, err := functions.Load(testLibrary, true); err != nil {
+		t.Errorf("replace failed: %v", err)
+	}
+	other := strings.Replace(testLibrary, "name=mylib", "name=other", 1)
+	if _, err := functions.Load(other, false); err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Errorf("expect function exists error, got %v", err)
+	}
+
+	call := fakeCall(map[string]string{})
+	fn, ok := functions.GetFunction("myset")
+	if !ok || fn.ReadOnly() || fn.Description != "set a key" {
+		t.Fatal("myset not found")
+	}
+	keys, args := [][]byte{[]byte("k")}, [][]byte{[]byte("v")}
+	if reply := fn.Library.Call(context.Background(), "myset", keys, args, call); string(reply.ToBytes()) != "+OK\r\n" {
+		t.Errorf("unexpected reply %q", reply.ToBytes())
+	}
+	fn, _ = functions.GetFunction("ro")
+	if !fn.ReadOnly() {
+		t.Error("ro should be read-only")
+	}
+	if reply := fn.Library.Call(context.Background(), "ro", keys, nil, call); string(reply.ToBytes()) != "$1\r\nv\r\n" {
+		t.Errorf("unexpected reply %q", reply.ToBytes())
+	}
+
+	payload := functions.Dump()
+	functions.Flush()
+	if len(functions.List("")) != 0 {
+		t.Error("expect no library after flush")
+	}
+	if err := functions.Restore(payload, RestoreAppend); err != nil {
+		t.Fatal(err)
+	}
+	if err := functions.Restore(payload, RestoreAppend); err == nil {
+		t.Error("expect library exists error")
+	}
+	if err := functions.Restore(payload, RestoreReplace); err != nil {
+		t.Error(err)
+	}
+	payload[len(payload)-1]++
+	if err := functions.Restore(payload, RestoreFlush); err != ErrBadPayload {
+		t.Errorf("expect bad payload, got %v", err)
+	}
+	if libs := functions.List("my*"); len(libs) != 1 || len(libs[0].Functions) != 3 {
+		t.Error("list failed")
+	}
+	if err := functions.Delete("mylib"); err != nil {
+		t.Error(err)
+	}
+	if _, ok := functions.GetFunction("myget"); ok {
+		t.Error("functions should be deleted with library")
+	}
+}
+
+func TestLoadLibraryErrors(t *testing.T) {
+	tests := []struct {
+		code   string
+		expect string
+	}{
+		{"return 1", "Missing library metadata"},
+		{"#!js name=x\n", "Engine 'js' not found"},
+		{"#!lua\n", "Library name was not given"},
+		{"#!lua name=a-b\n", "Library names can only contain"},
+		{"#!lua name=x\nlocal a = 1", "No functions registered"},
+		{"#!lua name=x\nredis.register_function('f', 1)", "callback argument"},
+		{"#!lua name=x\nredis.register_function{function_name='f', callback=function() end, flags={'bad'}}", "unknown flag"},
+		{"#!lua name=x\nredis.call('GET', 'k')", "not allowed"},
+		{"#!lua name=x\nlocal f = function() end\nredis.register_function('f', f)\nredis.register_function('f', f)", "already exists"},
+	}
+	for _, tt := range tests {
+		if _, err := LoadLibrary(tt.code); err == nil || !strings.Contains(err.Error(), tt.expect) {
+			t.Errorf("%q: expect %q, got %v", tt.code, tt.expect, err)
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package database
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"godis/config"
+	"godis/database/engine"
+	"godis/database/script"
+	"godis/interface/redis"
+	"godis/lib/logger"
+	"godis/redis/connection"
+	"godis/redis/protocol"
+)
+
+// runningScripts 记录执行中的脚本和函数，SCRIPT KILL、FUNCTION KILL 和 lua_time_limit 通过取消 context 终止它们。
+// 与 redis 一样，已经执行过写命令的脚本不会被终止，否则脚本的原子性被破坏
+type runningScripts struct {
+	mu   sync.Mutex
+	runs map[*scriptRun]struct{}
+}
+
+type scriptRun struct {
+	function bool // 由 FCALL 调用的函数
+	cancel   context.CancelCauseFunc
+	// mu 保证脚本不会在被终止之后执行写命令，也不会在执行写命令之后被终止
+	mu     sync.Mutex
+	wrote  bool
+	killed bool
+}
+
+// kill cancels the run with cause, it returns false if the run has executed write commands
+func (run *scriptRun) kill(cause error) bool {
+	run.mu.Lock()
+	defer run.mu.Unlock()
+	if run.wrote {
+		return false
+	}
+	run.killed = true
+	run.cancel(cause)
+	return true
+}
+
+// beforeWrite marks the run as written, it returns false if the run has been killed
+func (run *scriptRun) beforeWrite() bool {
+	run.mu.Lock()
+	defer run.mu.Unlock()
+	if run.killed {
+		return false
+	}
+	run.wrote = true
+	return true
+}
+
+// start returns a new script run and its context, the run is killed by kill or when lua_time_limit is exceeded
+// unless it has executed write commands. done must be called after the script returns
+func (r *runningScripts) start(function bool) (run *scriptRun, ctx context.Context, done func()) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	run = &scriptRun{function: function, cancel: cancel}
+	var timer *time.Timer
+	if limit := config.Properties().LuaTimeLimit; limit > 0 {
+		timer = time.AfterFunc(time.Duration(limit)*time.Millisecond, func() {
+			if !run.kill(context.DeadlineExceeded) {
+				logger.Warn("script exceeded lua_time_limit but it has executed write commands and can not be killed")
+			}
+		})
+	}
+	r.mu.Lock()
+	if r.runs == nil {
+		r.runs = make(map[*scriptRun]struct{})
+	}
+	r.runs[run] = struct{}{}
+	r.mu.Unlock()
+	return run, ctx, func() {
+		if timer != nil {
+			timer.Stop()
+		}
+		r.mu.Lock()
+		delete(r.runs, run)
+		r.mu.Unlock()
+		cancel(nil)
+	}
+}
+
+// kill kills running scripts or functions which have not executed write commands
+func (r *runningScripts) kill(function bool) redis.Reply {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	running, killed := 0, 0
+	for run := range r.runs {
+		if run.function != function {
+			continue
+		}
+		running++
+		if run.kill(context.Canceled) {
+			killed++
+		}
+	}
+	if running == 0 {
+		return protocol.MakeErrReply("NOTBUSY No scripts in execution right now.")
+	}
+	if killed == 0 {
+		return protocol.MakeErrReply("UNKILLABLE Sorry the script already executed write commands against the dataset. " +
+			"You can either wait the script termination or kill the server in a hard way using the SHUTDOWN NOSAVE command.")
+	}
+	return protocol.MakeOkReply()
+}
+
+// parseNumKeys 解析 EVAL 和 FCALL 的 numkeys 参数，返回 KEYS 和 ARGV
+func parseNumKeys(args [][]byte) ([][]byte, [][]byte, redis.Reply) {
+	numKeys, err := strconv.Atoi(string(args[0]))
+	if err != nil {
+		return nil, nil, protocol.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	if numKeys < 0 {
+		return nil, nil, protocol.MakeErrReply("ERR Number of keys can't be negative")
+	}
+	if numKeys > len(args)-1 {
+		return nil, nil, protocol.MakeErrReply("ERR Number of keys can't be greater than number of args")
+	}
+	return args[1 : 1+numKeys], args[1+numKeys:], nil
+}
+
+func compileErrReply(err error) redis.Reply {
+	msg := strings.TrimPrefix(strings.TrimSpace(err.Error()), "@")
+	return protocol.MakeErrReply("ERR Error compiling script (new function): " + msg)
+}
+
+// Eval EVAL script numkeys [key ...] [arg ...]
+func Eval(s *Server, c redis.Connection, args [][]byte) redis.Reply {
+	if len(args) < 2 {
+		return protocol.MakeArgNumErrReply("eval")
+	}
+	sc, err := s.scripts.Load(string(args[0]))
+	if err != nil {
+		return compileErrReply(err)
+	}
+	return s.runScript(c, "eval", args[1:], false, func(ctx context.Context, keys, argv [][]byte, call script.CallFunc) redis.Reply {
+		return script.Run(ctx, sc, keys, argv, call)
+	})
+}
+
+// EvalSHA EVALSHA sha1 numkeys [key ...] [arg ...]
+func EvalSHA(s *Server, c redis.Connection, args [][]byte) redis.Reply {
+	if len(args) < 2 {
+		return protocol.MakeArgNumErrReply("evalsha")
+	}
+	sc, ok := s.scripts.Get(string(args[0]))
+	if !ok {
+		return protocol.MakeErrReply("NOSCRIPT No matching script. Please use EVAL.")
+	}
+	return s.runScript(c, "evalsha", args[1:], false, func(ctx context.Context, keys, argv [][]byte, call script.CallFunc) redis.Reply {
+		return script.Run(ctx, sc, keys, argv, call)
+	})
+}
+
+// runScript locks the declared keys like a MULTI block and runs the script,
+// commands called by the script may only access declared keys.
+// Keys of read-only scripts are locked for reading and write commands are rejected.
+// The script can be killed by SCRIPT KILL, or FUNCTION KILL for functions, and is aborted after lua_time_limit,
+// unless it has executed write commands
+func (s *Server) runScript(c redis.Connection, cmdName string, args [][]byte, readOnly bool,
+	run func(ctx context.Context, keys, argv [][]byte, call script.CallFunc) redis.Reply) redis.Reply {
+	if c.GetMultiStatus() {
+		return protocol.MakeErrReply("ERR command '" + cmdName + "' cannot be used in MULTI")
+	}
+	keys, argv, errReply := parseNumKeys(args)
+	if errReply != nil {
+		return errReply
+	}
+	db, selectErr := s.selectDB(c.GetDBIndex())
+	if selectErr != nil {
+		return selectErr
+	}
+	declared := make(map[string]struct{}, len(keys))
+	lockKeys := make([]string, len(keys))
+	for i, key := range keys {
+		declared[string(key)] = struct{}{}
+		lockKeys[i] = string(key)
+	}
+
+	writeKeys, readKeys := lockKeys, []string(nil)
+	if readOnly {
+		writeKeys, readKeys = nil, lockKeys
+	}
+	var result redis.Reply
+	db.ExecLocked(writeKeys, readKeys, func(exec func(cmdLine engine.CmdLine) redis.Reply) {
+		c.SetExecStart(time.Now())
+		sr, ctx, done := s.scriptRuns.start(strings.HasPrefix(cmdName, "fcall"))
+		defer done()
+		result = run(ctx, keys, argv, func(cmdLine [][]byte) redis.Reply {
+			return s.scriptCall(c, db, declared, readOnly, sr, exec, cmdLine)
+		})
+	})
+	return result
+}
+
+// scriptCall executes a command issued by redis.call, only data commands are allowed
+func (s *Server) scriptCall(c redis.Connection, db *engine.DB, declared map[string]struct{}, readOnly bool, sr *scriptRun,
+	exec func(cmdLine engine.CmdLine) redis.Reply, cmdLine [][]byte) redis.Reply {
+	cmdName := strings.ToLower(string(cmdLine[0]))
+	if _, ok := systemCommandCategories[cmdName]; ok {
+		return protocol.MakeErrReply("ERR This Redis command is not allowed from script")
+	}
+	if !engine.IsCommand(cmdName) {
+		return protocol.MakeErrReply("ERR Unknown Redis command called from script")
+	}
+	if errReply := db.CheckSyntaxErr(cmdLine); errReply != nil {
+		return errReply
+	}
+	if readOnly && engine.IsWriteCommand(cmdName) {
+		return protocol.MakeErrReply("ERR Write commands are not allowed from read-only scripts.")
+	}
+	writeKeys, readKeys, _ := engine.GetRelatedKeys(cmdLine)
+	for _, keys := range [][]string{writeKeys, readKeys} {
+		for _, key := range keys {
+			if _, ok := declared[key]; !ok {
+				return protocol.MakeErrReply("ERR Script attempted to access key '" + key + "' which is not declared in KEYS")
+			}
+		}
+	}
+	if _, ok := c.(*connection.FakeConn); !ok {
+		if errReply := s.checkPermission(c, cmdLine); errReply != nil {
+			return errReply
+		}
+	}
+	if engine.IsWriteCommand(cmdName) && !sr.beforeWrite() {
+		return protocol.MakeErrReply("ERR Script killed before executing write commands")
+	}
+	return exec(cmdLine)
+}
+
+// execScript SCRIPT LOAD|EXISTS|FLUSH|KILL
+func execScript(s *Server, args [][]byte) redis.Reply {
+	if len(args) == 0 {
+		return protocol.MakeArgNumErrReply("script")
+	}
+	subCmd := strings.ToLower(string(args[0]))
+	args = args[1:]
+	switch subCmd {
+	case "load":
+		if len(args) != 1 {
+			return protocol.MakeArgNumErrReply("script|load")
+		}
+		sc, err := s.scripts.Load(string(args[0]))
+		if err != nil {
+			return compileErrReply(err)
+		}
+		return protocol.MakeBulkReply([]byte(sc.SHA))
+	case "exists":
+		if len(args) == 0 {
+			return protocol.MakeArgNumErrReply("script|exists")
+		}
+		replies := make([]redis.Reply, len(args))
+		for i, sha := range args {
+			if s.scripts.Exists(string(sha)) {
+				replies[i] = protocol.MakeIntReply(1)
+			} else {
+				replies[i] = protocol.MakeIntReply(0)
+			}
+		}
+		return protocol.MakeMultiRawReply(replies)
+	case "flush":
+		if len(args) > 1 {
+			return protocol.MakeArgNumErrReply("script|flush")
+		}
+		if len(args) == 1 {
+			mode := strings.ToLower(string(args[0]))
+			if mode != "async" && mode != "sync" {
+				return protocol.MakeErrReply("ERR SCRIPT FLUSH only support SYNC|ASYNC option")
+			}
+		}
+		s.scripts.Flush()
+		return protocol.MakeOkReply()
+	case "kill":
+		if len(args) != 0 {
+			return protocol.MakeArgNumErrReply("script|kill")
+		}
+		return s.scriptRuns.kill(false)
+	}
+	return protocol.MakeErrReply("ERR unknown subcommand '" + subCmd + "'. Try SCRIPT HELP.")
+}
@@ -0,0 +1,120 @@
+package database
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"godis/config"
+	"godis/redis/protocol"
+)
+
+func TestScriptKill(t *testing.T) {
+	s, _ := makeShutdownTestServer(t)
+	c1 := newRecordConn(1, protocol.RESP2)
+	c2 := newRecordConn(2, protocol.RESP2)
+	if r := execString(s, c2, "SCRIPT", "KILL"); r != "-NOTBUSY No scripts in execution right now.\r\n" {
+		t.Errorf("unexpected reply %q", r)
+	}
+
+	result := make(chan string, 1)
+	go func() {
+		result <- execString(s, c1, "EVAL", "while true do end", "0")
+	}()
+	deadline := time.Now().Add(time.Second)
+	for execString(s, c2, "SCRIPT", "KILL") != "+OK\r\n" {
+		if time.Now().After(deadline) {
+			t.Fatal("script is not running")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case r := <-result:
+		if !strings.HasPrefix(r, "-ERR Script killed by user") {
+			t.Errorf("unexpected reply %q", r)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("script is not killed")
+	}
+
+	// 函数只能由 FUNCTION KILL 终止
+	lib := "#!lua name=loop\nredis.register_function('loop', function() while true do end end)"
+	if r := execString(s, c2, "FUNCTION", "LOAD", lib); r != "$4\r\nloop\r\n" {
+		t.Fatalf("unexpected reply %q", r)
+	}
+	go func() {
+		result <- execString(s, c1, "FCALL", "loop", "0")
+	}()
+	deadline = time.Now().Add(time.Second)
+	for execString(s, c2, "FUNCTION", "KILL") != "+OK\r\n" {
+		if time.Now().After(deadline) {
+			t.Fatal("function is not running")
+		}
+		if r := execString(s, c2, "SCRIPT", "KILL"); r != "-NOTBUSY No scripts in execution right now.\r\n" {
+			t.Errorf("SCRIPT KILL should not kill functions: %q", r)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if r := <-result; !strings.HasPrefix(r, "-ERR Script killed by user") {
+		t.Errorf("unexpected reply %q", r)
+	}
+}
+
+func TestScriptTimeLimit(t *testing.T) {
+	s, _ := makeShutdownTestServer(t)
+	if config.Properties().LuaTimeLimit != 0 {
+		t.Error("lua_time_limit should be disabled by default")
+	}
+	config.Properties().LuaTimeLimit = 20
+	c := newRecordConn(1, protocol.RESP2)
+	start := time.Now()
+	r := execString(s, c, "EVAL", "redis.call('GET', KEYS[1]) while true do end", "1", "k")
+	if !strings.HasPrefix(r, "-ERR Script killed by timeout") {
+		t.Errorf("unexpected reply %q", r)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("script is killed after %v", elapsed)
+	}
+
+	// 执行过写命令的脚本超时后继续执行，直到结束
+	body := "redis.call('SET', KEYS[1], 'v') local n = 0 for i = 1, 1000000 do n = n + 1 end " +
+		"redis.call('SET', KEYS[1], n) return n"
+	if r := execString(s, c, "EVAL", body, "1", "k"); r != ":1000000\r\n" {
+		t.Errorf("unexpected reply %q", r)
+	}
+	if r := execString(s, c, "GET", "k"); r != "$7\r\n1000000\r\n" {
+		t.Errorf("unexpected value %q", r)
+	}
+}
+
+func TestScriptUnkillable(t *testing.T) {
+	s, _ := makeShutdownTestServer(t)
+	c1 := newRecordConn(1, protocol.RESP2)
+	c2 := newRecordConn(2, protocol.RESP2)
+	result := make(chan string, 1)
+	go func() {
+		body := "redis.call('SET', KEYS[1], 'v') for i = 1, 2000000 do end return 1"
+		result <- execString(s, c1, "EVAL", body, "1", "k")
+	}()
+	// 等待脚本执行第一条写命令，之前的 SCRIPT KILL 会终止脚本
+	time.Sleep(20 * time.Millisecond)
+	unkillable := false
+	for !unkillable {
+		select {
+		case r := <-result:
+			t.Fatalf("script finished before SCRIPT KILL was refused: %q", r)
+		default:
+		}
+		r := execString(s, c2, "SCRIPT", "KILL")
+		switch {
+		case strings.HasPrefix(r, "-UNKILLABLE"):
+			unkillable = true
+		case r != "-NOTBUSY No scripts in execution right now.\r\n":
+			t.Fatalf("unexpected reply %q", r)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if r := <-result; r != ":1\r\n" {
+		t.Errorf("script should run to the end, got %q", r)
+	}
+}
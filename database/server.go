@@ -7,14 +7,17 @@ import (
 	"time"
 
 	"godis/config"
+	"godis/database/acl"
 	"godis/database/aof"
 	"godis/database/cluster"
+	_ "godis/database/commands" // register data commands into engine
 	"godis/database/engine"
 	"godis/database/publish"
+	"godis/database/script"
 	"godis/interface/database"
 	"godis/interface/redis"
 	"godis/lib/logger"
-	"godis/lib/utils"
+	_ "godis/module" // register commands used to restore module data
 	"godis/redis/connection"
 	"godis/redis/protocol"
 )
@@ -28,51 +31,76 @@ type Server struct {
 	closed       chan struct{}
 	cluster      *cluster.Cluster
 	publish      publish.Publish
+	clients      database.ClientManager // 由网络层注入，用于 CLIENT LIST/KILL
+	pause        clientPause
+	slowLog      slowLog
+	acl          *acl.ACL
+	tracking     *trackingTable
+	scripts      *script.Cache
+	functions    *script.Functions
+	scriptRuns   runningScripts
+	executing    atomic.Int64 // 客户端正在执行的命令数，不包括暂停中的命令，SHUTDOWN 等待它们完成
+	shutdown     shutdownState
 }
 
 func initServer() *Server {
 	server := &Server{
 		closed: make(chan struct{}, 1),
 	}
-	if config.Properties.Databases <= 0 {
-		config.Properties.Databases = 16
-	}
-	server.dbSet = make([]*atomic.Value, config.Properties.Databases)
+	setDefaultProperties()
+	server.tracking = makeTrackingTable(server.getClient)
+	server.scripts = script.NewCache()
+	server.functions = script.NewFunctions()
+	server.dbSet = make([]*atomic.Value, config.Properties().Databases)
 	for i := range server.dbSet {
 		singleDB := engine.MakeDB()
 		singleDB.SetIndex(i)
+		singleDB.SetKeysChangedHook(server.tracking.invalidate)
 		holder := &atomic.Value{}
 		holder.Store(singleDB)
 		server.dbSet[i] = holder
 	}
+	server.registerKeyspaceMetrics()
+	server.initACL()
 
-	if config.Properties.AppendOnly {
-		if config.Properties.AofFilename == "" {
-			config.Properties.AofFilename = "dump.aof"
-		}
-		server.AofFileSize = utils.GetFileSizeByName(config.Properties.AofFilename)
-
-		AofPersister, err := aof.NewPersister(server, config.Properties.AofFilename, true, config.Properties.AofFsync, MakeAuxiliaryServer)
+	if config.Properties().AppendOnly {
+		AofPersister, err := aof.NewPersister(server, config.Properties().AofDirname, config.Properties().AofFilename,
+			true, config.Properties().AofFsync, MakeAuxiliaryServer)
 		if err != nil {
 			logger.Fatal(err)
 		}
 		server.bindPersister(AofPersister)
+		server.AofFileSize = AofPersister.Size()
 
-		if config.Properties.AutoAofRewrite {
-			if config.Properties.AutoAofRewritePercentage <= 0 {
-				config.Properties.AutoAofRewritePercentage = 100
-			}
-			if config.Properties.AutoAofRewriteMinSize <= 0 {
-				config.Properties.AutoAofRewriteMinSize = 16
-			}
-
-			go server.autoAofRewrite()
-		}
+		// auto_aof_rewrite 可以在运行时打开，所以总是启动检查
+		go server.autoAofRewrite()
 	}
+	config.AddObserver(server.onConfigChanged)
 
 	return server
 }
 
+// setDefaultProperties 补全未设置的配置项，替换为修改后的副本而不是修改其他协程可能正在读取的配置
+func setDefaultProperties() {
+	properties := *config.Properties()
+	if properties.Databases <= 0 {
+		properties.Databases = 16
+	}
+	if properties.AofFilename == "" {
+		properties.AofFilename = "dump.aof"
+	}
+	if properties.AofDirname == "" {
+		properties.AofDirname = "appendonlydir"
+	}
+	if properties.AutoAofRewritePercentage <= 0 {
+		properties.AutoAofRewritePercentage = 100
+	}
+	if properties.AutoAofRewriteMinSize <= 0 {
+		properties.AutoAofRewriteMinSize = 16
+	}
+	config.SetProperties(&properties)
+}
+
 func NewStandaloneServer() *Server {
 	server := initServer()
 	return server
@@ -81,7 +109,7 @@ func NewStandaloneServer() *Server {
 func NewClusterServer(peers []string) *Server {
 	server := initServer()
 
-	cluster := cluster.NewCluster(config.Properties.Self)
+	cluster := cluster.NewCluster(config.Properties().Self)
 	cluster.AddPeers(peers...)
 	if cluster == nil {
 		logger.Fatalf("please set 'self'(self ip:port) in conf file")
@@ -90,30 +118,59 @@ func NewClusterServer(peers []string) *Server {
 	return server
 }
 
-func (s *Server) Exec(client redis.Connection, cmdLine [][]byte) redis.Reply {
-	if s.cluster == nil {
-		return s.execCluster(client, cmdLine)
+// Exec executes cmdLine through the cluster when it is enabled, otherwise on local databases
+func (s *Server) Exec(client redis.Connection, cmdLine [][]byte) (result redis.Reply) {
+	start := time.Now()
+	client.SetExecStart(start)
+	if s.cluster != nil {
+		result = s.execCluster(client, cmdLine)
+	} else {
+		result = s.execStandalone(client, cmdLine)
 	}
-
-	return s.execStandalone(client, cmdLine)
+	recordCommand(strings.ToLower(string(cmdLine[0])), result, time.Since(start))
+	if _, ok := client.(*connection.FakeConn); !ok {
+		s.slowLog.record(client, cmdLine, time.Since(client.GetExecStart()))
+	}
+	return result
 }
 
 func (s *Server) execStandalone(client redis.Connection, cmdLine [][]byte) redis.Reply {
 
 	cmdName := strings.ToLower(string(cmdLine[0]))
+	client.SetLastCmd(cmdName)
+	if errReply := checkSystemArity(client, cmdName, cmdLine); errReply != nil {
+		return errReply
+	}
 
 	if cmdName == "ping" {
 		logger.Debugf("received heart beat from %v", client.Name())
+		if client.GetSubscribeNum() > 0 && client.GetProtocol() == protocol.RESP2 {
+			return protocol.MakeMultiBulkReply([][]byte{[]byte("pong"), {}})
+		}
 		return protocol.MakePongReply()
 	}
 
 	if _, ok := client.(*connection.FakeConn); !ok {
 		if cmdName == "auth" {
-			return Auth(client, cmdLine[1:])
+			return Auth(s, client, cmdLine[1:])
+		}
+		if cmdName == "hello" {
+			return Hello(s, client, cmdLine[1:])
 		}
-		if !isAuthenticated(client) {
+		if !isAuthenticated(s, client) {
 			return protocol.MakeErrReply("NOAUTH Authentication required")
 		}
+		if errReply := s.checkPermission(client, cmdLine); errReply != nil {
+			return errReply
+		}
+		if errReply := checkSubscribeContext(client, cmdName); errReply != nil {
+			return errReply
+		}
+		s.waitIfPaused(client, cmdName)
+		client.SetExecStart(time.Now())
+		s.feedMonitors(client, cmdName, cmdLine)
+		s.executing.Add(1)
+		defer s.executing.Add(-1)
 	}
 
 	switch cmdName {
@@ -141,6 +198,32 @@ func (s *Server) execStandalone(client redis.Connection, cmdLine [][]byte) redis
 		return UnSubscribe(s, client, cmdLine[1:])
 	case "pubsub":
 		return PubSub(s, cmdLine[1:])
+	case "client":
+		return execClient(s, client, cmdLine[1:])
+	case "slowlog":
+		return execSlowLog(s, cmdLine[1:])
+	case "monitor":
+		return Monitor(client, cmdLine[1:])
+	case "acl":
+		return execACL(s, client, cmdLine[1:])
+	case "eval":
+		return Eval(s, client, cmdLine[1:])
+	case "evalsha":
+		return EvalSHA(s, client, cmdLine[1:])
+	case "script":
+		return execScript(s, cmdLine[1:])
+	case "function":
+		return execFunction(s, client, cmdLine[1:])
+	case "fcall":
+		return FCall(s, client, cmdLine[1:], false)
+	case "fcall_ro":
+		return FCall(s, client, cmdLine[1:], true)
+	case "command":
+		return execCommand(cmdLine[1:])
+	case "config":
+		return execConfig(client, cmdLine[1:])
+	case "shutdown":
+		return execShutdown(s, cmdLine[1:])
 	}
 
 	dbIndex := client.GetDBIndex()
@@ -148,6 +231,9 @@ func (s *Server) execStandalone(client redis.Connection, cmdLine [][]byte) redis
 	if errReply != nil {
 		return errReply
 	}
+	if s.tracking != nil && !client.GetMultiStatus() { // 重写 aof 时使用的 Server 没有 tracking
+		s.tracking.trackRead(client, cmdLine)
+	}
 	return selectedDB.Exec(client, cmdLine)
 }
 func (s *Server) execCluster(client redis.Connection, cmdLine [][]byte) redis.Reply {
@@ -161,9 +247,9 @@ func (s *Server) execCluster(client redis.Connection, cmdLine [][]byte) redis.Re
 
 	// if _, ok := client.(*connection.FakeConn); !ok { // fakeConn不做校验
 	// 	if cmdName == "auth" {
-	// 		return Auth(client, cmdLine[1:])
+	// 		return Auth(s, client, cmdLine[1:])
 	// 	}
-	// 	if !isAuthenticated(client) {
+	// 	if !isAuthenticated(s, client) {
 	// 		return protocol.MakeErrReply("NOAUTH Authentication required")
 	// 	}
 	// }
@@ -228,7 +314,8 @@ func (s *Server) execCluster(client redis.Connection, cmdLine [][]byte) redis.Re
 }
 
 func (s *Server) AfterClientClose(c redis.Connection) {
-	UnSubscribe(s, c, nil)
+	s.publish.Remove(c)
+	s.tracking.disable(c)
 }
 
 func (s *Server) ForEach(dbIndex int, cb func(key string, data *database.DataEntity, expiration *time.Time) bool) {
@@ -251,7 +338,7 @@ func (s *Server) mustSelectDB(dbIndex int) *engine.DB {
 
 func (s *Server) Close() {
 	s.closed <- struct{}{}
-	if config.Properties.AppendOnly {
+	if config.Properties().AppendOnly {
 		s.AofPersister.Close()
 	}
 
@@ -274,14 +361,14 @@ func (s *Server) autoAofRewrite() {
 	for {
 		select {
 		case <-ticker.C:
-			if s.rewriting.Load() {
+			if !config.Properties().AutoAofRewrite || s.rewriting.Load() {
 				continue
 			}
 			s.rewriteWait.Add(1)
-			aofFileSize := utils.GetFileSizeByName(config.Properties.AofFilename)
+			aofFileSize := s.AofPersister.Size()
 
-			if aofFileSize > s.AofFileSize*config.Properties.AutoAofRewritePercentage/100 &&
-				aofFileSize > config.Properties.AutoAofRewriteMinSize*1024*1024 {
+			if aofFileSize > s.AofFileSize*config.Properties().AutoAofRewritePercentage/100 &&
+				aofFileSize > config.Properties().AutoAofRewriteMinSize*1024*1024 {
 				go s.AofPersister.Rewrite(&s.rewriteWait, &s.rewriting)
 				s.rewriteWait.Wait()
 				s.AofFileSize = aofFileSize
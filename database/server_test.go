@@ -0,0 +1,20 @@
+package database
+
+import (
+	"testing"
+
+	"godis/redis/protocol"
+)
+
+// TestExecStandalone 单机模式的命令在本地执行，不会转发给集群
+func TestExecStandalone(t *testing.T) {
+	s, _ := makeShutdownTestServer(t)
+	c := newRecordConn(1, protocol.RESP2)
+	if r := s.Exec(c, [][]byte{[]byte("PING")}); r == nil || string(r.ToBytes()) != "+PONG\r\n" {
+		t.Fatalf("unexpected reply of PING: %v", r)
+	}
+	execString(s, c, "SET", "k", "v")
+	if r := execString(s, c, "GET", "k"); r != "$1\r\nv\r\n" {
+		t.Errorf("unexpected reply of GET: %q", r)
+	}
+}
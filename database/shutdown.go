@@ -0,0 +1,151 @@
+package database
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"godis/config"
+	"godis/interface/redis"
+	"godis/lib/logger"
+	"godis/redis/protocol"
+)
+
+var shutdownErrReply = protocol.MakeErrReply("ERR Errors trying to SHUTDOWN. Check logs.")
+
+// shutdownState 记录正在等待中的 SHUTDOWN，等待期间可以被 SHUTDOWN ABORT 取消
+type shutdownState struct {
+	mu      sync.Mutex
+	aborted chan struct{} // 不为空表示 SHUTDOWN 正在等待，ABORT 时关闭
+	done    bool          // 已经开始关闭，不能再取消
+}
+
+// execShutdown SHUTDOWN [NOSAVE|SAVE] [NOW] [FORCE] [ABORT]
+//
+// 与 redis 一样，关闭前先暂停写命令并等待其他客户端执行中的命令完成，等待最多 shutdown_timeout 秒，
+// 期间可以使用 SHUTDOWN ABORT 取消。NOW 跳过等待，SAVE 在关闭前重写 AOF 生成一份紧凑的快照，
+// FORCE 忽略快照失败等错误继续关闭。成功时不回复，连接由网络层在排空后关闭，AOF 刷盘后进程退出
+func execShutdown(s *Server, args [][]byte) redis.Reply {
+	var save, noSave, now, force, abort bool
+	for _, arg := range args {
+		switch strings.ToLower(string(arg)) {
+		case "save":
+			save = true
+		case "nosave":
+			noSave = true
+		case "now":
+			now = true
+		case "force":
+			force = true
+		case "abort":
+			abort = true
+		default:
+			return protocol.MakeSyntaxErrReply()
+		}
+	}
+	if (save && noSave) || (abort && len(args) > 1) {
+		return protocol.MakeSyntaxErrReply()
+	}
+	if abort {
+		return s.abortShutdown()
+	}
+	if s.clients == nil {
+		return protocol.MakeErrReply("ERR SHUTDOWN is not supported without network layer")
+	}
+
+	st := &s.shutdown
+	st.mu.Lock()
+	if st.aborted != nil || st.done {
+		st.mu.Unlock()
+		return protocol.MakeErrReply("ERR Shutdown already in progress")
+	}
+	aborted := make(chan struct{})
+	st.aborted = aborted
+	st.mu.Unlock()
+
+	if !now {
+		timeout := time.Duration(config.Properties().ShutdownTimeout) * time.Second
+		s.pauseClients(pauseWrite, time.Now().Add(timeout))
+		s.waitExecuting(timeout, aborted)
+	}
+	if !s.commitShutdown(aborted) {
+		logger.Warn("shutdown is aborted")
+		s.unpauseClients()
+		return shutdownErrReply
+	}
+	if save && !s.saveBeforeShutdown() && !force {
+		s.shutdown.mu.Lock()
+		s.shutdown.done = false
+		s.shutdown.mu.Unlock()
+		s.unpauseClients()
+		return shutdownErrReply
+	}
+
+	// 不再暂停写命令，网络层排空连接时会执行完它们并由 AOF 持久化
+	s.unpauseClients()
+	logger.Info("user requested shutdown...")
+	s.clients.Shutdown()
+	return protocol.MakeNoReply()
+}
+
+// abortShutdown 取消正在等待的 SHUTDOWN
+func (s *Server) abortShutdown() redis.Reply {
+	st := &s.shutdown
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.aborted == nil {
+		return protocol.MakeErrReply("ERR No shutdown in progress.")
+	}
+	close(st.aborted)
+	st.aborted = nil
+	return protocol.MakeOkReply()
+}
+
+// commitShutdown 结束等待状态，之后不能再取消，已经被 ABORT 取消时返回 false
+func (s *Server) commitShutdown(aborted chan struct{}) bool {
+	st := &s.shutdown
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.aborted != aborted {
+		return false
+	}
+	st.aborted = nil
+	st.done = true
+	return true
+}
+
+// waitExecuting 等待其他客户端正在执行的命令完成，超时后同样继续关闭
+func (s *Server) waitExecuting(timeout time.Duration, aborted <-chan struct{}) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	// 计数中包括 SHUTDOWN 本身
+	for s.executing.Load() > 1 {
+		select {
+		case <-aborted:
+			return
+		case <-timer.C:
+			logger.Warn("some commands are still executing after shutdown_timeout")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// saveBeforeShutdown 重写 AOF 作为关闭前的快照，godis 没有 RDB，未开启 AOF 时无法保存
+func (s *Server) saveBeforeShutdown() bool {
+	if !config.Properties().AppendOnly || s.AofPersister == nil {
+		logger.Warn("SHUTDOWN SAVE requires append_only to be enabled")
+		return false
+	}
+	if s.rewriting.Load() {
+		s.rewriteWait.Wait()
+	}
+	s.rewriteWait.Add(1)
+	if err := s.AofPersister.Rewrite(&s.rewriteWait, &s.rewriting); err != nil {
+		logger.Error("rewrite aof before shutdown failed: " + err.Error())
+		return false
+	}
+	return true
+}
@@ -0,0 +1,119 @@
+package database
+
+import (
+	"testing"
+	"time"
+
+	"godis/config"
+	"godis/interface/redis"
+	"godis/lib/utils"
+	"godis/redis/protocol"
+)
+
+// shutdownRecorder 记录 SHUTDOWN 是否通知了网络层
+type shutdownRecorder struct {
+	requested chan struct{}
+}
+
+func (r *shutdownRecorder) ForEachClient(cb func(c redis.Connection) bool) {}
+
+func (r *shutdownRecorder) GetClient(id int64) (redis.Connection, bool) { return nil, false }
+
+func (r *shutdownRecorder) KillClient(id int64) bool { return false }
+
+func (r *shutdownRecorder) FeedMonitors(c redis.Connection, cmdLine [][]byte) {}
+
+func (r *shutdownRecorder) Shutdown() { close(r.requested) }
+
+func makeShutdownTestServer(t *testing.T) (*Server, *shutdownRecorder) {
+	old := config.Properties()
+	properties := *old
+	properties.AppendOnly = false
+	properties.Password = ""
+	properties.ShutdownTimeout = 5
+	config.SetProperties(&properties)
+	t.Cleanup(func() { config.SetProperties(old) })
+
+	s := NewStandaloneServer()
+	recorder := &shutdownRecorder{requested: make(chan struct{})}
+	s.SetClientManager(recorder)
+	return s, recorder
+}
+
+func TestShutdownAbort(t *testing.T) {
+	s, recorder := makeShutdownTestServer(t)
+	c1 := newRecordConn(1, protocol.RESP2)
+	c2 := newRecordConn(2, protocol.RESP2)
+
+	r := s.Exec(c1, utils.ToCmdLine("SHUTDOWN", "ABORT"))
+	if string(r.ToBytes()) != "-ERR No shutdown in progress.\r\n" {
+		t.Errorf("unexpected reply %q", r.ToBytes())
+	}
+	if r := s.Exec(c1, utils.ToCmdLine("SHUTDOWN", "SAVE", "NOSAVE")); !protocol.IsErrorReply(r) {
+		t.Error("expect syntax error")
+	}
+
+	// 模拟另一个客户端正在执行的命令，SHUTDOWN 会等待它完成
+	s.executing.Add(1)
+	done := make(chan redis.Reply, 1)
+	go func() {
+		done <- s.Exec(c1, utils.ToCmdLine("SHUTDOWN"))
+	}()
+	deadline := time.Now().Add(time.Second)
+	for {
+		r = s.Exec(c2, utils.ToCmdLine("SHUTDOWN", "ABORT"))
+		if protocol.IsOKReply(r) || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if !protocol.IsOKReply(r) {
+		t.Fatalf("abort failed: %q", r.ToBytes())
+	}
+	select {
+	case r := <-done:
+		if !protocol.IsErrorReply(r) {
+			t.Errorf("expect aborted shutdown to fail, got %q", r.ToBytes())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("shutdown is not aborted")
+	}
+	select {
+	case <-recorder.requested:
+		t.Error("aborted shutdown should not stop the server")
+	default:
+	}
+	// 写命令不再被暂停
+	if r := s.Exec(c2, utils.ToCmdLine("SET", "k", "v")); !protocol.IsOKReply(r) {
+		t.Errorf("unexpected reply %q", r.ToBytes())
+	}
+	s.executing.Add(-1)
+
+	if r := s.Exec(c1, utils.ToCmdLine("SHUTDOWN")); len(r.ToBytes()) != 0 {
+		t.Errorf("expect no reply, got %q", r.ToBytes())
+	}
+	select {
+	case <-recorder.requested:
+	default:
+		t.Error("shutdown is not requested")
+	}
+	if r := s.Exec(c2, utils.ToCmdLine("SHUTDOWN", "NOW")); !protocol.IsErrorReply(r) {
+		t.Error("expect shutdown already in progress")
+	}
+}
+
+func TestShutdownSaveWithoutAof(t *testing.T) {
+	s, recorder := makeShutdownTestServer(t)
+	c := newRecordConn(1, protocol.RESP2)
+	if r := s.Exec(c, utils.ToCmdLine("SHUTDOWN", "SAVE", "NOW")); !protocol.IsErrorReply(r) {
+		t.Errorf("expect save to fail without aof, got %q", r.ToBytes())
+	}
+	if r := s.Exec(c, utils.ToCmdLine("SHUTDOWN", "SAVE", "NOW", "FORCE")); protocol.IsErrorReply(r) {
+		t.Errorf("expect FORCE to ignore save error, got %q", r.ToBytes())
+	}
+	select {
+	case <-recorder.requested:
+	default:
+		t.Error("shutdown is not requested")
+	}
+}
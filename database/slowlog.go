@@ -0,0 +1,203 @@
+package database
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"godis/config"
+	"godis/database/acl"
+	"godis/interface/redis"
+	"godis/redis/protocol"
+)
+
+const (
+	slowLogMaxArgc   = 32  // 每条慢日志最多记录的参数个数
+	slowLogMaxArgLen = 128 // 每个参数最多记录的字节数
+)
+
+type slowLogEntry struct {
+	id         int64
+	timestamp  time.Time
+	duration   time.Duration
+	args       [][]byte
+	clientAddr string
+	clientName string
+}
+
+// slowLog 使用环形缓冲区保存最近的慢命令，满了之后覆盖最旧的记录
+type slowLog struct {
+	mu      sync.Mutex
+	entries []*slowLogEntry
+	head    int // 下一条记录写入的位置
+	size    int
+	nextID  int64
+}
+
+// record appends an entry if cost exceeds slowlog_log_slower_than
+func (l *slowLog) record(client redis.Connection, cmdLine [][]byte, cost time.Duration) {
+	threshold := config.Properties().SlowlogLogSlowerThan
+	if threshold < 0 || cost < time.Duration(threshold)*time.Microsecond {
+		return
+	}
+	entry := &slowLogEntry{
+		timestamp:  time.Now(),
+		duration:   cost,
+		args:       truncateSlowLogArgs(cmdLine),
+		clientAddr: client.Name(),
+		clientName: client.GetName(),
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.resize(config.Properties().SlowlogMaxLen)
+	if len(l.entries) == 0 {
+		return
+	}
+	entry.id = l.nextID
+	l.nextID++
+	l.entries[l.head] = entry
+	l.head = (l.head + 1) % len(l.entries)
+	if l.size < len(l.entries) {
+		l.size++
+	}
+}
+
+// resize keeps the newest entries when slowlog_max_len changed, caller must hold l.mu
+func (l *slowLog) resize(maxLen int) {
+	if maxLen < 0 {
+		maxLen = 0
+	}
+	if maxLen == len(l.entries) {
+		return
+	}
+	newest := l.latest(maxLen)
+	l.entries = make([]*slowLogEntry, maxLen)
+	l.size = len(newest)
+	for i := range newest {
+		l.entries[i] = newest[len(newest)-1-i]
+	}
+	if maxLen > 0 {
+		l.head = l.size % maxLen
+	} else {
+		l.head = 0
+	}
+}
+
+// latest returns at most count entries from newest to oldest, caller must hold l.mu
+func (l *slowLog) latest(count int) []*slowLogEntry {
+	if count < 0 || count > l.size {
+		count = l.size
+	}
+	result := make([]*slowLogEntry, 0, count)
+	for i := 1; i <= count; i++ {
+		idx := (l.head - i + len(l.entries)) % len(l.entries)
+		result = append(result, l.entries[idx])
+	}
+	return result
+}
+
+func (l *slowLog) get(count int) []*slowLogEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.latest(count)
+}
+
+func (l *slowLog) len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.size
+}
+
+func (l *slowLog) reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := range l.entries {
+		l.entries[i] = nil
+	}
+	l.head = 0
+	l.size = 0
+}
+
+func truncateSlowLogArgs(cmdLine [][]byte) [][]byte {
+	argc := len(cmdLine)
+	if argc > slowLogMaxArgc {
+		argc = slowLogMaxArgc
+	}
+	args := make([][]byte, 0, argc)
+	redactFrom := acl.RedactFrom(cmdLine)
+	for i := 0; i < argc; i++ {
+		if i == slowLogMaxArgc-1 && len(cmdLine) > slowLogMaxArgc {
+			more := len(cmdLine) - slowLogMaxArgc + 1
+			args = append(args, []byte("... ("+strconv.Itoa(more)+" more arguments)"))
+			break
+		}
+		arg := cmdLine[i]
+		if i >= redactFrom {
+			args = append(args, []byte("(redacted)"))
+			continue
+		}
+		if len(arg) > slowLogMaxArgLen {
+			more := len(arg) - slowLogMaxArgLen
+			truncated := make([]byte, 0, slowLogMaxArgLen+32)
+			truncated = append(truncated, arg[:slowLogMaxArgLen]...)
+			truncated = append(truncated, "... ("+strconv.Itoa(more)+" more bytes)"...)
+			args = append(args, truncated)
+			continue
+		}
+		args = append(args, append([]byte(nil), arg...))
+	}
+	return args
+}
+
+func (e *slowLogEntry) toReply() redis.Reply {
+	return protocol.MakeMultiRawReply([]redis.Reply{
+		protocol.MakeIntReply(e.id),
+		protocol.MakeIntReply(e.timestamp.Unix()),
+		protocol.MakeIntReply(e.duration.Microseconds()),
+		protocol.MakeMultiBulkReply(e.args),
+		protocol.MakeBulkReply([]byte(e.clientAddr)),
+		protocol.MakeBulkReply([]byte(e.clientName)),
+	})
+}
+
+// execSlowLog SLOWLOG GET [count] | LEN | RESET
+func execSlowLog(s *Server, args [][]byte) redis.Reply {
+	if len(args) == 0 {
+		return protocol.MakeArgNumErrReply("slowlog")
+	}
+	subCmd := strings.ToLower(string(args[0]))
+	switch subCmd {
+	case "get":
+		if len(args) > 2 {
+			return protocol.MakeArgNumErrReply("slowlog|get")
+		}
+		count := 10
+		if len(args) == 2 {
+			parsed, err := strconv.Atoi(string(args[1]))
+			if err != nil || parsed < -1 {
+				return protocol.MakeErrReply("ERR count should be greater than or equal to -1")
+			}
+			count = parsed
+		}
+		entries := s.slowLog.get(count)
+		replies := make([]redis.Reply, len(entries))
+		for i, entry := range entries {
+			replies[i] = entry.toReply()
+		}
+		return protocol.MakeMultiRawReply(replies)
+	case "len":
+		if len(args) != 1 {
+			return protocol.MakeArgNumErrReply("slowlog|len")
+		}
+		return protocol.MakeIntReply(int64(s.slowLog.len()))
+	case "reset":
+		if len(args) != 1 {
+			return protocol.MakeArgNumErrReply("slowlog|reset")
+		}
+		s.slowLog.reset()
+		return protocol.MakeOkReply()
+	}
+	return protocol.MakeErrReply("ERR unknown subcommand '" + subCmd + "'. Try SLOWLOG HELP.")
+}
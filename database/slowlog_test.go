@@ -0,0 +1,88 @@
+package database
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"godis/config"
+	"godis/lib/utils"
+	"godis/redis/connection"
+	"godis/redis/protocol"
+)
+
+func TestSlowLog(t *testing.T) {
+	config.Properties().SlowlogLogSlowerThan = 1000
+	config.Properties().SlowlogMaxLen = 3
+	log := &slowLog{}
+	client := connection.NewFakeConn()
+
+	log.record(client, utils.ToCmdLine("GET", "fast"), time.Microsecond)
+	if log.len() != 0 {
+		t.Fatal("fast command should not be recorded")
+	}
+	for i := 0; i < 5; i++ {
+		log.record(client, utils.ToCmdLine("SET", "k"+strconv.Itoa(i), "v"), 2*time.Millisecond)
+	}
+	if log.len() != 3 {
+		t.Fatalf("expect 3 entries, got %d", log.len())
+	}
+	entries := log.get(-1)
+	for i, entry := range entries {
+		if entry.id != int64(4-i) || string(entry.args[1]) != "k"+strconv.Itoa(4-i) {
+			t.Errorf("unexpected entry %d: %d %s", i, entry.id, entry.args[1])
+		}
+	}
+	if got := log.get(1); len(got) != 1 || got[0].id != 4 {
+		t.Error("get with count failed")
+	}
+
+	config.Properties().SlowlogMaxLen = 2
+	log.record(client, utils.ToCmdLine("SET", "k5", "v"), 2*time.Millisecond)
+	entries = log.get(-1)
+	if len(entries) != 2 || entries[0].id != 5 || entries[1].id != 4 {
+		t.Error("shrink slowlog failed")
+	}
+
+	log.reset()
+	if log.len() != 0 {
+		t.Error("reset failed")
+	}
+}
+
+func TestTruncateSlowLogArgs(t *testing.T) {
+	cmdLine := [][]byte{[]byte("SADD"), []byte(strings.Repeat("a", 200))}
+	for i := 0; i < 40; i++ {
+		cmdLine = append(cmdLine, []byte("m"))
+	}
+	args := truncateSlowLogArgs(cmdLine)
+	if len(args) != slowLogMaxArgc {
+		t.Fatalf("expect %d args, got %d", slowLogMaxArgc, len(args))
+	}
+	if string(args[1]) != strings.Repeat("a", 128)+"... (72 more bytes)" {
+		t.Errorf("unexpected truncated arg: %s", args[1])
+	}
+	if string(args[slowLogMaxArgc-1]) != "... (11 more arguments)" {
+		t.Errorf("unexpected last arg: %s", args[slowLogMaxArgc-1])
+	}
+}
+
+// TestSlowLogExcludesPause 慢日志只记录执行时间，不包括 CLIENT PAUSE 造成的等待
+func TestSlowLogExcludesPause(t *testing.T) {
+	s, _ := makeShutdownTestServer(t)
+	config.Properties().SlowlogLogSlowerThan = 20000
+	admin := newRecordConn(1, protocol.RESP2)
+	client := newRecordConn(2, protocol.RESP2)
+
+	execString(s, admin, "CLIENT", "PAUSE", "50", "ALL")
+	start := time.Now()
+	execString(s, client, "PUBLISH", "ch", "msg")
+	execString(s, client, "SET", "k", "v")
+	if time.Since(start) < 50*time.Millisecond {
+		t.Fatal("expect client to be paused")
+	}
+	if n := s.slowLog.len(); n != 0 {
+		t.Errorf("paused command should not be recorded, got %d entries", n)
+	}
+}
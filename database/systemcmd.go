@@ -1,32 +1,114 @@
 package database
 
 import (
-	"godis/config"
 	"godis/interface/redis"
+	"godis/redis/connection"
 	"godis/redis/protocol"
 	"strconv"
+	"strings"
 )
 
-func Auth(c redis.Connection, args [][]byte) redis.Reply {
-	if len(args) != 1 {
-		return protocol.MakeErrReply("ERR wrong number of arguments for 'auth' command")
+// 通过 HELLO 返回给客户端的服务端信息，version 与兼容的 redis 版本一致
+const (
+	serverName    = "redis"
+	serverVersion = "7.0.0"
+)
+
+// Hello HELLO [protover [AUTH username password] [SETNAME clientname]]
+func Hello(s *Server, c redis.Connection, args [][]byte) redis.Reply {
+	proto := c.GetProtocol()
+	if len(args) > 0 {
+		ver, err := strconv.Atoi(string(args[0]))
+		if err != nil {
+			return protocol.MakeErrReply("ERR Protocol version is not an integer or out of range")
+		}
+		if ver != protocol.RESP2 && ver != protocol.RESP3 {
+			return protocol.MakeErrReply("NOPROTO unsupported protocol version")
+		}
+		proto = ver
+	}
+
+	var username, password, name string
+	var auth, setName bool
+	for i := 1; i < len(args); i++ {
+		option := strings.ToLower(string(args[i]))
+		switch {
+		case option == "auth" && i+2 < len(args):
+			auth = true
+			username, password = string(args[i+1]), string(args[i+2])
+			i += 2
+		case option == "setname" && i+1 < len(args):
+			setName = true
+			name = string(args[i+1])
+			if !isValidClientName(name) {
+				return protocol.MakeErrReply("ERR Client names cannot contain spaces, newlines or special characters.")
+			}
+			i++
+		default:
+			return protocol.MakeErrReply("ERR Syntax error in HELLO option '" + option + "'")
+		}
 	}
-	if config.Properties.Password == "" {
-		return protocol.MakeErrReply("ERR Client sent AUTH, but no password is set")
+
+	if auth {
+		if err := s.acl.Authenticate(username, password); err != nil {
+			return protocol.MakeErrReply(err.Error())
+		}
+		c.SetUser(username)
+	} else if !isAuthenticated(s, c) {
+		return protocol.MakeErrReply("NOAUTH HELLO must be called with the client already authenticated, " +
+			"otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client " +
+			"and select the RESP protocol version at the same time")
 	}
-	passwd := string(args[0])
-	c.SetPassword(passwd)
-	if config.Properties.Password != passwd {
-		return protocol.MakeErrReply("ERR invalid password")
+	if setName {
+		c.SetName(name)
 	}
-	return protocol.MakeOkReply()
+	c.SetProtocol(proto)
+
+	mode := "standalone"
+	if s.cluster != nil {
+		mode = "cluster"
+	}
+	keys := []redis.Reply{
+		protocol.MakeBulkReply([]byte("server")),
+		protocol.MakeBulkReply([]byte("version")),
+		protocol.MakeBulkReply([]byte("proto")),
+		protocol.MakeBulkReply([]byte("id")),
+		protocol.MakeBulkReply([]byte("mode")),
+		protocol.MakeBulkReply([]byte("role")),
+		protocol.MakeBulkReply([]byte("modules")),
+	}
+	values := []redis.Reply{
+		protocol.MakeBulkReply([]byte(serverName)),
+		protocol.MakeBulkReply([]byte(serverVersion)),
+		protocol.MakeIntReply(int64(proto)),
+		protocol.MakeIntReply(c.GetID()),
+		protocol.MakeBulkReply([]byte(mode)),
+		protocol.MakeBulkReply([]byte("master")),
+		protocol.MakeEmptyMultiBulkReply(),
+	}
+	return protocol.MakeMapReply(keys, values)
+}
+
+// subscribeContextCommands RESP2 客户端订阅之后只能执行这些命令，RESP3 下 push 消息与普通回复可以区分，不受限制
+var subscribeContextCommands = map[string]struct{}{
+	"subscribe":    {},
+	"unsubscribe":  {},
+	"psubscribe":   {},
+	"punsubscribe": {},
+	"ping":         {},
+	"quit":         {},
+	"reset":        {},
 }
 
-func isAuthenticated(c redis.Connection) bool {
-	if config.Properties.Password == "" {
-		return true
+func checkSubscribeContext(c redis.Connection, cmdName string) redis.Reply {
+	if c.GetSubscribeNum() == 0 || c.GetProtocol() != protocol.RESP2 {
+		return nil
 	}
-	return c.GetPassword() == config.Properties.Password
+	if _, ok := subscribeContextCommands[cmdName]; ok {
+		return nil
+	}
+	return protocol.MakeErrReply("ERR Can't execute '" + cmdName +
+		"': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context")
 }
 
 func SelectDB(c redis.Connection, args [][]byte, dbNum int) redis.Reply {
@@ -58,6 +140,18 @@ func SelectDB(c redis.Connection, args [][]byte, dbNum int) redis.Reply {
 	return protocol.MakeOkReply()
 }
 
+// Monitor marks client as a monitor, the network layer will then stream every command to it
+func Monitor(c redis.Connection, args [][]byte) redis.Reply {
+	if len(args) != 0 {
+		return protocol.MakeArgNumErrReply("monitor")
+	}
+	if c.GetMultiStatus() {
+		return protocol.MakeErrReply("ERR MONITOR is not allowed in MULTI")
+	}
+	c.SetFlag(connection.FlagMonitor)
+	return protocol.MakeOkReply()
+}
+
 func BGRewriteAof(s *Server, args [][]byte) redis.Reply {
 	if s.rewriting.Load() {
 		return protocol.MakeStatusReply("Background append only file rewriting doing")
@@ -0,0 +1,366 @@
+package database
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"godis/config"
+	"godis/database/engine"
+	"godis/interface/redis"
+	"godis/redis/connection"
+	"godis/redis/protocol"
+)
+
+const trackingChannel = "__redis__:invalidate"
+
+var errTrackingModeSwitch = errors.New("ERR You can't switch BCAST mode on/off before disabling tracking for this client, and then re-enabling it with a different mode.")
+
+// trackingClient 记录开启 CLIENT TRACKING 的客户端
+type trackingClient struct {
+	id       int64 // 连接会被复用，发送前需要确认 client 仍然是同一个客户端
+	client   redis.Connection
+	bcast    bool
+	prefixes []string // BCAST 模式下订阅的前缀，为空时匹配所有 key
+	redirect int64    // 失效消息转发到的客户端 ID，0 表示发给自己
+}
+
+// invalidation 是一条待发送的失效消息
+type invalidation struct {
+	target trackingClient // 复制一份，避免和 CLIENT TRACKING 修改 redirect 产生竞争
+	keys   []string
+}
+
+// trackingTable 实现 client side caching：
+// 默认模式下记录每个客户端读过的 key，key 被修改或过期后通知读过它的客户端，通知一次后不再记录；
+// BCAST 模式下不记录 key，通知所有前缀匹配的客户端
+type trackingTable struct {
+	mu      sync.Mutex
+	clients map[int64]*trackingClient
+	keys    map[string]map[int64]struct{} // key -> 读过该 key 的客户端
+	active  atomic.Int32                  // 开启 tracking 的客户端数量，为 0 时写路径上不需要加锁
+
+	getter func(id int64) (redis.Connection, bool) // 查找 REDIRECT 的目标客户端
+}
+
+func makeTrackingTable(getter func(id int64) (redis.Connection, bool)) *trackingTable {
+	t := &trackingTable{
+		clients: make(map[int64]*trackingClient),
+		keys:    make(map[string]map[int64]struct{}),
+		getter:  getter,
+	}
+	return t
+}
+
+// enable turns on tracking for c, prefixes are appended if c has been tracking in BCAST mode
+func (t *trackingTable) enable(c redis.Connection, bcast bool, prefixes []string, redirect int64) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tc, ok := t.clients[c.GetID()]
+	if ok {
+		if tc.bcast != bcast {
+			return errTrackingModeSwitch
+		}
+		tc.prefixes = append(tc.prefixes, prefixes...)
+		tc.redirect = redirect
+		return nil
+	}
+	t.clients[c.GetID()] = &trackingClient{
+		id:       c.GetID(),
+		client:   c,
+		bcast:    bcast,
+		prefixes: prefixes,
+		redirect: redirect,
+	}
+	t.active.Add(1)
+	c.SetFlag(connection.FlagTracking)
+	return nil
+}
+
+// disable turns off tracking for c, keys read by c are removed lazily when they are invalidated
+func (t *trackingTable) disable(c redis.Connection) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.clients[c.GetID()]; !ok {
+		return
+	}
+	delete(t.clients, c.GetID())
+	t.active.Add(-1)
+	c.ClearFlag(connection.FlagTracking)
+	if len(t.clients) == 0 {
+		t.keys = make(map[string]map[int64]struct{})
+	}
+}
+
+func (t *trackingTable) get(c redis.Connection) (trackingClient, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tc, ok := t.clients[c.GetID()]
+	if !ok {
+		return trackingClient{}, false
+	}
+	return *tc, true
+}
+
+// trackRead remembers keys read by cmdLine, it is called before the command is executed
+// so a write happened during execution will not be missed
+func (t *trackingTable) trackRead(c redis.Connection, cmdLine [][]byte) {
+	if t.active.Load() == 0 || !engine.IsReadOnlyCommand(string(cmdLine[0])) {
+		return
+	}
+	writeKeys, readKeys, ok := engine.GetRelatedKeys(cmdLine)
+	if !ok {
+		return
+	}
+	t.mu.Lock()
+	tc, ok := t.clients[c.GetID()]
+	if !ok || tc.bcast {
+		t.mu.Unlock()
+		return
+	}
+	for _, keys := range [][]string{writeKeys, readKeys} {
+		for _, key := range keys {
+			readers, ok := t.keys[key]
+			if !ok {
+				readers = make(map[int64]struct{})
+				t.keys[key] = readers
+			}
+			readers[tc.id] = struct{}{}
+		}
+	}
+	msgs := t.evict(config.Properties().TrackingTableMaxKeys)
+	t.mu.Unlock()
+
+	for _, msg := range msgs {
+		t.send(msg)
+	}
+}
+
+// evict removes keys until at most maxKeys keys are tracked, like redis the readers are told the keys are invalid
+// since they will not be notified of later changes. Caller must hold t.mu
+func (t *trackingTable) evict(maxKeys int) []*invalidation {
+	if maxKeys <= 0 || len(t.keys) <= maxKeys {
+		return nil
+	}
+	batches := make(map[int64][]string)
+	for key, readers := range t.keys { // map 的遍历顺序是随机的，相当于随机淘汰
+		if len(t.keys) <= maxKeys {
+			break
+		}
+		for id := range readers {
+			batches[id] = append(batches[id], key)
+		}
+		delete(t.keys, key)
+	}
+	msgs := make([]*invalidation, 0, len(batches))
+	for id, batch := range batches {
+		if tc, ok := t.clients[id]; ok {
+			msgs = append(msgs, &invalidation{target: *tc, keys: batch})
+		}
+	}
+	return msgs
+}
+
+// invalidate is the keys changed hook of engine.DB, it runs with key locks held and must not block
+func (t *trackingTable) invalidate(keys []string) {
+	if t.active.Load() == 0 || len(keys) == 0 {
+		return
+	}
+	t.mu.Lock()
+	batches := make(map[*trackingClient][]string)
+	for _, key := range keys {
+		for id := range t.keys[key] {
+			if tc, ok := t.clients[id]; ok && !tc.bcast {
+				batches[tc] = append(batches[tc], key)
+			}
+		}
+		delete(t.keys, key)
+		for _, tc := range t.clients {
+			if tc.bcast && matchPrefixes(tc.prefixes, key) {
+				batches[tc] = append(batches[tc], key)
+			}
+		}
+	}
+	msgs := make([]*invalidation, 0, len(batches))
+	for tc, batch := range batches {
+		msgs = append(msgs, &invalidation{target: *tc, keys: batch})
+	}
+	t.mu.Unlock()
+
+	// Write 只追加到输出缓冲区，不会阻塞写命令并且保持消息顺序，超过输出缓冲区限制的客户端会被断开
+	for _, msg := range msgs {
+		t.send(msg)
+	}
+}
+
+func matchPrefixes(prefixes []string, key string) bool {
+	if len(prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// send writes an invalidation message to the tracking client or its redirect target
+func (t *trackingTable) send(msg *invalidation) {
+	tc := &msg.target
+	if tc.client.GetID() != tc.id {
+		return // 客户端已经断开
+	}
+	keys := make([][]byte, len(msg.keys))
+	for i, key := range msg.keys {
+		keys[i] = []byte(key)
+	}
+	if tc.redirect == 0 {
+		if tc.client.GetProtocol() == protocol.RESP3 {
+			_, _ = tc.client.Write(makeInvalidateMsg(keys).ToBytesWithProtocol(protocol.RESP3))
+		}
+		return // RESP2 的客户端只能通过 REDIRECT 接收失效消息
+	}
+
+	target, ok := t.getter(tc.redirect)
+	if !ok {
+		if tc.client.GetProtocol() == protocol.RESP3 {
+			broken := protocol.MakePushReply([]redis.Reply{
+				protocol.MakeBulkReply([]byte("tracking-redir-broken")),
+				protocol.MakeIntReply(tc.redirect),
+			})
+			_, _ = tc.client.Write(broken.ToBytesWithProtocol(protocol.RESP3))
+		}
+		return
+	}
+	if target.GetProtocol() == protocol.RESP3 {
+		_, _ = target.Write(makeInvalidateMsg(keys).ToBytesWithProtocol(protocol.RESP3))
+		return
+	}
+	if target.GetSubscribeNum() > 0 { // RESP2 的目标需要订阅 __redis__:invalidate
+		message := protocol.MakePushReply([]redis.Reply{
+			protocol.MakeBulkReply([]byte("message")),
+			protocol.MakeBulkReply([]byte(trackingChannel)),
+			protocol.MakeMultiBulkReply(keys),
+		})
+		_, _ = target.Write(message.ToBytes())
+	}
+}
+
+func makeInvalidateMsg(keys [][]byte) *protocol.PushReply {
+	return protocol.MakePushReply([]redis.Reply{
+		protocol.MakeBulkReply([]byte("invalidate")),
+		protocol.MakeMultiBulkReply(keys),
+	})
+}
+
+// clientTracking CLIENT TRACKING ON|OFF [REDIRECT client-id] [PREFIX prefix ...] [BCAST]
+func clientTracking(s *Server, c redis.Connection, args [][]byte) redis.Reply {
+	if len(args) == 0 {
+		return protocol.MakeArgNumErrReply("client|tracking")
+	}
+	var on bool
+	switch strings.ToLower(string(args[0])) {
+	case "on":
+		on = true
+	case "off":
+	default:
+		return protocol.MakeSyntaxErrReply()
+	}
+
+	var bcast bool
+	var redirect int64
+	var prefixes []string
+	for i := 1; i < len(args); i++ {
+		option := strings.ToLower(string(args[i]))
+		switch {
+		case option == "bcast":
+			bcast = true
+		case option == "redirect" && i+1 < len(args):
+			id, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil {
+				return protocol.MakeErrReply("ERR value is not an integer or out of range")
+			}
+			redirect = id
+			i++
+		case option == "prefix" && i+1 < len(args):
+			prefixes = append(prefixes, string(args[i+1]))
+			i++
+		case option == "optin" || option == "optout" || option == "noloop":
+			return protocol.MakeErrReply("ERR " + strings.ToUpper(option) + " option is not supported")
+		default:
+			return protocol.MakeSyntaxErrReply()
+		}
+	}
+
+	if !on {
+		s.tracking.disable(c)
+		return protocol.MakeOkReply()
+	}
+	if len(prefixes) > 0 && !bcast {
+		return protocol.MakeErrReply("ERR PREFIX option requires BCAST mode to be enabled")
+	}
+	if redirect != 0 {
+		if redirect == c.GetID() {
+			return protocol.MakeErrReply("ERR The client ID you want redirect to does not exist")
+		}
+		if _, ok := s.getClient(redirect); !ok {
+			return protocol.MakeErrReply("ERR The client ID you want redirect to does not exist")
+		}
+	}
+	if err := s.tracking.enable(c, bcast, prefixes, redirect); err != nil {
+		return protocol.MakeErrReply(err.Error())
+	}
+	return protocol.MakeOkReply()
+}
+
+// clientGetRedir returns -1 if tracking is off, 0 if invalidations are sent to the client itself
+func clientGetRedir(s *Server, c redis.Connection) redis.Reply {
+	tc, ok := s.tracking.get(c)
+	if !ok {
+		return protocol.MakeIntReply(-1)
+	}
+	return protocol.MakeIntReply(tc.redirect)
+}
+
+func clientTrackingInfo(s *Server, c redis.Connection) redis.Reply {
+	var flags [][]byte
+	redirect := int64(-1)
+	var prefixes []string
+	if tc, ok := s.tracking.get(c); !ok {
+		flags = append(flags, []byte("off"))
+	} else {
+		flags = append(flags, []byte("on"))
+		if tc.bcast {
+			flags = append(flags, []byte("bcast"))
+		}
+		redirect = tc.redirect
+		if redirect != 0 {
+			if _, ok := s.getClient(redirect); !ok {
+				flags = append(flags, []byte("broken_redirect"))
+			}
+		}
+		prefixes = tc.prefixes
+	}
+	keys := []redis.Reply{
+		protocol.MakeBulkReply([]byte("flags")),
+		protocol.MakeBulkReply([]byte("redirect")),
+		protocol.MakeBulkReply([]byte("prefixes")),
+	}
+	values := []redis.Reply{
+		protocol.MakeSetReply(bulkReplies(flags)),
+		protocol.MakeIntReply(redirect),
+		protocol.MakeMultiBulkReply(toBulks(prefixes)),
+	}
+	return protocol.MakeMapReply(keys, values)
+}
+
+func bulkReplies(args [][]byte) []redis.Reply {
+	replies := make([]redis.Reply, len(args))
+	for i, arg := range args {
+		replies[i] = protocol.MakeBulkReply(arg)
+	}
+	return replies
+}
@@ -0,0 +1,182 @@
+package database
+
+import (
+	"bytes"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"godis/config"
+	"godis/interface/redis"
+	"godis/lib/utils"
+	"godis/redis/connection"
+	"godis/redis/protocol"
+)
+
+// recordConn 记录写入的数据，用于检查失效消息
+type recordConn struct {
+	*connection.FakeConn
+	id  int64
+	mu  sync.Mutex
+	out bytes.Buffer
+}
+
+func newRecordConn(id int64, proto int) *recordConn {
+	c := &recordConn{FakeConn: connection.NewFakeConn(), id: id}
+	c.SetProtocol(proto)
+	return c
+}
+
+func (c *recordConn) GetID() int64 {
+	return c.id
+}
+
+func (c *recordConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.out.Write(b)
+}
+
+// waitOutput 等待异步发送的消息，超时返回已经收到的数据
+func (c *recordConn) waitOutput(expect string) string {
+	deadline := time.Now().Add(time.Second)
+	for {
+		c.mu.Lock()
+		out := c.out.String()
+		c.mu.Unlock()
+		if out == expect || time.Now().After(deadline) {
+			return out
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func (c *recordConn) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.out.Reset()
+}
+
+func TestTrackingDefaultMode(t *testing.T) {
+	table := makeTrackingTable(func(id int64) (redis.Connection, bool) { return nil, false })
+	client := newRecordConn(1, protocol.RESP3)
+	if err := table.enable(client, false, nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !client.HasFlag(connection.FlagTracking) {
+		t.Error("expect tracking flag")
+	}
+
+	table.trackRead(client, utils.ToCmdLine("GET", "k1"))
+	table.trackRead(client, utils.ToCmdLine("SET", "k2", "v")) // 写命令不记录
+	table.invalidate([]string{"k2"})
+	table.invalidate([]string{"k1"})
+	expect := ">2\r\n$10\r\ninvalidate\r\n*1\r\n$2\r\nk1\r\n"
+	if out := client.waitOutput(expect); out != expect {
+		t.Fatalf("unexpected invalidation %q", out)
+	}
+
+	// 通知过一次之后不再记录，需要重新读取
+	client.reset()
+	table.invalidate([]string{"k1"})
+	time.Sleep(20 * time.Millisecond)
+	if out := client.waitOutput(""); out != "" {
+		t.Errorf("expect no message, got %q", out)
+	}
+
+	if err := table.enable(client, true, nil, 0); err == nil {
+		t.Error("expect error when switching to bcast mode")
+	}
+	table.disable(client)
+	if client.HasFlag(connection.FlagTracking) || table.active.Load() != 0 {
+		t.Error("tracking should be disabled")
+	}
+}
+
+func TestTrackingBcastAndRedirect(t *testing.T) {
+	target := newRecordConn(2, protocol.RESP2)
+	target.AddSubscribeChannel(trackingChannel)
+	table := makeTrackingTable(func(id int64) (redis.Connection, bool) {
+		if id == target.id {
+			return target, true
+		}
+		return nil, false
+	})
+
+	client := newRecordConn(1, protocol.RESP2)
+	if err := table.enable(client, true, []string{"user:"}, target.id); err != nil {
+		t.Fatal(err)
+	}
+	table.invalidate([]string{"order:1", "user:1"})
+	expect := "*3\r\n$7\r\nmessage\r\n$20\r\n__redis__:invalidate\r\n*1\r\n$6\r\nuser:1\r\n"
+	if out := target.waitOutput(expect); out != expect {
+		t.Fatalf("unexpected redirected message %q", out)
+	}
+	if out := client.waitOutput(""); out != "" {
+		t.Errorf("expect no message for redirecting client, got %q", out)
+	}
+
+	// 转发目标不存在时通知 RESP3 客户端
+	broken := newRecordConn(3, protocol.RESP3)
+	if err := table.enable(broken, true, nil, 100); err != nil {
+		t.Fatal(err)
+	}
+	table.invalidate([]string{"any"})
+	expect = ">2\r\n$21\r\ntracking-redir-broken\r\n:100\r\n"
+	if out := broken.waitOutput(expect); out != expect {
+		t.Errorf("unexpected message %q", out)
+	}
+}
+
+// TestTrackingOrder 大量失效消息按修改的顺序发送
+func TestTrackingOrder(t *testing.T) {
+	table := makeTrackingTable(func(id int64) (redis.Connection, bool) { return nil, false })
+	client := newRecordConn(1, protocol.RESP3)
+	if err := table.enable(client, true, nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	var expect bytes.Buffer
+	for i := 0; i < 2000; i++ {
+		key := strconv.Itoa(i)
+		table.invalidate([]string{key})
+		expect.Write(makeInvalidateMsg([][]byte{[]byte(key)}).ToBytesWithProtocol(protocol.RESP3))
+	}
+	if out := client.waitOutput(expect.String()); out != expect.String() {
+		t.Error("invalidations are out of order")
+	}
+}
+
+// TestTrackingTableMaxKeys 记录的 key 超过 tracking_table_max_keys 时淘汰并通知读过它们的客户端
+func TestTrackingTableMaxKeys(t *testing.T) {
+	old := config.Properties()
+	properties := *old
+	properties.TrackingTableMaxKeys = 2
+	config.SetProperties(&properties)
+	t.Cleanup(func() { config.SetProperties(old) })
+
+	table := makeTrackingTable(func(id int64) (redis.Connection, bool) { return nil, false })
+	client := newRecordConn(1, protocol.RESP3)
+	if err := table.enable(client, false, nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	table.trackRead(client, utils.ToCmdLine("GET", "k1"))
+	table.trackRead(client, utils.ToCmdLine("GET", "k2"))
+	if out := client.waitOutput(""); out != "" {
+		t.Fatalf("unexpected invalidation %q", out)
+	}
+	table.trackRead(client, utils.ToCmdLine("GET", "k3"))
+	if len(table.keys) != 2 {
+		t.Errorf("expect 2 tracked keys, got %d", len(table.keys))
+	}
+	var evicted string
+	for _, key := range []string{"k1", "k2", "k3"} {
+		if _, ok := table.keys[key]; !ok {
+			evicted = key
+		}
+	}
+	expect := ">2\r\n$10\r\ninvalidate\r\n*1\r\n$2\r\n" + evicted + "\r\n"
+	if out := client.waitOutput(expect); out != expect {
+		t.Errorf("unexpected invalidation %q", out)
+	}
+}
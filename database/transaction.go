@@ -37,6 +37,11 @@ func ExecMultiStandalone(s *Server, client redis.Connection, args [][]byte) redi
 	if errReply != nil {
 		return errReply
 	}
+	if s.tracking != nil {
+		for _, cmdLine := range client.GetEnqueuedCmdLine() {
+			s.tracking.trackRead(client, cmdLine)
+		}
+	}
 	return localDB.ExecMulti(client)
 }
 
@@ -21,6 +21,45 @@ type DBEngine interface {
 	GetDBSize(dbIndex int) (int, int)
 }
 
+// FunctionStore is implemented by engines which keep server-side function libraries,
+// libraries are written into aof by rewrite
+type FunctionStore interface {
+	FunctionCodes() []string
+}
+
+// ClientManager is implemented by the network layer, it exposes all connected clients to db
+type ClientManager interface {
+	ForEachClient(cb func(c redis.Connection) bool)
+	GetClient(id int64) (redis.Connection, bool)
+	// KillClient disconnects the client with given id, returns false if it does not exist
+	KillClient(id int64) bool
+	// FeedMonitors is called with each command which passed authentication, permission and arity checks,
+	// commands rejected by db are never shown to MONITOR clients
+	FeedMonitors(c redis.Connection, cmdLine [][]byte)
+	// Shutdown asks the network layer to stop serving, it returns immediately.
+	// Connections are drained and db is closed asynchronously
+	Shutdown()
+}
+
 type DataEntity struct {
 	Data interface{}
 }
+
+// DataType describes a value type registered by a module, see package godis/module
+type DataType struct {
+	Name string // TYPE 命令返回的名字
+	// Rewrite returns a command which recreates value at key, it is used by aof rewrite.
+	// Values are written as a snapshot produced by Save if Rewrite is nil
+	Rewrite func(key string, value interface{}) [][]byte
+	// Save serializes value into a snapshot and Load restores it
+	Save func(value interface{}) ([]byte, error)
+	Load func(payload []byte) (interface{}, error)
+	// MemoryUsage returns approximate bytes used by value, it is reported by MEMORY USAGE
+	MemoryUsage func(value interface{}) int64
+}
+
+// ModuleValue is stored in DataEntity.Data for values of module data types
+type ModuleValue struct {
+	Type  *DataType
+	Value interface{}
+}
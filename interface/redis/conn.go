@@ -1,12 +1,29 @@
 package redis
 
+import "time"
+
 type Connection interface {
 	Write([]byte) (int, error)
 
 	Close() error
 
-	SetPassword(string)
-	GetPassword() string
+	GetID() int64
+	SetName(string)
+	GetName() string
+	GetCreatedAt() time.Time
+	SetLastCmd(string)
+	GetLastCmd() string
+	GetLastInteraction() time.Time
+	SetExecStart(time.Time)
+	GetExecStart() time.Time
+	SetFlag(uint64)
+	ClearFlag(uint64)
+	HasFlag(uint64) bool
+
+	SetUser(string)
+	GetUser() string
+	SetProtocol(int)
+	GetProtocol() int
 
 	GetDBIndex() int
 	SelectDB(int)
@@ -9,3 +9,21 @@ type Handler interface {
 	Handle(ctx context.Context, conn net.Conn)
 	Close() error
 }
+
+// EventHandler can also serve connections driven by an event loop,
+// no goroutine is blocked on reading an idle connection
+type EventHandler interface {
+	Handler
+	// Open is called when a connection is accepted, it returns nil if the connection is refused and closed
+	Open(conn net.Conn) Session
+}
+
+// Session receives data of a connection from the event loop. Its methods may be called from different
+// goroutines but never concurrently, and they may block without delaying other connections
+type Session interface {
+	// OnData handles data read from the connection, data is reused after OnData returns.
+	// It returns false if the connection has been closed by the session
+	OnData(data []byte) bool
+	// OnClose is called when the peer closes the connection or reading fails
+	OnClose()
+}
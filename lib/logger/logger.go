@@ -8,7 +8,9 @@ import (
 	"path"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -44,8 +46,21 @@ type logEntry struct {
 
 var (
 	levelFlags = []string{"DEBUG", "INFO", "WARN", "ERROR", "FATAL"}
+	// minLevel 低于该级别的日志会被丢弃，可以通过 CONFIG SET log_level 修改
+	minLevel atomic.Int32
 )
 
+// SetLevel sets the lowest level to output, name is one of debug, info, warn and error
+func SetLevel(name string) error {
+	for level, flag := range levelFlags[:FATAL] {
+		if strings.EqualFold(flag, name) {
+			minLevel.Store(int32(level))
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown log level %s", name)
+}
+
 // Logger is Logger
 type Logger struct {
 	logFile   *os.File
@@ -130,6 +145,9 @@ func Setup(settings *Settings) {
 
 // Output sends a msg to logger
 func (logger *Logger) Output(level logLevel, callerDepth int, msg string) {
+	if int32(level) < minLevel.Load() {
+		return
+	}
 	var formattedMsg string
 	_, file, line, ok := runtime.Caller(callerDepth)
 	if ok {
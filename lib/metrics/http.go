@@ -0,0 +1,27 @@
+package metrics
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"godis/lib/logger"
+)
+
+// Handler returns a http.Handler which exposes metrics of DefaultRegistry
+func Handler() http.Handler {
+	return promhttp.HandlerFor(DefaultRegistry.Gatherer(), promhttp.HandlerOpts{})
+}
+
+// ListenAndServe starts a http server exposing /metrics on addr, it blocks until the listener fails
+func ListenAndServe(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	logger.Infof("metrics bind: %s, start listening...", addr)
+	return http.Serve(listener, mux)
+}
@@ -0,0 +1,202 @@
+package metrics
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+// DefBuckets 默认的延迟直方图分桶，单位为秒
+var DefBuckets = []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1}
+
+// Registry wraps a prometheus registry, collectors registered with the same name replace each other
+// and counters and histograms can be reset by CONFIG RESETSTAT
+type Registry struct {
+	mu         sync.Mutex
+	registry   *prometheus.Registry
+	collectors map[string]prometheus.Collector
+	resetters  map[string]interface{ Reset() }
+}
+
+// DefaultRegistry is used by all New* functions of this package
+var DefaultRegistry = NewRegistry()
+
+func NewRegistry() *Registry {
+	return &Registry{
+		registry:   prometheus.NewRegistry(),
+		collectors: make(map[string]prometheus.Collector),
+		resetters:  make(map[string]interface{ Reset() }),
+	}
+}
+
+// Register adds c named name to registry, a collector with the same name will be replaced
+func (r *Registry) Register(name string, c prometheus.Collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if old, ok := r.collectors[name]; ok {
+		r.registry.Unregister(old)
+		delete(r.resetters, name)
+	}
+	r.registry.MustRegister(c)
+	r.collectors[name] = c
+	if resetter, ok := c.(interface{ Reset() }); ok {
+		r.resetters[name] = resetter
+	}
+}
+
+// Gatherer returns the underlying prometheus gatherer, used by Handler
+func (r *Registry) Gatherer() prometheus.Gatherer {
+	return r.registry
+}
+
+// WriteTo renders all metrics in prometheus text exposition format
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	families, err := r.registry.Gather()
+	if err != nil {
+		return 0, err
+	}
+	var written int64
+	for _, family := range families {
+		n, err := expfmt.MetricFamilyToText(w, family)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// Reset clears the values of all counters and histograms, used by CONFIG RESETSTAT
+func (r *Registry) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, resetter := range r.resetters {
+		resetter.Reset()
+	}
+}
+
+/* ---- Counter ---- */
+
+// Counter is a monotonically increasing value. It looks up its child on every call,
+// so it keeps working after the vector is reset
+type Counter struct {
+	vec         *prometheus.CounterVec
+	labelValues []string
+}
+
+// Inc increases counter by 1
+func (c *Counter) Inc() {
+	c.vec.WithLabelValues(c.labelValues...).Inc()
+}
+
+// Add increases counter by n
+func (c *Counter) Add(n uint64) {
+	c.vec.WithLabelValues(c.labelValues...).Add(float64(n))
+}
+
+// CounterVec is a family of counters partitioned by labels
+type CounterVec struct {
+	vec *prometheus.CounterVec
+}
+
+// NewCounterVec creates and registers a counter family
+func NewCounterVec(name string, help string, labelNames ...string) *CounterVec {
+	vec := prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: help}, labelNames)
+	DefaultRegistry.Register(name, vec)
+	return &CounterVec{vec: vec}
+}
+
+// NewCounter creates and registers a counter without labels
+func NewCounter(name string, help string) *Counter {
+	return NewCounterVec(name, help).WithLabelValues()
+}
+
+// WithLabelValues returns the counter for given label values
+func (v *CounterVec) WithLabelValues(values ...string) *Counter {
+	return &Counter{vec: v.vec, labelValues: values}
+}
+
+/* ---- Gauge ---- */
+
+// NewGauge creates and registers a gauge without labels, gauges are not reset by CONFIG RESETSTAT
+func NewGauge(name string, help string) prometheus.Gauge {
+	g := prometheus.NewGauge(prometheus.GaugeOpts{Name: name, Help: help})
+	DefaultRegistry.Register(name, g)
+	return g
+}
+
+// GaugeVecFunc is a gauge family whose values are collected on every scrape
+type GaugeVecFunc struct {
+	desc    *prometheus.Desc
+	collect func(emit func(value float64, labelValues ...string))
+}
+
+// NewGaugeVecFunc creates and registers a gauge family collected by fn,
+// a family registered with the same name before is replaced
+func NewGaugeVecFunc(name string, help string, labelNames []string,
+	fn func(emit func(value float64, labelValues ...string))) *GaugeVecFunc {
+	v := &GaugeVecFunc{
+		desc:    prometheus.NewDesc(name, help, labelNames, nil),
+		collect: fn,
+	}
+	DefaultRegistry.Register(name, v)
+	return v
+}
+
+// Describe implements prometheus.Collector
+func (v *GaugeVecFunc) Describe(ch chan<- *prometheus.Desc) {
+	ch <- v.desc
+}
+
+// Collect implements prometheus.Collector
+func (v *GaugeVecFunc) Collect(ch chan<- prometheus.Metric) {
+	v.collect(func(value float64, labelValues ...string) {
+		ch <- prometheus.MustNewConstMetric(v.desc, prometheus.GaugeValue, value, labelValues...)
+	})
+}
+
+/* ---- Histogram ---- */
+
+// Histogram counts observations into cumulative buckets. Like Counter it looks up its child on every call
+type Histogram struct {
+	vec         *prometheus.HistogramVec
+	labelValues []string
+}
+
+// Observe adds a single observation
+func (h *Histogram) Observe(v float64) {
+	h.vec.WithLabelValues(h.labelValues...).Observe(v)
+}
+
+// ObserveDuration adds d as an observation in seconds
+func (h *Histogram) ObserveDuration(d time.Duration) {
+	h.Observe(d.Seconds())
+}
+
+// NewHistogram creates and registers a histogram without labels
+func NewHistogram(name string, help string, buckets []float64) *Histogram {
+	return NewHistogramVec(name, help, buckets).WithLabelValues()
+}
+
+// HistogramVec is a family of histograms partitioned by labels
+type HistogramVec struct {
+	vec *prometheus.HistogramVec
+}
+
+// NewHistogramVec creates and registers a histogram family, buckets must be sorted
+func NewHistogramVec(name string, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefBuckets
+	}
+	vec := prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: name, Help: help, Buckets: buckets}, labelNames)
+	DefaultRegistry.Register(name, vec)
+	return &HistogramVec{vec: vec}
+}
+
+// WithLabelValues returns the histogram for given label values
+func (v *HistogramVec) WithLabelValues(values ...string) *Histogram {
+	return &Histogram{vec: v.vec, labelValues: values}
+}
@@ -0,0 +1,66 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestExposition(t *testing.T) {
+	calls := NewCounterVec("test_calls_total", "calls", "cmd")
+	calls.WithLabelValues("get").Inc()
+	calls.WithLabelValues("get").Inc()
+	calls.WithLabelValues(`se"t`).Add(3)
+
+	latency := NewHistogramVec("test_latency_seconds", "latency", []float64{0.1, 1}, "cmd")
+	latency.WithLabelValues("get").Observe(0.05)
+	latency.WithLabelValues("get").Observe(0.5)
+	latency.WithLabelValues("get").Observe(5)
+
+	gauge := NewGauge("test_clients", "clients")
+	gauge.Inc()
+	gauge.Inc()
+	gauge.Dec()
+
+	NewGaugeVecFunc("test_keys", "keys", []string{"db"}, func(emit func(float64, ...string)) {
+		emit(42, "0")
+	})
+
+	buf := &bytes.Buffer{}
+	if _, err := DefaultRegistry.WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	expected := []string{
+		"# TYPE test_calls_total counter",
+		`test_calls_total{cmd="get"} 2`,
+		`test_calls_total{cmd="se\"t"} 3`,
+		"# TYPE test_latency_seconds histogram",
+		`test_latency_seconds_bucket{cmd="get",le="0.1"} 1`,
+		`test_latency_seconds_bucket{cmd="get",le="1"} 2`,
+		`test_latency_seconds_bucket{cmd="get",le="+Inf"} 3`,
+		`test_latency_seconds_sum{cmd="get"} 5.55`,
+		`test_latency_seconds_count{cmd="get"} 3`,
+		"test_clients 1",
+		`test_keys{db="0"} 42`,
+	}
+	for _, line := range expected {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("missing line %q in:\n%s", line, out)
+		}
+	}
+
+	// 重置后已经取得的 Counter 依然有效
+	get := calls.WithLabelValues("get")
+	DefaultRegistry.Reset()
+	get.Inc()
+	buf.Reset()
+	if _, err := DefaultRegistry.WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	out = buf.String()
+	if !strings.Contains(out, `test_calls_total{cmd="get"} 1`+"\n") || strings.Contains(out, "test_latency_seconds_count") ||
+		!strings.Contains(out, "test_clients 1\n") {
+		t.Errorf("reset failed:\n%s", out)
+	}
+}
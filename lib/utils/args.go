@@ -0,0 +1,108 @@
+package utils
+
+import "errors"
+
+var errUnbalancedQuotes = errors.New("unbalanced quotes")
+
+// SplitArgs splits line into arguments like redis sdssplitargs:
+// arguments are separated by spaces, "double quoted" arguments support \n \r \t \b \a \\ \" and \xHH escapes,
+// 'single quoted' arguments only support \'
+func SplitArgs(line string) ([]string, error) {
+	var args []string
+	i := 0
+	for {
+		for i < len(line) && isSpace(line[i]) {
+			i++
+		}
+		if i >= len(line) {
+			return args, nil
+		}
+
+		var current []byte
+		inDouble, inSingle := false, false
+		for done := false; !done; {
+			if i >= len(line) {
+				if inDouble || inSingle {
+					return nil, errUnbalancedQuotes
+				}
+				break
+			}
+			ch := line[i]
+			switch {
+			case inDouble:
+				if ch == '\\' && i+3 < len(line) && line[i+1] == 'x' && isHex(line[i+2]) && isHex(line[i+3]) {
+					current = append(current, hexValue(line[i+2])<<4|hexValue(line[i+3]))
+					i += 3
+				} else if ch == '\\' && i+1 < len(line) {
+					i++
+					switch line[i] {
+					case 'n':
+						current = append(current, '\n')
+					case 'r':
+						current = append(current, '\r')
+					case 't':
+						current = append(current, '\t')
+					case 'b':
+						current = append(current, '\b')
+					case 'a':
+						current = append(current, '\a')
+					default:
+						current = append(current, line[i])
+					}
+				} else if ch == '"' {
+					// 闭合的引号后面必须是空白或者行尾
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, errUnbalancedQuotes
+					}
+					done = true
+				} else {
+					current = append(current, ch)
+				}
+			case inSingle:
+				if ch == '\\' && i+1 < len(line) && line[i+1] == '\'' {
+					i++
+					current = append(current, '\'')
+				} else if ch == '\'' {
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, errUnbalancedQuotes
+					}
+					done = true
+				} else {
+					current = append(current, ch)
+				}
+			default:
+				switch {
+				case isSpace(ch):
+					done = true
+				case ch == '"':
+					inDouble = true
+				case ch == '\'':
+					inSingle = true
+				default:
+					current = append(current, ch)
+				}
+			}
+			i++
+		}
+		args = append(args, string(current))
+	}
+}
+
+func isSpace(ch byte) bool {
+	return ch == ' ' || ch == '\n' || ch == '\r' || ch == '\t' || ch == '\v' || ch == '\f'
+}
+
+func isHex(ch byte) bool {
+	return (ch >= '0' && ch <= '9') || (ch >= 'a' && ch <= 'f') || (ch >= 'A' && ch <= 'F')
+}
+
+func hexValue(ch byte) byte {
+	switch {
+	case ch >= '0' && ch <= '9':
+		return ch - '0'
+	case ch >= 'a' && ch <= 'f':
+		return ch - 'a' + 10
+	default:
+		return ch - 'A' + 10
+	}
+}
@@ -0,0 +1,69 @@
+package utils
+
+import (
+	"godis/datastruct/dict"
+	List "godis/datastruct/list"
+	"godis/datastruct/set"
+	"godis/datastruct/sortedset"
+	"godis/interface/database"
+)
+
+// entryOverhead 估算的每个 key 或集合元素的额外开销（指针、字典节点等）
+const entryOverhead = 48
+
+// EntityTypeName returns type of entity reported by TYPE command, module data types report their own name
+func EntityTypeName(entity *database.DataEntity) string {
+	switch val := entity.Data.(type) {
+	case []byte:
+		return "string"
+	case List.List:
+		return "list"
+	case set.Set:
+		return "set"
+	case dict.Dict:
+		return "hash"
+	case *sortedset.SortedSet:
+		return "zset"
+	case *database.ModuleValue:
+		return val.Type.Name
+	}
+	return "none"
+}
+
+// EntityMemoryUsage returns approximate bytes used by key and entity,
+// module data types without MemoryUsage hook are counted as key only
+func EntityMemoryUsage(key string, entity *database.DataEntity) int64 {
+	size := int64(len(key) + entryOverhead)
+	switch val := entity.Data.(type) {
+	case []byte:
+		size += int64(len(val))
+	case List.List:
+		val.ForEach(func(i int, v interface{}) bool {
+			bytes, _ := v.([]byte)
+			size += int64(len(bytes) + entryOverhead)
+			return true
+		})
+	case set.Set:
+		val.ForEach(func(member string) bool {
+			size += int64(len(member) + entryOverhead)
+			return true
+		})
+	case dict.Dict:
+		val.ForEach(func(field string, v interface{}) bool {
+			bytes, _ := v.([]byte)
+			size += int64(len(field) + len(bytes) + entryOverhead)
+			return true
+		})
+	case *sortedset.SortedSet:
+		val.ForEach(0, val.Len(), false, func(element *sortedset.Element) bool {
+			// 成员同时保存在字典和跳表中
+			size += int64(len(element.Member) + 2*entryOverhead)
+			return true
+		})
+	case *database.ModuleValue:
+		if val.Type.MemoryUsage != nil {
+			size += val.Type.MemoryUsage(val.Value)
+		}
+	}
+	return size
+}
@@ -6,6 +6,7 @@ import (
 	"godis/datastruct/set"
 	"godis/datastruct/sortedset"
 	"godis/interface/database"
+	"godis/lib/logger"
 	"godis/redis/protocol"
 	"strconv"
 	"time"
@@ -20,6 +21,9 @@ var (
 	pExpireAtCmd = []byte("PEXPIREAT")
 )
 
+// ModuleRestoreCmd ModRestore key type payload 从 DataType.Save 生成的快照中恢复模块数据
+const ModuleRestoreCmd = "ModRestore"
+
 // ExpireToBytes 将expireAt命令转为[]byte(*reply.MultiBulkStringReply.ToBytes())
 func ExpireToBytes(key string, expireAt time.Time) []byte {
 	return ExpireToReply(key, expireAt).ToBytes()
@@ -73,6 +77,8 @@ func EntityToReply(key string, entity *database.DataEntity) *protocol.MultiBulkR
 		cmd = hashToCmd(key, val)
 	case *sortedset.SortedSet:
 		cmd = zSetToCmd(key, val)
+	case *database.ModuleValue:
+		cmd = moduleValueToCmd(key, val)
 	}
 	if cmd == nil {
 		return nil
@@ -141,3 +147,19 @@ func zSetToCmd(key string, zset *sortedset.SortedSet) *protocol.MultiBulkReply {
 
 	return protocol.MakeMultiBulkReply(args)
 }
+
+// moduleValueToCmd 优先使用模块提供的 Rewrite，否则写入快照
+func moduleValueToCmd(key string, val *database.ModuleValue) *protocol.MultiBulkReply {
+	if val.Type.Rewrite != nil {
+		return protocol.MakeMultiBulkReply(val.Type.Rewrite(key, val.Value))
+	}
+	if val.Type.Save == nil {
+		return nil
+	}
+	payload, err := val.Type.Save(val.Value)
+	if err != nil {
+		logger.Error("save value of " + key + " failed: " + err.Error())
+		return nil
+	}
+	return protocol.MakeMultiBulkReply(ToCmdLine2(ModuleRestoreCmd, []byte(key), []byte(val.Type.Name), payload))
+}
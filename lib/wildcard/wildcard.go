@@ -0,0 +1,112 @@
+package wildcard
+
+// Match reports whether str matches the redis style glob pattern.
+// Supported: * (any sequence), ? (any single byte), [abc], [^abc], [a-z] and \ escape.
+func Match(pattern string, str string) bool {
+	return match(pattern, str, false)
+}
+
+// MatchNoCase is like Match but ignores ascii case
+func MatchNoCase(pattern string, str string) bool {
+	return match(pattern, str, true)
+}
+
+func match(pattern string, str string, nocase bool) bool {
+	p, s := 0, 0
+	for p < len(pattern) {
+		switch pattern[p] {
+		case '*':
+			for p+1 < len(pattern) && pattern[p+1] == '*' {
+				p++
+			}
+			if p+1 == len(pattern) {
+				return true
+			}
+			for i := s; i <= len(str); i++ {
+				if match(pattern[p+1:], str[i:], nocase) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if s >= len(str) {
+				return false
+			}
+			s++
+		case '[':
+			if s >= len(str) {
+				return false
+			}
+			p++
+			not := p < len(pattern) && pattern[p] == '^'
+			if not {
+				p++
+			}
+			matched := false
+			for {
+				if p >= len(pattern) {
+					p-- // 没有闭合的 ']'，当作结尾处理
+					break
+				}
+				if pattern[p] == ']' {
+					break
+				}
+				if pattern[p] == '\\' && p+2 < len(pattern) {
+					p++
+					if pattern[p] == str[s] {
+						matched = true
+					}
+				} else if p+2 < len(pattern) && pattern[p+1] == '-' {
+					start, end := pattern[p], pattern[p+2]
+					if start > end {
+						start, end = end, start
+					}
+					c := str[s]
+					if nocase {
+						start, end, c = lower(start), lower(end), lower(c)
+					}
+					if c >= start && c <= end {
+						matched = true
+					}
+					p += 2
+				} else if equal(pattern[p], str[s], nocase) {
+					matched = true
+				}
+				p++
+			}
+			if not {
+				matched = !matched
+			}
+			if !matched {
+				return false
+			}
+			s++
+		case '\\':
+			if p+1 < len(pattern) {
+				p++
+			}
+			fallthrough
+		default:
+			if s >= len(str) || !equal(pattern[p], str[s], nocase) {
+				return false
+			}
+			s++
+		}
+		p++
+	}
+	return s == len(str)
+}
+
+func lower(c byte) byte {
+	if c >= 'A' && c <= 'Z' {
+		return c + ('a' - 'A')
+	}
+	return c
+}
+
+func equal(a, b byte, nocase bool) bool {
+	if nocase {
+		return lower(a) == lower(b)
+	}
+	return a == b
+}
@@ -0,0 +1,37 @@
+package wildcard
+
+import "testing"
+
+func TestMatch(t *testing.T) {
+	cases := []struct {
+		pattern string
+		str     string
+		want    bool
+	}{
+		{"*", "", true},
+		{"*", "anything", true},
+		{"user:*", "user:1000", true},
+		{"user:*", "order:1", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"h[a-c]llo", "hdllo", false},
+		{`h\*llo`, "h*llo", true},
+		{`h\*llo`, "hello", false},
+		{"a*b*c", "aXXbYYc", true},
+		{"a*b*c", "aXXbYY", false},
+		{"a/*", "a/b/c", true},
+	}
+	for _, c := range cases {
+		if got := Match(c.pattern, c.str); got != c.want {
+			t.Errorf("Match(%q, %q) = %v, want %v", c.pattern, c.str, got, c.want)
+		}
+	}
+	if !MatchNoCase("GET", "get") || MatchNoCase("GET", "set") {
+		t.Error("MatchNoCase failed")
+	}
+}
@@ -4,7 +4,11 @@ import (
 	"flag"
 	"fmt"
 	"godis/lib/logger"
+	"godis/lib/metrics"
 	"godis/tcp"
+	"os"
+	"runtime"
+	"strconv"
 
 	"godis/config"
 	"godis/redis/server"
@@ -26,14 +30,68 @@ const banner = `
 
 func main() {
 	// ListenAndServe(":8000")
-	flag.StringVar(&configFilename, "f", defaultconfigFileName, "the config file")
-	flag.Parse()
+	// 与 redis-server 一样支持 godis [config file] [--name value ...]
+	args, overrides := config.SplitOverrides(os.Args[1:])
+	flag.StringVar(&configFilename, "f", defaultconfigFileName, "the config file, redis.conf format is used if it ends with .conf")
+	_ = flag.CommandLine.Parse(args)
+	if flag.NArg() > 0 {
+		configFilename = flag.Arg(0)
+	}
+
+	config.SetupConfig(configFilename, overrides...)
 
-	config.SetupConfig(configFilename)
+	if config.Properties().MetricsPort > 0 {
+		go func() {
+			addr := fmt.Sprintf("%s:%d", config.Properties().Bind, config.Properties().MetricsPort)
+			if err := metrics.ListenAndServe(addr); err != nil {
+				logger.Error("metrics server stopped: " + err.Error())
+			}
+		}()
+	}
+
+	cfg := &tcp.Config{
+		OnReload: func() {
+			if err := config.Reload(); err != nil {
+				logger.Error("reload config failed: " + err.Error())
+			}
+		},
+	}
+	if config.Properties().Port > 0 {
+		cfg.Address = fmt.Sprintf("%s:%d", config.Properties().Bind, config.Properties().Port)
+	}
+	if config.Properties().UnixSocket != "" {
+		cfg.UnixAddress = config.Properties().UnixSocket
+		if config.Properties().UnixSocketPerm != "" {
+			perm, err := strconv.ParseUint(config.Properties().UnixSocketPerm, 8, 32)
+			if err != nil || perm > 0777 {
+				logger.Fatal("invalid unixsocketperm " + config.Properties().UnixSocketPerm)
+			}
+			cfg.UnixPerm = os.FileMode(perm)
+		}
+	}
+	switch config.Properties().IoModel {
+	case "epoll":
+		cfg.EventLoops = config.Properties().EventLoops
+		if cfg.EventLoops <= 0 {
+			cfg.EventLoops = runtime.NumCPU()
+		}
+	case "goroutine":
+	default:
+		logger.Fatal("unknown io_model " + config.Properties().IoModel)
+	}
+	if config.Properties().TlsPort > 0 {
+		tlsConfig, err := tcp.MakeServerTLSConfig(config.Properties().TlsCertFile, config.Properties().TlsKeyFile,
+			config.Properties().TlsCaCertFile, config.Properties().TlsAuthClients)
+		if err != nil {
+			logger.Fatal("load tls config failed: " + err.Error())
+		}
+		cfg.TLSAddress = fmt.Sprintf("%s:%d", config.Properties().Bind, config.Properties().TlsPort)
+		cfg.TLSConfig = tlsConfig
+	}
 
-	if err := tcp.ListenAndServeWithSignal(&tcp.Config{
-		Address: fmt.Sprintf("%s:%d", config.Properties.Bind, config.Properties.Port),
-	}, server.MakeHandler()); err != nil {
+	handler := server.MakeHandler()
+	cfg.ShutdownChan = handler.ShutdownRequested()
+	if err := tcp.ListenAndServeWithSignal(cfg, handler); err != nil {
 		logger.Error(err)
 	}
 }
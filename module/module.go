@@ -0,0 +1,149 @@
+// Package module is the public API for extending godis without forking it.
+//
+// A module is an ordinary Go package which registers its commands and data types in init(),
+// the binary enables the module by importing it, usually with a blank import in main:
+//
+//	import _ "example.com/godis-bloom"
+//
+// Registration must complete before the server starts, registering later is not safe.
+package module
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"godis/database/engine"
+	"godis/interface/database"
+	"godis/interface/redis"
+	"godis/lib/utils"
+	"godis/redis/protocol"
+)
+
+// DB is the database a module command runs on, keys of the command are locked while it executes
+type DB interface {
+	GetEntity(key string) (*database.DataEntity, bool)
+	PutEntity(key string, entity *database.DataEntity) int
+	Remove(key string)
+	Expire(key string, expireAt time.Time)
+	Persist(key string)
+}
+
+// ExecFunc executes a module command, args don't include command name
+type ExecFunc func(db DB, args [][]byte) redis.Reply
+
+// KeySpec describes positions of keys in args, see engine.KeySpec
+type KeySpec = engine.KeySpec
+
+// Command describes a module command
+type Command struct {
+	Name string
+	Exec ExecFunc
+	// Arity is the number of arguments including command name, arity < 0 means at least -arity arguments
+	Arity int
+	// ReadOnly commands never modify keys, other commands are appended to aof as they are
+	// when they don't return an error, so they must produce the same result when replayed
+	ReadOnly bool
+	// Keys are locked before Exec is called and are used by MULTI, WATCH, scripts and client side caching
+	Keys KeySpec
+}
+
+// RegisterCommand registers cmd into godis, it returns error if name is used by another command
+func RegisterCommand(cmd Command) error {
+	if cmd.Exec == nil {
+		return errors.New("command '" + cmd.Name + "' has no Exec")
+	}
+	flags := engine.FlagWrite
+	if cmd.ReadOnly {
+		flags = engine.FlagReadOnly
+	}
+	exec := cmd.Exec
+	readOnly := cmd.ReadOnly
+	return engine.RegisterModuleCommand(cmd.Name, func(db *engine.DB, args [][]byte) (redis.Reply, *engine.AofExpireCtx) {
+		r := exec(db, args)
+		if readOnly || protocol.IsErrorReply(r) {
+			return r, nil
+		}
+		return r, &engine.AofExpireCtx{NeedAof: true}
+	}, cmd.Keys, cmd.Arity, flags)
+}
+
+// DataType describes a value type, see database.DataType for its hooks
+type DataType = database.DataType
+
+// dataTypes 保存所有注册的数据类型，只在 init 阶段写入，之后只读
+var dataTypes = make(map[string]*DataType)
+
+// builtinTypeNames 内置类型的名字，TYPE 命令会返回这些名字
+var builtinTypeNames = []string{"none", "string", "list", "set", "hash", "zset"}
+
+// RegisterDataType registers a data type, Name must be unique and Save and Load are required
+// because values are restored from snapshots when Rewrite is not provided
+func RegisterDataType(t *DataType) error {
+	if t == nil || t.Name == "" || strings.ContainsAny(t.Name, " \r\n") {
+		return errors.New("invalid data type name")
+	}
+	if t.Save == nil || t.Load == nil {
+		return errors.New("data type '" + t.Name + "' must provide Save and Load")
+	}
+	for _, name := range builtinTypeNames {
+		if strings.EqualFold(name, t.Name) {
+			return errors.New("data type '" + t.Name + "' already exists")
+		}
+	}
+	if _, ok := dataTypes[t.Name]; ok {
+		return errors.New("data type '" + t.Name + "' already exists")
+	}
+	dataTypes[t.Name] = t
+	return nil
+}
+
+// LookupDataType returns the registered data type with given name
+func LookupDataType(name string) (*DataType, bool) {
+	t, ok := dataTypes[name]
+	return t, ok
+}
+
+// NewEntity wraps value of type t into a DataEntity which can be put into DB
+func NewEntity(t *DataType, value interface{}) *database.DataEntity {
+	return &database.DataEntity{
+		Data: &database.ModuleValue{Type: t, Value: value},
+	}
+}
+
+// ValueOf returns the value in entity if it belongs to type t,
+// commands should reply &protocol.WrongTypeErrReply{} when ok is false
+func ValueOf(entity *database.DataEntity, t *DataType) (interface{}, bool) {
+	val, ok := entity.Data.(*database.ModuleValue)
+	if !ok || val.Type != t {
+		return nil, false
+	}
+	return val.Value, true
+}
+
+func init() {
+	err := RegisterCommand(Command{
+		Name:  utils.ModuleRestoreCmd,
+		Exec:  execModRestore,
+		Arity: 4,
+		Keys:  KeySpec{FirstKey: 1, LastKey: 1, Step: 1},
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// execModRestore ModRestore key type payload，由 aof 重写生成，用于恢复没有提供 Rewrite 的模块数据
+func execModRestore(db DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	t, ok := LookupDataType(string(args[1]))
+	if !ok {
+		return protocol.MakeErrReply("ERR unknown data type '" + string(args[1]) + "', is the module loaded?")
+	}
+	value, err := t.Load(args[2])
+	if err != nil {
+		return protocol.MakeErrReply("ERR load " + t.Name + " value failed: " + err.Error())
+	}
+	db.PutEntity(key, NewEntity(t, value))
+	return protocol.MakeOkReply()
+}
@@ -0,0 +1,198 @@
+package module
+
+import (
+	"strconv"
+	"testing"
+
+	_ "godis/database/commands"
+	"godis/database/engine"
+	"godis/interface/redis"
+	"godis/lib/utils"
+	"godis/redis/connection"
+	"godis/redis/protocol"
+)
+
+var counterType = &DataType{
+	Name: "counter",
+	Save: func(value interface{}) ([]byte, error) {
+		return []byte(strconv.FormatInt(value.(int64), 10)), nil
+	},
+	Load: func(payload []byte) (interface{}, error) {
+		return strconv.ParseInt(string(payload), 10, 64)
+	},
+	MemoryUsage: func(value interface{}) int64 {
+		return 8
+	},
+}
+
+func execCounterIncrBy(db DB, args [][]byte) redis.Reply {
+	delta, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return protocol.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	var n int64
+	if entity, ok := db.GetEntity(string(args[0])); ok {
+		value, ok := ValueOf(entity, counterType)
+		if !ok {
+			return &protocol.WrongTypeErrReply{}
+		}
+		n = value.(int64)
+	}
+	n += delta
+	db.PutEntity(string(args[0]), NewEntity(counterType, n))
+	return protocol.MakeIntReply(n)
+}
+
+func execCounterGet(db DB, args [][]byte) redis.Reply {
+	entity, ok := db.GetEntity(string(args[0]))
+	if !ok {
+		return protocol.MakeNullBulkReply()
+	}
+	value, ok := ValueOf(entity, counterType)
+	if !ok {
+		return &protocol.WrongTypeErrReply{}
+	}
+	return protocol.MakeIntReply(value.(int64))
+}
+
+func init() {
+	if err := RegisterDataType(counterType); err != nil {
+		panic(err)
+	}
+	for _, cmd := range []Command{
+		{Name: "counter.incrby", Exec: execCounterIncrBy, Arity: 3, Keys: KeySpec{FirstKey: 1, LastKey: 1, Step: 1}},
+		{Name: "counter.get", Exec: execCounterGet, Arity: 2, ReadOnly: true, Keys: KeySpec{FirstKey: 1, LastKey: 1, Step: 1}},
+	} {
+		if err := RegisterCommand(cmd); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func exec(db *engine.DB, args ...string) redis.Reply {
+	return db.Exec(connection.NewFakeConn(), utils.ToCmdLine(args...))
+}
+
+func TestRegister(t *testing.T) {
+	if err := RegisterCommand(Command{Name: "Set", Exec: execCounterGet, Arity: 3}); err == nil {
+		t.Error("expect error when registering an existing command")
+	}
+	if err := RegisterCommand(Command{Name: "counter.none", Arity: 2}); err == nil {
+		t.Error("expect error when Exec is nil")
+	}
+	if err := RegisterDataType(&DataType{Name: "counter", Save: counterType.Save, Load: counterType.Load}); err == nil {
+		t.Error("expect error when registering an existing data type")
+	}
+	if err := RegisterDataType(&DataType{Name: "Hash", Save: counterType.Save, Load: counterType.Load}); err == nil {
+		t.Error("expect error when registering a built-in data type")
+	}
+	if err := RegisterDataType(&DataType{Name: "nosave"}); err == nil {
+		t.Error("expect error when Save and Load are missing")
+	}
+}
+
+func TestCommand(t *testing.T) {
+	db := engine.MakeDB()
+	var aof [][][]byte
+	db.SetAddAof(func(lines ...engine.CmdLine) {
+		aof = append(aof, lines...)
+	})
+
+	if r := exec(db, "counter.incrby", "c", "3"); string(r.ToBytes()) != ":3\r\n" {
+		t.Errorf("unexpected reply %q", r.ToBytes())
+	}
+	if r := exec(db, "counter.incrby", "c", "x"); !protocol.IsErrorReply(r) {
+		t.Errorf("expect error, got %q", r.ToBytes())
+	}
+	if r := exec(db, "counter.get", "c"); string(r.ToBytes()) != ":3\r\n" {
+		t.Errorf("unexpected reply %q", r.ToBytes())
+	}
+	if r := exec(db, "counter.get"); !protocol.IsErrorReply(r) {
+		t.Errorf("expect arity error, got %q", r.ToBytes())
+	}
+	if len(aof) != 1 || string(aof[0][0]) != "counter.incrby" {
+		t.Errorf("only successful write commands should be appended to aof, got %d lines", len(aof))
+	}
+	if db.GetVersion("c") != 1 {
+		t.Errorf("expect version 1, got %d", db.GetVersion("c"))
+	}
+
+	exec(db, "set", "s", "v")
+	if r := exec(db, "counter.get", "s"); string(r.ToBytes()) != string((&protocol.WrongTypeErrReply{}).ToBytes()) {
+		t.Errorf("expect wrong type error, got %q", r.ToBytes())
+	}
+	if r := exec(db, "type", "c"); string(r.ToBytes()) != "+counter\r\n" {
+		t.Errorf("unexpected type %q", r.ToBytes())
+	}
+	if r := exec(db, "type", "s"); string(r.ToBytes()) != "+string\r\n" {
+		t.Errorf("unexpected type %q", r.ToBytes())
+	}
+	if r := exec(db, "type", "none"); string(r.ToBytes()) != "+none\r\n" {
+		t.Errorf("unexpected type %q", r.ToBytes())
+	}
+	expected := ":" + strconv.Itoa(len("c")+48+8) + "\r\n"
+	if r := exec(db, "memory", "usage", "c"); string(r.ToBytes()) != expected {
+		t.Errorf("expect %q, got %q", expected, r.ToBytes())
+	}
+	if r := exec(db, "memory", "usage", "none"); string(r.ToBytes()) != "$-1\r\n" {
+		t.Errorf("unexpected reply %q", r.ToBytes())
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	db := engine.MakeDB()
+	exec(db, "counter.incrby", "c", "42")
+	entity, _ := db.GetEntity("c")
+	cmdLine := utils.EntityToCmdLine("c", entity)
+	if string(cmdLine[0]) != utils.ModuleRestoreCmd || string(cmdLine[2]) != "counter" || string(cmdLine[3]) != "42" {
+		t.Fatalf("unexpected rewrite command %q", cmdLine)
+	}
+
+	restored := engine.MakeDB()
+	if r := restored.Exec(connection.NewFakeConn(), cmdLine); protocol.IsErrorReply(r) {
+		t.Fatalf("restore failed: %s", r.ToBytes())
+	}
+	if r := exec(restored, "counter.get", "c"); string(r.ToBytes()) != ":42\r\n" {
+		t.Errorf("unexpected reply %q", r.ToBytes())
+	}
+	if r := exec(restored, utils.ModuleRestoreCmd, "d", "unknown", "1"); !protocol.IsErrorReply(r) {
+		t.Errorf("expect error for unknown data type, got %q", r.ToBytes())
+	}
+
+	// 提供 Rewrite 时使用模块生成的命令
+	rewriteType := &DataType{
+		Name: "counter",
+		Rewrite: func(key string, value interface{}) [][]byte {
+			return utils.ToCmdLine("counter.incrby", key, strconv.FormatInt(value.(int64), 10))
+		},
+	}
+	entity = NewEntity(rewriteType, int64(7))
+	if cmdLine := utils.EntityToCmdLine("c", entity); string(cmdLine[0]) != "counter.incrby" || string(cmdLine[2]) != "7" {
+		t.Errorf("unexpected rewrite command %q", cmdLine)
+	}
+}
+
+func TestKeySpec(t *testing.T) {
+	args := utils.ToCmdLine("k1", "v1", "k2", "v2", "k3", "v3")
+	cases := []struct {
+		spec KeySpec
+		keys []string
+	}{
+		{KeySpec{}, nil},
+		{KeySpec{FirstKey: 1, LastKey: 1, Step: 1}, []string{"k1"}},
+		{KeySpec{FirstKey: 1, LastKey: -1, Step: 2}, []string{"k1", "k2", "k3"}},
+		{KeySpec{FirstKey: 2, LastKey: -2, Step: 1}, []string{"v1", "k2", "v2", "k3"}},
+	}
+	for _, c := range cases {
+		keys := c.spec.Keys(args)
+		if len(keys) != len(c.keys) {
+			t.Errorf("%+v: expect %v, got %v", c.spec, c.keys, keys)
+			continue
+		}
+		for i := range keys {
+			if keys[i] != c.keys[i] {
+				t.Errorf("%+v: expect %v, got %v", c.spec, c.keys, keys)
+			}
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package client
 
 import (
+	"crypto/tls"
 	"godis/interface/redis"
 	"godis/lib/logger"
 	"godis/lib/sync/wait"
@@ -39,6 +40,8 @@ type Client struct {
 	working *sync.WaitGroup
 
 	keepalive time.Duration
+
+	pushHandler func(reply *protocol.PushReply) // 处理 RESP3 push 消息，为空时丢弃
 }
 
 type request struct {
@@ -50,11 +53,32 @@ type request struct {
 	err       error
 }
 
+// unixScheme 以此开头的地址是 Unix socket 路径，如 unix:///tmp/godis.sock
+const unixScheme = "unix://"
+
+// MakeClient creates a client connected to addr, addr is host:port or unix:///path/to/socket
 func MakeClient(addr string, keepalive int) (*Client, error) {
-	conn, err := net.Dial("tcp", addr)
+	network, address := "tcp", addr
+	if strings.HasPrefix(addr, unixScheme) {
+		network, address = "unix", strings.TrimPrefix(addr, unixScheme)
+	}
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return newClient(conn, addr, keepalive), nil
+}
+
+// MakeTLSClient creates a client connected to addr through tls
+func MakeTLSClient(addr string, keepalive int, tlsConfig *tls.Config) (*Client, error) {
+	conn, err := tls.Dial("tcp", addr, tlsConfig)
 	if err != nil {
 		return nil, err
 	}
+	return newClient(conn, addr, keepalive), nil
+}
+
+func newClient(conn net.Conn, addr string, keepalive int) *Client {
 	return &Client{
 		conn:        conn,
 		pendingReqs: make(chan *request, chanSize),
@@ -62,7 +86,7 @@ func MakeClient(addr string, keepalive int) (*Client, error) {
 		addr:        addr,
 		working:     &sync.WaitGroup{},
 		keepalive:   time.Second * time.Duration(keepalive),
-	}, nil
+	}
 }
 
 func (client *Client) Start() {
@@ -154,10 +178,23 @@ func (client *Client) handleRead() {
 			// client.reconnect()
 			return
 		}
+		if push, ok := payload.Data.(*protocol.PushReply); ok {
+			// push 消息不对应任何请求
+			if client.pushHandler != nil {
+				client.pushHandler(push)
+			}
+			continue
+		}
 		client.finishRequest(payload.Data)
 	}
 }
 
+// SetPushHandler sets the callback of RESP3 push messages such as pub/sub messages,
+// it must be called before Start
+func (client *Client) SetPushHandler(handler func(reply *protocol.PushReply)) {
+	client.pushHandler = handler
+}
+
 func (client *Client) finishRequest(reply redis.Reply) {
 	defer func() {
 		if err := recover(); err != nil {
@@ -4,20 +4,44 @@ import (
 	"godis/interface/redis"
 	"godis/lib/logger"
 	"godis/lib/sync/wait"
+	"godis/redis/protocol"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// 客户端标志位，CLIENT LIST 中展示
+const (
+	FlagNoEvict  uint64 = 1 << iota // CLIENT NO-EVICT on
+	FlagMonitor                     // 执行过 MONITOR 命令
+	FlagTracking                    // 开启了 CLIENT TRACKING
+)
+
+// 全局自增的客户端 ID，从 1 开始，0 留给 FakeConn
+var clientIDGenerator int64
+
 type Connection struct {
 	conn net.Conn
 
 	sendingData wait.Wait
 
-	mu sync.Mutex
+	outMu sync.Mutex // 保护输出缓冲区，多个协程可能同时向一个客户端写入
+	out   outputBuffer
+
+	mu sync.Mutex // 保护下面的客户端信息，CLIENT LIST 会在其他协程中读取
+
+	id              int64
+	name            string
+	createdAt       time.Time
+	lastCmd         string
+	lastInteraction time.Time
+	flags           uint64
+	user            string // AUTH 成功后的用户名，空串表示未认证
+	protocol        int    // HELLO 协商的协议版本，0 表示默认的 RESP2
 
-	password   string
 	selectedDB int
+	execStart  time.Time // 当前命令开始执行的时间，不包括等待暂停和 key 锁的时间
 
 	isMulti        bool       //
 	queue          [][][]byte //waiting command
@@ -35,6 +59,10 @@ func NewConn(conn net.Conn) *Connection {
 		return &Connection{conn: conn}
 	}
 	c.conn = conn
+	c.out = outputBuffer{}
+	c.id = atomic.AddInt64(&clientIDGenerator, 1)
+	c.createdAt = time.Now()
+	c.lastInteraction = c.createdAt
 	return c
 }
 
@@ -44,25 +72,24 @@ var connPool = sync.Pool{
 	},
 }
 
-func (c *Connection) Write(bytes []byte) (int, error) {
-	if len(bytes) == 0 {
-		return 0, nil
-	}
-
-	c.sendingData.Add(1)
-	defer func() {
-		c.sendingData.Done()
-	}()
-	return c.conn.Write(bytes)
-}
-
-// Close disconnect with the client
+// Close disconnect with the client after pending replies are sent
 func (c *Connection) Close() error {
+	c.Flush()
 	c.sendingData.WaitWithTimeout(10 * time.Second)
 	_ = c.conn.Close()
+	c.outMu.Lock()
+	c.out = outputBuffer{closed: true}
+	c.outMu.Unlock()
 	c.sendingData = wait.Wait{}
-	c.password = ""
+	c.mu.Lock()
+	c.name = ""
+	c.lastCmd = ""
+	c.flags = 0
+	c.user = ""
+	c.protocol = 0
+	c.mu.Unlock()
 	c.selectedDB = 0
+	c.execStart = time.Time{}
 	c.isMulti = false
 	c.queue = nil
 	c.syntaxErrQueue = nil
@@ -75,16 +102,123 @@ func (c *Connection) Close() error {
 
 func (c *Connection) Name() string {
 	if c.conn != nil {
+		// Unix socket 客户端没有地址，与 redis 一样使用 socket 路径:0
+		if _, ok := c.conn.RemoteAddr().(*net.UnixAddr); ok {
+			return c.conn.LocalAddr().String() + ":0"
+		}
 		return c.conn.RemoteAddr().String()
 	}
 	return ""
 }
 
-func (c *Connection) SetPassword(password string) {
-	c.password = password
+// Kill shuts down the underlying network connection,
+// the reading goroutine or event loop will notice it and release the connection through Close
+func (c *Connection) Kill() error {
+	return shutdown(c.conn)
+}
+
+// shutdown 关闭读写但不释放文件描述符，事件循环在读到 EOF 后才会移除连接，不会与复用该描述符的新连接混淆
+func shutdown(conn net.Conn) error {
+	type halfCloser interface {
+		CloseRead() error
+		CloseWrite() error
+	}
+	if hc, ok := conn.(halfCloser); ok {
+		_ = hc.CloseWrite()
+		return hc.CloseRead()
+	}
+	return conn.Close()
+}
+
+func (c *Connection) GetID() int64 {
+	return c.id
+}
+
+func (c *Connection) SetName(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.name = name
+}
+func (c *Connection) GetName() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.name
+}
+
+func (c *Connection) GetCreatedAt() time.Time {
+	return c.createdAt
 }
-func (c *Connection) GetPassword() string {
-	return c.password
+
+func (c *Connection) SetLastCmd(cmdName string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastCmd = cmdName
+}
+func (c *Connection) GetLastCmd() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lastCmd
+}
+
+func (c *Connection) SetLastInteraction(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastInteraction = t
+}
+func (c *Connection) GetLastInteraction() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lastInteraction
+}
+
+// SetExecStart is called when the current command starts or stops waiting, SLOWLOG measures from the last call
+func (c *Connection) SetExecStart(t time.Time) {
+	c.execStart = t
+}
+func (c *Connection) GetExecStart() time.Time {
+	return c.execStart
+}
+
+func (c *Connection) SetFlag(flag uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.flags |= flag
+}
+func (c *Connection) ClearFlag(flag uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.flags &^= flag
+}
+func (c *Connection) HasFlag(flag uint64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.flags&flag != 0
+}
+
+func (c *Connection) SetUser(user string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.user = user
+}
+func (c *Connection) GetUser() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.user
+}
+
+// SetProtocol sets the protocol version replies are encoded with
+func (c *Connection) SetProtocol(proto int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.protocol = proto
+}
+func (c *Connection) GetProtocol() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.protocol == 0 {
+		return protocol.RESP2
+	}
+	return c.protocol
 }
 
 func (c *Connection) GetDBIndex() int {
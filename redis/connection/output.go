@@ -0,0 +1,146 @@
+package connection
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"godis/config"
+	"godis/lib/logger"
+	"godis/lib/metrics"
+)
+
+// ErrOutputBufferLimit is returned by Write when the client is disconnected for exceeding its output buffer limit
+var ErrOutputBufferLimit = errors.New("client output buffer limit reached")
+
+// errConnClosed 连接已关闭或写入失败后不再接受新的数据
+var errConnClosed = errors.New("connection closed")
+
+var outputLimitDisconnections = metrics.NewCounter("godis_client_output_buffer_limit_disconnections_total",
+	"Number of clients disconnected for exceeding output buffer limit.")
+
+// outputBuffer 保存尚未写入网络的回复，由独立的协程写入，慢客户端不会阻塞发布消息等其他客户端的操作
+type outputBuffer struct {
+	pending   [][]byte
+	size      int64     // pending 及正在写入的数据的总长度
+	writing   bool      // 是否有协程正在写入
+	closed    bool      // 写入失败或超出限制后不再接受数据
+	softSince time.Time // 开始超过 soft limit 的时间，零值表示未超过
+}
+
+// Class returns output buffer limit class of the client: normal, replica or pubsub
+func (c *Connection) Class() string {
+	if c.GetSubscribeNum() > 0 {
+		return config.ClientClassPubsub
+	}
+	return config.ClientClassNormal
+}
+
+// OutputBufferSize returns length of replies not yet written to the client
+func (c *Connection) OutputBufferSize() int64 {
+	c.outMu.Lock()
+	defer c.outMu.Unlock()
+	return c.out.size
+}
+
+// Write appends bytes to the output buffer and sends them asynchronously in order.
+// The client is disconnected if the output buffer exceeds the limit of its class
+func (c *Connection) Write(bytes []byte) (int, error) {
+	if len(bytes) == 0 {
+		return 0, nil
+	}
+	if err := c.Buffer(bytes); err != nil {
+		return 0, err
+	}
+	c.Flush()
+	return len(bytes), nil
+}
+
+// Buffer appends a reply to the output buffer without sending it, replies of a pipeline are sent together by Flush
+func (c *Connection) Buffer(bytes []byte) error {
+	c.outMu.Lock()
+	if c.out.closed {
+		c.outMu.Unlock()
+		return errConnClosed
+	}
+	c.out.pending = append(c.out.pending, bytes)
+	c.out.size += int64(len(bytes))
+	if c.exceedOutputLimit(time.Now()) {
+		c.out.closed = true
+		c.out.pending = nil
+		c.outMu.Unlock()
+		outputLimitDisconnections.Inc()
+		logger.Warn("client " + c.Name() + " is closed for exceeding output buffer limit of class " + c.Class())
+		_ = shutdown(c.conn)
+		return ErrOutputBufferLimit
+	}
+	c.outMu.Unlock()
+	return nil
+}
+
+// Flush starts sending buffered replies if they are not being sent
+func (c *Connection) Flush() {
+	c.outMu.Lock()
+	defer c.outMu.Unlock()
+	if c.out.writing || c.out.closed || len(c.out.pending) == 0 {
+		return
+	}
+	c.out.writing = true
+	c.sendingData.Add(1)
+	go c.flush()
+}
+
+// WaitFlushed blocks until replies passed to Flush have been written
+func (c *Connection) WaitFlushed() {
+	c.sendingData.Wait()
+}
+
+// exceedOutputLimit 调用者需持有 outMu
+func (c *Connection) exceedOutputLimit(now time.Time) bool {
+	limit := config.GetOutputBufferLimit(c.Class())
+	if limit.Hard > 0 && c.out.size >= limit.Hard {
+		return true
+	}
+	if limit.Soft <= 0 || c.out.size < limit.Soft {
+		c.out.softSince = time.Time{}
+		return false
+	}
+	if c.out.softSince.IsZero() {
+		c.out.softSince = now
+	}
+	return now.Sub(c.out.softSince) >= time.Duration(limit.SoftSeconds)*time.Second
+}
+
+// flush 将缓冲区中的数据合并写入网络，直到缓冲区为空
+func (c *Connection) flush() {
+	defer c.sendingData.Done()
+	for {
+		c.outMu.Lock()
+		if len(c.out.pending) == 0 || c.out.closed {
+			c.out.writing = false
+			c.outMu.Unlock()
+			return
+		}
+		buffers := net.Buffers(c.out.pending)
+		var n int64
+		for _, b := range buffers {
+			n += int64(len(b))
+		}
+		c.out.pending = nil
+		c.outMu.Unlock()
+
+		_, err := buffers.WriteTo(c.conn)
+
+		c.outMu.Lock()
+		c.out.size -= n
+		if c.out.size < config.GetOutputBufferLimit(c.Class()).Soft {
+			c.out.softSince = time.Time{}
+		}
+		if err != nil {
+			c.out.closed = true
+			c.out.pending = nil
+			c.out.size = 0
+		}
+		c.outMu.Unlock()
+	}
+}
@@ -0,0 +1,88 @@
+package connection
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"godis/config"
+)
+
+func TestOutputBufferLimit(t *testing.T) {
+	old := config.Properties()
+	properties := *old
+	properties.ClientOutputBufferLimit = "normal 100 50 1"
+	config.SetProperties(&properties)
+	defer func() {
+		config.SetProperties(old)
+	}()
+
+	server, client := net.Pipe()
+	conn := NewConn(server)
+	defer func() {
+		_ = client.Close()
+		_ = conn.Close()
+	}()
+
+	// 没有读取时写入协程会阻塞在 net.Pipe 上，数据积压在输出缓冲区
+	msg := bytes.Repeat([]byte("a"), 60)
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(client, buf); err != nil || !bytes.Equal(buf, msg) {
+		t.Fatalf("unexpected read %q %v", buf, err)
+	}
+	for conn.OutputBufferSize() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// 超过 soft limit 但未超过持续时间
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if size := conn.OutputBufferSize(); size != 60 {
+		t.Errorf("expect 60 bytes pending, got %d", size)
+	}
+	if _, err := conn.Write(msg); !errors.Is(err, ErrOutputBufferLimit) {
+		t.Fatalf("expect hard limit error, got %v", err)
+	}
+	if _, err := conn.Write(msg); err == nil {
+		t.Error("client over limit should not accept more data")
+	}
+	if _, err := io.ReadAll(client); err != nil {
+		t.Errorf("connection should be closed, got %v", err)
+	}
+}
+
+func TestOutputBufferSoftLimit(t *testing.T) {
+	old := config.Properties()
+	properties := *old
+	properties.ClientOutputBufferLimit = "normal 0 50 1"
+	config.SetProperties(&properties)
+	defer func() {
+		config.SetProperties(old)
+	}()
+
+	server, client := net.Pipe()
+	conn := NewConn(server)
+	defer func() {
+		_ = client.Close()
+		_ = conn.Close()
+	}()
+	msg := bytes.Repeat([]byte("a"), 60)
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte("b")); err != nil {
+		t.Fatal("soft limit should allow writing for a while")
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if _, err := conn.Write([]byte("b")); !errors.Is(err, ErrOutputBufferLimit) {
+		t.Fatalf("expect soft limit error, got %v", err)
+	}
+}
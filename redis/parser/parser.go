@@ -4,13 +4,16 @@ import (
 	"bufio"
 	"bytes"
 	"errors"
+	"fmt"
 	"io"
+	"math"
 	"runtime/debug"
 	"strconv"
 	"strings"
 
 	"godis/interface/redis"
 	"godis/lib/logger"
+	"godis/lib/utils"
 	"godis/redis/protocol"
 )
 
@@ -19,21 +22,393 @@ type Payload struct {
 	Err  error
 }
 
+// protocolErr 表示收到了不合法的数据，fatal 为 false 时连接仍然可以继续使用，
+// 为 true 时无法确定下一个请求的位置，应当关闭连接
+type protocolErr struct {
+	msg   string
+	fatal bool
+}
+
+func (e *protocolErr) Error() string {
+	return "protocol error: " + e.msg
+}
+
+// Recoverable returns true if err is caused by an illegal request and following requests can still be parsed
+func Recoverable(err error) bool {
+	var perr *protocolErr
+	return errors.As(err, &perr) && !perr.fatal
+}
+
+const (
+	// readBufferSize 与 redis 的 PROTO_IOBUF_LEN 相同
+	readBufferSize = 16 * 1024
+	// maxInlineSize 与 redis 的 PROTO_INLINE_MAX_SIZE 相同，同时限制 RESP 的头部
+	maxInlineSize = 64 * 1024
+	// bigArgSize 超过这个长度的参数直接读入单独的内存，不经过 arena 复制
+	bigArgSize = 32 * 1024
+)
+
+// span 记录一个命令参数在 arena 中的位置
+type span struct {
+	start, end int
+	big        []byte // 长度超过 bigArgSize 的参数
+	null       bool
+}
+
+// Parser reads RESP requests and replies from a stream synchronously, it is not safe for concurrent use
+type Parser struct {
+	reader *bufio.Reader
+	line   []byte // 长度超过 bufio 缓冲区的行
+	arena  []byte // 读取命令参数的缓冲区，在命令之间复用
+	spans  []span
+
+	// MaxBulkLen limits length of a bulk string, 0 means no limit
+	MaxBulkLen int64
+	// MaxMultiBulkLen limits number of elements in an array, 0 means no limit
+	MaxMultiBulkLen int64
+	// MultiBulkOnly rejects inline commands, commands in aof files are always arrays.
+	// Lines starting with '#' between commands are annotations and skipped
+	MultiBulkOnly bool
+	// OnAnnotation is called with each annotation line skipped in MultiBulkOnly mode, such as #TS:<unix>
+	OnAnnotation func(line []byte)
+}
+
+// NewParser creates a Parser reading from reader
+func NewParser(reader io.Reader) *Parser {
+	return &Parser{reader: bufio.NewReaderSize(reader, readBufferSize)}
+}
+
+// Buffered returns the number of bytes already read from the stream but not parsed,
+// a pipelining client usually has more requests buffered
+func (p *Parser) Buffered() int {
+	return p.reader.Buffered()
+}
+
+// Next reads a command sent as an array of bulk strings or an inline command like `set a 1`,
+// empty arrays and empty lines are skipped.
+// The returned arguments are kept by the database, so they are copied out of the reused read buffer
+// into a single allocation instead of being overwritten by the next command
+func (p *Parser) Next() ([][]byte, error) {
+	for {
+		line, err := p.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 {
+			continue
+		}
+		if line[0] != '*' {
+			if p.MultiBulkOnly && line[0] == '#' {
+				if p.OnAnnotation != nil {
+					p.OnAnnotation(line)
+				}
+				continue
+			}
+			if p.MultiBulkOnly {
+				return nil, &protocolErr{msg: "expected '*', got '" + string(line[:1]) + "'", fatal: true}
+			}
+			args, err := parseInline(line)
+			if err != nil || len(args) > 0 {
+				return args, err
+			}
+			continue
+		}
+		n, ok := parseInt(line[1:])
+		if !ok || (p.MaxMultiBulkLen > 0 && n > p.MaxMultiBulkLen) {
+			return nil, &protocolErr{msg: "invalid multibulk length", fatal: true}
+		}
+		if n <= 0 {
+			continue
+		}
+		return p.readCommand(int(n))
+	}
+}
+
+// readCommand 读取 n 个 bulk string
+func (p *Parser) readCommand(n int) ([][]byte, error) {
+	p.arena = p.arena[:0]
+	p.spans = p.spans[:0]
+	for i := 0; i < n; i++ {
+		line, err := p.readLine()
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		if len(line) == 0 || line[0] != '$' {
+			got := "EOF"
+			if len(line) > 0 {
+				got = string(line[:1])
+			}
+			return nil, &protocolErr{msg: "expected '$', got '" + got + "'", fatal: true}
+		}
+		size, ok := parseInt(line[1:])
+		if !ok || size < -1 || (p.MaxBulkLen > 0 && size > p.MaxBulkLen) {
+			return nil, &protocolErr{msg: "invalid bulk length", fatal: true}
+		}
+		if size == -1 {
+			p.spans = append(p.spans, span{null: true})
+			continue
+		}
+		if size >= bigArgSize {
+			arg, err := p.readBulk(make([]byte, size+2))
+			if err != nil {
+				return nil, err
+			}
+			p.spans = append(p.spans, span{big: arg})
+			continue
+		}
+		start := len(p.arena)
+		p.arena = append(p.arena, make([]byte, size+2)...)
+		if _, err := p.readBulk(p.arena[start:]); err != nil {
+			return nil, err
+		}
+		p.arena = p.arena[:start+int(size)]
+		p.spans = append(p.spans, span{start: start, end: len(p.arena)})
+	}
+
+	data := make([]byte, len(p.arena))
+	copy(data, p.arena)
+	args := make([][]byte, n)
+	for i, s := range p.spans {
+		switch {
+		case s.null:
+			args[i] = nil
+		case s.big != nil:
+			args[i] = s.big
+		default:
+			args[i] = data[s.start:s.end:s.end] // 限制容量，避免 append 覆盖下一个参数
+		}
+	}
+	return args, nil
+}
+
+// ParseCommand parses a command from the beginning of buf for callers which receive data by themselves,
+// such as an event loop. It returns the command and the number of bytes consumed,
+// consumed is 0 and error is nil if buf does not contain a complete command yet.
+// Limits of the parser are applied, its reader is not used
+func (p *Parser) ParseCommand(buf []byte) ([][]byte, int, error) {
+	pos := 0
+	for {
+		line, next, err := sliceLine(buf, pos)
+		if err != nil || next == 0 {
+			return nil, 0, err
+		}
+		if len(line) == 0 {
+			pos = next
+			continue
+		}
+		if line[0] != '*' {
+			args, err := parseInline(line)
+			if err != nil || len(args) > 0 {
+				return args, next, err
+			}
+			pos = next
+			continue
+		}
+		n, ok := parseInt(line[1:])
+		if !ok || (p.MaxMultiBulkLen > 0 && n > p.MaxMultiBulkLen) {
+			return nil, 0, &protocolErr{msg: "invalid multibulk length", fatal: true}
+		}
+		pos = next
+		if n <= 0 {
+			continue
+		}
+
+		p.spans = p.spans[:0]
+		total := 0
+		for i := int64(0); i < n; i++ {
+			line, next, err := sliceLine(buf, pos)
+			if err != nil || next == 0 {
+				return nil, 0, err
+			}
+			if len(line) == 0 || line[0] != '$' {
+				return nil, 0, &protocolErr{msg: "expected '$', got '" + string(line[:min(len(line), 1)]) + "'", fatal: true}
+			}
+			size, ok := parseInt(line[1:])
+			if !ok || size < -1 || (p.MaxBulkLen > 0 && size > p.MaxBulkLen) {
+				return nil, 0, &protocolErr{msg: "invalid bulk length", fatal: true}
+			}
+			pos = next
+			if size == -1 {
+				p.spans = append(p.spans, span{null: true})
+				continue
+			}
+			if int64(len(buf)-pos) < size+2 {
+				return nil, 0, nil
+			}
+			end := pos + int(size)
+			if buf[end] != '\r' || buf[end+1] != '\n' {
+				return nil, 0, &protocolErr{msg: "invalid bulk terminator", fatal: true}
+			}
+			p.spans = append(p.spans, span{start: pos, end: end})
+			total += int(size)
+			pos = end + 2
+		}
+
+		// buf 由调用者复用，参数需要复制到一块新的内存中
+		data := make([]byte, 0, total)
+		args := make([][]byte, n)
+		for i, s := range p.spans {
+			if s.null {
+				continue
+			}
+			start := len(data)
+			data = append(data, buf[s.start:s.end]...)
+			args[i] = data[start:len(data):len(data)]
+		}
+		return args, pos, nil
+	}
+}
+
+// sliceLine 返回 buf 中从 pos 开始的一行及下一行的位置，没有完整的一行时 next 为 0
+func sliceLine(buf []byte, pos int) (line []byte, next int, err error) {
+	idx := bytes.IndexByte(buf[pos:], '\n')
+	if idx < 0 {
+		if len(buf)-pos > maxInlineSize {
+			return nil, 0, &protocolErr{msg: "too big inline request", fatal: true}
+		}
+		return nil, 0, nil
+	}
+	line = buf[pos : pos+idx]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+	return line, pos + idx + 1, nil
+}
+
+// readBulk 读取 bulk string 的内容和结尾的 CRLF，buf 的长度为内容长度加 2
+func (p *Parser) readBulk(buf []byte) ([]byte, error) {
+	if _, err := io.ReadFull(p.reader, buf); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	size := len(buf) - 2
+	if buf[size] != '\r' || buf[size+1] != '\n' {
+		return nil, &protocolErr{msg: "invalid bulk terminator", fatal: true}
+	}
+	return buf[:size], nil
+}
+
+// NextReply reads a RESP2 or RESP3 value, inline commands are returned as MultiBulkReply
+func (p *Parser) NextReply() (redis.Reply, error) {
+	for {
+		line, err := p.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 {
+			// some empty lines, ignore them
+			continue
+		}
+		if !isTypePrefix(line[0]) {
+			args, err := parseInline(line)
+			if err != nil {
+				return nil, err
+			}
+			if len(args) == 0 {
+				continue
+			}
+			return protocol.MakeMultiBulkReply(args), nil
+		}
+		return p.parseReply(line)
+	}
+}
+
+// readLine 读取一行并去掉结尾的 CRLF 或 LF，返回的切片在下一次读取前有效
+func (p *Parser) readLine() ([]byte, error) {
+	line, err := p.reader.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		p.line = append(p.line[:0], line...)
+		for err == bufio.ErrBufferFull {
+			if len(p.line) > maxInlineSize {
+				return nil, &protocolErr{msg: "too big inline request", fatal: true}
+			}
+			line, err = p.reader.ReadSlice('\n')
+			p.line = append(p.line, line...)
+		}
+		line = p.line
+	}
+	if err != nil {
+		return nil, err
+	}
+	line = line[:len(line)-1]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+	return line, nil
+}
+
+// readElementLine 读取聚合类型中的下一行，不允许空行
+func (p *Parser) readElementLine() ([]byte, error) {
+	line, err := p.readLine()
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if len(line) == 0 {
+		return nil, &protocolErr{msg: "illegal empty line"}
+	}
+	return line, nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// parseInline 与 redis 一样按照空格分割参数，支持引号
+func parseInline(line []byte) ([][]byte, error) {
+	strs, err := utils.SplitArgs(string(line))
+	if err != nil {
+		return nil, &protocolErr{msg: "unbalanced quotes in request"}
+	}
+	args := make([][]byte, len(strs))
+	for i, s := range strs {
+		args[i] = []byte(s)
+	}
+	return args, nil
+}
+
+// parseInt 解析十进制整数，不需要转换为 string
+func parseInt(b []byte) (int64, bool) {
+	if len(b) == 0 || len(b) > 19 {
+		return 0, false
+	}
+	negative := b[0] == '-'
+	if negative {
+		b = b[1:]
+		if len(b) == 0 {
+			return 0, false
+		}
+	}
+	var n int64
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		n = n*10 + int64(c-'0')
+	}
+	if negative {
+		n = -n
+	}
+	return n, true
+}
+
+// ParseStream parses data from reader in a goroutine, at most parseAhead payloads are buffered in the channel
 func ParseStream(reader io.Reader) <-chan *Payload {
-	ch := make(chan *Payload)
+	ch := make(chan *Payload, parseAhead)
 	go parse0(reader, ch)
 	return ch
 }
 
+// parseAhead 解析协程可以领先于调用者的请求数，pipeline 中的命令可以提前解析好，供调用者批量处理
+const parseAhead = 128
+
 func ParseOne(data []byte) (redis.Reply, error) {
-	ch := make(chan *Payload)
-	reader := bytes.NewReader(data)
-	go parse0(reader, ch)
-	Payload := <-ch
-	if Payload == nil {
+	reply, err := NewParser(bytes.NewReader(data)).NextReply()
+	if err == io.EOF {
 		return nil, errors.New("no reply")
 	}
-	return Payload.Data, Payload.Err
+	return reply, err
 }
 
 func parse0(rawReader io.Reader, ch chan<- *Payload) {
@@ -42,146 +417,240 @@ func parse0(rawReader io.Reader, ch chan<- *Payload) {
 			logger.Error(err, string(debug.Stack()))
 		}
 	}()
-	reader := bufio.NewReader(rawReader)
+	p := NewParser(rawReader)
 	for {
-		line, err := reader.ReadBytes('\n')
+		reply, err := p.NextReply()
 		if err != nil {
 			ch <- &Payload{Err: err}
+			if Recoverable(err) {
+				continue
+			}
 			close(ch)
 			return
 		}
-		length := len(line)
-		if length <= 2 || line[length-2] != '\r' {
-			//some empty lines , ignore this error
-			continue
-		}
-		line = bytes.TrimSuffix(line, []byte{'\r', '\n'})
-		switch line[0] {
-		case '+':
-			content := string(line[1:])
-			ch <- &Payload{Data: protocol.MakeStatusReply(content)}
-			if strings.HasPrefix(content, "FULLRESYNC") {
-				if err = parseRDBBulkString(reader, ch); err != nil {
-					ch <- &Payload{Err: err}
-					close(ch)
-					return
-				}
-			}
-		case '-':
-			ch <- &Payload{Data: protocol.MakeErrReply(string(line[1:]))}
-		case ':':
-			value, err := strconv.ParseInt(string(line[1:]), 10, 64)
-			if err != nil {
-				protocolError(ch, "illegal number "+string(line[1:]))
-			}
-			ch <- &Payload{Data: protocol.MakeIntReply(value)}
-		case '$':
-			if err = parseBulkString(line, reader, ch); err != nil {
+		ch <- &Payload{Data: reply}
+		if status, ok := reply.(*protocol.StatusReply); ok && strings.HasPrefix(status.Status, "FULLRESYNC") {
+			if err = p.parseRDBBulkString(ch); err != nil {
 				ch <- &Payload{Err: err}
 				close(ch)
 				return
 			}
-		case '*':
-			err = parseArray(line, reader, ch)
-			if err != nil {
-				ch <- &Payload{Err: err}
-				close(ch)
-				return
-			}
-		default:
-			args := bytes.Split(line, []byte{' '})
-			ch <- &Payload{Data: protocol.MakeMultiBulkReply(args)}
 		}
 	}
 }
 
-// there is no CRLF between RDB and following AOF, therefore it needs to be treated differently
-func parseRDBBulkString(reader *bufio.Reader, ch chan<- *Payload) error {
-	header, err := reader.ReadBytes('\n')
-	if err != nil {
-		return errors.New("failed to read bytes")
+func isTypePrefix(b byte) bool {
+	switch b {
+	case '+', '-', ':', '$', '*', '%', '~', '>', ',', '#', '_', '(', '=', '!', '|':
+		return true
 	}
-	header = bytes.TrimSuffix(header, []byte{'\r', '\n'})
-	if len(header) == 0 {
-		return errors.New("empty header")
+	return false
+}
+
+func (p *Parser) readNextReply() (redis.Reply, error) {
+	line, err := p.readElementLine()
+	if err != nil {
+		return nil, err
 	}
-	strLen, err := strconv.ParseInt(string(header[1:]), 10, 64)
-	if err != nil || strLen <= 0 {
-		return errors.New("illegal bulk header: " + string(header))
+	return p.parseReply(line)
+}
+
+// parseReply parses a RESP2 or RESP3 value whose header line has been read, aggregates are parsed recursively.
+// header 在继续读取后失效，需要先取出其中的内容
+func (p *Parser) parseReply(header []byte) (redis.Reply, error) {
+	kind := header[0]
+	body := string(header[1:])
+	switch kind {
+	case '+':
+		return protocol.MakeStatusReply(body), nil
+	case '-':
+		return protocol.MakeErrReply(body), nil
+	case ':':
+		value, err := strconv.ParseInt(body, 10, 64)
+		if err != nil {
+			return nil, &protocolErr{msg: "illegal number " + body}
+		}
+		return protocol.MakeIntReply(value), nil
+	case '$':
+		data, err := p.readBlob(body)
+		if err != nil {
+			return nil, err
+		}
+		if data == nil {
+			return protocol.MakeNullBulkReply(), nil
+		}
+		return protocol.MakeBulkReply(data), nil
+	case '!':
+		data, err := p.readBlob(body)
+		if err != nil || data == nil {
+			return nil, errOrIllegal(err, body)
+		}
+		return protocol.MakeErrReply(string(data)), nil
+	case '=':
+		data, err := p.readBlob(body)
+		if err != nil || data == nil {
+			return nil, errOrIllegal(err, body)
+		}
+		if len(data) < 4 || data[3] != ':' {
+			return nil, &protocolErr{msg: "illegal verbatim string " + string(data)}
+		}
+		return protocol.MakeVerbatimReply(string(data[:3]), string(data[4:])), nil
+	case ',':
+		value, err := parseDouble(body)
+		if err != nil {
+			return nil, &protocolErr{msg: "illegal double " + body}
+		}
+		return protocol.MakeDoubleReply(value), nil
+	case '#':
+		switch body {
+		case "t":
+			return protocol.MakeBooleanReply(true), nil
+		case "f":
+			return protocol.MakeBooleanReply(false), nil
+		}
+		return nil, &protocolErr{msg: "illegal boolean " + body}
+	case '_':
+		return protocol.MakeNullReply(), nil
+	case '(':
+		if _, err := strconv.ParseFloat(body, 64); err != nil && !errors.Is(err, strconv.ErrRange) {
+			return nil, &protocolErr{msg: "illegal big number " + body}
+		}
+		return protocol.MakeBigNumberReply(body), nil
+	case '*':
+		return p.parseArray(body)
+	case '~', '>':
+		replies, err := p.readAggregate(body, 1)
+		if err != nil {
+			return nil, err
+		}
+		if kind == '~' {
+			return protocol.MakeSetReply(replies), nil
+		}
+		return protocol.MakePushReply(replies), nil
+	case '%':
+		replies, err := p.readAggregate(body, 2)
+		if err != nil {
+			return nil, err
+		}
+		keys := make([]redis.Reply, 0, len(replies)/2)
+		values := make([]redis.Reply, 0, len(replies)/2)
+		for i := 0; i < len(replies); i += 2 {
+			keys = append(keys, replies[i])
+			values = append(values, replies[i+1])
+		}
+		return protocol.MakeMapReply(keys, values), nil
+	case '|':
+		// attribute 只是附加信息，丢弃后返回紧随其后的数据
+		if _, err := p.readAggregate(body, 2); err != nil {
+			return nil, err
+		}
+		return p.readNextReply()
 	}
-	body := make([]byte, strLen)
-	_, err = io.ReadFull(reader, body)
+	return nil, &protocolErr{msg: "unknown type " + strconv.Quote(string(kind))}
+}
+
+func errOrIllegal(err error, header string) error {
 	if err != nil {
 		return err
 	}
-	ch <- &Payload{
-		Data: protocol.MakeBulkReply(body[:len(body)-2]),
-	}
-	return nil
+	return &protocolErr{msg: "illegal header " + header}
 }
 
-func protocolError(ch chan<- *Payload, msg string) {
-	err := errors.New("protocol error: " + msg)
-	ch <- &Payload{Err: err}
+func parseDouble(s string) (float64, error) {
+	switch s {
+	case "inf":
+		return math.Inf(1), nil
+	case "-inf":
+		return math.Inf(-1), nil
+	case "nan":
+		return math.NaN(), nil
+	}
+	return strconv.ParseFloat(s, 64)
 }
 
-func parseBulkString(header []byte, reader *bufio.Reader, ch chan<- *Payload) error {
-	strLen, err := strconv.ParseInt(string(header[1:]), 10, 64)
+// readBlob reads body of $, ! and =, returns nil for null bulk string
+func (p *Parser) readBlob(header string) ([]byte, error) {
+	strLen, err := strconv.ParseInt(header, 10, 64)
 	if err != nil || strLen < -1 {
-		protocolError(ch, "illegal bulk string header: "+string(header))
-		return nil
+		return nil, &protocolErr{msg: "illegal bulk string header: " + header}
 	} else if strLen == -1 {
-		ch <- &Payload{Data: protocol.MakeNullBulkReply()}
-		return nil
+		return nil, nil
 	}
-	body := make([]byte, strLen+2)
-	_, err = io.ReadFull(reader, body)
-	if err != nil {
-		return err
+	if p.MaxBulkLen > 0 && strLen > p.MaxBulkLen {
+		return nil, &protocolErr{msg: "invalid bulk length", fatal: true}
 	}
-	ch <- &Payload{Data: protocol.MakeBulkReply(body[:len(body)-2])}
-	return nil
+	return p.readBulk(make([]byte, strLen+2))
+}
+
+// readAggregate reads count*multiple elements, count is parsed from header
+func (p *Parser) readAggregate(header string, multiple int) ([]redis.Reply, error) {
+	count, err := strconv.ParseInt(header, 10, 64)
+	if err != nil || count < 0 {
+		return nil, &protocolErr{msg: "illegal aggregate header " + header}
+	}
+	if p.MaxMultiBulkLen > 0 && count > p.MaxMultiBulkLen {
+		return nil, &protocolErr{msg: "invalid multibulk length", fatal: true}
+	}
+	replies := make([]redis.Reply, 0, count*int64(multiple))
+	for i := int64(0); i < count*int64(multiple); i++ {
+		reply, err := p.readNextReply()
+		if err != nil {
+			return nil, err
+		}
+		replies = append(replies, reply)
+	}
+	return replies, nil
 }
 
-func parseArray(header []byte, reader *bufio.Reader, ch chan<- *Payload) error {
-	nStrs, err := strconv.ParseInt(string(header[1:]), 10, 64)
-	if err != nil || nStrs < 0 {
-		protocolError(ch, "illegal array header "+string(header[1:]))
-		return nil
+// parseArray returns MultiBulkReply if all elements are bulk strings, which is how commands are sent,
+// otherwise MultiRawReply
+func (p *Parser) parseArray(header string) (redis.Reply, error) {
+	nStrs, err := strconv.ParseInt(header, 10, 64)
+	if err != nil || nStrs < -1 {
+		return nil, &protocolErr{msg: "illegal array header " + header}
+	} else if nStrs == -1 {
+		return protocol.MakeNullReply(), nil
 	} else if nStrs == 0 {
-		ch <- &Payload{Data: protocol.MakeEmptyMultiBulkReply()}
-		return nil
+		return protocol.MakeEmptyMultiBulkReply(), nil
+	}
+	replies, err := p.readAggregate(header, 1)
+	if err != nil {
+		return nil, err
 	}
 	lines := make([][]byte, 0, nStrs)
-	for i := int64(0); i < nStrs; i++ {
-		var line []byte
-		line, err = reader.ReadBytes('\n')
-		if err != nil {
-			return err
-		}
-		var length = len(line)
-		// fmt.Println(length, line[length-2] == '\r', line[0] == '$', line[1])
-		if length <= 2 || line[length-2] != '\r' || line[0] != '$' {
-			//some empty lines , ignore this error
-			protocolError(ch, "illegal bulk string header "+string(line))
-			break
-		}
-		strLen, err := strconv.ParseInt(string(line[1:length-2]), 10, 64)
-		if err != nil || strLen < -1 {
-			protocolError(ch, "illegal bulk string length: "+string(line))
-			break
-		} else if strLen == -1 {
-			ch <- &Payload{Data: protocol.MakeNullBulkReply()}
-		} else {
-			// fmt.Println(strLen)
-			body := make([]byte, strLen+2)
-			_, err = io.ReadFull(reader, body)
-			if err != nil {
-				return err
-			}
-			lines = append(lines, body[:len(body)-2])
+	for _, reply := range replies {
+		switch r := reply.(type) {
+		case *protocol.BulkReply:
+			lines = append(lines, r.Arg)
+		case *protocol.NullBulkReply:
+			lines = append(lines, nil)
+		default:
+			return protocol.MakeMultiRawReply(replies), nil
 		}
 	}
-	ch <- &Payload{Data: protocol.MakeMultiBulkReply(lines)}
+	return protocol.MakeMultiBulkReply(lines), nil
+}
+
+// there is no CRLF between RDB and following AOF, therefore it needs to be treated differently
+func (p *Parser) parseRDBBulkString(ch chan<- *Payload) error {
+	header, err := p.readLine()
+	if err != nil {
+		return errors.New("failed to read bytes")
+	}
+	if len(header) == 0 {
+		return errors.New("empty header")
+	}
+	strLen, err := strconv.ParseInt(string(header[1:]), 10, 64)
+	if err != nil || strLen <= 0 {
+		return fmt.Errorf("illegal bulk header: %s", header)
+	}
+	body := make([]byte, strLen)
+	_, err = io.ReadFull(p.reader, body)
+	if err != nil {
+		return err
+	}
+	ch <- &Payload{
+		Data: protocol.MakeBulkReply(body[:len(body)-2]),
+	}
 	return nil
 }
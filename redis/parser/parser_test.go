@@ -7,6 +7,7 @@ import (
 	"godis/lib/utils"
 	reply "godis/redis/protocol"
 	"io"
+	"math"
 	"testing"
 )
 
@@ -83,3 +84,189 @@ func TestParseOne(t *testing.T) {
 		}
 	}
 }
+
+func TestParseRESP3(t *testing.T) {
+	replies := []resp.Reply{
+		reply.MakeMapReply(
+			[]resp.Reply{reply.MakeBulkReply([]byte("f1")), reply.MakeStatusReply("f2")},
+			[]resp.Reply{reply.MakeIntReply(1), reply.MakeMultiBulkReply([][]byte{[]byte("a")})},
+		),
+		reply.MakeSetReply([]resp.Reply{reply.MakeBulkReply([]byte("m1")), reply.MakeBulkReply([]byte("m2"))}),
+		reply.MakeDoubleReply(3.14),
+		reply.MakeDoubleReply(math.Inf(-1)),
+		reply.MakeBooleanReply(true),
+		reply.MakeBooleanReply(false),
+		reply.MakeNullReply(),
+		reply.MakeBigNumberReply("3492890328409238509324850943850943825024385"),
+		reply.MakeVerbatimReply("txt", "Some string\r\n"),
+		reply.MakePushReply([]resp.Reply{
+			reply.MakeBulkReply([]byte("message")),
+			reply.MakeBulkReply([]byte("ch")),
+			reply.MakeBulkReply([]byte("hello")),
+		}),
+		reply.MakeMultiRawReply([]resp.Reply{
+			reply.MakeIntReply(1),
+			reply.MakeMapReply([]resp.Reply{reply.MakeBulkReply([]byte("k"))}, []resp.Reply{reply.MakeNullReply()}),
+		}),
+	}
+	for _, re := range replies {
+		data := reply.Encode(re, reply.RESP3)
+		result, err := ParseOne(data)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if !utils.BytesEquals(reply.Encode(result, reply.RESP3), data) {
+			t.Errorf("parse failed: %q, actual: %q", data, reply.Encode(result, reply.RESP3))
+		}
+	}
+
+	// attribute 被忽略, blob error 转为错误
+	result, err := ParseOne([]byte("|1\r\n+ttl\r\n:3600\r\n:42\r\n"))
+	if err != nil || !utils.BytesEquals(result.ToBytes(), []byte(":42\r\n")) {
+		t.Errorf("attribute should be skipped, actual: %v %v", result, err)
+	}
+	result, err = ParseOne([]byte("!21\r\nSYNTAX invalid syntax\r\n"))
+	if err != nil || !reply.IsErrorReply(result) {
+		t.Errorf("expect blob error, actual: %v %v", result, err)
+	}
+}
+
+func TestEncodeRESP2(t *testing.T) {
+	m := reply.MakeMapReply(
+		[]resp.Reply{reply.MakeBulkReply([]byte("k"))},
+		[]resp.Reply{reply.MakeDoubleReply(1.5)},
+	)
+	if string(m.ToBytes()) != "*2\r\n$1\r\nk\r\n$3\r\n1.5\r\n" {
+		t.Errorf("unexpected RESP2 map: %q", m.ToBytes())
+	}
+	if string(reply.Encode(reply.MakeBooleanReply(true), reply.RESP2)) != ":1\r\n" {
+		t.Error("unexpected RESP2 boolean")
+	}
+	if string(reply.Encode(reply.MakeNullBulkReply(), reply.RESP3)) != "_\r\n" {
+		t.Error("unexpected RESP3 null")
+	}
+}
+
+func TestNext(t *testing.T) {
+	big := bytes.Repeat([]byte("x"), bigArgSize+1)
+	var input bytes.Buffer
+	input.Write(reply.MakeMultiBulkReply([][]byte{[]byte("SET"), []byte("k"), []byte("a\r\nb")}).ToBytes())
+	input.WriteString("*0\r\n\r\n")
+	input.WriteString("set \"hello world\" 'v'\n")
+	input.Write(reply.MakeMultiBulkReply([][]byte{[]byte("SET"), big}).ToBytes())
+	input.WriteString("*2\r\n$3\r\nGET\r\n$-1\r\n")
+
+	p := NewParser(&input)
+	expected := [][][]byte{
+		{[]byte("SET"), []byte("k"), []byte("a\r\nb")},
+		{[]byte("set"), []byte("hello world"), []byte("v")},
+		{[]byte("SET"), big},
+		{[]byte("GET"), nil},
+	}
+	var results [][][]byte
+	for {
+		cmdLine, err := p.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		results = append(results, cmdLine)
+	}
+	// 之前返回的参数不会被之后的命令覆盖
+	if len(results) != len(expected) {
+		t.Fatalf("expect %d commands, got %d", len(expected), len(results))
+	}
+	for i, cmdLine := range results {
+		if fmt.Sprintf("%q", cmdLine) != fmt.Sprintf("%q", expected[i]) || (expected[i][1] == nil) != (cmdLine[1] == nil) {
+			t.Errorf("expect %q, got %q", expected[i], cmdLine)
+		}
+	}
+}
+
+func TestNextErrors(t *testing.T) {
+	cases := []struct {
+		input       string
+		recoverable bool
+	}{
+		{"*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$100\r\nv\r\n", false},
+		{"*2000\r\n", false},
+		{"*x\r\n", false},
+		{"*1\r\n:1\r\n", false},
+		{"*1\r\n$1\r\nab\r\n", false},
+		{"set \"a\r\n", true},
+	}
+	for _, c := range cases {
+		p := NewParser(bytes.NewReader([]byte(c.input)))
+		p.MaxBulkLen = 10
+		p.MaxMultiBulkLen = 1000
+		_, err := p.Next()
+		if err == nil || err == io.EOF || Recoverable(err) != c.recoverable {
+			t.Errorf("%q: unexpected error %v", c.input, err)
+		}
+	}
+
+	p := NewParser(bytes.NewReader([]byte("*1\r\n$4\r\nPI")))
+	if _, err := p.Next(); err != io.ErrUnexpectedEOF {
+		t.Errorf("expect unexpected EOF, got %v", err)
+	}
+	p = NewParser(bytes.NewReader(bytes.Repeat([]byte("a"), maxInlineSize+readBufferSize)))
+	if _, err := p.Next(); err == nil || Recoverable(err) {
+		t.Errorf("expect too big inline request, got %v", err)
+	}
+}
+
+func TestNextAllocs(t *testing.T) {
+	cmd := reply.MakeMultiBulkReply([][]byte{[]byte("SET"), []byte("key"), []byte("value")}).ToBytes()
+	reader := bytes.NewReader(nil)
+	p := NewParser(reader)
+	allocs := testing.AllocsPerRun(100, func() {
+		reader.Reset(cmd)
+		if _, err := p.Next(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	// 参数和参数切片各一次
+	if allocs > 2 {
+		t.Errorf("expect at most 2 allocations per command, got %v", allocs)
+	}
+}
+
+func makePipeline(n int) []byte {
+	var buf bytes.Buffer
+	for i := 0; i < n; i++ {
+		buf.Write(reply.MakeMultiBulkReply([][]byte{[]byte("SET"), []byte("key"), []byte("value")}).ToBytes())
+	}
+	return buf.Bytes()
+}
+
+func BenchmarkNext(b *testing.B) {
+	data := makePipeline(100)
+	reader := bytes.NewReader(nil)
+	p := NewParser(reader)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		reader.Reset(data)
+		for {
+			if _, err := p.Next(); err != nil {
+				break
+			}
+		}
+	}
+}
+
+func BenchmarkParseStream(b *testing.B) {
+	data := makePipeline(100)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		for payload := range ParseStream(bytes.NewReader(data)) {
+			if payload.Err != nil {
+				break
+			}
+		}
+	}
+}
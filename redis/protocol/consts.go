@@ -57,6 +57,13 @@ func (r *NullBulkReply) ToBytes() []byte {
 	return nullBulkBytes
 }
 
+func (r *NullBulkReply) ToBytesWithProtocol(proto int) []byte {
+	if proto == RESP3 {
+		return nullBytes
+	}
+	return nullBulkBytes
+}
+
 func (r *NullBulkReply) DataString() string {
 	return "(nil)"
 }
@@ -14,6 +14,10 @@ func (r *UnknownErrReply) Error() string {
 	return "Err unknown"
 }
 
+func (r *UnknownErrReply) DataString() string {
+	return "(error) " + r.Error()
+}
+
 // ArgNumErrReply represents wrong number of arguments for command
 type ArgNumErrReply struct {
 	Cmd string
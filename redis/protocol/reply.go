@@ -35,6 +35,13 @@ func (r *BulkReply) ToBytes() []byte {
 	}
 	return []byte("$" + strconv.Itoa(len(r.Arg)) + CRLF + string(r.Arg) + CRLF)
 }
+func (r *BulkReply) ToBytesWithProtocol(proto int) []byte {
+	if r.Arg == nil && proto == RESP3 {
+		return nullBytes
+	}
+	return r.ToBytes()
+}
+
 func (r *BulkReply) DataString() string {
 	return string(r.Arg)
 }
@@ -121,15 +128,33 @@ func MakeMultiRawReply(replies []redis.Reply) *MultiRawReply {
 
 // ToBytes marshal redis.Reply
 func (r *MultiRawReply) ToBytes() []byte {
-	argLen := len(r.Replies)
+	return r.ToBytesWithProtocol(RESP2)
+}
+
+// ToBytesWithProtocol marshals nested replies with the same protocol version
+func (r *MultiRawReply) ToBytesWithProtocol(proto int) []byte {
 	var buf bytes.Buffer
-	buf.WriteString("*" + strconv.Itoa(argLen) + CRLF)
-	for _, arg := range r.Replies {
-		buf.Write(arg.ToBytes())
-	}
+	writeAggregate(&buf, '*', len(r.Replies), r.Replies, proto)
 	return buf.Bytes()
 }
 
+func (r *MultiRawReply) DataString() string {
+	if len(r.Replies) == 0 {
+		return "(empty list or set)"
+	}
+
+	var builder strings.Builder
+	for i, arg := range r.Replies {
+		builder.WriteString(strconv.Itoa(i+1) + ") ")
+		builder.WriteString(arg.DataString())
+		if i != len(r.Replies)-1 {
+			builder.WriteByte('\n')
+		}
+	}
+
+	return builder.String()
+}
+
 /* ---- Status Reply ---- */
 
 // StatusReply stores a simple status string
@@ -203,7 +228,8 @@ func MakeErrReply(status string) *StandardErrReply {
 
 // IsErrorReply returns true if the given protocol is error
 func IsErrorReply(reply redis.Reply) bool {
-	return reply.ToBytes()[0] == '-'
+	_, ok := reply.(ErrorReply)
+	return ok
 }
 
 // ToBytes marshal redis.Reply
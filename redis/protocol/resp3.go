@@ -0,0 +1,344 @@
+package protocol
+
+import (
+	"bytes"
+	"math"
+	"strconv"
+	"strings"
+
+	"godis/interface/redis"
+)
+
+// 协议版本，客户端通过 HELLO 命令协商，默认为 RESP2
+const (
+	RESP2 = 2
+	RESP3 = 3
+)
+
+// VersionedReply is implemented by replies whose encoding differs between RESP2 and RESP3,
+// their ToBytes always returns the RESP2 encoding
+type VersionedReply interface {
+	redis.Reply
+	ToBytesWithProtocol(proto int) []byte
+}
+
+// Encode marshals reply with the given protocol version
+func Encode(reply redis.Reply, proto int) []byte {
+	if v, ok := reply.(VersionedReply); ok {
+		return v.ToBytesWithProtocol(proto)
+	}
+	return reply.ToBytes()
+}
+
+var nullBytes = []byte("_\r\n")
+
+// writeAggregate 写入聚合类型的头部和所有元素，元素按照相同的协议版本编码
+func writeAggregate(buf *bytes.Buffer, prefix byte, n int, replies []redis.Reply, proto int) {
+	buf.WriteByte(prefix)
+	buf.WriteString(strconv.Itoa(n))
+	buf.WriteString(CRLF)
+	for _, reply := range replies {
+		buf.Write(Encode(reply, proto))
+	}
+}
+
+func aggregateDataString(replies []redis.Reply) string {
+	if len(replies) == 0 {
+		return "(empty list or set)"
+	}
+	var builder strings.Builder
+	for i, reply := range replies {
+		builder.WriteString(strconv.Itoa(i+1) + ") ")
+		builder.WriteString(reply.DataString())
+		if i != len(replies)-1 {
+			builder.WriteByte('\n')
+		}
+	}
+	return builder.String()
+}
+
+/* ---- Map Reply ---- */
+
+// MapReply is an ordered list of key-value pairs, a flat array in RESP2
+type MapReply struct {
+	Keys   []redis.Reply
+	Values []redis.Reply
+}
+
+// MakeMapReply creates MapReply, keys and values must have the same length
+func MakeMapReply(keys []redis.Reply, values []redis.Reply) *MapReply {
+	return &MapReply{
+		Keys:   keys,
+		Values: values,
+	}
+}
+
+// ToBytes marshal redis.Reply
+func (r *MapReply) ToBytes() []byte {
+	return r.ToBytesWithProtocol(RESP2)
+}
+
+func (r *MapReply) ToBytesWithProtocol(proto int) []byte {
+	var buf bytes.Buffer
+	if proto == RESP3 {
+		buf.WriteString("%" + strconv.Itoa(len(r.Keys)) + CRLF)
+	} else {
+		buf.WriteString("*" + strconv.Itoa(len(r.Keys)*2) + CRLF)
+	}
+	for i := range r.Keys {
+		buf.Write(Encode(r.Keys[i], proto))
+		buf.Write(Encode(r.Values[i], proto))
+	}
+	return buf.Bytes()
+}
+
+func (r *MapReply) DataString() string {
+	if len(r.Keys) == 0 {
+		return "(empty hash)"
+	}
+	var builder strings.Builder
+	for i := range r.Keys {
+		builder.WriteString(strconv.Itoa(i+1) + "# " + r.Keys[i].DataString() + " => " + r.Values[i].DataString())
+		if i != len(r.Keys)-1 {
+			builder.WriteByte('\n')
+		}
+	}
+	return builder.String()
+}
+
+/* ---- Set Reply ---- */
+
+// SetReply is an unordered collection of distinct elements, an array in RESP2
+type SetReply struct {
+	Members []redis.Reply
+}
+
+// MakeSetReply creates SetReply
+func MakeSetReply(members []redis.Reply) *SetReply {
+	return &SetReply{
+		Members: members,
+	}
+}
+
+// ToBytes marshal redis.Reply
+func (r *SetReply) ToBytes() []byte {
+	return r.ToBytesWithProtocol(RESP2)
+}
+
+func (r *SetReply) ToBytesWithProtocol(proto int) []byte {
+	var buf bytes.Buffer
+	prefix := byte('*')
+	if proto == RESP3 {
+		prefix = '~'
+	}
+	writeAggregate(&buf, prefix, len(r.Members), r.Members, proto)
+	return buf.Bytes()
+}
+
+func (r *SetReply) DataString() string {
+	return aggregateDataString(r.Members)
+}
+
+/* ---- Push Reply ---- */
+
+// PushReply is an out-of-band message such as pub/sub messages, an array in RESP2
+type PushReply struct {
+	Replies []redis.Reply
+}
+
+// MakePushReply creates PushReply
+func MakePushReply(replies []redis.Reply) *PushReply {
+	return &PushReply{
+		Replies: replies,
+	}
+}
+
+// ToBytes marshal redis.Reply
+func (r *PushReply) ToBytes() []byte {
+	return r.ToBytesWithProtocol(RESP2)
+}
+
+func (r *PushReply) ToBytesWithProtocol(proto int) []byte {
+	var buf bytes.Buffer
+	prefix := byte('*')
+	if proto == RESP3 {
+		prefix = '>'
+	}
+	writeAggregate(&buf, prefix, len(r.Replies), r.Replies, proto)
+	return buf.Bytes()
+}
+
+func (r *PushReply) DataString() string {
+	return aggregateDataString(r.Replies)
+}
+
+/* ---- Double Reply ---- */
+
+// DoubleReply is a floating point number, a bulk string in RESP2
+type DoubleReply struct {
+	Value float64
+}
+
+// MakeDoubleReply creates DoubleReply
+func MakeDoubleReply(value float64) *DoubleReply {
+	return &DoubleReply{
+		Value: value,
+	}
+}
+
+func formatDouble(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "inf"
+	case math.IsInf(value, -1):
+		return "-inf"
+	case math.IsNaN(value):
+		return "nan"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// ToBytes marshal redis.Reply
+func (r *DoubleReply) ToBytes() []byte {
+	return r.ToBytesWithProtocol(RESP2)
+}
+
+func (r *DoubleReply) ToBytesWithProtocol(proto int) []byte {
+	s := formatDouble(r.Value)
+	if proto == RESP3 {
+		return []byte("," + s + CRLF)
+	}
+	return []byte("$" + strconv.Itoa(len(s)) + CRLF + s + CRLF)
+}
+
+func (r *DoubleReply) DataString() string {
+	return "(double) " + formatDouble(r.Value)
+}
+
+/* ---- Boolean Reply ---- */
+
+// BooleanReply is true or false, integer 1 or 0 in RESP2
+type BooleanReply struct {
+	Value bool
+}
+
+// MakeBooleanReply creates BooleanReply
+func MakeBooleanReply(value bool) *BooleanReply {
+	return &BooleanReply{
+		Value: value,
+	}
+}
+
+// ToBytes marshal redis.Reply
+func (r *BooleanReply) ToBytes() []byte {
+	return r.ToBytesWithProtocol(RESP2)
+}
+
+func (r *BooleanReply) ToBytesWithProtocol(proto int) []byte {
+	if proto == RESP3 {
+		if r.Value {
+			return []byte("#t\r\n")
+		}
+		return []byte("#f\r\n")
+	}
+	if r.Value {
+		return []byte(":1\r\n")
+	}
+	return []byte(":0\r\n")
+}
+
+func (r *BooleanReply) DataString() string {
+	if r.Value {
+		return "(true)"
+	}
+	return "(false)"
+}
+
+/* ---- Null Reply ---- */
+
+// NullReply is the RESP3 null, a null bulk string in RESP2
+type NullReply struct{}
+
+// MakeNullReply creates NullReply
+func MakeNullReply() *NullReply {
+	return &NullReply{}
+}
+
+// ToBytes marshal redis.Reply
+func (r *NullReply) ToBytes() []byte {
+	return nullBulkBytes
+}
+
+func (r *NullReply) ToBytesWithProtocol(proto int) []byte {
+	if proto == RESP3 {
+		return nullBytes
+	}
+	return nullBulkBytes
+}
+
+func (r *NullReply) DataString() string {
+	return "(nil)"
+}
+
+/* ---- Big Number Reply ---- */
+
+// BigNumberReply is an integer out of the range of int64, a bulk string in RESP2
+type BigNumberReply struct {
+	Value string
+}
+
+// MakeBigNumberReply creates BigNumberReply
+func MakeBigNumberReply(value string) *BigNumberReply {
+	return &BigNumberReply{
+		Value: value,
+	}
+}
+
+// ToBytes marshal redis.Reply
+func (r *BigNumberReply) ToBytes() []byte {
+	return r.ToBytesWithProtocol(RESP2)
+}
+
+func (r *BigNumberReply) ToBytesWithProtocol(proto int) []byte {
+	if proto == RESP3 {
+		return []byte("(" + r.Value + CRLF)
+	}
+	return []byte("$" + strconv.Itoa(len(r.Value)) + CRLF + r.Value + CRLF)
+}
+
+func (r *BigNumberReply) DataString() string {
+	return "(big number) " + r.Value
+}
+
+/* ---- Verbatim String Reply ---- */
+
+// VerbatimReply is a string with a three bytes format hint such as txt or mkd, a bulk string in RESP2
+type VerbatimReply struct {
+	Format string
+	Text   string
+}
+
+// MakeVerbatimReply creates VerbatimReply
+func MakeVerbatimReply(format string, text string) *VerbatimReply {
+	return &VerbatimReply{
+		Format: format,
+		Text:   text,
+	}
+}
+
+// ToBytes marshal redis.Reply
+func (r *VerbatimReply) ToBytes() []byte {
+	return r.ToBytesWithProtocol(RESP2)
+}
+
+func (r *VerbatimReply) ToBytesWithProtocol(proto int) []byte {
+	if proto == RESP3 {
+		body := r.Format + ":" + r.Text
+		return []byte("=" + strconv.Itoa(len(body)) + CRLF + body + CRLF)
+	}
+	return []byte("$" + strconv.Itoa(len(r.Text)) + CRLF + r.Text + CRLF)
+}
+
+func (r *VerbatimReply) DataString() string {
+	return r.Text
+}
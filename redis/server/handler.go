@@ -2,10 +2,13 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
 	"godis/config"
 	database2 "godis/database"
 	"godis/interface/database"
+	"godis/interface/redis"
 	"godis/lib/logger"
+	"godis/lib/metrics"
 	"godis/lib/sync/atomic"
 	"godis/redis/connection"
 	"godis/redis/parser"
@@ -14,94 +17,176 @@ import (
 	"net"
 	"strings"
 	"sync"
+	stdatomic "sync/atomic"
 	"time"
 )
 
-var unknownErrReplyBytes = []byte("-ERR unknown\r\n")
+var (
+	unknownErrReplyBytes    = []byte("-ERR unknown\r\n")
+	maxClientsErrReplyBytes = []byte("-ERR max number of clients reached\r\n")
+	shuttingDownReplyBytes  = []byte("-ERR server is shutting down\r\n")
+)
+
+var (
+	connectedClients = metrics.NewGauge("godis_connected_clients",
+		"Number of client connections.")
+	connectionsReceived = metrics.NewCounter("godis_connections_received_total",
+		"Total number of connections accepted by server.")
+)
 
 type Handler struct {
-	activeConn  sync.Map // value记录activeConn的心跳
+	activeConn  sync.Map // 客户端 ID -> *connection.Connection
+	clientCount stdatomic.Int64
 	db          database.DB
 	closing     atomic.Boolean // refusing new client and new request
 	closingChan chan struct{}  // 停止心跳检查计时器
+	monitors    *monitorHub
+	flushEach   bool // 每条回复同步发送，即合并发送之前的行为，只用于基准测试对比
+
+	executing    stdatomic.Int64 // 正在执行的命令数，关闭时等待它们完成
+	shutdownOnce sync.Once
+	shutdownChan chan struct{} // SHUTDOWN 命令执行后关闭，通知网络层停止服务
 }
 
 func MakeHandler() *Handler {
-	var db database.DB
-	if config.Properties.Peers != nil && len(config.Properties.Peers) != 0 {
-		db = database2.NewClusterServer(config.Properties.Peers)
-		logger.Infof("cluster mode, peer is %v", config.Properties.Peers)
+	var db *database2.Server
+	if config.Properties().Peers != nil && len(config.Properties().Peers) != 0 {
+		db = database2.NewClusterServer(config.Properties().Peers)
+		logger.Infof("cluster mode, peer is %v", config.Properties().Peers)
 	} else {
 		db = database2.NewStandaloneServer()
 	}
 	h := &Handler{
-		db:          db,
-		closingChan: make(chan struct{}, 1),
+		db:           db,
+		closingChan:  make(chan struct{}, 1),
+		monitors:     makeMonitorHub(),
+		shutdownChan: make(chan struct{}),
 	}
+	db.SetClientManager(h)
 
-	if config.Properties.Keepalive > 0 {
-		go h.checkActiveHeartbeat(config.Properties.Keepalive)
-	}
+	go h.checkActiveHeartbeat()
 	return h
 }
 
 func (h *Handler) Handle(ctx context.Context, conn net.Conn) {
+	client := h.accept(conn)
+	if client == nil {
+		return
+	}
+
+	p := newParser(conn)
+	batch := 0
+	for {
+		cmdLine, err := p.Next()
+		if !h.handleCommand(client, cmdLine, err) {
+			return
+		}
+		// 客户端使用 pipeline 时，已经读入缓冲区的命令全部执行后再一次性发送回复
+		batch++
+		if h.flushEach {
+			client.Flush()
+			client.WaitFlushed()
+		} else if p.Buffered() == 0 || batch >= maxPipelineBatch {
+			client.Flush()
+			batch = 0
+		}
+	}
+}
+
+// accept 创建客户端，服务器关闭中或者客户端数量达到上限时关闭连接并返回 nil
+func (h *Handler) accept(conn net.Conn) *connection.Connection {
 	if h.closing.Get() {
 		conn.Close()
-		return
+		return nil
 	}
 
+	connectionsReceived.Inc()
+	if h.clientCount.Add(1) > int64(config.Properties().MaxClients) {
+		h.clientCount.Add(-1)
+		_, _ = conn.Write(maxClientsErrReplyBytes)
+		_ = conn.Close()
+		return nil
+	}
+	setKeepAlive(conn)
 	client := connection.NewConn(conn)
-	h.activeConn.Store(client, time.Now())
-
-	ch := parser.ParseStream(conn)
-	for payload := range ch {
-		if payload.Err != nil {
-			if payload.Err == io.EOF || payload.Err == io.ErrUnexpectedEOF ||
-				strings.Contains(payload.Err.Error(), "use of closed network connection") {
-				h.closeClient(client)
-				logger.Info("connection closed: " + client.RemoteAddr().String())
-				return
-			}
-			errReply := protocol.MakeErrReply(payload.Err.Error())
-			_, err := client.Write(errReply.ToBytes())
-			if err != nil {
-				h.closeClient(client)
-				logger.Info("connection closed: " + client.RemoteAddr().String())
-				return
-			}
-			continue
-		}
-		if payload.Data == nil {
-			logger.Error("empty payload")
-			continue
+	h.activeConn.Store(client.GetID(), client)
+	connectedClients.Inc()
+	return client
+}
+
+// newParser 创建使用当前协议限制的解析器，conn 为空时只用于 ParseCommand
+func newParser(conn net.Conn) *parser.Parser {
+	p := parser.NewParser(conn)
+	p.MaxBulkLen = config.Properties().ProtoMaxBulkLen
+	p.MaxMultiBulkLen = config.Properties().ProtoMaxMultiBulkLen
+	return p
+}
+
+// maxPipelineBatch 一批最多执行的命令数，避免持续发送命令的客户端迟迟收不到回复
+const maxPipelineBatch = 1024
+
+// handleCommand 执行一条命令并将回复放入输出缓冲区，返回 false 表示连接已关闭
+func (h *Handler) handleCommand(client *connection.Connection, cmdLine [][]byte, err error) bool {
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF ||
+			strings.Contains(err.Error(), "use of closed network connection") {
+			// closeClient 会把连接放回对象池，先记录日志
+			logger.Info("connection closed: " + client.RemoteAddr().String())
+			h.closeClient(client)
+			return false
 		}
-		r, ok := payload.Data.(*protocol.MultiBulkReply)
-		if !ok {
-			logger.Error("require multi bulk protocol")
-			continue
+		errReply := protocol.MakeErrReply(err.Error())
+		if bufErr := client.Buffer(errReply.ToBytes()); bufErr != nil || !parser.Recoverable(err) {
+			// 无法继续解析的协议错误与 redis 一样回复后关闭连接
+			logger.Info("connection closed: " + client.RemoteAddr().String() + ", " + err.Error())
+			h.closeClient(client)
+			return false
 		}
+		return true
+	}
 
-		h.activeConn.Store(client, time.Now())
+	// 先计数再检查 closing，Close 设置 closing 后看到的计数一定包含了所有会继续执行的命令
+	h.executing.Add(1)
+	defer h.executing.Add(-1)
+	if h.closing.Get() {
+		_ = client.Buffer(shuttingDownReplyBytes)
+		return true
+	}
 
-		result := h.db.Exec(client, r.Args)
+	client.SetLastInteraction(time.Now())
+	result := h.db.Exec(client, cmdLine)
+	if client.HasFlag(connection.FlagMonitor) {
+		h.monitors.add(client)
+	}
 
-		if result != nil {
-			_, _ = client.Write(result.ToBytes())
-		} else {
-			_, _ = client.Write(unknownErrReplyBytes)
-		}
+	if result != nil {
+		_ = client.Buffer(protocol.Encode(result, client.GetProtocol()))
+	} else {
+		_ = client.Buffer(unknownErrReplyBytes)
 	}
+	return true
 }
 
-func (h *Handler) checkActiveHeartbeat(keepalive int) {
-	ticker := time.NewTicker(time.Second * time.Duration(keepalive/2))
+// checkActiveHeartbeat 每秒检查一次，关闭空闲时间超过 timeout 的客户端。
+// timeout 可以通过 CONFIG SET 修改，为 0 时不检查。与 redis 一样，订阅中的客户端和 monitor 不会因空闲被关闭
+func (h *Handler) checkActiveHeartbeat() {
+	ticker := time.NewTicker(time.Second)
 	for {
 		select {
 		case <-ticker.C:
+			timeout := config.Properties().Timeout
+			if timeout <= 0 {
+				continue
+			}
+			deadline := time.Now().Add(-time.Second * time.Duration(timeout))
 			h.activeConn.Range(func(key, value any) bool {
-				if time.Now().After(value.(time.Time).Add(time.Second * time.Duration(keepalive))) {
-					h.closeClient(key.(*connection.Connection))
+				client := value.(*connection.Connection)
+				if client.GetSubscribeNum() > 0 || client.HasFlag(connection.FlagMonitor) {
+					return true
+				}
+				if client.GetLastInteraction().Before(deadline) {
+					logger.Info("closing idle client " + client.Name())
+					_ = client.Kill()
 				}
 				return true
 			})
@@ -112,22 +197,99 @@ func (h *Handler) checkActiveHeartbeat(keepalive int) {
 	}
 }
 
+// setKeepAlive 开启 TCP keepalive 以发现已经断开的客户端
+func setKeepAlive(conn net.Conn) {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	keepalive := config.Properties().Keepalive
+	if tcpConn, ok := conn.(*net.TCPConn); ok && keepalive > 0 {
+		_ = tcpConn.SetKeepAlive(true)
+		_ = tcpConn.SetKeepAlivePeriod(time.Second * time.Duration(keepalive))
+	}
+}
+
 func (h *Handler) closeClient(client *connection.Connection) {
-	_ = client.Close()
+	if _, loaded := h.activeConn.LoadAndDelete(client.GetID()); !loaded {
+		return // 已被心跳检查关闭
+	}
+	connectedClients.Dec()
+	h.clientCount.Add(-1)
+	h.monitors.remove(client)
 	h.db.AfterClientClose(client)
-	h.activeConn.Delete(client)
+	_ = client.Close()
 }
 
+// Close stops accepting new commands, waits at most shutdown_timeout for executing commands,
+// then sends pending replies, closes all clients and closes db which flushes the aof
 func (h *Handler) Close() error {
 	logger.Info("handler shutting down...")
 	h.closing.Set(true)
 	h.closingChan <- struct{}{}
-	// TODO: concurrent wait
-	h.activeConn.Range(func(key interface{}, val interface{}) bool { // close all active conn
-		client := key.(*connection.Connection)
-		_ = client.Close()
+	if !h.waitExecuting(time.Duration(config.Properties().ShutdownTimeout) * time.Second) {
+		logger.Warn("some commands are still executing after shutdown_timeout, closing clients anyway")
+	}
+	h.activeConn.Range(func(key interface{}, val interface{}) bool {
+		h.closeClient(val.(*connection.Connection))
 		return true
 	})
 	h.db.Close()
 	return nil
 }
+
+// waitExecuting 等待正在执行的命令完成，超时返回 false
+func (h *Handler) waitExecuting(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for h.executing.Load() > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
+// Shutdown implements database.ClientManager
+func (h *Handler) Shutdown() {
+	h.shutdownOnce.Do(func() {
+		close(h.shutdownChan)
+	})
+}
+
+// ShutdownRequested returns a channel which is closed after SHUTDOWN is executed
+func (h *Handler) ShutdownRequested() <-chan struct{} {
+	return h.shutdownChan
+}
+
+// ForEachClient implements database.ClientManager
+func (h *Handler) ForEachClient(cb func(c redis.Connection) bool) {
+	h.activeConn.Range(func(key, value any) bool {
+		return cb(value.(*connection.Connection))
+	})
+}
+
+// GetClient implements database.ClientManager
+func (h *Handler) GetClient(id int64) (redis.Connection, bool) {
+	value, ok := h.activeConn.Load(id)
+	if !ok {
+		return nil, false
+	}
+	return value.(*connection.Connection), true
+}
+
+// FeedMonitors implements database.ClientManager
+func (h *Handler) FeedMonitors(c redis.Connection, cmdLine [][]byte) {
+	if h.monitors.active() {
+		h.monitors.feed(c, cmdLine)
+	}
+}
+
+// KillClient implements database.ClientManager, the connection is released by its reading goroutine
+func (h *Handler) KillClient(id int64) bool {
+	value, ok := h.activeConn.Load(id)
+	if !ok {
+		return false
+	}
+	_ = value.(*connection.Connection).Kill()
+	return true
+}
@@ -0,0 +1,307 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"godis/config"
+	"godis/lib/utils"
+	"godis/redis/client"
+	"godis/redis/protocol"
+	"godis/tcp"
+)
+
+// startTestServer 启动不开启 AOF 的服务器，返回其监听地址
+func startTestServer(tb testing.TB) string {
+	return startTestHandler(tb, func(*Handler) {})
+}
+
+// startTestHandler 与 startTestServer 相同，setup 在开始接受连接前修改 Handler
+func startTestHandler(tb testing.TB, setup func(h *Handler)) string {
+	old := config.Properties()
+	properties := *old
+	properties.AppendOnly = false
+	properties.Password = ""
+	config.SetProperties(&properties)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	h := MakeHandler()
+	setup(h)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go h.Handle(context.Background(), conn)
+		}
+	}()
+	tb.Cleanup(func() {
+		_ = listener.Close()
+		_ = h.Close()
+		config.SetProperties(old)
+	})
+	return listener.Addr().String()
+}
+
+func makeSetCommands(n int) []byte {
+	var buf bytes.Buffer
+	for i := 0; i < n; i++ {
+		key := "key:" + strconv.Itoa(i)
+		buf.WriteString("*3\r\n$3\r\nSET\r\n$" + strconv.Itoa(len(key)) + "\r\n" + key + "\r\n$5\r\nvalue\r\n")
+	}
+	return buf.Bytes()
+}
+
+func TestPipeline(t *testing.T) {
+	addr := startTestServer(t)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// 批量执行的回复必须与命令的顺序一致
+	var request bytes.Buffer
+	var expected bytes.Buffer
+	for i := 0; i < 500; i++ {
+		value := strconv.Itoa(i)
+		request.WriteString("*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$" + strconv.Itoa(len(value)) + "\r\n" + value + "\r\n")
+		request.WriteString("*2\r\n$3\r\nGET\r\n$1\r\nk\r\n")
+		expected.WriteString("+OK\r\n$" + strconv.Itoa(len(value)) + "\r\n" + value + "\r\n")
+	}
+	if _, err := conn.Write(request.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, expected.Len())
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(reply, expected.Bytes()) {
+		t.Errorf("unexpected replies %q", reply)
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	startTestServer(t)
+	path := filepath.Join(t.TempDir(), "godis.sock")
+	listener, err := tcp.ListenUnix(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := MakeHandler()
+	closeChan := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		tcp.ListenAndServe([]net.Listener{listener}, h, closeChan)
+		close(done)
+	}()
+	defer func() {
+		close(closeChan)
+		<-done
+	}()
+
+	c, err := client.MakeClient("unix://"+path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Start()
+	defer c.Close()
+	if reply := c.Send(utils.ToCmdLine("SET", "k", "v")); !protocol.IsOKReply(reply) {
+		t.Errorf("unexpected reply %s", reply.ToBytes())
+	}
+	reply := c.Send(utils.ToCmdLine("CLIENT", "LIST"))
+	if !bytes.Contains(reply.ToBytes(), []byte("addr="+path+":0")) {
+		t.Errorf("unexpected client list %s", reply.ToBytes())
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	startTestServer(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := MakeHandler()
+	done := make(chan struct{})
+	go func() {
+		tcp.ListenAndServe([]net.Listener{listener}, h, h.ShutdownRequested())
+		close(done)
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// SET 的回复在关闭连接前发送，SHUTDOWN 成功时没有回复
+	if _, err := conn.Write([]byte("*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$1\r\nv\r\n*1\r\n$8\r\nSHUTDOWN\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := io.ReadAll(conn)
+	if err != nil || string(reply) != "+OK\r\n" {
+		t.Errorf("unexpected reply %q %v", reply, err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("server does not shut down")
+	}
+	if _, err := net.Dial("tcp", listener.Addr().String()); err == nil {
+		t.Error("expect listener to be closed")
+	}
+}
+
+// TestMaxClients 客户端数量达到 maxclients 后新连接收到错误并被关闭，已有连接关闭后可以再次连接
+func TestMaxClients(t *testing.T) {
+	addr := startTestServer(t)
+	properties := *config.Properties()
+	properties.MaxClients = 1
+	config.SetProperties(&properties)
+
+	first, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := first.Write([]byte("*1\r\n$4\r\nPING\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, len("+PONG\r\n"))
+	if _, err := io.ReadFull(first, reply); err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	rejected, err := io.ReadAll(second)
+	if err != nil || string(rejected) != "-ERR max number of clients reached\r\n" {
+		t.Errorf("unexpected reply %q %v", rejected, err)
+	}
+
+	_ = first.Close()
+	// 服务端异步发现连接关闭，等待计数减少
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = conn.Write([]byte("*1\r\n$4\r\nPING\r\n"))
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		_ = conn.Close()
+		if line == "+PONG\r\n" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("client slot is not released, last reply %q", line)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// BenchmarkPipeline 每次迭代执行 100 条 SET，pipeline=N 表示每次发送 N 条命令后再读取回复。
+// flush=reply 每条回复同步发送(合并发送之前的 Write)，用于和默认的整批 Buffer+Flush 对比
+func BenchmarkPipeline(b *testing.B) {
+	const commands = 100
+	batchAddr := startTestServer(b)
+	replyAddr := startTestHandler(b, func(h *Handler) {
+		h.flushEach = true
+	})
+	for _, bench := range []struct {
+		name string
+		addr string
+		size int
+	}{
+		{"pipeline=1", batchAddr, 1},
+		{"pipeline=10", batchAddr, 10},
+		{"pipeline=100", batchAddr, 100},
+		{"pipeline=100/flush=reply", replyAddr, 100},
+	} {
+		addr, size := bench.addr, bench.size
+		b.Run(bench.name, func(b *testing.B) {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer conn.Close()
+			request := makeSetCommands(size)
+			reply := make([]byte, len("+OK\r\n")*size)
+			b.SetBytes(int64(len(request) * commands / size))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for sent := 0; sent < commands; sent += size {
+					if _, err := conn.Write(request); err != nil {
+						b.Fatal(err)
+					}
+					if _, err := io.ReadFull(conn, reply); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+			b.ReportMetric(float64(b.N*commands)/b.Elapsed().Seconds(), "cmds/s")
+		})
+	}
+}
+
+// TestMonitorRejectedCommands 被拒绝的命令不会发送给 MONITOR 客户端
+func TestMonitorRejectedCommands(t *testing.T) {
+	addr := startTestServer(t)
+	monitor, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer monitor.Close()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	send := func(c net.Conn, request string, expected string) {
+		if _, err := c.Write([]byte(request)); err != nil {
+			t.Fatal(err)
+		}
+		reply := make([]byte, len(expected))
+		if _, err := io.ReadFull(c, reply); err != nil || string(reply) != expected {
+			t.Fatalf("unexpected reply %q %v", reply, err)
+		}
+	}
+	send(conn, "*5\r\n$3\r\nACL\r\n$7\r\nSETUSER\r\n$4\r\nuser\r\n$2\r\non\r\n$3\r\n>pw\r\n", "+OK\r\n")
+	send(conn, "*4\r\n$3\r\nACL\r\n$7\r\nSETUSER\r\n$4\r\nuser\r\n$4\r\n+get\r\n", "+OK\r\n")
+	send(conn, "*4\r\n$3\r\nACL\r\n$7\r\nSETUSER\r\n$4\r\nuser\r\n$3\r\n~k*\r\n", "+OK\r\n")
+	send(monitor, "*1\r\n$7\r\nMONITOR\r\n", "+OK\r\n")
+
+	send(conn, "*3\r\n$4\r\nAUTH\r\n$4\r\nuser\r\n$2\r\npw\r\n", "+OK\r\n")
+	send(conn, "*2\r\n$6\r\nNOSUCH\r\n$1\r\nk\r\n", "-ERR unknown command 'nosuch'\r\n")
+	send(conn, "*1\r\n$3\r\nGET\r\n", "-ERR wrong number of arguments for 'get' command\r\n")
+	if _, err := conn.Write([]byte("*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$1\r\nv\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if reply, _ := bufio.NewReader(conn).ReadString('\n'); !strings.HasPrefix(reply, "-NOPERM") {
+		t.Fatalf("expect NOPERM, got %q", reply)
+	}
+	send(conn, "*2\r\n$3\r\nGET\r\n$1\r\nk\r\n", "$-1\r\n")
+
+	_ = monitor.SetReadDeadline(time.Now().Add(time.Second))
+	line, err := bufio.NewReader(monitor).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(line, `] "GET" "k"`+"\r\n") {
+		t.Errorf("expect only GET to be monitored, got %q", line)
+	}
+}
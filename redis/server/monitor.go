@@ -0,0 +1,167 @@
+package server
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"godis/database/acl"
+	"godis/interface/redis"
+	"godis/lib/logger"
+	"godis/redis/connection"
+)
+
+// 每个 MONITOR 客户端最多积压的消息数，超过之后丢弃新消息，避免拖慢命令执行
+const monitorQueueSize = 1024
+
+type monitor struct {
+	client  *connection.Connection
+	queue   chan []byte
+	done    chan struct{} // remove 关闭 done 通知发送协程退出
+	stopped chan struct{} // 发送协程退出后关闭
+	dropped uint64
+}
+
+// monitorHub 将 Handle 处理的每一条命令广播给所有 MONITOR 客户端
+type monitorHub struct {
+	mu       sync.RWMutex
+	monitors map[int64]*monitor
+	count    int32 // 用于在没有 monitor 时快速跳过
+}
+
+func makeMonitorHub() *monitorHub {
+	return &monitorHub{
+		monitors: make(map[int64]*monitor),
+	}
+}
+
+func (hub *monitorHub) active() bool {
+	return atomic.LoadInt32(&hub.count) > 0
+}
+
+// add registers client as a monitor, messages are sent by a dedicated goroutine
+func (hub *monitorHub) add(client *connection.Connection) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	if _, ok := hub.monitors[client.GetID()]; ok {
+		return
+	}
+	m := &monitor{
+		client:  client,
+		queue:   make(chan []byte, monitorQueueSize),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	hub.monitors[client.GetID()] = m
+	atomic.AddInt32(&hub.count, 1)
+	go m.loopSend()
+}
+
+// remove stops sending messages to client, it returns after the sending goroutine exited
+// so that no message is written after client is put back to the pool and reused
+func (hub *monitorHub) remove(client *connection.Connection) {
+	hub.mu.Lock()
+	m, ok := hub.monitors[client.GetID()]
+	if !ok {
+		hub.mu.Unlock()
+		return
+	}
+	delete(hub.monitors, client.GetID())
+	atomic.AddInt32(&hub.count, -1)
+	hub.mu.Unlock()
+	close(m.done)
+	<-m.stopped
+}
+
+// feed broadcasts a command, it never blocks on slow monitors
+func (hub *monitorHub) feed(client redis.Connection, cmdLine [][]byte) {
+	msg := formatMonitorMsg(time.Now(), client.GetDBIndex(), client.Name(), cmdLine)
+	hub.mu.RLock()
+	defer hub.mu.RUnlock()
+	for _, m := range hub.monitors {
+		select {
+		case m.queue <- msg:
+		default:
+			if atomic.AddUint64(&m.dropped, 1) == 1 {
+				logger.Warn("monitor " + m.client.Name() + " is too slow, dropping messages")
+			}
+		}
+	}
+}
+
+// loopSend 发送队列中的消息直到 remove 被调用，之后丢弃剩余的消息
+func (m *monitor) loopSend() {
+	defer close(m.stopped)
+	for {
+		select {
+		case <-m.done:
+			return
+		case msg := <-m.queue:
+			// done 和 queue 同时就绪时 select 随机选择，需要再检查一次
+			select {
+			case <-m.done:
+				return
+			default:
+			}
+			if _, err := m.client.Write(msg); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// formatMonitorMsg 生成 redis 格式的 monitor 消息: +1339518083.107412 [0 127.0.0.1:60866] "keys" "*"
+func formatMonitorMsg(t time.Time, dbIndex int, addr string, cmdLine [][]byte) []byte {
+	var sb strings.Builder
+	sb.WriteByte('+')
+	sb.WriteString(strconv.FormatInt(t.Unix(), 10))
+	sb.WriteByte('.')
+	micro := strconv.FormatInt(int64(t.Nanosecond()/1000), 10)
+	sb.WriteString(strings.Repeat("0", 6-len(micro)) + micro)
+	sb.WriteString(" [" + strconv.Itoa(dbIndex) + " " + addr + "]")
+	redactFrom := acl.RedactFrom(cmdLine)
+	for i, arg := range cmdLine {
+		sb.WriteByte(' ')
+		if i >= redactFrom {
+			sb.WriteString(`"(redacted)"`)
+			continue
+		}
+		writeQuoted(&sb, arg)
+	}
+	sb.WriteString("\r\n")
+	return []byte(sb.String())
+}
+
+// writeQuoted 与 redis 的 sdscatrepr 相同，转义不可打印字符
+func writeQuoted(sb *strings.Builder, arg []byte) {
+	const hex = "0123456789abcdef"
+	sb.WriteByte('"')
+	for _, b := range arg {
+		switch b {
+		case '\\', '"':
+			sb.WriteByte('\\')
+			sb.WriteByte(b)
+		case '\n':
+			sb.WriteString(`\n`)
+		case '\r':
+			sb.WriteString(`\r`)
+		case '\t':
+			sb.WriteString(`\t`)
+		case '\a':
+			sb.WriteString(`\a`)
+		case '\b':
+			sb.WriteString(`\b`)
+		default:
+			if b < 0x20 || b > 0x7e {
+				sb.WriteString(`\x`)
+				sb.WriteByte(hex[b>>4])
+				sb.WriteByte(hex[b&0xf])
+			} else {
+				sb.WriteByte(b)
+			}
+		}
+	}
+	sb.WriteByte('"')
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"net"
+
+	"godis/interface/tcp"
+	"godis/redis/connection"
+	"godis/redis/parser"
+)
+
+// maxIdlePending 空闲连接保留的读缓冲区上限，超过时释放，大量空闲连接不会占用过多内存
+const maxIdlePending = 4 * 1024
+
+// session 是由事件循环驱动的客户端，收到的数据不足一条命令时保存在 pending 中
+type session struct {
+	h       *Handler
+	client  *connection.Connection
+	parser  *parser.Parser
+	pending []byte
+}
+
+// Open implements tcp.EventHandler
+func (h *Handler) Open(conn net.Conn) tcp.Session {
+	client := h.accept(conn)
+	if client == nil {
+		return nil
+	}
+	return &session{h: h, client: client, parser: newParser(nil)}
+}
+
+// OnData 执行收到的所有完整的命令，回复在这一批命令执行完后一起发送
+func (s *session) OnData(data []byte) bool {
+	buf := data
+	if len(s.pending) > 0 {
+		s.pending = append(s.pending, data...)
+		buf = s.pending
+	}
+	for len(buf) > 0 {
+		cmdLine, n, err := s.parser.ParseCommand(buf)
+		if err == nil && n == 0 {
+			break
+		}
+		buf = buf[n:]
+		if !s.h.handleCommand(s.client, cmdLine, err) {
+			return false
+		}
+	}
+	s.client.Flush()
+
+	// data 由事件循环复用，不完整的命令需要复制
+	switch {
+	case len(buf) > 0:
+		s.pending = append(s.pending[:0], buf...)
+	case cap(s.pending) > maxIdlePending:
+		s.pending = nil
+	default:
+		s.pending = s.pending[:0]
+	}
+	return true
+}
+
+func (s *session) OnClose() {
+	s.h.closeClient(s.client)
+}
@@ -2,12 +2,14 @@ package tcp
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"io"
 	"net"
 	"sync"
 	"time"
 
+	"godis/interface/tcp"
 	"godis/lib/logger"
 	"godis/lib/sync/atomic"
 	"godis/lib/sync/wait"
@@ -62,6 +64,45 @@ func (h *EchoHandler) Handle(ctx context.Context, conn net.Conn) {
 	}
 }
 
+// Open implements tcp.EventHandler
+func (h *EchoHandler) Open(conn net.Conn) tcp.Session {
+	if h.closing.Get() {
+		conn.Close()
+		return nil
+	}
+	client := &EchoClient{
+		Conn: conn,
+	}
+	h.activeConn.Store(client, struct{}{})
+	return &echoSession{handler: h, client: client}
+}
+
+// echoSession 原样返回收到的每一行，不完整的行保存在 pending 中
+type echoSession struct {
+	handler *EchoHandler
+	client  *EchoClient
+	pending []byte
+}
+
+func (s *echoSession) OnData(data []byte) bool {
+	s.pending = append(s.pending, data...)
+	end := bytes.LastIndexByte(s.pending, '\n')
+	if end < 0 {
+		return true
+	}
+	s.client.Waiting.Add(1)
+	s.client.Conn.Write(s.pending[:end+1])
+	s.client.Waiting.Done()
+	s.pending = append(s.pending[:0], s.pending[end+1:]...)
+	return true
+}
+
+func (s *echoSession) OnClose() {
+	logger.Info("connection close")
+	s.handler.activeConn.Delete(s.client)
+	s.client.Conn.Close()
+}
+
 func (h *EchoHandler) Close() error {
 	logger.Info("handler shutting down...")
 	h.closing.Set(true)
@@ -0,0 +1,247 @@
+//go:build linux
+
+package tcp
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"godis/interface/tcp"
+	"godis/lib/logger"
+)
+
+// loopReadSize 每次读取的最大字节数，读缓冲区在处理数据期间从 readBufPool 中借用，空闲连接不占用
+const loopReadSize = 64 * 1024
+
+// loopEvents 使用水平触发，一次事件只读取一次，数据没读完时重新监听后还会收到事件，连接之间比较公平。
+// EPOLLONESHOT 使连接在处理数据期间不再触发事件，处理完成后由 rearm 重新监听
+const loopEvents = syscall.EPOLLIN | syscall.EPOLLRDHUP | syscall.EPOLLONESHOT
+
+var readBufPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, loopReadSize)
+		return &buf
+	},
+}
+
+// reactor 将连接分配给固定数量的 epoll 事件循环，空闲连接不占用协程
+type reactor struct {
+	loops []*eventLoop
+	next  atomic.Uint32
+	wg    sync.WaitGroup
+}
+
+// eventLoop 使用 epoll 监听一组连接的可读事件，可读的连接交给单独的协程读取并由 session 处理，
+// 执行命令时阻塞(如 CLIENT PAUSE、耗时的脚本、向慢客户端发送回复)不会影响同一个事件循环中的其他连接
+type eventLoop struct {
+	epfd int
+	wake [2]int // 用于唤醒 epoll_wait 的管道
+	// mu 保护 conns 和 closed，连接关闭后文件描述符可能立即被新连接复用，
+	// 移除和重新监听连接前需要确认 conns 中保存的仍然是这个连接
+	mu      sync.Mutex
+	conns   map[int]*loopConn
+	closed  bool
+	workers sync.WaitGroup // 正在处理数据的协程，全部结束后才能关闭 epfd
+}
+
+type loopConn struct {
+	fd      int
+	conn    net.Conn
+	session tcp.Session
+	// mu 保证 session 的方法不会被并发调用，同时使 session 的状态对下一个处理协程可见
+	mu sync.Mutex
+}
+
+func newReactor(n int) (*reactor, error) {
+	r := &reactor{}
+	for i := 0; i < n; i++ {
+		loop, err := newEventLoop()
+		if err != nil {
+			r.close()
+			return nil, err
+		}
+		r.loops = append(r.loops, loop)
+	}
+	for _, loop := range r.loops {
+		r.wg.Add(1)
+		go func(loop *eventLoop) {
+			defer r.wg.Done()
+			loop.run()
+		}(loop)
+	}
+	return r, nil
+}
+
+func newEventLoop() (*eventLoop, error) {
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	loop := &eventLoop{
+		epfd:  epfd,
+		conns: make(map[int]*loopConn),
+	}
+	if err := syscall.Pipe2(loop.wake[:], syscall.O_NONBLOCK|syscall.O_CLOEXEC); err != nil {
+		_ = syscall.Close(epfd)
+		return nil, err
+	}
+	event := &syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(loop.wake[0])}
+	if err := syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, loop.wake[0], event); err != nil {
+		loop.release()
+		return nil, err
+	}
+	return loop, nil
+}
+
+// serve opens a session for conn and hands it over to one of the event loops
+func (r *reactor) serve(handler tcp.EventHandler, conn net.Conn) {
+	session := handler.Open(conn)
+	if session == nil {
+		return
+	}
+	loop := r.loops[int(r.next.Add(1))%len(r.loops)]
+	if err := loop.register(conn, session); err != nil {
+		logger.Warn("register connection to event loop failed: " + err.Error())
+		session.OnClose()
+	}
+}
+
+// close stops all event loops, sessions are closed by the handler.
+// Goroutines handling data may still be blocked, epoll instances are released after they exit
+func (r *reactor) close() {
+	for _, loop := range r.loops {
+		_, _ = syscall.Write(loop.wake[1], []byte{0})
+	}
+	r.wg.Wait()
+	for _, loop := range r.loops {
+		go func(loop *eventLoop) {
+			loop.workers.Wait()
+			loop.release()
+		}(loop)
+	}
+}
+
+func connFd(conn net.Conn) (int, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return 0, errors.New("unsupported connection type")
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	fd := -1
+	if err := raw.Control(func(f uintptr) { fd = int(f) }); err != nil {
+		return 0, err
+	}
+	return fd, nil
+}
+
+func (l *eventLoop) register(conn net.Conn, session tcp.Session) error {
+	fd, err := connFd(conn)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	event := &syscall.EpollEvent{Events: loopEvents, Fd: int32(fd)}
+	if err := syscall.EpollCtl(l.epfd, syscall.EPOLL_CTL_ADD, fd, event); err != nil {
+		return err
+	}
+	l.conns[fd] = &loopConn{fd: fd, conn: conn, session: session}
+	return nil
+}
+
+func (l *eventLoop) run() {
+	events := make([]syscall.EpollEvent, 128)
+	for {
+		n, err := syscall.EpollWait(l.epfd, events, -1)
+		if err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+			logger.Error("epoll wait failed: " + err.Error())
+			return
+		}
+		l.mu.Lock()
+		for i := 0; i < n; i++ {
+			fd := int(events[i].Fd)
+			if fd == l.wake[0] {
+				l.closed = true
+				l.mu.Unlock()
+				return
+			}
+			if c, ok := l.conns[fd]; ok {
+				l.workers.Add(1)
+				go l.handle(c)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// handle 读取一次数据交给 session 处理，连接在此期间不会触发新的事件，所以同一个连接的数据按顺序处理
+func (l *eventLoop) handle(c *loopConn) {
+	defer l.workers.Done()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	bufPtr := readBufPool.Get().(*[]byte)
+	defer readBufPool.Put(bufPtr)
+	buf := *bufPtr
+	for {
+		n, err := syscall.Read(c.fd, buf)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err == syscall.EAGAIN {
+			l.rearm(c)
+			return
+		}
+		if n > 0 {
+			if c.session.OnData(buf[:n]) {
+				l.rearm(c)
+			} else {
+				l.remove(c)
+			}
+			return
+		}
+		// 读到 EOF 或者出错
+		l.remove(c)
+		c.session.OnClose()
+		return
+	}
+}
+
+// rearm 重新监听连接的可读事件，事件循环已经停止或者连接已经被移除时不做任何事
+func (l *eventLoop) rearm(c *loopConn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed || l.conns[c.fd] != c {
+		return
+	}
+	event := &syscall.EpollEvent{Events: loopEvents, Fd: int32(c.fd)}
+	if err := syscall.EpollCtl(l.epfd, syscall.EPOLL_CTL_MOD, c.fd, event); err != nil {
+		logger.Warn("rearm connection in event loop failed: " + err.Error())
+	}
+}
+
+// remove 将连接移出事件循环。连接可能已经被 session 关闭，此时内核已经将其移出 epoll，
+// 并且文件描述符可能已经被新注册的连接复用，这种情况下不能移除新连接
+func (l *eventLoop) remove(c *loopConn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conns[c.fd] != c {
+		return
+	}
+	_ = syscall.EpollCtl(l.epfd, syscall.EPOLL_CTL_DEL, c.fd, nil)
+	delete(l.conns, c.fd)
+}
+
+func (l *eventLoop) release() {
+	_ = syscall.Close(l.epfd)
+	_ = syscall.Close(l.wake[0])
+	_ = syscall.Close(l.wake[1])
+}
@@ -0,0 +1,233 @@
+//go:build linux
+
+package tcp
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"godis/interface/tcp"
+)
+
+func TestListenAndServeEventLoop(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := MakeEchoHandler()
+	closeChan := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- ListenAndServeEventLoop([]net.Listener{listener}, handler, 2, closeChan)
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := net.Dial("tcp", listener.Addr().String())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer conn.Close()
+			// 一行分多次发送，事件循环需要保存不完整的数据
+			_ = conn.SetDeadline(time.Now().Add(3 * time.Second))
+			reader := bufio.NewReader(conn)
+			for _, part := range []string{"hel", "lo\nwor", "ld\n"} {
+				if _, err := conn.Write([]byte(part)); err != nil {
+					t.Error(err)
+					return
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			for _, expected := range []string{"hello\n", "world\n"} {
+				if line, err := reader.ReadString('\n'); err != nil || line != expected {
+					t.Errorf("expect %q, got %q %v", expected, line, err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// 客户端断开后 session 被关闭
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		count := 0
+		handler.activeConn.Range(func(key, value any) bool {
+			count++
+			return true
+		})
+		if count == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d sessions are not closed", count)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	close(closeChan)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("server does not shut down")
+	}
+}
+
+// blockingHandler 收到以 block 开头的数据时阻塞到 release 被关闭，其他数据原样返回
+type blockingHandler struct {
+	*EchoHandler
+	release chan struct{}
+}
+
+func (h *blockingHandler) Open(conn net.Conn) tcp.Session {
+	return &blockingSession{Session: h.EchoHandler.Open(conn), release: h.release}
+}
+
+type blockingSession struct {
+	tcp.Session
+	release chan struct{}
+}
+
+func (s *blockingSession) OnData(data []byte) bool {
+	if bytes.HasPrefix(data, []byte("block")) {
+		<-s.release
+	}
+	return s.Session.OnData(data)
+}
+
+// TestEventLoopBlockingSession 一个连接的处理阻塞时，同一个事件循环中的其他连接和新连接不受影响
+func TestEventLoopBlockingSession(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := &blockingHandler{EchoHandler: MakeEchoHandler(), release: make(chan struct{})}
+	closeChan := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- ListenAndServeEventLoop([]net.Listener{listener}, handler, 1, closeChan)
+	}()
+	defer func() {
+		close(closeChan)
+		<-done
+	}()
+
+	blocked, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blocked.Close()
+	if _, err := blocked.Write([]byte("block\n")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Write([]byte("hello\n")); err != nil {
+		t.Fatal(err)
+	}
+	if line, err := bufio.NewReader(conn).ReadString('\n'); err != nil || line != "hello\n" {
+		t.Fatalf("connection is stalled by a blocking session: %q %v", line, err)
+	}
+
+	close(handler.release)
+	_ = blocked.SetDeadline(time.Now().Add(time.Second))
+	if line, err := bufio.NewReader(blocked).ReadString('\n'); err != nil || line != "block\n" {
+		t.Errorf("unexpected reply of blocked connection: %q %v", line, err)
+	}
+}
+
+// BenchmarkIdleConnections 保持 idle 个空闲连接的同时在一个连接上收发消息，
+// 比较每个连接一个协程与事件循环两种方式的延迟、协程数和内存占用。
+// GOMAXPROCS 为 1 时事件循环从 epoll_wait 返回需要重新获取 P，延迟明显高于多核的情况
+func BenchmarkIdleConnections(b *testing.B) {
+	const idle = 5000
+	serveModes := map[string]func(listener net.Listener, closeChan chan struct{}){
+		"goroutine": func(listener net.Listener, closeChan chan struct{}) {
+			ListenAndServe([]net.Listener{listener}, MakeEchoHandler(), closeChan)
+		},
+		"epoll": func(listener net.Listener, closeChan chan struct{}) {
+			_ = ListenAndServeEventLoop([]net.Listener{listener}, MakeEchoHandler(), 4, closeChan)
+		},
+	}
+	for _, mode := range []string{"goroutine", "epoll"} {
+		b.Run("io="+mode, func(b *testing.B) {
+			var before runtime.MemStats
+			runtime.GC()
+			runtime.ReadMemStats(&before)
+			goroutines := runtime.NumGoroutine()
+
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				b.Fatal(err)
+			}
+			closeChan := make(chan struct{})
+			done := make(chan struct{})
+			go func() {
+				serveModes[mode](listener, closeChan)
+				close(done)
+			}()
+			defer func() {
+				close(closeChan)
+				<-done
+			}()
+
+			conns := make([]net.Conn, 0, idle+1)
+			defer func() {
+				for _, conn := range conns {
+					_ = conn.Close()
+				}
+			}()
+			for i := 0; i <= idle; i++ {
+				conn, err := net.Dial("tcp", listener.Addr().String())
+				if err != nil {
+					b.Fatal(err)
+				}
+				conns = append(conns, conn)
+			}
+			active := conns[idle]
+			reader := bufio.NewReader(active)
+			msg := []byte("ping\n")
+			// 确认所有连接都已经被服务端接受
+			if _, err := active.Write(msg); err != nil {
+				b.Fatal(err)
+			}
+			if _, err := reader.ReadString('\n'); err != nil {
+				b.Fatal(err)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := active.Write(msg); err != nil {
+					b.Fatal(err)
+				}
+				if _, err := reader.ReadString('\n'); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+
+			var after runtime.MemStats
+			runtime.GC()
+			runtime.ReadMemStats(&after)
+			b.ReportMetric(float64(runtime.NumGoroutine()-goroutines), "goroutines")
+			b.ReportMetric(float64(int64(after.StackInuse+after.HeapInuse)-int64(before.StackInuse+before.HeapInuse))/1024/idle, "KB/conn")
+		})
+	}
+}
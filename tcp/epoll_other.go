@@ -0,0 +1,21 @@
+//go:build !linux
+
+package tcp
+
+import (
+	"errors"
+	"net"
+
+	"godis/interface/tcp"
+)
+
+// reactor epoll 事件循环只在 linux 上可用
+type reactor struct{}
+
+func newReactor(n int) (*reactor, error) {
+	return nil, errors.New("event loop is only supported on linux")
+}
+
+func (r *reactor) serve(handler tcp.EventHandler, conn net.Conn) {}
+
+func (r *reactor) close() {}
@@ -2,6 +2,8 @@ package tcp
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"godis/interface/tcp"
 	"godis/lib/logger"
@@ -13,40 +15,107 @@ import (
 	"time"
 )
 
-func ListenAndServe(listener net.Listener, handler tcp.Handler, closechan <-chan struct{}) {
+// tls 握手超时时间，避免不发送数据的连接一直占用协程
+const tlsHandshakeTimeout = 10 * time.Second
+
+// ListenAndServe serves connections accepted by all listeners until closechan is notified
+func ListenAndServe(listeners []net.Listener, handler tcp.Handler, closechan <-chan struct{}) {
+	serve(listeners, handler, nil, closechan)
+}
+
+// ListenAndServeEventLoop is like ListenAndServe but plain connections are served by loops epoll event loops
+// instead of a goroutine per connection, tls connections are still served by goroutines. It works on linux only
+func ListenAndServeEventLoop(listeners []net.Listener, handler tcp.EventHandler, loops int, closechan <-chan struct{}) error {
+	r, err := newReactor(loops)
+	if err != nil {
+		return err
+	}
+	serve(listeners, handler, r, closechan)
+	return nil
+}
+
+// serve 接受连接，r 不为空时普通连接交给事件循环处理
+func serve(listeners []net.Listener, handler tcp.Handler, r *reactor, closechan <-chan struct{}) {
+	var closeOnce sync.Once
+	closeAll := func() {
+		closeOnce.Do(func() {
+			for _, listener := range listeners {
+				_ = listener.Close()
+			}
+			if r != nil {
+				r.close()
+			}
+			_ = handler.Close()
+		})
+	}
 	go func() {
 		<-closechan
 		logger.Info("shutting down ...")
-		_ = listener.Close()
-		_ = handler.Close()
-	}()
-	defer func() {
-		_ = listener.Close()
-		_ = handler.Close()
+		closeAll()
 	}()
+
 	ctx := context.Background()
 	var waitDown sync.WaitGroup
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			break
-		}
-		logger.Info("accept link..")
-		waitDown.Add(1)
-		go func() {
-			defer func() {
-				waitDown.Done()
-			}()
-			handler.Handle(ctx, conn)
-		}()
+	var waitAccept sync.WaitGroup
+	for _, listener := range listeners {
+		waitAccept.Add(1)
+		go func(listener net.Listener) {
+			defer waitAccept.Done()
+			defer closeAll() // 任意一个 listener 出错都会关闭其他的 listener，结束所有 accept 循环
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					break
+				}
+				logger.Info("accept link..")
+				if _, isTLS := conn.(*tls.Conn); r != nil && !isTLS {
+					r.serve(handler.(tcp.EventHandler), conn)
+					continue
+				}
+				waitDown.Add(1)
+				go func() {
+					defer func() {
+						waitDown.Done()
+					}()
+					if tlsConn, ok := conn.(*tls.Conn); ok && !handshake(tlsConn) {
+						return
+					}
+					handler.Handle(ctx, conn)
+				}()
+			}
+		}(listener)
 	}
+	waitAccept.Wait()
 	waitDown.Wait()
 }
 
+// handshake 在交给 handler 之前完成 tls 握手，这样证书错误可以及时记录并断开
+func handshake(conn *tls.Conn) bool {
+	_ = conn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	if err := conn.Handshake(); err != nil {
+		logger.Warn(fmt.Sprintf("tls handshake with %s failed: %v", conn.RemoteAddr(), err))
+		_ = conn.Close()
+		return false
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return true
+}
+
+// Config 监听地址等网络配置，连接数和超时等限制由 handler 根据服务器配置处理
 type Config struct {
-	Address    string        `yaml:"address"`
-	MaxConnect uint32        `yaml:"max-connect"`
-	Timeout    time.Duration `yaml:"timeout"`
+	Address string `yaml:"address"` // 为空时不监听 TCP 端口
+
+	UnixAddress string      // Unix socket 路径，为空时不监听
+	UnixPerm    os.FileMode // Unix socket 文件的权限，0 时使用默认权限
+
+	EventLoops int // 大于 0 时普通连接由 epoll 事件循环处理，handler 需要实现 tcp.EventHandler
+
+	TLSAddress string      // 为空时不开启 tls 端口
+	TLSConfig  *tls.Config // TLSAddress 不为空时必须设置
+
+	OnReload func() // 收到 SIGHUP 时调用，为空时 SIGHUP 与其他信号一样关闭服务器
+
+	ShutdownChan <-chan struct{} // 关闭时与收到 SIGTERM 一样关闭服务器，用于 SHUTDOWN 命令
 }
 
 func ListenAndServeWithSignal(cfg *Config, handler tcp.Handler) error {
@@ -54,17 +123,89 @@ func ListenAndServeWithSignal(cfg *Config, handler tcp.Handler) error {
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT)
 	go func() {
-		sig := <-sigCh
-		switch sig {
-		case syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT:
+		for {
+			select {
+			case sig := <-sigCh:
+				if sig == syscall.SIGHUP && cfg.OnReload != nil {
+					logger.Info("received SIGHUP, reloading config ...")
+					cfg.OnReload()
+					continue
+				}
+				logger.Info(fmt.Sprintf("received %v", sig))
+			case <-cfg.ShutdownChan:
+				logger.Info("shutdown requested")
+			}
 			closeChan <- struct{}{}
+			return
 		}
 	}()
-	listener, err := net.Listen("tcp", cfg.Address)
-	if err != nil {
-		return err
+	var listeners []net.Listener
+	if cfg.Address != "" {
+		listener, err := net.Listen("tcp", cfg.Address)
+		if err != nil {
+			return err
+		}
+		logger.Info(fmt.Sprintf("bind: %s, start listening...", cfg.Address))
+		listeners = append(listeners, listener)
+	}
+	if cfg.TLSAddress != "" {
+		tlsListener, err := tls.Listen("tcp", cfg.TLSAddress, cfg.TLSConfig)
+		if err != nil {
+			closeListeners(listeners)
+			return err
+		}
+		logger.Info(fmt.Sprintf("bind: %s, start listening tls...", cfg.TLSAddress))
+		listeners = append(listeners, tlsListener)
+	}
+	if cfg.UnixAddress != "" {
+		unixListener, err := ListenUnix(cfg.UnixAddress, cfg.UnixPerm)
+		if err != nil {
+			closeListeners(listeners)
+			return err
+		}
+		logger.Info(fmt.Sprintf("bind: %s, start listening unix socket...", cfg.UnixAddress))
+		listeners = append(listeners, unixListener)
+	}
+	if len(listeners) == 0 {
+		return errors.New("no address to listen on")
+	}
+	if cfg.EventLoops > 0 {
+		eventHandler, ok := handler.(tcp.EventHandler)
+		if !ok {
+			closeListeners(listeners)
+			return errors.New("handler does not support event loop")
+		}
+		if err := ListenAndServeEventLoop(listeners, eventHandler, cfg.EventLoops, closeChan); err != nil {
+			closeListeners(listeners)
+			return err
+		}
+		return nil
 	}
-	logger.Info(fmt.Sprintf("bind: %s, start listening...", cfg.Address))
-	ListenAndServe(listener, handler, closeChan)
+	ListenAndServe(listeners, handler, closeChan)
 	return nil
 }
+
+func closeListeners(listeners []net.Listener) {
+	for _, listener := range listeners {
+		_ = listener.Close()
+	}
+}
+
+// ListenUnix listens on the unix socket path, a stale socket file left by a crashed server is removed first.
+// The socket file is removed when the listener is closed
+func ListenUnix(path string, perm os.FileMode) (net.Listener, error) {
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		_ = os.Remove(path)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if perm != 0 {
+		if err := os.Chmod(path, perm); err != nil {
+			_ = listener.Close()
+			return nil, err
+		}
+	}
+	return listener, nil
+}
@@ -0,0 +1,227 @@
+package tcp
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// makeCert 生成证书，parent 为 nil 时生成自签名的 CA
+func makeCert(t *testing.T, serial int64, parent *testCert, isClient bool) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "godis-test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signerKey = parent.cert, parent.key
+		template.KeyUsage = x509.KeyUsageDigitalSignature
+		if isClient {
+			template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+		} else {
+			template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+			template.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func writeCert(t *testing.T, dir string, name string, c *testCert) (string, string) {
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	if err := os.WriteFile(certFile, c.certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, c.keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func echo(conn net.Conn, msg string) (string, error) {
+	_ = conn.SetDeadline(time.Now().Add(3 * time.Second))
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		return "", err
+	}
+	return bufio.NewReader(conn).ReadString('\n')
+}
+
+func TestListenAndServeTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := makeCert(t, 1, nil, false)
+	caFile, _ := writeCert(t, dir, "ca", ca)
+	serverCert, serverKey := writeCert(t, dir, "server", makeCert(t, 2, ca, false))
+	clientCert, clientKey := writeCert(t, dir, "client", makeCert(t, 3, ca, true))
+
+	serverConfig, err := MakeServerTLSConfig(serverCert, serverKey, caFile, TLSAuthClientsYes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plainListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsListener, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closeChan := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		ListenAndServe([]net.Listener{plainListener, tlsListener}, MakeEchoHandler(), closeChan)
+		close(done)
+	}()
+
+	plainConn, err := net.Dial("tcp", plainListener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line, err := echo(plainConn, "plain\n"); err != nil || line != "plain\n" {
+		t.Errorf("plain echo failed: %q %v", line, err)
+	}
+
+	clientConfig, err := MakeClientTLSConfig(clientCert, clientKey, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConn, err := tls.Dial("tcp", tlsListener.Addr().String(), clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line, err := echo(tlsConn, "secure\n"); err != nil || line != "secure\n" {
+		t.Errorf("tls echo failed: %q %v", line, err)
+	}
+
+	// 没有客户端证书时服务端拒绝握手
+	noCertConfig, err := MakeClientTLSConfig("", "", caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn, err := tls.Dial("tcp", tlsListener.Addr().String(), noCertConfig); err == nil {
+		if _, err := echo(conn, "anonymous\n"); err == nil {
+			t.Error("expect connection without client certificate to be rejected")
+		}
+		_ = conn.Close()
+	}
+
+	// 不信任服务端证书的客户端无法连接
+	if _, err := tls.Dial("tcp", tlsListener.Addr().String(), &tls.Config{}); err == nil {
+		t.Error("expect unknown authority error")
+	}
+
+	_ = plainConn.Close()
+	_ = tlsConn.Close()
+	close(closeChan)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("server does not shut down")
+	}
+}
+
+func TestMakeServerTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	ca := makeCert(t, 1, nil, false)
+	serverCert, serverKey := writeCert(t, dir, "server", makeCert(t, 2, ca, false))
+	if _, err := MakeServerTLSConfig("", "", "", TLSAuthClientsNo); err == nil {
+		t.Error("expect missing cert error")
+	}
+	if _, err := MakeServerTLSConfig(serverCert, serverKey, "", TLSAuthClientsYes); err == nil {
+		t.Error("expect missing ca error")
+	}
+	if _, err := MakeServerTLSConfig(serverCert, serverKey, "", "maybe"); err == nil {
+		t.Error("expect invalid tls_auth_clients error")
+	}
+	cfg, err := MakeServerTLSConfig(serverCert, serverKey, "", TLSAuthClientsNo)
+	if err != nil || cfg.ClientAuth != tls.NoClientCert {
+		t.Errorf("unexpected config: %v", err)
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "godis.sock")
+	// 上次异常退出遗留的 socket 文件不影响监听
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	_ = stale.Close()
+
+	listener, err := ListenUnix(path, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0700 {
+		t.Errorf("unexpected socket file mode: %v %v", info, err)
+	}
+	closeChan := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		ListenAndServe([]net.Listener{listener}, MakeEchoHandler(), closeChan)
+		close(done)
+	}()
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line, err := echo(conn, "unix\n"); err != nil || line != "unix\n" {
+		t.Errorf("unix echo failed: %q %v", line, err)
+	}
+	_ = conn.Close()
+	close(closeChan)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("server does not shut down")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("expect socket file to be removed")
+	}
+}
@@ -0,0 +1,88 @@
+package tcp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+	"strings"
+)
+
+// tls_auth_clients 的取值
+const (
+	TLSAuthClientsNo       = "no"       // 不要求客户端证书
+	TLSAuthClientsOptional = "optional" // 客户端提供证书时校验
+	TLSAuthClientsYes      = "yes"      // 必须提供由 CA 签发的证书
+)
+
+// MakeServerTLSConfig builds tls config for the tls listener,
+// caFile is required when authClients is yes or optional
+func MakeServerTLSConfig(certFile, keyFile, caFile, authClients string) (*tls.Config, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("tls_cert_file and tls_key_file are required for tls")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	switch strings.ToLower(authClients) {
+	case "", TLSAuthClientsNo:
+		cfg.ClientAuth = tls.NoClientCert
+		return cfg, nil
+	case TLSAuthClientsOptional:
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	case TLSAuthClientsYes:
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, errors.New("tls_auth_clients should be one of no, optional and yes")
+	}
+	if caFile == "" {
+		return nil, errors.New("tls_ca_cert_file is required to authenticate clients")
+	}
+	cfg.ClientCAs, err = loadCertPool(caFile)
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// MakeClientTLSConfig builds tls config for outgoing connections,
+// the certificate is presented to servers which require mutual tls, and caFile verifies the server.
+// System roots are used if caFile is empty
+func MakeClientTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+	if certFile != "" && keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+	return cfg, nil
+}
+
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificate found in " + caFile)
+	}
+	return pool, nil
+}